@@ -2,22 +2,44 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"tg-blobsync/internal/adapter/filesystem"
 	"tg-blobsync/internal/adapter/telegram"
 	"tg-blobsync/internal/adapter/ui"
 	"tg-blobsync/internal/config"
+	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/cache"
+	"tg-blobsync/internal/pkg/daemon"
+	"tg-blobsync/internal/pkg/lowprio"
+	"tg-blobsync/internal/pkg/promfile"
+	"tg-blobsync/internal/pkg/quota"
+	"tg-blobsync/internal/pkg/retry"
 	"tg-blobsync/internal/usecase"
 )
 
 // These variables will be set by the linker during build
-// -ldflags "-X main.AppID=12345 -X main.AppHash=abcdef..."
+// -ldflags "-X main.AppID=12345 -X main.AppHash=abcdef... -X main.Version=v1.2.3"
 var (
 	AppID   string
 	AppHash string
+	Version = "dev"
 )
 
 func main() {
@@ -33,45 +55,528 @@ func run() error {
 		return err
 	}
 
+	if cfg.Command == "daemon" {
+		return runDaemon(cfg)
+	}
+	if proxied(cfg) {
+		err := callDaemon(cfg)
+		if !errors.Is(err, daemon.ErrNotRunning) {
+			return err
+		}
+	}
+	ctx, stop := interruptible()
+	defer stop()
+	err = execute(ctx, cfg, nil)
+	if err != nil && ctx.Err() != nil {
+		// Whatever failed, failed because of it
+		return errors.New("interrupted")
+	}
+	return err
+}
+
+// interruptible returns a context cancelled on the first Ctrl+C or SIGTERM,
+// which stops the transfers in flight and lets the run clean up, save its
+// state and report. A second one quits at once.
+func interruptible() (context.Context, context.CancelFunc) {
 	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			// Back to the default behavior for the next one
+			signal.Stop(signals)
+			log.Println("[!] Interrupted: stopping the transfers in flight (press Ctrl+C again to quit now)")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// execute runs the command of cfg with tgClient, or with a client connected
+// for the run when nil.
+func execute(ctx context.Context, cfg *config.CLIConfig, tgClient *telegram.TelegramClient) (err error) {
+	start := time.Now()
+
+	// Failed runs are reported too, whatever they failed at
+	stats := usecase.NewStats()
+	defer func() {
+		stats.Log()
+		if cfg.Debug {
+			stats.LogTimings()
+		}
+		if cfg.ReportFile != "" {
+			if err := writeReport(cfg, stats, start, err); err != nil {
+				log.Printf("[!] Warning: %v", err)
+			}
+		}
+		if cfg.MetricsFile != "" {
+			if err := writeMetrics(cfg, stats, start, err); err != nil {
+				log.Printf("[!] Warning: %v", err)
+			}
+		}
+	}()
+
+	if err := checkMarker(cfg); err != nil {
+		return err
+	}
+
+	if cfg.NiceIO {
+		// Concurrent reads are what makes a disk unresponsive
+		cfg.Workers = 1
+		cfg.HashWorkers = 1
+		if err := lowprio.Apply(); err != nil {
+			log.Printf("[!] Warning: %v", err)
+		}
+	}
+
+	// hash only reads local files, no need to connect
+	if cfg.Command == "hash" {
+		return runHash(cfg)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	console := ui.NewConsoleUI(cfg.NonInteractive)
 
+	if tgClient == nil {
+		var stop context.CancelFunc
+		tgClient, stop, err = connectOrWait(ctx, cfg, console)
+		if err != nil {
+			return err
+		}
+		defer stop()
+		defer tgClient.Close()
+	}
+
+	threads := make([]telegram.ThreadClass, 0, len(cfg.UploadThreads))
+	for _, c := range cfg.UploadThreads {
+		threads = append(threads, telegram.ThreadClass{Below: c.Below, Threads: c.Threads})
+	}
+	tgClient.SetUploadThreads(threads)
+	tgClient.SetChunkSize(cfg.ChunkSize)
+	tgClient.SetStallTimeout(cfg.StallTimeout)
+	countsPath, err := config.GetUploadCountsPath()
+	if err != nil {
+		return err
+	}
+	counter, err := quota.Open(countsPath, cfg.DailyUploadWarn, cfg.DailyUploadLimit)
+	if err != nil {
+		return err
+	}
+	tgClient.SetUploadQuota(counter)
+	host, _ := os.Hostname()
+	runID := newRunID()
+	tgClient.SetOrigin(host, Version, runID)
+	log.Printf("Run ID: %s", runID)
+	tgClient.SetProgressTracker(console)
+	notifier := rateLimitNotifiers{console, stats}
+	tgClient.SetRateLimitNotifier(notifier)
+	retry.SetWaitNotifier(notifier.RateLimited)
+	tgClient.SetIndexEnabled(!cfg.NoIndex)
+
+	if err := ensureSelection(ctx, cfg, tgClient, console); err != nil {
+		return err
+	}
+
+	cfg.StateDir, err = config.GetStateDir(cfg.Profile, cfg.GroupID, cfg.TopicID)
+	if err != nil {
+		return fmt.Errorf("failed to get state dir: %w", err)
+	}
+	log.Printf("State dir: %s", cfg.StateDir)
+
+	localFS := filesystem.NewLocalFileSystem()
+	localFS.SetAlgorithm(cfg.Hash)
+	localFS.SetHashWorkers(cfg.HashWorkers)
+	if !cfg.NoCache {
+		store, err := cache.Open(filepath.Join(cfg.StateDir, "cache.db"))
+		if err != nil {
+			return err
+		}
+		defer func() {
+			// The client of the daemon goes on with other commands
+			tgClient.SetCache(nil)
+			if err := store.Save(); err != nil {
+				log.Printf("[!] Warning: %v", err)
+			}
+		}()
+		tgClient.SetCache(store)
+		// Repair must detect local corruption, which leaves size and modification time untouched
+		if cfg.Command != "repair" {
+			localFS.SetChecksumCache(store)
+		}
+	}
+
+	if err := runCommand(ctx, cfg, tgClient, localFS, console, stats); err != nil {
+		return err
+	}
+
+	// Let the next run read the listing from the index instead of the history
+	if err := tgClient.SaveIndex(ctx, cfg.GroupID, cfg.TopicID); err != nil {
+		log.Printf("[!] Warning: failed to update the remote index: %v", err)
+	}
+	return nil
+}
+
+// connect creates the Telegram client and connects it, authenticating
+// through console when the session isn't yet.
+func connect(ctx context.Context, cfg *config.CLIConfig, console *ui.ConsoleUI) (*telegram.TelegramClient, error) {
 	log.Printf("Session file: %s", cfg.SessionPath)
 
 	tgClient, err := telegram.NewTelegramClient(cfg.AppID, cfg.AppHash, cfg.SessionPath, console)
 	if err != nil {
-		return fmt.Errorf("failed to create telegram client: %w", err)
+		return nil, fmt.Errorf("failed to create telegram client: %w", err)
 	}
 
+	tgClient.SetConnections(cfg.Connections)
+	tgClient.SetBandwidthLimit(cfg.BWLimit)
+	tgClient.SetDebug(cfg.Debug)
+	tgClient.SetDebugRPC(cfg.DebugRPC)
+
 	log.Println("Connecting to Telegram...")
 	if err := tgClient.Start(ctx, console); err != nil {
-		return fmt.Errorf("failed to start telegram client: %w", err)
+		return nil, fmt.Errorf("failed to start telegram client: %w", err)
 	}
-	defer tgClient.Close()
 
 	log.Println("Connected!")
+	return tgClient, nil
+}
 
-	tgClient.SetUploadThreads(cfg.UploadThreads)
-	tgClient.SetProgressTracker(console)
+// connectTimeout bounds each connection attempt of --wait-online, and
+// reconnectInterval is the pause between them.
+const (
+	connectTimeout    = time.Minute
+	reconnectInterval = time.Minute
+)
 
-	if err := ensureSelection(ctx, cfg, tgClient, console); err != nil {
+// newRunID returns the ID of a run: its start time, followed by random
+// digits telling apart the runs started in the same second.
+func newRunID() string {
+	b := make([]byte, 2)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}
+
+// connectOrWait connects like connect. With --wait-online, it keeps trying
+// while Telegram is unreachable, hashing the local files of the run after
+// the first failure so that the plan is made right away once connected.
+// stop disconnects the client.
+func connectOrWait(ctx context.Context, cfg *config.CLIConfig, console *ui.ConsoleUI) (tgClient *telegram.TelegramClient, stop context.CancelFunc, err error) {
+	if cfg.WaitOnline <= 0 {
+		tgClient, err = connect(ctx, cfg, console)
+		return tgClient, func() {}, err
+	}
+
+	deadline := time.Now().Add(cfg.WaitOnline)
+	hashed := false
+	for {
+		clientCtx, cancel := context.WithCancel(ctx)
+		timer := time.AfterFunc(connectTimeout, cancel)
+		tgClient, err = connect(clientCtx, cfg, console)
+		if timer.Stop() && err == nil {
+			return tgClient, cancel, nil
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		if err == nil || errors.Is(err, context.Canceled) {
+			err = fmt.Errorf("no connection within %s", connectTimeout)
+		}
+		if time.Now().Add(reconnectInterval).After(deadline) {
+			return nil, nil, fmt.Errorf("telegram unreachable for %s: %w", cfg.WaitOnline, err)
+		}
+
+		log.Printf("[!] Telegram unreachable (%v), trying again until %s", err, deadline.Format("15:04"))
+		if !hashed {
+			hashed = true
+			if err := hashAhead(cfg); err != nil {
+				log.Printf("[!] Warning: %v", err)
+			}
+		}
+		select {
+		case <-time.After(reconnectInterval):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// hashAhead checksums the local files of the run into the checksum cache,
+// where the run finds them once connected. The cache is the topic's: with
+// the group or topic yet to be picked, there is none to fill.
+func hashAhead(cfg *config.CLIConfig) error {
+	// Repair reads every file anyway, bypassing the cache
+	if cfg.SkipMD5 || cfg.NoCache || cfg.Command == "repair" || (cfg.DirPath == "" && len(cfg.Roots) == 0) {
+		return nil
+	}
+	if cfg.GroupID == 0 || cfg.TopicID == 0 {
+		return nil
+	}
+
+	stateDir, err := config.GetStateDir(cfg.Profile, cfg.GroupID, cfg.TopicID)
+	if err != nil {
+		return fmt.Errorf("failed to get state dir: %w", err)
+	}
+	store, err := cache.Open(filepath.Join(stateDir, "cache.db"))
+	if err != nil {
+		return err
+	}
+	localFS := filesystem.NewLocalFileSystem()
+	localFS.SetAlgorithm(cfg.Hash)
+	localFS.SetHashWorkers(cfg.HashWorkers)
+	localFS.SetChecksumCache(store)
+
+	syncer := usecase.NewSynchronizer(localFS, nil, cfg.Workers, nil, false)
+	syncer.SetSubDir(cfg.SubDir)
+	syncer.SetRules(cfg.Rules)
+	hashed, err := syncer.HashAhead(cfg.DirPath, cfg.Roots)
+	if err != nil {
+		return fmt.Errorf("failed to hash local files: %w", err)
+	}
+	if err := store.Save(); err != nil {
 		return err
 	}
+	log.Printf("[*] Hashed %d local files while offline", hashed)
+	return nil
+}
+
+// rateLimitNotifiers informs every notifier of a rate limit pause.
+type rateLimitNotifiers []telegram.RateLimitNotifier
+
+func (n rateLimitNotifiers) RateLimited(wait time.Duration) {
+	for _, notifier := range n {
+		notifier.RateLimited(wait)
+	}
+}
 
+func runCommand(ctx context.Context, cfg *config.CLIConfig, tgClient *telegram.TelegramClient, localFS *filesystem.LocalFileSystem, console *ui.ConsoleUI, stats *usecase.Stats) error {
 	switch cfg.Command {
 	case "push":
-		return runSync(ctx, cfg, tgClient, console, true)
+		return runSync(ctx, cfg, tgClient, localFS, console, stats, true)
 	case "pull":
-		return runSync(ctx, cfg, tgClient, console, false)
+		return runSync(ctx, cfg, tgClient, localFS, console, stats, false)
+	case "watch":
+		return runWatch(ctx, cfg, tgClient, localFS, console)
 	case "list":
 		return runList(ctx, cfg, tgClient, console)
+	case "get":
+		return runGet(ctx, cfg, tgClient, localFS, stats)
+	case "put":
+		return runPut(ctx, cfg, tgClient, localFS, stats)
+	case "rm":
+		return runRemove(ctx, cfg, tgClient, console, stats)
+	case "mv":
+		return runMove(ctx, cfg, tgClient)
+	case "du":
+		return runDu(ctx, cfg, tgClient)
+	case "find":
+		return runFind(ctx, cfg, tgClient)
+	case "tree":
+		return runTree(ctx, cfg, tgClient)
+	case "explain":
+		return runExplain(ctx, cfg, tgClient, localFS)
+	case "history":
+		return runHistory(ctx, cfg, tgClient, localFS)
+	case "undelete":
+		return runUndelete(ctx, cfg, tgClient)
+	case "restore":
+		return runRestore(ctx, cfg, tgClient, localFS)
+	case "tag":
+		return runTag(ctx, cfg, tgClient)
+	case "meta":
+		return runMeta(ctx, cfg, tgClient)
+	case "archive", "recall":
+		return runArchive(ctx, cfg, tgClient, localFS, console)
+	case "repair":
+		return runRepair(ctx, cfg, tgClient, localFS, console)
+	case "verify":
+		return runVerify(ctx, cfg, tgClient, localFS, console)
+	case "fsck":
+		return runFsck(ctx, cfg, tgClient, console)
+	case "gc":
+		return runGC(ctx, cfg, tgClient)
+	case "expire":
+		return runExpire(ctx, cfg, tgClient)
+	case "snapshot":
+		return runSnapshot(ctx, cfg, tgClient, localFS, console, stats)
+	case "adopt":
+		return runAdopt(ctx, cfg, tgClient, console)
+	case "apply":
+		return runApply(ctx, cfg, tgClient, localFS, console, stats)
+	case "status":
+		return runStatus(ctx, cfg, tgClient, localFS, console)
+	case "dupes":
+		return runDupes(ctx, cfg, tgClient, localFS)
 	default:
 		return fmt.Errorf("unknown command: %s", cfg.Command)
 	}
 }
 
+// checkMarker ensures that the directory synced by push, pull, watch and
+// snapshot restore, or every root pushed, holds the marker file required by --require-marker, if any.
+func checkMarker(cfg *config.CLIConfig) error {
+	if cfg.RequireMarker == "" {
+		return nil
+	}
+	switch {
+	case cfg.Command == "push", cfg.Command == "pull", cfg.Command == "watch":
+	case cfg.Command == "snapshot" && cfg.Args[0] == "restore":
+	default:
+		return nil
+	}
+	dirs := []string{cfg.DirPath}
+	if len(cfg.Roots) > 0 {
+		dirs = dirs[:0]
+		for _, root := range cfg.Roots {
+			dirs = append(dirs, root.Dir)
+		}
+	}
+	for _, dir := range dirs {
+		if _, err := os.Stat(filepath.Join(dir, cfg.RequireMarker)); err != nil {
+			return fmt.Errorf("marker %s not found in %s (is the right directory mounted?): %w", cfg.RequireMarker, dir, err)
+		}
+	}
+	return nil
+}
+
+// runHash logs the checksums of local files, as push computes them. The
+// checksums cached for the topic, if any, are checked against the content
+// of the files, and dropped when stale.
+func runHash(cfg *config.CLIConfig) error {
+	localFS := filesystem.NewLocalFileSystem()
+	localFS.SetAlgorithm(cfg.Hash)
+	localFS.SetHashWorkers(cfg.HashWorkers)
+	if !cfg.NoCache && cfg.GroupID != 0 && cfg.TopicID != 0 {
+		stateDir, err := config.GetStateDir(cfg.Profile, cfg.GroupID, cfg.TopicID)
+		if err != nil {
+			return fmt.Errorf("failed to get state dir: %w", err)
+		}
+		store, err := cache.Open(filepath.Join(stateDir, "cache.db"))
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := store.Save(); err != nil {
+				log.Printf("[!] Warning: %v", err)
+			}
+		}()
+		localFS.SetChecksumCache(store)
+	}
+	uncached := filesystem.NewLocalFileSystem()
+	uncached.SetAlgorithm(cfg.Hash)
+	uncached.SetHashWorkers(cfg.HashWorkers)
+
+	stale := 0
+	for _, arg := range cfg.Args {
+		// Paths relative to --dir are spelled as push spells them, which the cache is keyed by
+		full := filepath.Join(cfg.DirPath, arg)
+		info, err := os.Stat(full)
+		if err != nil {
+			return err
+		}
+		var files []domain.LocalFile
+		if info.IsDir() {
+			files, err = uncached.ListFiles(full, false)
+		} else {
+			var f domain.LocalFile
+			f, err = uncached.StatFile(filepath.Dir(full), filepath.Base(full), false)
+			files = append(files, f)
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			note := ""
+			if cached, ok := localFS.CachedChecksum(f.AbsPath); ok && cached == f.Checksum {
+				note = "  (cached)"
+			} else if ok {
+				log.Printf("[!] Stale cached checksum for %s: %s, the content hashes to %s", f.AbsPath, cached, f.Checksum)
+				localFS.ForgetChecksum(f.AbsPath)
+				stale++
+			}
+			log.Printf("%s  %12d  %s  %s%s", f.Checksum, f.Size, time.Unix(f.ModTime, 0).Format("2006-01-02 15:04:05"), f.AbsPath, note)
+		}
+	}
+	if stale > 0 {
+		log.Printf("[*] Dropped %d stale cached checksums: the next push reads those files again", stale)
+	}
+	return nil
+}
+
+// runReport is the JSON summary of a run written to --report-file.
+type runReport struct {
+	Command  string    `json:"command"`
+	Profile  string    `json:"profile"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration_seconds"`
+	Success  bool      `json:"success"`
+	Error    string    `json:"error,omitempty"`
+	usecase.StatReport
+}
+
+// writeReport writes the JSON summary of the run to --report-file.
+func writeReport(cfg *config.CLIConfig, stats *usecase.Stats, start time.Time, runErr error) error {
+	report := runReport{
+		Command:    cfg.Command,
+		Profile:    cfg.Profile,
+		Start:      start,
+		Duration:   time.Since(start).Seconds(),
+		Success:    runErr == nil,
+		StatReport: stats.Report(),
+	}
+	if runErr != nil {
+		report.Error = runErr.Error()
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+	if err := os.WriteFile(cfg.ReportFile, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
+
+// writeMetrics writes the outcome of the run to --metrics-file, for the
+// textfile collector of node_exporter. The time of the last successful run is
+// carried over from the previous file when the run failed.
+func writeMetrics(cfg *config.CLIConfig, stats *usecase.Stats, start time.Time, runErr error) error {
+	labels := map[string]string{"command": cfg.Command, "profile": cfg.Profile}
+	now := time.Now()
+
+	success := 0.0
+	lastSuccess, _ := promfile.Read(cfg.MetricsFile, "tgblobsync_last_success_timestamp_seconds")
+	if runErr == nil {
+		success = 1
+		lastSuccess = float64(now.Unix())
+	}
+
+	metrics := []promfile.Metric{
+		{Name: "tgblobsync_last_run_success", Help: "Whether the last run succeeded.", Type: "gauge", Labels: labels, Value: success},
+		{Name: "tgblobsync_last_run_timestamp_seconds", Help: "Time the last run ended.", Type: "gauge", Labels: labels, Value: float64(now.Unix())},
+		{Name: "tgblobsync_last_success_timestamp_seconds", Help: "Time the last successful run ended.", Type: "gauge", Labels: labels, Value: lastSuccess},
+		{Name: "tgblobsync_last_run_duration_seconds", Help: "Duration of the last run.", Type: "gauge", Labels: labels, Value: now.Sub(start).Seconds()},
+	}
+	for _, kind := range usecase.StatKinds {
+		l := maps.Clone(labels)
+		l["op"] = string(kind)
+		metrics = append(metrics, promfile.Metric{Name: "tgblobsync_last_run_files", Help: "Files processed by the last run, by operation.", Type: "gauge", Labels: l, Value: float64(stats.Count(kind).Files)})
+	}
+	for _, kind := range usecase.StatKinds {
+		l := maps.Clone(labels)
+		l["op"] = string(kind)
+		metrics = append(metrics, promfile.Metric{Name: "tgblobsync_last_run_bytes", Help: "Size of the files processed by the last run, by operation.", Type: "gauge", Labels: l, Value: float64(stats.Count(kind).Bytes)})
+	}
+	return promfile.Write(cfg.MetricsFile, metrics)
+}
+
 func ensureSelection(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient, console *ui.ConsoleUI) error {
 	selector := usecase.NewSelector(storage)
 
@@ -95,7 +600,8 @@ func ensureSelection(ctx context.Context, cfg *config.CLIConfig, storage *telegr
 		}
 	}
 
-	if cfg.TopicID == 0 {
+	// Remote duplicates are looked for across all topics
+	if cfg.TopicID == 0 && !(cfg.Command == "dupes" && cfg.Remote) {
 		log.Println("Fetching topics...")
 		topics, err := selector.ListTopics(ctx, cfg.GroupID)
 		if err != nil {
@@ -112,18 +618,554 @@ func ensureSelection(ctx context.Context, cfg *config.CLIConfig, storage *telegr
 	return nil
 }
 
-func runSync(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient, ui *ui.ConsoleUI, push bool) error {
-	localFS := filesystem.NewLocalFileSystem()
+func runSync(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient, localFS *filesystem.LocalFileSystem, ui *ui.ConsoleUI, stats *usecase.Stats, push bool) error {
 	syncer := usecase.NewSynchronizer(localFS, storage, cfg.Workers, ui, cfg.SkipMD5)
 	syncer.SetSubDir(cfg.SubDir)
+	syncer.SetRules(cfg.Rules)
+	syncer.SetStats(stats)
+	syncer.SetNoDelete(cfg.NoDelete)
+	syncer.SetMaxDelete(cfg.MaxDelete, cfg.MaxDeletePercent)
+	syncer.SetPlanOut(cfg.PlanOut)
+	if cfg.MaxDuration > 0 {
+		syncer.SetDeadline(time.Now().Add(cfg.MaxDuration))
+	}
 
 	if push {
+		syncer.SetTags(cfg.Tags)
+		syncer.SetPacking(cfg.PackThreshold, cfg.PackSize)
+		syncer.SetStateDir(cfg.StateDir)
+		syncer.SetResume(cfg.Resume)
+		syncer.SetDeleteGrace(cfg.DeleteGrace)
+		syncer.SetForce(cfg.Force)
+		syncer.SetPruneAfterVerify(cfg.PruneAfterVerify)
+		syncer.SetHashOnUpload(cfg.HashOnUpload, cfg.Hash)
+		syncer.SetKeepVersions(cfg.KeepVersions)
+		syncer.SetPipeline(cfg.Pipeline)
+		syncer.SetTrash(cfg.TrashTopicID, cfg.TrashRetention)
+		if len(cfg.Roots) > 0 {
+			if usecase.HasRoutes(cfg.Rules) {
+				return fmt.Errorf("rules routing files to other topics can't be combined with roots")
+			}
+			return syncer.PushRoots(ctx, cfg.Roots, cfg.GroupID, cfg.TopicID)
+		}
+		if usecase.HasRoutes(cfg.Rules) {
+			return syncer.PushRouted(ctx, cfg.DirPath, cfg.GroupID, cfg.TopicID)
+		}
 		return syncer.Push(ctx, cfg.DirPath, cfg.GroupID, cfg.TopicID)
 	}
+	if cfg.Command == "snapshot" {
+		syncer.SetSnapshot(cfg.Args[1])
+	}
+	syncer.SetTagFilter(cfg.Tags)
+	syncer.SetHostFilter(cfg.FromHost)
+	syncer.SetRemoteGlob(cfg.RemoteGlob)
+	syncer.SetVerify(cfg.Verify)
+	syncer.SetPathPolicy(usecase.PathPolicy(cfg.UnsafePaths))
+	syncer.SetCasePolicy(usecase.CasePolicy(cfg.CaseConflicts))
+	syncer.SetMirror(cfg.MirrorDir)
+	syncer.SetBackupDir(cfg.BackupDir)
+	syncer.SetLinkDupes(cfg.HardlinkDupes)
+	// A snapshot records a single topic
+	if usecase.HasRoutes(cfg.Rules) && cfg.Command != "snapshot" {
+		return syncer.PullRouted(ctx, cfg.DirPath, cfg.GroupID, cfg.TopicID)
+	}
 	return syncer.Pull(ctx, cfg.DirPath, cfg.GroupID, cfg.TopicID)
 }
 
+func runStatus(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient, localFS *filesystem.LocalFileSystem, ui *ui.ConsoleUI) error {
+	syncer := usecase.NewSynchronizer(localFS, storage, cfg.Workers, ui, cfg.SkipMD5)
+	syncer.SetSubDir(cfg.SubDir)
+	syncer.SetRules(cfg.Rules)
+	syncer.SetDeleteGrace(cfg.DeleteGrace)
+	syncer.SetNoDelete(cfg.NoDelete)
+	syncer.SetTagFilter(cfg.Tags)
+	syncer.SetPathPolicy(usecase.PathPolicy(cfg.UnsafePaths))
+	syncer.SetCasePolicy(usecase.CasePolicy(cfg.CaseConflicts))
+	syncer.SetPlanOut(cfg.PlanOut)
+
+	push, pull := true, true
+	if len(cfg.Args) == 1 {
+		push, pull = cfg.Args[0] == "push", cfg.Args[0] == "pull"
+	}
+	if usecase.HasRoutes(cfg.Rules) {
+		return syncer.StatusRouted(ctx, os.Stdout, cfg.DirPath, cfg.GroupID, cfg.TopicID, push, pull)
+	}
+	return syncer.Status(ctx, os.Stdout, cfg.DirPath, cfg.GroupID, cfg.TopicID, push, pull)
+}
+
+// runApply executes a plan saved by --plan-out, with the transfer options
+// of push and pull.
+func runApply(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient, localFS *filesystem.LocalFileSystem, ui *ui.ConsoleUI, stats *usecase.Stats) error {
+	syncer := usecase.NewSynchronizer(localFS, storage, cfg.Workers, ui, cfg.SkipMD5)
+	syncer.SetRules(cfg.Rules)
+	syncer.SetStats(stats)
+	if cfg.MaxDuration > 0 {
+		syncer.SetDeadline(time.Now().Add(cfg.MaxDuration))
+	}
+	syncer.SetTags(cfg.Tags)
+	syncer.SetPacking(cfg.PackThreshold, cfg.PackSize)
+	syncer.SetStateDir(cfg.StateDir)
+	syncer.SetKeepVersions(cfg.KeepVersions)
+	syncer.SetPipeline(cfg.Pipeline)
+	syncer.SetTrash(cfg.TrashTopicID, cfg.TrashRetention)
+	syncer.SetHashOnUpload(cfg.HashOnUpload, cfg.Hash)
+	syncer.SetPruneAfterVerify(cfg.PruneAfterVerify)
+	syncer.SetVerify(cfg.Verify)
+	syncer.SetMirror(cfg.MirrorDir)
+	syncer.SetBackupDir(cfg.BackupDir)
+	syncer.SetLinkDupes(cfg.HardlinkDupes)
+	return syncer.Apply(ctx, cfg.Args[0], cfg.DirPath, cfg.GroupID, cfg.TopicID)
+}
+
+func runWatch(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient, localFS *filesystem.LocalFileSystem, ui *ui.ConsoleUI) error {
+	var fileWatcher domain.FileWatcher = filesystem.NewWatcher()
+	if cfg.WatchBackend == "poll" {
+		fileWatcher = filesystem.NewPollingWatcher(cfg.PollInterval)
+	}
+
+	watcher := usecase.NewWatcher(localFS, storage, fileWatcher, cfg.Workers, ui, cfg.SkipMD5)
+	watcher.SetSubDir(cfg.SubDir)
+	watcher.SetRules(cfg.Rules)
+	watcher.SetStateDir(cfg.StateDir)
+	watcher.SetTags(cfg.Tags)
+	watcher.SetPacking(cfg.PackThreshold, cfg.PackSize)
+	watcher.SetReconcileInterval(cfg.ReconcileInterval)
+	watcher.SetDeleteGrace(cfg.DeleteGrace)
+	watcher.SetNoDelete(cfg.NoDelete)
+	watcher.SetForce(cfg.Force)
+	watcher.SetPruneAfterVerify(cfg.PruneAfterVerify)
+	watcher.SetKeepVersions(cfg.KeepVersions)
+	watcher.SetPipeline(cfg.Pipeline)
+	watcher.SetTrash(cfg.TrashTopicID, cfg.TrashRetention)
+	watcher.SetMarker(cfg.RequireMarker)
+	return watcher.Watch(ctx, cfg.DirPath, cfg.GroupID, cfg.TopicID)
+}
+
 func runList(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient, ui *ui.ConsoleUI) error {
 	browser := usecase.NewBrowser(storage, ui)
+	browser.SetTagFilter(cfg.Tags)
+	format := cfg.Format
+	if format == "" && cfg.NonInteractive {
+		format = "table"
+	}
+	if format != "" {
+		return browser.ListTo(ctx, os.Stdout, cfg.GroupID, cfg.TopicID, format)
+	}
 	return browser.ListAndBrowse(ctx, cfg.GroupID, cfg.TopicID)
 }
+
+func runTag(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient) error {
+	tags := make(map[string]string)
+	for _, arg := range cfg.Args[1:] {
+		key, value, err := config.ParseTag(arg)
+		if err != nil {
+			return err
+		}
+		tags[key] = value
+	}
+
+	tagger := usecase.NewTagger(storage)
+	return tagger.Tag(ctx, cfg.GroupID, cfg.TopicID, cfg.Args[0], tags)
+}
+
+func runMeta(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient) error {
+	var edit usecase.MetaEdit
+	for _, arg := range cfg.Args[2:] {
+		key, value, err := config.ParseTag(arg)
+		if err != nil {
+			return err
+		}
+		switch {
+		case key == "mtime":
+			modTime, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				t, tsErr := config.ParseTimestamp(value)
+				if tsErr != nil {
+					return fmt.Errorf("invalid mtime %q: expected Unix seconds or a timestamp", value)
+				}
+				modTime = t.Unix()
+			}
+			edit.ModTime = &modTime
+		case key == "flags":
+			var flags []string
+			for _, f := range strings.Split(value, ",") {
+				if f = strings.TrimSpace(f); f != "" {
+					flags = append(flags, strings.ToUpper(f))
+				}
+			}
+			edit.Flags = &flags
+		case strings.HasPrefix(key, "tag.") && key != "tag.":
+			if edit.Tags == nil {
+				edit.Tags = make(map[string]string)
+			}
+			edit.Tags[strings.TrimPrefix(key, "tag.")] = value
+		default:
+			return fmt.Errorf("unknown metadata field %q: expected mtime, flags or tag.<key>", key)
+		}
+	}
+
+	editor := usecase.NewMetaEditor(storage)
+	return editor.Set(ctx, cfg.GroupID, cfg.TopicID, cfg.Args[1], edit)
+}
+
+func runArchive(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient, localFS *filesystem.LocalFileSystem, ui *ui.ConsoleUI) error {
+	archiver := usecase.NewArchiver(localFS, storage, cfg.Workers, ui, cfg.SkipMD5)
+	archiver.SetSubDir(cfg.SubDir)
+
+	if cfg.Command == "archive" {
+		return archiver.Archive(ctx, cfg.DirPath, cfg.GroupID, cfg.TopicID, cfg.OlderThan)
+	}
+	path := ""
+	if len(cfg.Args) > 0 {
+		path = cfg.Args[0]
+	}
+	return archiver.Recall(ctx, cfg.DirPath, cfg.GroupID, cfg.TopicID, path)
+}
+
+func runRepair(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient, localFS *filesystem.LocalFileSystem, ui *ui.ConsoleUI) error {
+	verifier := usecase.NewVerifier(localFS, storage, cfg.Workers, ui)
+	verifier.SetSubDir(cfg.SubDir)
+
+	report, err := verifier.Verify(ctx, cfg.DirPath, cfg.GroupID, cfg.TopicID)
+	if err != nil {
+		return err
+	}
+	return verifier.Repair(ctx, report, cfg.DirPath, cfg.GroupID, cfg.TopicID)
+}
+
+func runVerify(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient, localFS *filesystem.LocalFileSystem, ui *ui.ConsoleUI) error {
+	verifier := usecase.NewVerifier(localFS, storage, cfg.Workers, ui)
+	verifier.SetSubDir(cfg.SubDir)
+	verifier.SetSample(cfg.Sample, cfg.SizeCap)
+
+	report, err := verifier.Scrub(ctx, cfg.GroupID, cfg.TopicID)
+	if err != nil {
+		return err
+	}
+	if len(report.Issues) > 0 {
+		return fmt.Errorf("found %d damaged remote files", len(report.Issues))
+	}
+	return nil
+}
+
+func runFsck(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient, console *ui.ConsoleUI) error {
+	checker := usecase.NewChecker(storage)
+	if cfg.Malformed == "ask" {
+		checker.SetMalformed("", console)
+	} else {
+		checker.SetMalformed(domain.RecoveryAction(cfg.Malformed), nil)
+	}
+	report, err := checker.Check(ctx, cfg.GroupID, cfg.TopicID)
+	if err != nil {
+		return err
+	}
+	if cfg.Repair {
+		return checker.Repair(ctx, report, cfg.GroupID, cfg.TopicID)
+	}
+	if len(report.Issues) > 0 {
+		return fmt.Errorf("found %d issues, run again with --repair to fix them", len(report.Issues))
+	}
+	return nil
+}
+
+func runGet(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient, localFS *filesystem.LocalFileSystem, stats *usecase.Stats) error {
+	dest := path.Base(cfg.Args[0])
+	if len(cfg.Args) > 1 {
+		dest = cfg.Args[1]
+		if info, err := os.Stat(dest); err == nil && info.IsDir() {
+			dest = filepath.Join(dest, path.Base(cfg.Args[0]))
+		}
+	}
+	getter := usecase.NewGetter(localFS, storage)
+	getter.SetStats(stats)
+	return getter.Get(ctx, cfg.GroupID, cfg.TopicID, cfg.Args[0], dest)
+}
+
+func runPut(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient, localFS *filesystem.LocalFileSystem, stats *usecase.Stats) error {
+	remote := filepath.Base(cfg.Args[0])
+	if len(cfg.Args) > 1 {
+		remote = cfg.Args[1]
+		if strings.HasSuffix(remote, "/") {
+			remote += filepath.Base(cfg.Args[0])
+		}
+	}
+	putter := usecase.NewPutter(localFS, storage)
+	putter.SetTags(cfg.Tags)
+	putter.SetRules(cfg.Rules)
+	putter.SetKeepVersions(cfg.KeepVersions)
+	putter.SetPipeline(cfg.Pipeline)
+	putter.SetAlgorithm(cfg.Hash)
+	putter.SetStats(stats)
+	if cfg.Args[0] == "-" {
+		return putter.PutReader(ctx, cfg.GroupID, cfg.TopicID, os.Stdin, remote)
+	}
+	return putter.Put(ctx, cfg.GroupID, cfg.TopicID, cfg.Args[0], remote)
+}
+
+func runRemove(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient, ui *ui.ConsoleUI, stats *usecase.Stats) error {
+	remover := usecase.NewRemover(storage, ui)
+	remover.SetRecursive(cfg.Recursive)
+	remover.SetTrash(cfg.TrashTopicID, cfg.TrashRetention)
+	remover.SetStats(stats)
+	return remover.Remove(ctx, cfg.GroupID, cfg.TopicID, cfg.Args)
+}
+
+func runMove(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient) error {
+	mover := usecase.NewMover(storage)
+	return mover.Move(ctx, cfg.GroupID, cfg.TopicID, cfg.Args[0], cfg.Args[1])
+}
+
+func runDu(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient) error {
+	dir := ""
+	if len(cfg.Args) > 0 {
+		dir = cfg.Args[0]
+	}
+	du := usecase.NewDiskUsage(storage)
+	du.SetTagFilter(cfg.Tags)
+	usage, err := du.Usage(ctx, cfg.GroupID, cfg.TopicID, dir)
+	if err != nil {
+		return err
+	}
+	var garbage []usecase.GarbageUsage
+	if cfg.Garbage || cfg.Collect {
+		du.SetRetention(cfg.DeleteGrace, cfg.TrashRetention)
+		if garbage, err = du.Garbage(ctx, cfg.GroupID, cfg.TopicID); err != nil {
+			return err
+		}
+	}
+	if err := usecase.WriteUsage(os.Stdout, usage, garbage, cfg.Format == "json"); err != nil {
+		return err
+	}
+	if cfg.Collect {
+		collector := usecase.NewCollector(storage)
+		collector.SetDryRun(cfg.DryRun)
+		return collector.Collect(ctx, cfg.GroupID, cfg.TopicID)
+	}
+	return nil
+}
+
+func runFind(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient) error {
+	dir := ""
+	if len(cfg.Args) > 0 {
+		dir = cfg.Args[0]
+	}
+	finder := usecase.NewFinder(storage)
+	found, err := finder.Find(ctx, cfg.GroupID, cfg.TopicID, dir, usecase.FindFilter{
+		Name:      cfg.Name,
+		MinSize:   cfg.MinSize,
+		MaxSize:   cfg.MaxSize,
+		NewerThan: cfg.NewerThan,
+		OlderThan: cfg.OlderThan,
+		Tags:      cfg.Tags,
+	})
+	if err != nil {
+		return err
+	}
+	return usecase.WriteFound(os.Stdout, found, cfg.Format == "json")
+}
+
+func runTree(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient) error {
+	dir := ""
+	if len(cfg.Args) > 0 {
+		dir = cfg.Args[0]
+	}
+	printer := usecase.NewTreePrinter(storage)
+	printer.SetTagFilter(cfg.Tags)
+	printer.SetSizes(cfg.Sizes)
+	printer.SetMaxDepth(cfg.MaxDepth)
+	return printer.Print(ctx, os.Stdout, cfg.GroupID, cfg.TopicID, dir)
+}
+
+func runExplain(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient, localFS *filesystem.LocalFileSystem) error {
+	explainer := usecase.NewExplainer(localFS, storage, cfg.SkipMD5)
+	explainer.SetRules(cfg.Rules)
+	explainer.SetStateDir(cfg.StateDir)
+	explainer.SetDeleteGrace(cfg.DeleteGrace)
+	return explainer.Explain(ctx, cfg.DirPath, cfg.GroupID, cfg.TopicID, cfg.Args[0])
+}
+
+func runHistory(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient, localFS *filesystem.LocalFileSystem) error {
+	historian := usecase.NewHistorian(localFS, storage)
+	_, err := historian.History(ctx, cfg.GroupID, cfg.TopicID, cfg.Args[0])
+	return err
+}
+
+func runRestore(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient, localFS *filesystem.LocalFileSystem) error {
+	dest := filepath.Base(cfg.Args[0])
+	if len(cfg.Args) > 1 {
+		dest = cfg.Args[1]
+	}
+	historian := usecase.NewHistorian(localFS, storage)
+	return historian.Restore(ctx, cfg.GroupID, cfg.TopicID, cfg.Args[0], cfg.Version, cfg.At, dest)
+}
+
+func runUndelete(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient) error {
+	undeleter := usecase.NewUndeleter(storage)
+	return undeleter.Undelete(ctx, cfg.GroupID, cfg.TopicID, cfg.TrashTopicID, cfg.Args[0])
+}
+
+func runGC(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient) error {
+	collector := usecase.NewCollector(storage)
+	collector.SetDryRun(cfg.DryRun)
+	return collector.Collect(ctx, cfg.GroupID, cfg.TopicID)
+}
+
+func runExpire(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient) error {
+	expirer := usecase.NewExpirer(storage)
+	expirer.SetDryRun(cfg.DryRun)
+	expirer.SetByUpload(cfg.ByUpload)
+	return expirer.Expire(ctx, cfg.GroupID, cfg.TopicID, cfg.Retention)
+}
+
+func runSnapshot(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient, localFS *filesystem.LocalFileSystem, ui *ui.ConsoleUI, stats *usecase.Stats) error {
+	snapshotter := usecase.NewSnapshotter(storage)
+	switch cfg.Args[0] {
+	case "create":
+		return snapshotter.Create(ctx, cfg.GroupID, cfg.TopicID, cfg.Args[1])
+	case "restore":
+		return runSync(ctx, cfg, storage, localFS, ui, stats, false)
+	case "prune":
+		policy := usecase.SnapshotPolicy{Daily: cfg.KeepDaily, Weekly: cfg.KeepWeekly, Monthly: cfg.KeepMonthly}
+		return snapshotter.Prune(ctx, cfg.GroupID, cfg.TopicID, policy, cfg.DryRun)
+	}
+	_, err := snapshotter.List(ctx, cfg.GroupID, cfg.TopicID)
+	return err
+}
+
+func runAdopt(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient, console *ui.ConsoleUI) error {
+	dir := ""
+	if len(cfg.Args) > 0 {
+		dir = cfg.Args[0]
+	}
+	adopter := usecase.NewAdopter(storage, cfg.SkipMD5)
+	if cfg.Mapping != "" {
+		mapping, err := usecase.LoadAdoptMapping(cfg.Mapping)
+		if err != nil {
+			return err
+		}
+		adopter.SetMapping(mapping)
+	} else {
+		adopter.SetPrompter(console)
+	}
+	return adopter.Adopt(ctx, cfg.GroupID, cfg.TopicID, dir)
+}
+
+func runDupes(ctx context.Context, cfg *config.CLIConfig, storage *telegram.TelegramClient, localFS *filesystem.LocalFileSystem) error {
+	finder := usecase.NewDupeFinder(localFS, storage)
+	finder.SetSubDir(cfg.SubDir)
+	if !cfg.Remote {
+		_, err := finder.FindLocal(ctx, cfg.DirPath, cfg.GroupID, cfg.TopicID)
+		return err
+	}
+
+	report, err := finder.FindRemote(ctx, cfg.GroupID)
+	if err != nil || !cfg.Dedup {
+		return err
+	}
+	return finder.Dedup(ctx, cfg.GroupID, report)
+}
+
+// proxied reports whether the command can be run by the daemon, if one is
+// running. Interactive commands need the terminal, watch would keep the
+// daemon busy for good, and put - reads the standard input. The connection
+// options are set once the daemon connects: runs asking for their own need
+// their own connection.
+func proxied(cfg *config.CLIConfig) bool {
+	switch {
+	case !cfg.NonInteractive || cfg.NoDaemon || cfg.NiceIO:
+		return false
+	case cfg.Connections != 1 || cfg.BWLimit != 0 || cfg.Debug || cfg.DebugRPC:
+		return false
+	case cfg.Command == "hash" || cfg.Command == "watch" || cfg.Command == "daemon":
+		return false
+	case cfg.Command == "put" && cfg.Args[0] == "-":
+		return false
+	}
+	return true
+}
+
+// callDaemon runs the command line through the daemon, returning
+// daemon.ErrNotRunning when there is none.
+func callDaemon(cfg *config.CLIConfig) error {
+	socket, err := config.GetDaemonSocketPath()
+	if err != nil {
+		return err
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	return daemon.Call(socket, daemon.Request{Args: os.Args[1:], Cwd: cwd}, os.Stdout, os.Stderr)
+}
+
+// runDaemon keeps a client connected and runs the non-interactive commands
+// of other invocations with it, until interrupted.
+func runDaemon(cfg *config.CLIConfig) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	socket, err := config.GetDaemonSocketPath()
+	if err != nil {
+		return err
+	}
+
+	tgClient, err := connect(ctx, cfg, ui.NewConsoleUI(cfg.NonInteractive))
+	if err != nil {
+		return err
+	}
+	defer tgClient.Close()
+
+	log.Printf("[*] Daemon listening on %s", socket)
+	err = daemon.Serve(ctx, socket, func(ctx context.Context, req daemon.Request, stdout, stderr io.Writer) error {
+		return serveRequest(ctx, req, tgClient, stdout, stderr)
+	})
+	log.Println("[*] Daemon stopped")
+	return err
+}
+
+// serveRequest runs a command line received by the daemon, as if it had been
+// run in the working directory of the invocation, with its standard output
+// and logs sent back to it.
+func serveRequest(ctx context.Context, req daemon.Request, tgClient *telegram.TelegramClient, stdout, stderr io.Writer) error {
+	cfg, err := config.ParseArgs(req.Args, AppID, AppHash, flag.ContinueOnError)
+	if err != nil {
+		return err
+	}
+	if !proxied(cfg) {
+		return fmt.Errorf("the %s command can't be run by the daemon", cfg.Command)
+	}
+	log.Printf("[*] Running: %s", strings.Join(req.Args, " "))
+
+	// Requests are served one at a time, so the process state is theirs
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(req.Cwd); err != nil {
+		return err
+	}
+	defer os.Chdir(dir)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(stdout, r)
+		close(copied)
+	}()
+	savedStdout := os.Stdout
+	os.Stdout = w
+	log.SetOutput(stderr)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		os.Stdout = savedStdout
+		w.Close()
+		<-copied
+		r.Close()
+		log.Printf("[*] Done: %s", strings.Join(req.Args, " "))
+	}()
+
+	return execute(ctx, cfg, tgClient)
+}
@@ -1,26 +1,87 @@
 package filesystem
 
 import (
-	"crypto/md5"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"io/fs"
+	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/cache"
+	"tg-blobsync/internal/pkg/checksum"
 	"time"
+
+	"golang.org/x/sync/errgroup"
 )
 
-type LocalFileSystem struct{}
+type LocalFileSystem struct {
+	cache       *cache.Store
+	algorithm   string
+	hashWorkers int
+
+	saveMu    sync.Mutex
+	lastSaved time.Time // when the cache was last saved by a scan
+}
 
 func NewLocalFileSystem() *LocalFileSystem {
 	return &LocalFileSystem{}
 }
 
+// checksumBucket holds the cached checksums, keyed by absolute path.
+const checksumBucket = "checksums"
+
+// saveInterval is how often the cache is saved while checksums are being
+// calculated, so that an interrupted scan of a large tree doesn't start over.
+const saveInterval = time.Minute
+
+// cachedChecksum is a checksum valid as long as the size and modification
+// time of the file don't change, and the algorithm is the one in use.
+type cachedChecksum struct {
+	Size      int64  `json:"s"`
+	ModTime   int64  `json:"t"` // Nanoseconds
+	Checksum  string `json:"m"`
+	Algorithm string `json:"a,omitempty"`
+}
+
+// valid reports whether the cached checksum still applies to a file.
+func (c cachedChecksum) valid(info fs.FileInfo, algorithm string) bool {
+	return c.Size == info.Size() && c.ModTime == info.ModTime().UnixNano() && c.Algorithm == algorithm
+}
+
+// SetChecksumCache makes checksums be reused from the given cache while the
+// size and modification time of the files don't change.
+func (l *LocalFileSystem) SetChecksumCache(store *cache.Store) {
+	l.cache = store
+}
+
+// SetAlgorithm sets the algorithm of the checksums calculated, MD5 by
+// default (see the checksum package).
+func (l *LocalFileSystem) SetAlgorithm(algorithm string) {
+	l.algorithm = algorithm
+}
+
+// SetHashWorkers sets the number of files ListFiles checksums concurrently,
+// 1 by default.
+func (l *LocalFileSystem) SetHashWorkers(n int) {
+	l.hashWorkers = n
+}
+
+// listedFile is a file found by ListFiles, yet to be checksummed.
+type listedFile struct {
+	path    string
+	relPath string
+	info    fs.FileInfo
+}
+
 // ListFiles recursively scans the root directory and returns a list of files with their metadata.
 func (l *LocalFileSystem) ListFiles(root string, skipMD5 bool) ([]domain.LocalFile, error) {
-	var files []domain.LocalFile
+	var listed []listedFile
 
 	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
@@ -29,6 +90,10 @@ func (l *LocalFileSystem) ListFiles(root string, skipMD5 bool) ([]domain.LocalFi
 		if d.IsDir() {
 			return nil
 		}
+		// Downloads in progress are not part of the tree yet
+		if domain.IsTempFile(d.Name()) {
+			return nil
+		}
 
 		// Calculate relative path
 		relPath, err := filepath.Rel(root, path)
@@ -44,41 +109,205 @@ func (l *LocalFileSystem) ListFiles(root string, skipMD5 bool) ([]domain.LocalFi
 			return err
 		}
 
-		// Calculate MD5 if not skipped
-		checksum := ""
-		if !skipMD5 {
-			checksum, err = l.calculateMD5(path)
+		listed = append(listed, listedFile{path: path, relPath: relPath, info: info})
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Files are hashed once all are found, by several workers on request:
+	// a single reader rarely keeps an SSD busy
+	files := make([]domain.LocalFile, len(listed))
+	reused := make([]bool, len(listed))
+	g, gCtx := errgroup.WithContext(context.Background())
+	g.SetLimit(max(l.hashWorkers, 1))
+	for i, f := range listed {
+		if gCtx.Err() != nil {
+			break
+		}
+		g.Go(func() error {
+			file, cached, err := l.newLocalFile(f.path, f.relPath, f.info, skipMD5)
 			if err != nil {
-				return fmt.Errorf("failed to calculate md5 for %s: %w", path, err)
+				return err
+			}
+			files[i] = file
+			reused[i] = cached
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	if l.cache != nil && !skipMD5 {
+		hits := 0
+		for _, cached := range reused {
+			if cached {
+				hits++
 			}
 		}
+		pruned := l.pruneChecksums(root, listed)
+		log.Printf("[*] Checksums: %d reused from the cache, %d calculated, %d of deleted files dropped", hits, len(listed)-hits, pruned)
+	}
 
-		files = append(files, domain.LocalFile{
-			Path:     relPath,
-			Checksum: checksum,
-			ModTime:  info.ModTime().Unix(),
-			Size:     info.Size(),
-			AbsPath:  path,
-		})
+	return files, nil
+}
 
-		return nil
+// pruneChecksums drops the cached checksums of the files under root that
+// are no longer there, and returns how many were dropped.
+func (l *LocalFileSystem) pruneChecksums(root string, listed []listedFile) int {
+	present := make(map[string]bool, len(listed))
+	for _, f := range listed {
+		present[f.path] = true
+	}
+	prefix := filepath.Clean(root) + string(filepath.Separator)
+	pruned := 0
+	for _, key := range l.cache.Keys(checksumBucket) {
+		if strings.HasPrefix(key, prefix) && !present[key] {
+			l.cache.Delete(checksumBucket, key)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// StatFile returns the metadata of the single file at relPath under root.
+// The error wraps fs.ErrNotExist if the file doesn't exist.
+func (l *LocalFileSystem) StatFile(root, relPath string, skipMD5 bool) (domain.LocalFile, error) {
+	path := filepath.Join(root, filepath.FromSlash(relPath))
+	info, err := os.Stat(path)
+	if err != nil {
+		return domain.LocalFile{}, err
+	}
+	if info.IsDir() {
+		return domain.LocalFile{}, fmt.Errorf("%s is a directory", path)
+	}
+	file, _, err := l.newLocalFile(path, filepath.ToSlash(relPath), info, skipMD5)
+	return file, err
+}
+
+// newLocalFile returns the file at path, and whether its checksum came from
+// the cache.
+func (l *LocalFileSystem) newLocalFile(path, relPath string, info fs.FileInfo, skipMD5 bool) (domain.LocalFile, bool, error) {
+	file := domain.LocalFile{
+		Path:    relPath,
+		ModTime: info.ModTime().Unix(),
+		Size:    info.Size(),
+		AbsPath: path,
+	}
+	// Calculate the checksum if not skipped
+	var cached bool
+	if !skipMD5 {
+		sum, hit, err := l.checksum(path, info)
+		if err != nil {
+			return domain.LocalFile{}, false, fmt.Errorf("failed to calculate %s for %s: %w", checksum.Name(l.algorithm), path, err)
+		}
+		file.Checksum = sum
+		file.Algorithm = l.algorithm
+		cached = hit
+	}
+	return file, cached, nil
+}
+
+// checksum returns the checksum of the file at path, and whether it came
+// from the cache.
+func (l *LocalFileSystem) checksum(path string, info fs.FileInfo) (string, bool, error) {
+	if l.cache == nil {
+		sum, err := l.calculate(path)
+		return sum, false, err
+	}
+
+	var cached cachedChecksum
+	if l.cache.Get(checksumBucket, path, &cached) && cached.valid(info, l.algorithm) {
+		return cached.Checksum, true, nil
+	}
+
+	sum, err := l.calculate(path)
+	if err != nil {
+		return "", false, err
+	}
+	l.cache.Put(checksumBucket, path, cachedChecksum{
+		Size:      info.Size(),
+		ModTime:   info.ModTime().UnixNano(),
+		Checksum:  sum,
+		Algorithm: l.algorithm,
 	})
+	l.saveCheckpoint()
+	return sum, false, nil
+}
+
+// saveCheckpoint saves the cache if it wasn't for saveInterval.
+func (l *LocalFileSystem) saveCheckpoint() {
+	l.saveMu.Lock()
+	defer l.saveMu.Unlock()
+	if l.lastSaved.IsZero() {
+		l.lastSaved = time.Now()
+		return
+	}
+	if time.Since(l.lastSaved) < saveInterval {
+		return
+	}
+	l.lastSaved = time.Now()
+	if err := l.cache.Save(); err != nil {
+		log.Printf("[!] Warning: %v", err)
+	}
+}
 
+// CachedChecksum returns the checksum cached for the file at path, as long
+// as it is still valid for the current size and modification time of the file.
+func (l *LocalFileSystem) CachedChecksum(path string) (string, bool) {
+	if l.cache == nil {
+		return "", false
+	}
+	info, err := os.Stat(path)
 	if err != nil {
-		return nil, err
+		return "", false
+	}
+	var cached cachedChecksum
+	if !l.cache.Get(checksumBucket, path, &cached) || !cached.valid(info, l.algorithm) {
+		return "", false
+	}
+	return cached.Checksum, true
+}
+
+// RememberChecksum implements domain.ChecksumCache.
+func (l *LocalFileSystem) RememberChecksum(file domain.LocalFile, sum string) {
+	if l.cache == nil || file.Algorithm != l.algorithm {
+		return
 	}
+	info, err := os.Stat(file.AbsPath)
+	if err != nil || info.Size() != file.Size || info.ModTime().Unix() != file.ModTime {
+		return
+	}
+	l.cache.Put(checksumBucket, file.AbsPath, cachedChecksum{
+		Size:      info.Size(),
+		ModTime:   info.ModTime().UnixNano(),
+		Checksum:  sum,
+		Algorithm: l.algorithm,
+	})
+}
 
-	return files, nil
+// ForgetChecksum drops the checksum cached for the file at path, so that
+// it is calculated again.
+func (l *LocalFileSystem) ForgetChecksum(path string) {
+	if l.cache != nil {
+		l.cache.Delete(checksumBucket, path)
+	}
 }
 
-func (l *LocalFileSystem) calculateMD5(path string) (string, error) {
+func (l *LocalFileSystem) calculate(path string) (string, error) {
+	h, err := checksum.New(l.algorithm)
+	if err != nil {
+		return "", err
+	}
 	f, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
 
-	h := md5.New()
 	if _, err := io.Copy(h, f); err != nil {
 		return "", err
 	}
@@ -107,6 +336,97 @@ func (l *LocalFileSystem) WriteFile(path string, data io.Reader) error {
 	return err
 }
 
+// AppendFile writes data at the end of the file at path, creating it if needed.
+func (l *LocalFileSystem) AppendFile(path string, data io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// TruncateFile cuts the file at path to its first size bytes.
+func (l *LocalFileSystem) TruncateFile(path string, size int64) error {
+	return os.Truncate(path, size)
+}
+
+// ReflinkFile creates dst as a copy of src sharing its blocks, failing on
+// filesystems that can't.
+func (l *LocalFileSystem) ReflinkFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	err = reflink(in, out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// LinkFile creates dst as a hard link to src.
+func (l *LocalFileSystem) LinkFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return os.Link(src, dst)
+}
+
+// CaseInsensitive reports whether the filesystem holding dir, or its closest
+// existing parent, ignores case in file names, by creating a file there. When
+// it can't tell, it assumes the default of the system.
+func (l *LocalFileSystem) CaseInsensitive(dir string) bool {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	f, err := os.CreateTemp(dir, domain.TempMarker+"case-*")
+	if err != nil {
+		return runtime.GOOS == "darwin" || runtime.GOOS == "windows"
+	}
+	name := f.Name()
+	f.Close()
+	defer os.Remove(name)
+
+	lower, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+	upper, err := os.Stat(filepath.Join(filepath.Dir(name), strings.ToUpper(filepath.Base(name))))
+	return err == nil && os.SameFile(lower, upper)
+}
+
+func (l *LocalFileSystem) RenameFile(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
 func (l *LocalFileSystem) SetModTime(path string, modTime int64) error {
 	if modTime <= 0 {
 		return nil
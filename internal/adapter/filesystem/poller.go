@@ -0,0 +1,113 @@
+package filesystem
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// PollingWatcher detects changes by comparing snapshots of the size and
+// modification time of every file, for filesystems where inotify doesn't
+// fire such as NFS or SMB mounts.
+type PollingWatcher struct {
+	interval time.Duration
+}
+
+func NewPollingWatcher(interval time.Duration) *PollingWatcher {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	return &PollingWatcher{interval: interval}
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// Watch walks root every interval and reports the files created, modified
+// or deleted since the previous walk.
+func (w *PollingWatcher) Watch(ctx context.Context, root string) (<-chan string, error) {
+	previous, err := snapshot(root)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan string, 4096)
+	go func() {
+		defer close(out)
+
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			current, err := snapshot(root)
+			if err != nil {
+				log.Printf("[!] Warning: failed to scan %s: %v", root, err)
+				continue
+			}
+
+			var changed []string
+			for path, state := range current {
+				if prev, ok := previous[path]; !ok || prev != state {
+					changed = append(changed, path)
+				}
+			}
+			for path := range previous {
+				if _, ok := current[path]; !ok {
+					changed = append(changed, path)
+				}
+			}
+			previous = current
+
+			for _, path := range changed {
+				select {
+				case out <- path:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func snapshot(root string) (map[string]fileState, error) {
+	files := make(map[string]fileState)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files may vanish while walking, they are picked up by the next walk
+			if path != root {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(relPath)] = fileState{
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		}
+		return nil
+	})
+	return files, err
+}
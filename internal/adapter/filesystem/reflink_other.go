@@ -0,0 +1,13 @@
+//go:build !linux
+
+package filesystem
+
+import (
+	"errors"
+	"os"
+)
+
+// reflink is only supported on Linux.
+func reflink(src, dst *os.File) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,171 @@
+//go:build linux
+
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// InotifyWatcher watches a directory tree with Linux inotify.
+type InotifyWatcher struct{}
+
+func NewWatcher() *InotifyWatcher {
+	return &InotifyWatcher{}
+}
+
+// Watch adds a watch on every directory under root, including the ones
+// created later, and reports the changed paths.
+func (w *InotifyWatcher) Watch(ctx context.Context, root string) (<-chan string, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize inotify: %w", err)
+	}
+
+	// Going through os.File puts the descriptor in the runtime poller, so
+	// that closing it unblocks the pending read
+	iw := &inotify{
+		fd:   fd,
+		file: os.NewFile(uintptr(fd), "inotify"),
+		root: root,
+		dirs: make(map[int]string),
+		out:  make(chan string, 4096),
+	}
+	if err := iw.addTree(ctx, "", false); err != nil {
+		iw.file.Close()
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		iw.file.Close()
+	}()
+	go iw.readEvents(ctx)
+
+	return iw.out, nil
+}
+
+type inotify struct {
+	fd   int
+	file *os.File
+	root string
+	dirs map[int]string // watch descriptor -> relative directory
+	out  chan string
+}
+
+// addTree watches dir and its subdirectories. When emit is set, the files
+// found are reported as well, since they may have been created before the
+// watch was in place.
+func (iw *inotify) addTree(ctx context.Context, dir string, emit bool) error {
+	return filepath.WalkDir(filepath.Join(iw.root, filepath.FromSlash(dir)), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// The directory may be gone already, its deletion is reported separately
+			if dir != "" && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		rel, err := filepath.Rel(iw.root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			rel = ""
+		}
+
+		if !d.IsDir() {
+			if emit {
+				iw.emit(ctx, rel)
+			}
+			return nil
+		}
+
+		wd, err := syscall.InotifyAddWatch(iw.fd, p, watchMask)
+		if err != nil {
+			return fmt.Errorf("failed to watch %s: %w", p, err)
+		}
+		iw.dirs[wd] = rel
+		return nil
+	})
+}
+
+// removeTree drops the watches of dir and its subdirectories.
+func (iw *inotify) removeTree(dir string) {
+	for wd, d := range iw.dirs {
+		if d == dir || strings.HasPrefix(d, dir+"/") {
+			syscall.InotifyRmWatch(iw.fd, uint32(wd))
+			delete(iw.dirs, wd)
+		}
+	}
+}
+
+func (iw *inotify) emit(ctx context.Context, path string) {
+	select {
+	case iw.out <- path:
+	case <-ctx.Done():
+	}
+}
+
+func (iw *inotify) readEvents(ctx context.Context) {
+	defer close(iw.out)
+
+	buf := make([]byte, 4096*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := iw.file.Read(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("[!] Watch stopped: %v", err)
+			}
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				log.Printf("[!] Warning: too many changes at once, some events were lost")
+				continue
+			}
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				delete(iw.dirs, int(event.Wd))
+				continue
+			}
+
+			dir, ok := iw.dirs[int(event.Wd)]
+			if !ok {
+				continue
+			}
+			rel := path.Join(dir, string(bytes.TrimRight(nameBytes, "\x00")))
+
+			if event.Mask&syscall.IN_ISDIR != 0 {
+				switch {
+				case event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+					if err := iw.addTree(ctx, rel, true); err != nil {
+						log.Printf("[!] Warning: %v", err)
+					}
+				case event.Mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+					iw.removeTree(rel)
+					iw.emit(ctx, rel)
+				}
+				continue
+			}
+			iw.emit(ctx, rel)
+		}
+	}
+}
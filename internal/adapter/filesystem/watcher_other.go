@@ -0,0 +1,19 @@
+//go:build !linux
+
+package filesystem
+
+import (
+	"context"
+	"errors"
+)
+
+// InotifyWatcher is only available on Linux.
+type InotifyWatcher struct{}
+
+func NewWatcher() *InotifyWatcher {
+	return &InotifyWatcher{}
+}
+
+func (w *InotifyWatcher) Watch(ctx context.Context, root string) (<-chan string, error) {
+	return nil, errors.New("watch mode is only supported on Linux")
+}
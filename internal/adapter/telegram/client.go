@@ -8,32 +8,60 @@ import (
 	"path/filepath"
 	"sync"
 	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/cache"
+	"tg-blobsync/internal/pkg/clock"
+	"tg-blobsync/internal/pkg/quota"
+	"tg-blobsync/internal/pkg/ratelimit"
 
 	"time"
 
 	"github.com/gotd/td/session"
 	"github.com/gotd/td/telegram"
 	"github.com/gotd/td/telegram/auth"
+	"github.com/gotd/td/telegram/downloader"
 	"github.com/gotd/td/telegram/message"
-	"github.com/gotd/td/telegram/uploader"
 	"github.com/gotd/td/tg"
 )
 
 // TelegramClient implements domain.BlobStorage using gotd.
 type TelegramClient struct {
-	client   *telegram.Client
-	api      *tg.Client
-	sender   *message.Sender
-	uploader *uploader.Uploader
-	ctx      context.Context
+	client     *telegram.Client
+	api        *tg.Client
+	transfer   *tg.Client // API used for file content, see SetConnections
+	parts      *partClient
+	sender     *message.Sender
+	downloader *downloader.Downloader
+	ctx        context.Context
 
-	peerCache      map[int64]int64 // map[ChannelID]AccessHash
-	progressStarts map[int64]time.Time
-	progressTasks  map[int64]domain.ProgressTask
-	mu             sync.RWMutex
+	peerCache map[int64]int64 // map[ChannelID]AccessHash
+	mu        sync.RWMutex
 
-	progressTracker domain.ProgressTracker
-	uploadThreads   int
+	progressTracker   domain.ProgressTracker
+	rateLimitNotifier RateLimitNotifier
+	uploadThreads     []ThreadClass
+	chunkSize         int64
+	connections       int
+	limiter           *ratelimit.Limiter
+	stallTimeout      time.Duration
+	quota             *quota.Counter
+	origin            domain.FileMeta // only the origin fields are set
+	debug             bool
+	clock             clock.Clock
+	rpc               rpcTrace
+	cache             *cache.Store
+
+	useIndex bool
+	index    *indexState
+	indexMu  sync.Mutex
+}
+
+// defaultChunkSize is the largest document accepted by Telegram for
+// non-premium accounts (4000 parts of 512 KB).
+const defaultChunkSize = 2000 * 1024 * 1024
+
+// RateLimitNotifier is informed when requests are paused by Telegram rate limits.
+type RateLimitNotifier interface {
+	RateLimited(wait time.Duration)
 }
 
 // AuthInput defines an interface for interactive authentication input.
@@ -49,32 +77,131 @@ func NewTelegramClient(appID int, appHash string, sessionFile string, input Auth
 		return nil, fmt.Errorf("failed to create session dir: %w", err)
 	}
 
+	tc := &TelegramClient{
+		peerCache:     make(map[int64]int64),
+		uploadThreads: []ThreadClass{{Threads: 4}},
+		chunkSize:     defaultChunkSize,
+		connections:   1,
+		clock:         clock.Real,
+		// Shared by all downloads so that part buffers are reused. Downloads
+		// never go through Telegram CDNs: gotd neither lets the downloader
+		// follow CDN redirects nor connects to CDN datacenters.
+		downloader: downloader.NewDownloader().WithPartSize(downloadPartSize),
+	}
+
 	opts := telegram.Options{
 		SessionStorage: &session.FileStorage{Path: sessionFile},
+		Middlewares:    []telegram.Middleware{tc.floodWaiter(), tc.rpcTracer()},
+		// A request is resent when unacknowledged after RetryInterval, and fails
+		// after MaxRetries. On slow links a 512 KB part alone can take minutes,
+		// so the default 25 seconds window is stretched to 5 minutes.
+		RetryInterval: 15 * time.Second,
+		MaxRetries:    20,
 	}
 
-	client := telegram.NewClient(appID, appHash, opts)
+	tc.client = telegram.NewClient(appID, appHash, opts)
 
-	tc := &TelegramClient{
-		client:         client,
-		peerCache:      make(map[int64]int64),
-		progressStarts: make(map[int64]time.Time),
-		progressTasks:  make(map[int64]domain.ProgressTask),
-		uploadThreads:  4,
+	return tc, nil
+}
+
+// ThreadClass is the number of upload threads used for documents smaller
+// than Below, or of any size when Below is 0.
+type ThreadClass struct {
+	Below   int64
+	Threads int
+}
+
+// SetUploadThreads sets the number of parallel threads used to upload a
+// document, by size class. Classes are checked in order and the first one
+// the document fits in applies; documents fitting none use a single thread.
+func (t *TelegramClient) SetUploadThreads(classes []ThreadClass) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.uploadThreads = classes
+}
+
+// threadsFor returns the number of upload threads for a document of the given size.
+func (t *TelegramClient) threadsFor(size int64) int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, c := range t.uploadThreads {
+		if c.Below == 0 || size < c.Below {
+			return max(c.Threads, 1)
+		}
 	}
+	return 1
+}
 
-	return tc, nil
+// SetStallTimeout sets how long a download may go without receiving any
+// data before it is aborted, to be retried. Zero waits forever.
+func (t *TelegramClient) SetStallTimeout(timeout time.Duration) {
+	t.stallTimeout = timeout
 }
 
-func (t *TelegramClient) SetUploadThreads(threads int) {
-	if threads <= 0 {
-		threads = 1
+// SetChunkSize sets the size above which files are split into several messages.
+func (t *TelegramClient) SetChunkSize(size int64) {
+	if size <= 0 {
+		size = defaultChunkSize
 	}
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	t.uploadThreads = threads
-	if t.uploader != nil {
-		t.uploader = t.uploader.WithThreads(threads)
+	t.chunkSize = size
+}
+
+// SetConnections sets the number of connections to the Telegram datacenter
+// used to transfer file content. They are opened once by Start and shared by
+// all the transfers of the run; with 1, file content goes through the main
+// connection. It must be called before Start.
+func (t *TelegramClient) SetConnections(n int) {
+	if n <= 0 {
+		n = 1
+	}
+	t.connections = n
+}
+
+// SetBandwidthLimit limits the combined upload and download throughput of
+// all transfers to bytesPerSecond (0 for no limit). It must be called
+// before Start.
+func (t *TelegramClient) SetBandwidthLimit(bytesPerSecond int64) {
+	t.limiter = ratelimit.New(bytesPerSecond)
+}
+
+// SetUploadQuota makes uploads count their bytes in counter, and fail with
+// domain.ErrUploadLimit when they would pass its hard limit.
+func (t *TelegramClient) SetUploadQuota(counter *quota.Counter) {
+	counter.SetClock(t.clock)
+	t.quota = counter
+}
+
+// SetOrigin sets the origin recorded in the metadata of the files stored:
+// the host name of the machine, the version of the tool and the ID of the
+// run.
+func (t *TelegramClient) SetOrigin(host, tool, runID string) {
+	t.origin = domain.FileMeta{Host: host, Tool: tool, RunID: runID}
+}
+
+// stampOrigin sets the origin of meta to the one of the client.
+func (t *TelegramClient) stampOrigin(meta *domain.FileMeta) {
+	meta.Host = t.origin.Host
+	meta.Tool = t.origin.Tool
+	meta.RunID = t.origin.RunID
+}
+
+// SetClock sets the clock of rate limit pauses, bandwidth limits and
+// transfer speeds. It must be called before Start.
+func (t *TelegramClient) SetClock(c clock.Clock) {
+	t.clock = c
+}
+
+// SetDebug enables diagnostic logs, such as the time each transfer spends
+// before its first part goes through.
+func (t *TelegramClient) SetDebug(debug bool) {
+	t.debug = debug
+}
+
+func (t *TelegramClient) debugf(format string, args ...any) {
+	if t.debug {
+		log.Printf("[debug] "+format, args...)
 	}
 }
 
@@ -109,10 +236,19 @@ func (t *TelegramClient) Start(ctx context.Context, input AuthInput) error {
 			// Initialize helpers
 			t.api = t.client.API()
 			t.sender = message.NewSender(t.api)
-			t.uploader = uploader.NewUploader(t.api).
-				WithProgress(t).
-				WithPartSize(512 * 1024). // 512KB is the maximum part size
-				WithThreads(t.uploadThreads)
+			t.transfer = t.api
+			if t.connections > 1 {
+				pool, err := t.client.Pool(int64(t.connections))
+				if err != nil {
+					return fmt.Errorf("failed to create connection pool: %w", err)
+				}
+				defer pool.Close()
+				// Pool connections bypass the client middlewares
+				t.transfer = tg.NewClient(t.floodWaiter().Handle(t.rpcTracer().Handle(pool)))
+				log.Printf("[Telegram] Using %d connections for transfers", t.connections)
+			}
+			t.limiter.SetClock(t.clock)
+			t.parts = newPartClient(t.transfer, t.limiter, t.clock)
 
 			// Signal ready
 			select {
@@ -148,6 +284,7 @@ func (t *TelegramClient) Start(ctx context.Context, input AuthInput) error {
 }
 
 func (t *TelegramClient) Close() error {
+	t.rpc.logSummary()
 	return nil
 }
 
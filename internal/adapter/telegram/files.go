@@ -2,35 +2,104 @@ package telegram
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"mime"
+	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/checksum"
+	"tg-blobsync/internal/pkg/clock"
 	"tg-blobsync/internal/pkg/retry"
 
 	"github.com/gotd/td/crypto"
-	"github.com/gotd/td/telegram/downloader"
 	"github.com/gotd/td/telegram/message"
 	"github.com/gotd/td/telegram/message/styling"
 	"github.com/gotd/td/telegram/uploader"
 	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
 )
 
-// ListFiles returns files from the topic.
+// ListFiles returns files from the topic. The listing comes from the pinned
+// index of the topic when available, and from its whole history otherwise.
 func (t *TelegramClient) ListFiles(ctx context.Context, groupID int64, topicID int64) ([]domain.RemoteFile, error) {
+	if t.useIndex {
+		messages, err := t.listFromIndex(ctx, groupID, topicID)
+		if err == nil {
+			return t.assembleFiles(ctx, groupID, messages), nil
+		}
+		if errors.Is(err, errNoIndex) {
+			log.Printf("[*] No remote index found, listing the whole history")
+		} else {
+			log.Printf("[!] Remote index unavailable, listing the whole history: %v", err)
+		}
+	}
+
+	messages, err := t.walkHistory(ctx, groupID, topicID)
+	if err != nil {
+		return nil, err
+	}
+	return t.assembleFiles(ctx, groupID, messages), nil
+}
+
+// listedMessage is a message holding a file, or a part of it.
+type listedMessage struct {
+	file domain.RemoteFile
+	doc  *tg.Document // nil when not known
+}
+
+// walkHistory returns the file messages of the topic, newest first, paging
+// through its whole history.
+func (t *TelegramClient) walkHistory(ctx context.Context, groupID int64, topicID int64) ([]listedMessage, error) {
 	accessHash, _ := t.getAccessHash(groupID)
 	inputPeer := &tg.InputPeerChannel{
 		ChannelID:  groupID,
 		AccessHash: accessHash,
 	}
 
-	var files []domain.RemoteFile
+	// Any change made while walking is replayed from this point
+	var pts int
+	if t.useIndex {
+		var err error
+		pts, err = t.channelPts(ctx, groupID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var result []listedMessage
+	var indexes []int
+	err := t.forEachMessage(ctx, inputPeer, func(msg tg.MessageClass) {
+		if m, ok := t.parseMessage(msg, topicID); ok {
+			result = append(result, m)
+		} else if m, ok := msg.(*tg.Message); ok && inTopic(m, topicID) && isIndexMessage(m) {
+			indexes = append(indexes, m.ID)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if t.useIndex {
+		t.resetIndex(groupID, topicID, pts, result, indexes)
+	}
+	return result, nil
+}
+
+// forEachMessage calls fn with every message of the peer, newest first,
+// paging through its whole history.
+func (t *TelegramClient) forEachMessage(ctx context.Context, inputPeer tg.InputPeerClass, fn func(msg tg.MessageClass)) error {
 	offsetID := 0
 	limit := 100
 
@@ -41,87 +110,259 @@ func (t *TelegramClient) ListFiles(ctx context.Context, groupID int64, topicID i
 			Limit:    limit,
 		})
 		if err != nil {
-			return nil, err
-		}
-
-		var messages []tg.MessageClass
-		switch h := history.(type) {
-		case *tg.MessagesChannelMessages:
-			messages = h.Messages
-		case *tg.MessagesMessagesSlice:
-			messages = h.Messages
-		case *tg.MessagesMessages:
-			messages = h.Messages
+			return err
 		}
 
+		messages := messagesOf(history)
 		if len(messages) == 0 {
-			break
+			return nil
 		}
 
 		for _, msg := range messages {
-			file, ok := t.parseMessageToFile(msg, topicID)
-			if ok {
-				files = append(files, file)
-			}
+			fn(msg)
 		}
 
 		lastMsg := messages[len(messages)-1]
 		if lastMsg.GetID() >= offsetID && offsetID != 0 {
-			break
+			return nil
 		}
 		offsetID = lastMsg.GetID()
 	}
+}
+
+// ListMessages returns every document message of the topic, newest first,
+// whatever its caption. The topic index is left out.
+func (t *TelegramClient) ListMessages(ctx context.Context, groupID int64, topicID int64) ([]domain.RemoteMessage, error) {
+	accessHash, _ := t.getAccessHash(groupID)
+	inputPeer := &tg.InputPeerChannel{
+		ChannelID:  groupID,
+		AccessHash: accessHash,
+	}
+
+	var result []domain.RemoteMessage
+	err := t.forEachMessage(ctx, inputPeer, func(msg tg.MessageClass) {
+		m, ok := msg.(*tg.Message)
+		if !ok || !inTopic(m, topicID) || isIndexMessage(m) {
+			return
+		}
+		media, ok := m.Media.(*tg.MessageMediaDocument)
+		if !ok {
+			return
+		}
+		d, ok := media.Document.(*tg.Document)
+		if !ok {
+			return
+		}
+
+		rm := domain.RemoteMessage{
+			ID:         m.ID,
+			Caption:    m.Message,
+			Size:       d.Size,
+			DocumentID: d.ID,
+			Date:       int64(m.Date),
+		}
+		for _, attr := range d.Attributes {
+			if name, ok := attr.(*tg.DocumentAttributeFilename); ok {
+				rm.FileName = name.FileName
+			}
+		}
+		var meta domain.FileMeta
+		if err := json.Unmarshal([]byte(m.Message), &meta); err == nil && (meta.Path != "" || meta.Sidecar != 0) {
+			rm.Meta = &meta
+		}
+		result = append(result, rm)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, rm := range result {
+		if rm.Meta == nil || rm.Meta.Sidecar == 0 {
+			continue
+		}
+		meta, err := t.resolveSidecar(ctx, groupID, *rm.Meta)
+		if err != nil {
+			log.Printf("[!] Warning: metadata sidecar of message %d unreadable: %v", rm.ID, err)
+			result[i].Meta = nil
+			continue
+		}
+		result[i].Meta = &meta
+	}
+	return result, nil
+}
+
+// assembleFiles turns file messages, newest first, into files: packs are
+// expanded and the parts of chunked files are put together.
+func (t *TelegramClient) assembleFiles(ctx context.Context, groupID int64, messages []listedMessage) []domain.RemoteFile {
+	var files []domain.RemoteFile
+	chunked := make(map[chunkKey]int) // index into files of the chunked file being assembled
+
+	for _, m := range messages {
+		if m.file.Meta.Sidecar != 0 {
+			meta, err := t.resolveSidecar(ctx, groupID, m.file.Meta)
+			if err != nil {
+				log.Printf("[!] Ignoring message %d: unreadable metadata sidecar: %v", m.file.MessageID, err)
+				continue
+			}
+			m.file.Meta = meta
+		}
+		file := m.file
+		if file.Meta.HasFlag(domain.FlagPack) {
+			files = append(files, t.expandPack(ctx, groupID, m)...)
+			continue
+		}
+		if !file.Meta.IsChunked() {
+			files = append(files, file)
+			continue
+		}
+
+		key := chunkKeyOf(file.Meta)
+		idx, exists := chunked[key]
+		if !exists {
+			idx = len(files)
+			chunked[key] = idx
+			files = append(files, domain.RemoteFile{
+				Meta:   file.Meta,
+				Chunks: make([]domain.RemoteChunk, file.Meta.Parts),
+			})
+		}
+		if file.Meta.Part >= 0 && file.Meta.Part < file.Meta.Parts {
+			files[idx].Chunks[file.Meta.Part] = domain.RemoteChunk{
+				MessageID: file.MessageID,
+				Size:      file.Size,
+				Checksum:  file.Meta.PartChecksum,
+			}
+			if file.Meta.Part == 0 {
+				files[idx].DocumentID = file.DocumentID
+			}
+		}
+	}
+
+	return assembleChunks(files)
+}
+
+// chunkKey identifies the parts belonging to the same upload of a chunked file.
+type chunkKey struct {
+	path     string
+	checksum string
+	modTime  int64
+	parts    int
+}
+
+func chunkKeyOf(meta domain.FileMeta) chunkKey {
+	return chunkKey{
+		path:     meta.Path,
+		checksum: meta.Checksum,
+		modTime:  meta.ModTime,
+		parts:    meta.Parts,
+	}
+}
 
-	return files, nil
+// assembleChunks finalizes the chunked files collected by assembleFiles and
+// drops those with missing parts, which are left behind by interrupted uploads.
+func assembleChunks(files []domain.RemoteFile) []domain.RemoteFile {
+	result := files[:0]
+	for _, f := range files {
+		if len(f.Chunks) == 0 {
+			result = append(result, f)
+			continue
+		}
+
+		complete := true
+		f.Size = 0
+		for _, c := range f.Chunks {
+			if c.MessageID == 0 {
+				complete = false
+				break
+			}
+			f.Size += c.Size
+		}
+		if !complete {
+			log.Printf("[!] Ignoring incomplete chunked file: %s", f.Meta.Path)
+			continue
+		}
+
+		f.MessageID = f.Chunks[0].MessageID
+		f.Meta.Part = 0
+		f.Meta.PartChecksum = ""
+		result = append(result, f)
+	}
+	return result
 }
 
-func (t *TelegramClient) parseMessageToFile(msg tg.MessageClass, topicID int64) (domain.RemoteFile, bool) {
+// parseMessage returns the file held by a message of the topic, if any.
+func (t *TelegramClient) parseMessage(msg tg.MessageClass, topicID int64) (listedMessage, bool) {
 	m, ok := msg.(*tg.Message)
+	if !ok || !inTopic(m, topicID) {
+		return listedMessage{}, false
+	}
+
+	meta, ok := parseCaption(m.Message)
 	if !ok {
-		return domain.RemoteFile{}, false
+		return listedMessage{}, false
 	}
 
-	// Topic Filter Logic
-	if topicID != 0 {
-		match := false
-		if m.ReplyTo != nil {
-			if h, ok := m.ReplyTo.(*tg.MessageReplyHeader); ok {
-				if h.ReplyToTopID == int(topicID) || h.ReplyToMsgID == int(topicID) {
-					match = true
-				}
+	var doc *tg.Document
+	size := int64(0)
+	docID := int64(0)
+	if m.Media != nil {
+		if media, ok := m.Media.(*tg.MessageMediaDocument); ok {
+			if d, ok := media.Document.(*tg.Document); ok {
+				doc = d
+				size = d.Size
+				docID = d.ID
 			}
 		}
-		if !match {
-			return domain.RemoteFile{}, false
-		}
 	}
+	return listedMessage{
+		file: domain.RemoteFile{
+			Meta:       meta,
+			MessageID:  m.ID,
+			Size:       size,
+			DocumentID: docID,
+		},
+		doc: doc,
+	}, true
+}
 
-	// Parse Caption and Document Info
-	if m.Message != "" {
-		var meta domain.FileMeta
-		// Ignore unmarshal errors, it means it's not a file created by us
-		if err := json.Unmarshal([]byte(m.Message), &meta); err == nil {
-			if meta.Path != "" && (meta.Checksum != "" || meta.ModTime != 0) {
-				size := int64(0)
-				if m.Media != nil {
-					if doc, ok := m.Media.(*tg.MessageMediaDocument); ok {
-						if d, ok := doc.Document.(*tg.Document); ok {
-							size = d.Size
-						}
-					}
-				}
-				return domain.RemoteFile{
-					Meta:      meta,
-					MessageID: m.ID,
-					Size:      size,
-				}, true
+// inTopic reports whether the message belongs to the topic (any for 0).
+func inTopic(m *tg.Message, topicID int64) bool {
+	if topicID == 0 {
+		return true
+	}
+	if m.ReplyTo != nil {
+		if h, ok := m.ReplyTo.(*tg.MessageReplyHeader); ok {
+			if h.ReplyToTopID == int(topicID) || h.ReplyToMsgID == int(topicID) {
+				return true
 			}
 		}
 	}
-	return domain.RemoteFile{}, false
+	return false
+}
+
+// parseCaption parses the metadata of a file message. Captions that are not
+// metadata written by us, the topic index, metadata sidecars, quarantined
+// files and superseded versions are rejected. The captions pointing to a
+// sidecar are returned as they are, without a path.
+func parseCaption(caption string) (domain.FileMeta, bool) {
+	if caption == "" {
+		return domain.FileMeta{}, false
+	}
+	var meta domain.FileMeta
+	// Ignore unmarshal errors, it means it's not a file created by us
+	if err := json.Unmarshal([]byte(caption), &meta); err != nil {
+		return domain.FileMeta{}, false
+	}
+	if (meta.Path == "" && meta.Sidecar == 0) || (meta.Checksum == "" && meta.ModTime == 0) ||
+		meta.HasFlag(domain.FlagIndex) || meta.HasFlag(domain.FlagSidecar) || meta.HasFlag(domain.FlagQuarantined) || meta.HasFlag(domain.FlagSuperseded) {
+		return domain.FileMeta{}, false
+	}
+	return meta, true
 }
 
 // UploadFile uploads a file to the topic with progress reporting.
+// Files larger than the chunk size are split into parts, each sent as its
+// own message carrying the chunk manifest in its metadata.
 func (t *TelegramClient) UploadFile(ctx context.Context, groupID int64, topicID int64, file domain.LocalFile) error {
 	accessHash, _ := t.getAccessHash(groupID)
 	inputPeer := &tg.InputPeerChannel{
@@ -129,129 +370,472 @@ func (t *TelegramClient) UploadFile(ctx context.Context, groupID int64, topicID
 		AccessHash: accessHash,
 	}
 
+	if !t.quota.Fits(file.Size) {
+		_, hard := t.quota.Limits()
+		return fmt.Errorf("%w: %s would pass %s, %s uploaded today", domain.ErrUploadLimit, file.Path, formatSize(hard), formatSize(t.quota.Today()))
+	}
+
 	log.Printf("[...] Uploading: %s (%s)", file.Path, formatSize(file.Size))
 
-	var task domain.ProgressTask
+	meta := uploadMeta(file)
+	t.stampOrigin(&meta)
 
-	err := retry.WithRetry(ctx, "UploadFile: "+file.Path, func() error {
-		// 0. Generate a fresh upload ID for each retry to ensure a clean state
-		uploadID, _ := crypto.RandInt64(crypto.DefaultRand())
+	parts := 1
+	partSize := file.Size
+	if file.Size > t.chunkSize {
+		partSize = t.chunkSize
+		parts = int((file.Size + partSize - 1) / partSize)
+		meta.Parts = parts
+		meta.PartSize = partSize
+		log.Printf("[*] Splitting %s into %d parts of %s", file.Path, parts, formatSize(partSize))
+	}
+	if name := documentName(file.Path, 0, 1); name != path.Base(file.Path) {
+		log.Printf("[!] %s can't be used as document name, sending it as %s (the path is kept in the metadata)", path.Base(file.Path), name)
+	}
 
-		t.mu.Lock()
-		t.progressStarts[uploadID] = time.Now()
-		if t.progressTracker != nil {
-			// If we already had a task from a previous attempt, abort it before starting a new one
-			if task != nil {
-				task.Abort()
-			}
-			task = t.progressTracker.Start(file.Path, file.Size)
-			t.progressTasks[uploadID] = task
+	// Checksum the content as it is read, when asked to
+	sumDest := domain.UploadChecksumFrom(ctx)
+	hashing := sumDest != nil && file.Checksum == "" && file.Size > 0
+	if hashing && parts > 1 {
+		// Every part carries the checksum: it is needed before the first is sent
+		sum, err := hashFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to checksum %s: %w", file.Path, err)
 		}
-		t.mu.Unlock()
+		meta.Checksum = sum
+		*sumDest = sum
+		hashing = false
+	}
+	// Every part also carries the checksum of its own content, so that a
+	// corrupt one can be downloaded again on its own
+	if _, err := checksum.New(file.Algorithm); (hashing || parts > 1) && err != nil {
+		return err
+	}
+	meta, err := t.fitCaption(ctx, inputPeer, topicID, meta)
+	if err != nil {
+		return err
+	}
 
-		// Ensure we clean up progress tracking for this ID if this attempt fails
-		defer func() {
-			t.mu.Lock()
-			delete(t.progressStarts, uploadID)
-			delete(t.progressTasks, uploadID)
-			t.mu.Unlock()
-		}()
+	task, owned := t.progressTask(ctx, file.Path, file.Size)
 
-		// 1. Raw content upload
-		var u tg.InputFileClass
-		var uploadErr error
+	var sent []int
+	for i := 0; i < parts; i++ {
+		offset := int64(i) * partSize
+		size := min(partSize, file.Size-offset)
 
-		// Special case for empty files: Telegram rejects 0-byte files.
-		// We upload a 1-byte dummy file and mark it with a flag.
-		if file.Size == 0 {
-			u, uploadErr = t.uploader.WithIDGenerator(func() (int64, error) {
-				return uploadID, nil
-			}).FromBytes(ctx, filepath.Base(file.Path), []byte{0})
-		} else {
-			// If it's a file from disk, use uploader.FromPath for potential optimizations (like random access for concurrent parts)
-			u, uploadErr = t.uploader.WithIDGenerator(func() (int64, error) {
-				return uploadID, nil
-			}).FromPath(ctx, file.AbsPath)
+		partMeta := meta
+		name := documentName(file.Path, i, parts)
+		opName := "UploadFile: " + file.Path
+		if parts > 1 {
+			partMeta.Part = i
+			opName = fmt.Sprintf("UploadFile: %s [%d/%d]", file.Path, i+1, parts)
 		}
 
-		if uploadErr != nil {
-			return fmt.Errorf("failed to upload raw content: %w", uploadErr)
-		}
+		err := retry.WithRetry(ctx, opName, func() error {
+			var h hash.Hash
+			if hashing || parts > 1 {
+				h, _ = checksum.New(file.Algorithm)
+			}
+			msgID, err := t.sendDocument(ctx, inputPeer, topicID, file, offset, size, name, partMeta, task, h)
+			if err != nil {
+				return err
+			}
+			if hashing {
+				*sumDest = hex.EncodeToString(h.Sum(nil))
+			}
+			sent = append(sent, msgID)
+			return nil
+		}, 5, 1*time.Second)
 
-		// 2. JSON Metadata preparation
-		meta := domain.FileMeta{
-			Path:     file.Path,
-			Checksum: file.Checksum,
-			ModTime:  file.ModTime,
+		if err != nil {
+			if owned {
+				task.Abort()
+			}
+			// Don't leave orphaned parts behind
+			var orphans []int
+			if parts > 1 {
+				orphans = sent
+			}
+			if meta.Sidecar != 0 {
+				orphans = append(orphans, meta.Sidecar)
+			}
+			if len(orphans) > 0 {
+				if delErr := t.DeleteFile(context.WithoutCancel(ctx), groupID, topicID, orphans...); delErr != nil {
+					log.Printf("Warning: failed to delete uploaded parts of %s: %v", file.Path, delErr)
+				}
+			}
+			return err
 		}
-		if file.Size == 0 {
-			meta.Flags = "EMPTY_FILE"
+	}
+
+	if owned {
+		task.Complete()
+	}
+	log.Printf("[+] Uploaded: %s", file.Path)
+	return nil
+}
+
+// hashFile returns the checksum of the content of file.
+func hashFile(file domain.LocalFile) (string, error) {
+	h, err := checksum.New(file.Algorithm)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(file.AbsPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// progressTask returns the task the progress of a transfer is reported to:
+// the one of ctx, or else a new one from the tracker, which the transfer
+// owns and must finish. It is nil without either.
+func (t *TelegramClient) progressTask(ctx context.Context, name string, total int64) (task domain.ProgressTask, owned bool) {
+	if task := domain.ProgressTaskFrom(ctx); task != nil {
+		return task, false
+	}
+	if t.progressTracker == nil {
+		return nil, false
+	}
+	return t.progressTracker.Start(name, total), true
+}
+
+// maxDocumentName is the length of the longest document name sent, in bytes.
+// Telegram truncates longer names: they are shortened beforehand instead, so
+// that the result doesn't depend on the server.
+const maxDocumentName = 128
+
+// documentName returns the name of the document holding the given part of
+// the file at filePath. Documents are only named for the convenience of
+// other clients: the tool always reads the path from the metadata.
+func documentName(filePath string, part, parts int) string {
+	name := strings.ToValidUTF8(path.Base(filePath), "_")
+	var suffix string
+	if parts > 1 {
+		suffix = fmt.Sprintf(".part%03d", part)
+	}
+	if len(name)+len(suffix) <= maxDocumentName {
+		return name + suffix
+	}
+
+	// Keep the extension, which tells other clients how to open the file
+	ext := path.Ext(name)
+	if len(ext) > 16 {
+		ext = ""
+	}
+	stem := name[:len(name)-len(ext)]
+	keep := maxDocumentName - len("~") - len(ext) - len(suffix)
+	for keep > 0 && !utf8.RuneStart(stem[keep]) {
+		keep--
+	}
+	return stem[:keep] + "~" + ext + suffix
+}
+
+// uploadMeta returns the metadata stored in the caption of an uploaded file.
+func uploadMeta(file domain.LocalFile) domain.FileMeta {
+	meta := domain.FileMeta{
+		Path:      file.Path,
+		Checksum:  file.Checksum,
+		Algorithm: file.Algorithm,
+		ModTime:   file.ModTime,
+		Flags:     file.Flags,
+		Version:   file.Version,
+		DeletedAt: file.DeletedAt,
+	}
+	if len(file.Tags) > 0 {
+		meta.Tags = file.Tags
+	}
+	if len(file.Pipeline) > 0 {
+		meta.Pipeline = file.Pipeline
+		meta.ContentSize = file.ContentSize
+	}
+	if file.Size == 0 {
+		meta.SetFlag(domain.FlagEmptyFile)
+	}
+	return meta
+}
+
+// CopyFile stores file by sending new messages that reference the documents
+// of source, which must have the same content, instead of uploading it again.
+func (t *TelegramClient) CopyFile(ctx context.Context, groupID int64, topicID int64, source domain.RemoteFile, file domain.LocalFile) error {
+	accessHash, _ := t.getAccessHash(groupID)
+	inputPeer := &tg.InputPeerChannel{
+		ChannelID:  groupID,
+		AccessHash: accessHash,
+	}
+
+	docs, err := t.getDocuments(ctx, groupID, source.MessageIDs())
+	if err != nil {
+		return fmt.Errorf("failed to get documents of %s: %w", source.Meta.Path, err)
+	}
+
+	meta := uploadMeta(file)
+	t.stampOrigin(&meta)
+	// The documents hold the content as transformed for source
+	meta.Pipeline = source.Meta.Pipeline
+	meta.ContentSize = source.Meta.ContentSize
+	if len(docs) > 1 {
+		meta.Parts = source.Meta.Parts
+		meta.PartSize = source.Meta.PartSize
+	}
+	meta, err = t.fitCaption(ctx, inputPeer, topicID, meta)
+	if err != nil {
+		return err
+	}
+
+	var sent []int
+	for i, doc := range docs {
+		partMeta := meta
+		if len(docs) > 1 {
+			partMeta.Part = i
+			if i < len(source.Chunks) {
+				partMeta.PartChecksum = source.Chunks[i].Checksum
+			}
 		}
-		captionBytes, err := json.Marshal(meta)
+		captionBytes, err := json.Marshal(partMeta)
 		if err != nil {
 			return fmt.Errorf("failed to marshal metadata: %w", err)
 		}
-		caption := string(captionBytes)
 
-		// 3. MIME type determination
-		mimeType := mime.TypeByExtension(filepath.Ext(file.Path))
-		if mimeType == "" {
-			mimeType = "application/octet-stream"
+		err = retry.WithRetry(ctx, "CopyFile: "+file.Path, func() error {
+			updates, err := t.sender.To(inputPeer).
+				Reply(int(topicID)).
+				Media(ctx, message.Document(doc, styling.Plain(string(captionBytes))))
+			if err != nil {
+				return err
+			}
+			msgID, ok := sentMessageID(updates)
+			if !ok {
+				return errors.New("no message ID in the response")
+			}
+			sent = append(sent, msgID)
+			return nil
+		}, 5, 1*time.Second)
+		if err != nil {
+			if meta.Sidecar != 0 {
+				sent = append(sent, meta.Sidecar)
+			}
+			if len(sent) > 0 {
+				if delErr := t.DeleteFile(context.WithoutCancel(ctx), groupID, topicID, sent...); delErr != nil {
+					log.Printf("Warning: failed to delete copied parts of %s: %v", file.Path, delErr)
+				}
+			}
+			return fmt.Errorf("failed to send document message: %w", err)
 		}
+	}
 
-		// 4. Send Message with Document
-		_, err = t.sender.To(inputPeer).
-			Reply(int(topicID)).
-			Media(ctx, message.UploadedDocument(u, styling.Plain(caption)).
-				MIME(mimeType).
-				Filename(filepath.Base(file.Path)),
-			)
+	log.Printf("[+] Copied: %s (same content as %s)", file.Path, source.Meta.Path)
+	return nil
+}
+
+// getDocuments returns the documents attached to the given messages, in order.
+func (t *TelegramClient) getDocuments(ctx context.Context, groupID int64, messageIDs []int) ([]*tg.Document, error) {
+	accessHash, _ := t.getAccessHash(groupID)
 
+	ids := make([]tg.InputMessageClass, 0, len(messageIDs))
+	for _, id := range messageIDs {
+		ids = append(ids, &tg.InputMessageID{ID: id})
+	}
+
+	var docs map[int]*tg.Document
+	err := retry.WithRetry(ctx, "GetMessages", func() error {
+		msgs, err := t.api.ChannelsGetMessages(ctx, &tg.ChannelsGetMessagesRequest{
+			Channel: &tg.InputChannel{
+				ChannelID:  groupID,
+				AccessHash: accessHash,
+			},
+			ID: ids,
+		})
 		if err != nil {
-			return fmt.Errorf("failed to send document message: %w", err)
+			return err
+		}
+
+		m, ok := msgs.(*tg.MessagesChannelMessages)
+		if !ok {
+			return errors.New("unexpected response type")
+		}
+		docs = make(map[int]*tg.Document)
+		for _, msg := range m.Messages {
+			mm, ok := msg.(*tg.Message)
+			if !ok {
+				continue
+			}
+			if media, ok := mm.Media.(*tg.MessageMediaDocument); ok {
+				if d, ok := media.Document.(*tg.Document); ok {
+					docs[mm.ID] = d
+				}
+			}
 		}
 		return nil
 	}, 5, 1*time.Second)
-
 	if err != nil {
-		if task != nil {
-			task.Abort()
+		return nil, err
+	}
+
+	result := make([]*tg.Document, 0, len(messageIDs))
+	for _, id := range messageIDs {
+		d, ok := docs[id]
+		if !ok {
+			return nil, fmt.Errorf("message %d not found or not a document", id)
 		}
-		return err
+		result = append(result, d)
 	}
+	return result, nil
+}
+
+// sendDocument uploads size bytes of the file starting at offset and sends
+// them as a document with the given metadata as caption. With h, the content
+// is checksummed as it is read, and the checksum set in the metadata: the
+// one of the part for a part of a chunked file.
+func (t *TelegramClient) sendDocument(ctx context.Context, inputPeer tg.InputPeerClass, topicID int64, file domain.LocalFile, offset, size int64, name string, meta domain.FileMeta, task domain.ProgressTask, h hash.Hash) (int, error) {
+	// 0. Generate a fresh upload ID for each retry to ensure a clean state
+	uploadID, _ := crypto.RandInt64(crypto.DefaultRand())
 
 	if task != nil {
-		task.Complete()
+		// Rewind the bar to the start of this part in case a previous attempt failed
+		task.SetCurrent(offset)
 	}
-	log.Printf("[+] Uploaded: %s", file.Path)
-	return nil
+	progress := &uploadProgress{t: t, task: task, offset: offset, start: t.clock.Now()}
+
+	// 1. Raw content upload
+	var u tg.InputFileClass
+	var uploadErr error
+
+	// Uploaders aren't shared: their ID generator and thread count are per upload
+	up := uploader.NewUploader(t.parts).
+		WithProgress(progress).
+		WithPartSize(512 * 1024). // 512KB is the maximum part size
+		WithThreads(t.threadsFor(size)).
+		WithIDGenerator(func() (int64, error) {
+			return uploadID, nil
+		})
+
+	switch {
+	case file.Size == 0:
+		// Special case for empty files: Telegram rejects 0-byte files.
+		// We upload a 1-byte dummy file and mark it with a flag.
+		u, uploadErr = up.FromBytes(ctx, name, []byte{0})
+	case size == file.Size && h == nil:
+		// If it's a file from disk, use uploader.FromPath for potential optimizations (like random access for concurrent parts)
+		u, uploadErr = up.FromPath(ctx, file.AbsPath)
+	default:
+		f, err := os.Open(file.AbsPath)
+		if err != nil {
+			return 0, fmt.Errorf("failed to open file: %w", err)
+		}
+		defer f.Close()
+		// The uploader reads the content in order, from a single goroutine
+		var r io.Reader = io.NewSectionReader(f, offset, size)
+		if h != nil {
+			r = io.TeeReader(r, h)
+		}
+		u, uploadErr = up.Upload(ctx, uploader.NewUpload(name, r, size))
+	}
+
+	if uploadErr != nil {
+		return 0, fmt.Errorf("failed to upload raw content: %w", uploadErr)
+	}
+	if h != nil && meta.IsChunked() {
+		meta.PartChecksum = hex.EncodeToString(h.Sum(nil))
+	} else if h != nil {
+		meta.Checksum = hex.EncodeToString(h.Sum(nil))
+	}
+
+	// 2. JSON Metadata preparation
+	captionBytes, err := json.Marshal(meta)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+	caption := string(captionBytes)
+
+	// 3. MIME type determination
+	mimeType := mime.TypeByExtension(filepath.Ext(file.Path))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	// 4. Send Message with Document
+	updates, err := t.sender.To(inputPeer).
+		Reply(int(topicID)).
+		Media(ctx, message.UploadedDocument(u, styling.Plain(caption)).
+			MIME(mimeType).
+			Filename(name),
+		)
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to send document message: %w", err)
+	}
+	t.quota.Add(size)
+
+	msgID, ok := sentMessageID(updates)
+	if !ok {
+		return 0, errors.New("no message ID in the response")
+	}
+	return msgID, nil
+}
+
+// sentMessageID extracts the ID of the message created by a send request.
+func sentMessageID(updates tg.UpdatesClass) (int, bool) {
+	var list []tg.UpdateClass
+	switch u := updates.(type) {
+	case *tg.UpdateShortSentMessage:
+		return u.ID, true
+	case *tg.Updates:
+		list = u.Updates
+	case *tg.UpdatesCombined:
+		list = u.Updates
+	}
+
+	for _, update := range list {
+		switch u := update.(type) {
+		case *tg.UpdateNewChannelMessage:
+			return u.Message.GetID(), true
+		case *tg.UpdateNewMessage:
+			return u.Message.GetID(), true
+		case *tg.UpdateMessageID:
+			return u.ID, true
+		}
+	}
+	return 0, false
+}
+
+// uploadProgress tracks a single upload attempt of the part of a file
+// starting at offset, reporting it to task relative to the whole file.
+type uploadProgress struct {
+	t      *TelegramClient
+	task   domain.ProgressTask
+	offset int64
+	start  time.Time
 }
 
 // Chunk implements uploader.Progress interface.
-func (t *TelegramClient) Chunk(ctx context.Context, state uploader.ProgressState) error {
-	t.mu.RLock()
-	task, hasTask := t.progressTasks[state.ID]
-	startTime, hasStart := t.progressStarts[state.ID]
-	t.mu.RUnlock()
+func (p *uploadProgress) Chunk(ctx context.Context, state uploader.ProgressState) error {
+	t := p.t
+	if p.task != nil {
+		p.task.SetCurrent(p.offset + state.Uploaded)
+	}
 
-	if hasTask {
-		task.SetCurrent(state.Uploaded)
+	// Until the first part is through, time goes into connection and request setup
+	if state.Uploaded <= int64(state.PartSize) {
+		t.debugf("Upload %s: first part after %s", state.Name, clock.Since(t.clock, p.start).Round(time.Millisecond))
 	}
 
 	if state.Total > 0 {
 		percent := float64(state.Uploaded) / float64(state.Total) * 100
 
 		speedStr := ""
-		if hasStart {
-			elapsed := time.Since(startTime).Seconds()
-			if elapsed > 0 {
-				speed := float64(state.Uploaded) / elapsed
-				speedStr = fmt.Sprintf(" | %s/s", formatSize(int64(speed)))
-			}
+		if elapsed := clock.Since(t.clock, p.start).Seconds(); elapsed > 0 {
+			speed := float64(state.Uploaded) / elapsed
+			speedStr = fmt.Sprintf(" | %s/s", formatSize(int64(speed)))
 		}
 
 		// Log only if no interactive reporter is active
-		if t.progressTracker == nil {
+		if p.task == nil {
 			if state.Uploaded == state.Total || state.Uploaded%(5*1024*1024) < int64(state.PartSize) {
 				log.Printf("  [%s] %.1f%% (%s/%s)%s", state.Name, percent, formatSize(state.Uploaded), formatSize(state.Total), speedStr)
 			}
@@ -273,31 +857,86 @@ func formatSize(b int64) string {
 	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "KMGTPE"[exp])
 }
 
-func (t *TelegramClient) DeleteFile(ctx context.Context, groupID int64, topicID int64, messageID int) error {
+// DeleteFile deletes the given messages, in batches of at most 100 as
+// accepted by Telegram.
+func (t *TelegramClient) DeleteFile(ctx context.Context, groupID int64, topicID int64, messageIDs ...int) error {
 	accessHash, _ := t.getAccessHash(groupID)
 	inputChannel := &tg.InputChannel{
 		ChannelID:  groupID,
 		AccessHash: accessHash,
 	}
 
-	_, err := t.api.ChannelsDeleteMessages(ctx, &tg.ChannelsDeleteMessagesRequest{
-		Channel: inputChannel,
-		ID:      []int{messageID},
-	})
-	return err
+	for len(messageIDs) > 0 {
+		batch := messageIDs[:min(len(messageIDs), 100)]
+		messageIDs = messageIDs[len(batch):]
+
+		_, err := t.api.ChannelsDeleteMessages(ctx, &tg.ChannelsDeleteMessagesRequest{
+			Channel: inputChannel,
+			ID:      batch,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (t *TelegramClient) DownloadFile(ctx context.Context, groupID int64, topicID int64, messageID int, fileName string, size int64) (io.ReadCloser, error) {
+// UpdateFileMeta rewrites the caption of every message holding the file with
+// the given metadata, keeping the chunk index of each part.
+func (t *TelegramClient) UpdateFileMeta(ctx context.Context, groupID int64, topicID int64, file domain.RemoteFile, meta domain.FileMeta) error {
 	accessHash, _ := t.getAccessHash(groupID)
+	inputPeer := &tg.InputPeerChannel{
+		ChannelID:  groupID,
+		AccessHash: accessHash,
+	}
+
+	// The sidecar of the previous metadata is left to gc: the other parts of
+	// a chunked file may still point to it
+	meta, err := t.fitCaption(ctx, inputPeer, topicID, meta)
+	if err != nil {
+		return err
+	}
+
+	for i, msgID := range file.MessageIDs() {
+		partMeta := meta
+		if len(file.Chunks) > 0 {
+			partMeta.Part = i
+			partMeta.PartChecksum = file.Chunks[i].Checksum
+		}
+		captionBytes, err := json.Marshal(partMeta)
+		if err != nil {
+			return fmt.Errorf("failed to marshal metadata: %w", err)
+		}
+
+		err = retry.WithRetry(ctx, "UpdateFileMeta: "+meta.Path, func() error {
+			_, err := t.api.MessagesEditMessage(ctx, &tg.MessagesEditMessageRequest{
+				Peer:    inputPeer,
+				ID:      msgID,
+				Message: string(captionBytes),
+			})
+			if tgerr.Is(err, "MESSAGE_NOT_MODIFIED") {
+				return nil
+			}
+			return err
+		}, 5, 1*time.Second)
+		if err != nil {
+			return fmt.Errorf("failed to edit caption of message %d: %w", msgID, err)
+		}
+	}
+	return nil
+}
 
-	log.Printf("[...] Downloading: %s (%s)", fileName, formatSize(size))
+// DownloadFile streams the content of the document of the given message,
+// skipping its first offset bytes.
+func (t *TelegramClient) DownloadFile(ctx context.Context, groupID int64, topicID int64, messageID int, fileName string, size int64, offset int64) (io.ReadCloser, error) {
+	accessHash, _ := t.getAccessHash(groupID)
 
-	// Track start time for speed calculation (using a negative ID for downloads to avoid collision with uploads if any)
-	// Actually we can use the messageID as part of the key
-	downloadID := int64(messageID)
-	t.mu.Lock()
-	t.progressStarts[downloadID] = time.Now()
-	t.mu.Unlock()
+	if offset > 0 {
+		log.Printf("[...] Resuming download: %s at %s/%s", fileName, formatSize(offset), formatSize(size))
+	} else {
+		log.Printf("[...] Downloading: %s (%s)", fileName, formatSize(size))
+	}
+	requested := t.clock.Now()
 
 	var msg *tg.Message
 	{
@@ -322,48 +961,45 @@ func (t *TelegramClient) DownloadFile(ctx context.Context, groupID int64, topicI
 					}
 				}
 			}
-			return errors.New("message not found or invalid type")
+			return fmt.Errorf("message %d: %w", messageID, domain.ErrNotFound)
 		}, 5, 1*time.Second)
 
 		if err != nil {
-			t.mu.Lock()
-			delete(t.progressStarts, downloadID)
-			t.mu.Unlock()
 			return nil, err
 		}
 	}
 
 	doc, ok := msg.Media.(*tg.MessageMediaDocument)
 	if !ok {
-		t.mu.Lock()
-		delete(t.progressStarts, downloadID)
-		t.mu.Unlock()
-		return nil, errors.New("message is not a document")
+		return nil, fmt.Errorf("message %d is not a document: %w", messageID, domain.ErrNotFound)
 	}
 
 	d, ok := doc.Document.(*tg.Document)
 	if !ok {
-		t.mu.Lock()
-		delete(t.progressStarts, downloadID)
-		t.mu.Unlock()
-		return nil, errors.New("media is not a document")
+		return nil, fmt.Errorf("media of message %d is not a document: %w", messageID, domain.ErrNotFound)
 	}
 
 	// Pipe for streaming
 	pr, pw := io.Pipe()
 
-	var task domain.ProgressTask
-	if t.progressTracker != nil {
-		task = t.progressTracker.Start(fileName, size)
+	task, owned := t.progressTask(ctx, fileName, size)
+	if owned {
+		task.SetCurrent(offset)
 	}
 
+	// Cancelling the download unblocks both ends of the pipe, even when the
+	// reader is no longer reading
+	stopClosing := context.AfterFunc(ctx, func() {
+		pw.CloseWithError(ctx.Err())
+	})
+
 	var downloadSuccess bool
 	go func() {
+		defer stopClosing()
+		ctx, cancel := context.WithCancelCause(ctx)
+		defer cancel(nil)
 		defer func() {
-			t.mu.Lock()
-			delete(t.progressStarts, downloadID)
-			t.mu.Unlock()
-			if task != nil {
+			if owned {
 				if downloadSuccess {
 					task.Complete()
 				} else {
@@ -376,21 +1012,34 @@ func (t *TelegramClient) DownloadFile(ctx context.Context, groupID int64, topicI
 		tr := &trackingWriter{
 			w:         pw,
 			t:         t,
-			id:        downloadID,
 			name:      fileName,
 			total:     size,
-			lastLog:   0,
-			startTime: time.Now(),
+			uploaded:  offset,
+			offset:    offset,
+			lastLog:   offset,
+			ctx:       ctx,
+			startTime: t.clock.Now(),
+			requested: requested,
 			task:      task,
 		}
 
-		// gotd downloader
-		dl := downloader.NewDownloader().
-			WithPartSize(512 * 1024) // Max part size for download
 		// Check location
 		loc := d.AsInputDocumentFileLocation()
 
-		_, err := dl.Download(t.api, loc).Stream(ctx, tr)
+		// Parts can only be requested at multiples of their size: start from
+		// the part holding offset, and drop what precedes it
+		start := offset - offset%downloadPartSize
+		tr.skip = offset - start
+
+		if t.stallTimeout > 0 {
+			tr.lastData.Store(t.clock.Now().UnixNano())
+			go t.watchStall(ctx, cancel, tr)
+		}
+
+		_, err := t.downloader.Download(offsetClient{Client: t.transfer, offset: start}, loc).Stream(ctx, tr)
+		if cause := context.Cause(ctx); errors.Is(cause, errStalled) {
+			err = cause
+		}
 		if err != nil {
 			pw.CloseWithError(err)
 		} else {
@@ -406,17 +1055,44 @@ func (t *TelegramClient) DownloadFile(ctx context.Context, groupID int64, topicI
 type trackingWriter struct {
 	w         io.Writer
 	t         *TelegramClient
-	id        int64
 	name      string
 	total     int64
 	uploaded  int64
+	offset    int64 // where the download was resumed
+	skip      int64 // bytes still to drop before offset
 	lastLog   int64
+	ctx       context.Context
 	startTime time.Time
+	requested time.Time
 	task      domain.ProgressTask
+
+	// For stall detection: when data was last received, and whether the
+	// download is held up on this side instead, by the bandwidth limit or
+	// the reader
+	lastData atomic.Int64
+	holding  atomic.Bool
 }
 
 func (tw *trackingWriter) Write(p []byte) (n int, err error) {
-	n, err = tw.w.Write(p)
+	tw.holding.Store(true)
+	defer func() {
+		tw.lastData.Store(tw.t.clock.Now().UnixNano())
+		tw.holding.Store(false)
+	}()
+	if err := tw.t.limiter.Wait(tw.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	if !tw.requested.IsZero() {
+		tw.t.debugf("Download %s: first part after %s", tw.name, clock.Since(tw.t.clock, tw.requested).Round(time.Millisecond))
+		tw.requested = time.Time{}
+	}
+
+	skipped := int(min(tw.skip, int64(len(p))))
+	tw.skip -= int64(skipped)
+	if skipped == len(p) {
+		return skipped, nil
+	}
+	n, err = tw.w.Write(p[skipped:])
 	if n > 0 {
 		tw.uploaded += int64(n)
 		if tw.task != nil {
@@ -424,11 +1100,11 @@ func (tw *trackingWriter) Write(p []byte) (n int, err error) {
 		}
 		tw.report()
 	}
-	return n, err
+	return skipped + n, err
 }
 
 func (tw *trackingWriter) report() {
-	if tw.total <= 0 || tw.t.progressTracker != nil {
+	if tw.total <= 0 || tw.task != nil {
 		return
 	}
 
@@ -436,12 +1112,68 @@ func (tw *trackingWriter) report() {
 	if tw.uploaded == tw.total || tw.uploaded-tw.lastLog >= 5*1024*1024 {
 		tw.lastLog = tw.uploaded
 		percent := float64(tw.uploaded) / float64(tw.total) * 100
-		elapsed := time.Since(tw.startTime).Seconds()
+		elapsed := clock.Since(tw.t.clock, tw.startTime).Seconds()
 		speedStr := ""
 		if elapsed > 0 {
-			speed := float64(tw.uploaded) / elapsed
+			speed := float64(tw.uploaded-tw.offset) / elapsed
 			speedStr = fmt.Sprintf(" | %s/s", formatSize(int64(speed)))
 		}
 		log.Printf("  [%s] %.1f%% (%s/%s)%s", tw.name, percent, formatSize(tw.uploaded), formatSize(tw.total), speedStr)
 	}
 }
+
+// errStalled is the error of a download aborted for receiving no data.
+var errStalled = errors.New("download stalled")
+
+// watchStall aborts the download written to tw with errStalled once it
+// received no data for the stall timeout, marking its task stalled after
+// half of it. The executor then retries it, resuming where it stopped.
+func (t *TelegramClient) watchStall(ctx context.Context, cancel context.CancelCauseFunc, tw *trackingWriter) {
+	stalled := false
+	setStalled := func(s bool) {
+		if task, ok := tw.task.(domain.StallAwareTask); ok && s != stalled {
+			task.SetStalled(s)
+		}
+		stalled = s
+	}
+	defer setStalled(false)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.clock.After(t.stallTimeout / 8):
+		}
+		if tw.holding.Load() {
+			continue
+		}
+		idle := t.clock.Now().Sub(time.Unix(0, tw.lastData.Load()))
+		switch {
+		case idle >= t.stallTimeout:
+			log.Printf("[!] Download stalled: %s (no data for %s), retrying", tw.name, idle.Round(time.Second))
+			cancel(fmt.Errorf("%w: no data for %s", errStalled, idle.Round(time.Second)))
+			return
+		case idle >= t.stallTimeout/2:
+			setStalled(true)
+		default:
+			setStalled(false)
+		}
+	}
+}
+
+// downloadPartSize is the size of the parts downloaded, the largest allowed.
+const downloadPartSize = 512 * 1024
+
+// offsetClient shifts the parts requested by a downloader by offset, which
+// must be a multiple of downloadPartSize, so that a download can resume
+// where a previous one stopped.
+type offsetClient struct {
+	*tg.Client
+	offset int64
+}
+
+func (c offsetClient) UploadGetFile(ctx context.Context, request *tg.UploadGetFileRequest) (tg.UploadFileClass, error) {
+	shifted := *request
+	shifted.Offset += c.offset
+	return c.Client.UploadGetFile(ctx, &shifted)
+}
@@ -0,0 +1,136 @@
+package telegram
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"tg-blobsync/internal/domain"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+)
+
+func TestDocumentName(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  string
+		part  int
+		parts int
+		want  string
+	}{
+		{
+			name:  "short name",
+			path:  "docs/report.pdf",
+			parts: 1,
+			want:  "report.pdf",
+		},
+		{
+			name:  "300 character ASCII name",
+			path:  "docs/" + strings.Repeat("a", 300),
+			parts: 1,
+			want:  strings.Repeat("a", 127) + "~",
+		},
+		{
+			name:  "300 character multibyte name cut at a rune boundary",
+			path:  strings.Repeat("日", 300),
+			parts: 1,
+			// 127 bytes are left, 42 runes of 3 bytes fit
+			want: strings.Repeat("日", 42) + "~",
+		},
+		{
+			name:  "extension kept",
+			path:  strings.Repeat("b", 296) + ".iso",
+			parts: 1,
+			want:  strings.Repeat("b", 123) + "~.iso",
+		},
+		{
+			name:  "part suffix kept",
+			path:  strings.Repeat("c", 296) + ".iso",
+			part:  7,
+			parts: 12,
+			want:  strings.Repeat("c", 115) + "~.iso.part007",
+		},
+		{
+			name:  "short name with part suffix",
+			path:  "movie.mkv",
+			part:  0,
+			parts: 3,
+			want:  "movie.mkv.part000",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := documentName(tt.path, tt.part, tt.parts)
+			if got != tt.want {
+				t.Errorf("documentName() = %q, want %q", got, tt.want)
+			}
+			if len(got) > maxDocumentName {
+				t.Errorf("documentName() is %d bytes, over %d", len(got), maxDocumentName)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("documentName() = %q is not valid UTF-8", got)
+			}
+		})
+	}
+}
+
+// editRecorder is an API invoker recording the captions set by edits.
+type editRecorder struct {
+	captions map[int]string
+}
+
+func (r *editRecorder) Invoke(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+	req, ok := input.(*tg.MessagesEditMessageRequest)
+	if !ok {
+		return fmt.Errorf("unexpected request %T", input)
+	}
+	r.captions[req.ID] = req.Message
+	return tgerr.New(400, "MESSAGE_NOT_MODIFIED")
+}
+
+func TestUpdateFileMetaKeepsPartChecksums(t *testing.T) {
+	meta := domain.FileMeta{Path: "movie.mkv", Checksum: "f00d", ModTime: 1, Parts: 3, PartSize: 100}
+	var files []domain.RemoteFile
+	file := domain.RemoteFile{Meta: meta}
+	for i, sum := range []string{"aaa", "bbb", "ccc"} {
+		file.Chunks = append(file.Chunks, domain.RemoteChunk{MessageID: 10 + i, Size: 100, Checksum: sum})
+	}
+	// As left by assembleFiles: the metadata of the last part listed
+	file.Meta.Part = 2
+	file.Meta.PartChecksum = "ccc"
+	files = assembleChunks(append(files, file))
+	if len(files) != 1 {
+		t.Fatalf("assembleChunks() returned %d files, want 1", len(files))
+	}
+	file = files[0]
+	if file.Meta.PartChecksum != "" {
+		t.Errorf("assembled PartChecksum = %q, want none", file.Meta.PartChecksum)
+	}
+
+	rec := &editRecorder{captions: make(map[int]string)}
+	c := &TelegramClient{api: tg.NewClient(rec)}
+	newMeta := file.Meta
+	newMeta.Tags = map[string]string{"kind": "movie"}
+	if err := c.UpdateFileMeta(context.Background(), 1, 2, file, newMeta); err != nil {
+		t.Fatalf("UpdateFileMeta() error = %v", err)
+	}
+
+	for i, chunk := range file.Chunks {
+		var got domain.FileMeta
+		if err := json.Unmarshal([]byte(rec.captions[chunk.MessageID]), &got); err != nil {
+			t.Fatalf("caption of part %d: %v", i, err)
+		}
+		if got.Part != i || got.PartChecksum != chunk.Checksum {
+			t.Errorf("caption of part %d has part %d, checksum %q, want part %d, checksum %q", i, got.Part, got.PartChecksum, i, chunk.Checksum)
+		}
+		if got.Tags["kind"] != "movie" {
+			t.Errorf("caption of part %d has tags %v, want the new ones", i, got.Tags)
+		}
+	}
+}
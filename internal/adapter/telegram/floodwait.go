@@ -0,0 +1,66 @@
+package telegram
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"tg-blobsync/internal/pkg/retry"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+)
+
+const (
+	// maxFloodWait is the longest FLOOD_WAIT slept on transparently.
+	// Longer waits are returned to the caller.
+	maxFloodWait = 10 * time.Minute
+	// maxFloodWaitRetries bounds the number of FLOOD_WAITs slept on per request.
+	maxFloodWaitRetries = 5
+)
+
+// floodWaiter returns a middleware that sleeps for the duration mandated by
+// FLOOD_WAIT errors and then repeats the request, notifying the rate limit
+// notifier so that the UI doesn't appear frozen in the meantime.
+func (t *TelegramClient) floodWaiter() telegram.Middleware {
+	return telegram.MiddlewareFunc(func(next tg.Invoker) telegram.InvokeFunc {
+		return func(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+			for attempt := 1; ; attempt++ {
+				err := next.Invoke(ctx, input, output)
+				wait, ok := tgerr.AsFloodWait(err)
+				if !ok || wait > maxFloodWait || attempt > maxFloodWaitRetries {
+					return err
+				}
+
+				wait = retry.Jitter(wait)
+				t.notifyRateLimited(wait)
+				select {
+				case <-t.clock.After(wait):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	})
+}
+
+func (t *TelegramClient) notifyRateLimited(wait time.Duration) {
+	t.mu.RLock()
+	notifier := t.rateLimitNotifier
+	t.mu.RUnlock()
+
+	if notifier != nil {
+		notifier.RateLimited(wait)
+	} else {
+		log.Printf("[!] Rate limited by Telegram, resuming in %s", wait)
+	}
+}
+
+// SetRateLimitNotifier sets the notifier informed about FLOOD_WAIT pauses.
+func (t *TelegramClient) SetRateLimitNotifier(notifier RateLimitNotifier) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rateLimitNotifier = notifier
+}
@@ -0,0 +1,441 @@
+package telegram
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/retry"
+
+	"github.com/gotd/td/tg"
+)
+
+// indexPath is the path of the message holding the index of a topic.
+const indexPath = ".tgblobsync/index.json.gz"
+
+// errNoIndex is returned when the topic has no pinned index.
+var errNoIndex = errors.New("no index pinned in the topic")
+
+// topicIndex is the content of the index of a topic: its file messages as of
+// the channel update sequence Pts. The changes made after Pts are replayed
+// from the channel difference when the index is read.
+type topicIndex struct {
+	Pts      int            `json:"pts"`
+	Messages []indexMessage `json:"msgs"`
+}
+
+type indexMessage struct {
+	ID   int             `json:"i"`
+	Meta domain.FileMeta `json:"m"`
+	Size int64           `json:"s"`
+	Doc  int64           `json:"d,omitempty"`
+}
+
+// indexState is the listing of a topic, kept up to date through the channel
+// difference.
+type indexState struct {
+	groupID  int64
+	topicID  int64
+	pts      int
+	messages map[int]indexMessage
+	pinnedID int   // message holding the index the state was read from
+	stale    []int // older index messages, deleted once a new one is pinned
+	changed  bool  // whether the state differs from the pinned index
+}
+
+// SetIndexEnabled sets whether the file listing is read from, and saved to,
+// an index pinned in the topic instead of walking the whole message history.
+func (t *TelegramClient) SetIndexEnabled(enabled bool) {
+	t.useIndex = enabled
+}
+
+// listFromIndex returns the file messages of the topic, newest first, from
+// its pinned index and the changes made since it was saved.
+func (t *TelegramClient) listFromIndex(ctx context.Context, groupID int64, topicID int64) ([]listedMessage, error) {
+	t.indexMu.Lock()
+	defer t.indexMu.Unlock()
+
+	st := t.index
+	if st == nil || st.groupID != groupID || st.topicID != topicID {
+		var err error
+		st, err = t.readIndex(ctx, groupID, topicID)
+		if err != nil {
+			return nil, err
+		}
+		t.index = st
+	}
+
+	if err := t.catchUp(ctx, st); err != nil {
+		t.index = nil
+		return nil, err
+	}
+	return st.listed(), nil
+}
+
+// resetIndex replaces the index state with a listing made by walking the
+// history of the topic after the channel was at pts.
+func (t *TelegramClient) resetIndex(groupID int64, topicID int64, pts int, messages []listedMessage, indexes []int) {
+	st := &indexState{
+		groupID:  groupID,
+		topicID:  topicID,
+		pts:      pts,
+		messages: make(map[int]indexMessage, len(messages)),
+		stale:    indexes,
+		changed:  true,
+	}
+	for _, m := range messages {
+		st.messages[m.file.MessageID] = indexMessage{
+			ID:   m.file.MessageID,
+			Meta: m.file.Meta,
+			Size: m.file.Size,
+			Doc:  m.file.DocumentID,
+		}
+	}
+
+	t.indexMu.Lock()
+	t.index = st
+	t.indexMu.Unlock()
+}
+
+// SaveIndex pins a new index of the topic if the listing changed since the
+// pinned one was saved. The previous index is only deleted once the new one
+// is pinned, so that the topic always has a complete index.
+func (t *TelegramClient) SaveIndex(ctx context.Context, groupID int64, topicID int64) error {
+	if !t.useIndex {
+		return nil
+	}
+
+	t.indexMu.Lock()
+	defer t.indexMu.Unlock()
+
+	st := t.index
+	if st == nil || st.groupID != groupID || st.topicID != topicID {
+		// Nothing was listed, so nothing can have changed either
+		return nil
+	}
+	if err := t.catchUp(ctx, st); err != nil {
+		t.index = nil
+		return err
+	}
+	if !st.changed && st.pinnedID != 0 && len(st.stale) == 0 {
+		return nil
+	}
+
+	index := topicIndex{Pts: st.pts}
+	for _, m := range st.messages {
+		index.Messages = append(index.Messages, m)
+	}
+	sort.Slice(index.Messages, func(i, j int) bool {
+		return index.Messages[i].ID < index.Messages[j].ID
+	})
+
+	f, err := os.CreateTemp("", "tgblobsync-index-*.json.gz")
+	if err != nil {
+		return fmt.Errorf("failed to create index: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	zw := gzip.NewWriter(f)
+	if err := json.NewEncoder(zw).Encode(index); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+
+	file := domain.LocalFile{
+		Path:    indexPath,
+		ModTime: time.Now().Unix(),
+		Size:    info.Size(),
+		AbsPath: f.Name(),
+		Flags:   domain.FlagIndex,
+	}
+
+	accessHash, _ := t.getAccessHash(groupID)
+	inputPeer := &tg.InputPeerChannel{
+		ChannelID:  groupID,
+		AccessHash: accessHash,
+	}
+
+	var msgID int
+	err = retry.WithRetry(ctx, "SaveIndex", func() error {
+		var err error
+		msgID, err = t.sendDocument(ctx, inputPeer, topicID, file, 0, file.Size, path.Base(indexPath), uploadMeta(file), nil, nil)
+		return err
+	}, 5, 1*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to upload index: %w", err)
+	}
+
+	err = retry.WithRetry(ctx, "PinIndex", func() error {
+		_, err := t.api.MessagesUpdatePinnedMessage(ctx, &tg.MessagesUpdatePinnedMessageRequest{
+			Silent: true,
+			Peer:   inputPeer,
+			ID:     msgID,
+		})
+		return err
+	}, 5, 1*time.Second)
+	if err != nil {
+		if delErr := t.DeleteFile(context.WithoutCancel(ctx), groupID, topicID, msgID); delErr != nil {
+			log.Printf("Warning: failed to delete unpinned index: %v", delErr)
+		}
+		return fmt.Errorf("failed to pin index: %w", err)
+	}
+
+	old := st.stale
+	if st.pinnedID != 0 {
+		old = append(old, st.pinnedID)
+	}
+	st.pinnedID = msgID
+	st.stale = nil
+	st.changed = false
+
+	if len(old) > 0 {
+		if err := t.DeleteFile(ctx, groupID, topicID, old...); err != nil {
+			// Left behind indexes are deleted the next time
+			st.stale = old
+			log.Printf("[!] Warning: failed to delete the previous index: %v", err)
+		}
+	}
+	log.Printf("[+] Saved remote index (%d messages)", len(index.Messages))
+	return nil
+}
+
+// readIndex downloads the newest index pinned in the topic.
+func (t *TelegramClient) readIndex(ctx context.Context, groupID int64, topicID int64) (*indexState, error) {
+	accessHash, _ := t.getAccessHash(groupID)
+
+	var pinned tg.MessagesMessagesClass
+	err := retry.WithRetry(ctx, "SearchPinned", func() error {
+		var err error
+		pinned, err = t.api.MessagesSearch(ctx, &tg.MessagesSearchRequest{
+			Peer: &tg.InputPeerChannel{
+				ChannelID:  groupID,
+				AccessHash: accessHash,
+			},
+			TopMsgID: int(topicID),
+			Filter:   &tg.InputMessagesFilterPinned{},
+			Limit:    100,
+		})
+		return err
+	}, 5, 1*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *tg.Message
+	var stale []int
+	for _, msg := range messagesOf(pinned) {
+		m, ok := msg.(*tg.Message)
+		if !ok || !inTopic(m, topicID) || !isIndexMessage(m) {
+			continue
+		}
+		if latest != nil && latest.ID > m.ID {
+			stale = append(stale, m.ID)
+			continue
+		}
+		if latest != nil {
+			stale = append(stale, latest.ID)
+		}
+		latest = m
+	}
+	if latest == nil {
+		return nil, errNoIndex
+	}
+
+	media, ok := latest.Media.(*tg.MessageMediaDocument)
+	if !ok {
+		return nil, errors.New("index message is not a document")
+	}
+	d, ok := media.Document.(*tg.Document)
+	if !ok {
+		return nil, errors.New("index media is not a document")
+	}
+
+	var buf bytes.Buffer
+	if _, err := t.downloader.Download(t.transfer, d.AsInputDocumentFileLocation()).Stream(ctx, &buf); err != nil {
+		return nil, fmt.Errorf("failed to download index: %w", err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	var index topicIndex
+	if err := json.NewDecoder(zr).Decode(&index); err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+
+	st := &indexState{
+		groupID:  groupID,
+		topicID:  topicID,
+		pts:      index.Pts,
+		messages: make(map[int]indexMessage, len(index.Messages)),
+		pinnedID: latest.ID,
+		stale:    stale,
+	}
+	for _, m := range index.Messages {
+		st.messages[m.ID] = m
+	}
+	return st, nil
+}
+
+// catchUp applies to the state the changes made to the channel since its
+// pts. Telegram only keeps a limited backlog of changes: when the state is
+// too old an error is returned and the history must be walked instead.
+func (t *TelegramClient) catchUp(ctx context.Context, st *indexState) error {
+	accessHash, _ := t.getAccessHash(st.groupID)
+	channel := &tg.InputChannel{
+		ChannelID:  st.groupID,
+		AccessHash: accessHash,
+	}
+
+	for {
+		var diff tg.UpdatesChannelDifferenceClass
+		err := retry.WithRetry(ctx, "GetChannelDifference", func() error {
+			var err error
+			diff, err = t.api.UpdatesGetChannelDifference(ctx, &tg.UpdatesGetChannelDifferenceRequest{
+				Force:   true,
+				Channel: channel,
+				Filter:  &tg.ChannelMessagesFilterEmpty{},
+				Pts:     st.pts,
+				Limit:   100,
+			})
+			return err
+		}, 5, 1*time.Second)
+		if err != nil {
+			return err
+		}
+
+		switch d := diff.(type) {
+		case *tg.UpdatesChannelDifferenceEmpty:
+			st.pts = d.Pts
+			return nil
+		case *tg.UpdatesChannelDifferenceTooLong:
+			return errors.New("index is too old to be brought up to date")
+		case *tg.UpdatesChannelDifference:
+			for _, msg := range d.NewMessages {
+				t.applyMessage(st, msg)
+			}
+			for _, u := range d.OtherUpdates {
+				switch u := u.(type) {
+				case *tg.UpdateNewChannelMessage:
+					t.applyMessage(st, u.Message)
+				case *tg.UpdateEditChannelMessage:
+					t.applyMessage(st, u.Message)
+				case *tg.UpdateDeleteChannelMessages:
+					for _, id := range u.Messages {
+						if _, ok := st.messages[id]; ok {
+							delete(st.messages, id)
+							st.changed = true
+						}
+					}
+				}
+			}
+			st.pts = d.Pts
+			if d.Final {
+				return nil
+			}
+		default:
+			return fmt.Errorf("unexpected channel difference %T", diff)
+		}
+	}
+}
+
+// applyMessage records a new or edited message in the state.
+func (t *TelegramClient) applyMessage(st *indexState, msg tg.MessageClass) {
+	m, ok := t.parseMessage(msg, st.topicID)
+	if !ok {
+		// An edit may have turned a file message into something else
+		if _, known := st.messages[msg.GetID()]; known {
+			delete(st.messages, msg.GetID())
+			st.changed = true
+		}
+		return
+	}
+	st.messages[m.file.MessageID] = indexMessage{
+		ID:   m.file.MessageID,
+		Meta: m.file.Meta,
+		Size: m.file.Size,
+		Doc:  m.file.DocumentID,
+	}
+	st.changed = true
+}
+
+// listed returns the file messages of the state, newest first.
+func (st *indexState) listed() []listedMessage {
+	result := make([]listedMessage, 0, len(st.messages))
+	for _, m := range st.messages {
+		result = append(result, listedMessage{
+			file: domain.RemoteFile{
+				Meta:       m.Meta,
+				MessageID:  m.ID,
+				Size:       m.Size,
+				DocumentID: m.Doc,
+			},
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].file.MessageID > result[j].file.MessageID
+	})
+	return result
+}
+
+// channelPts returns the current update sequence of the channel.
+func (t *TelegramClient) channelPts(ctx context.Context, groupID int64) (int, error) {
+	accessHash, _ := t.getAccessHash(groupID)
+
+	var full *tg.MessagesChatFull
+	err := retry.WithRetry(ctx, "GetFullChannel", func() error {
+		var err error
+		full, err = t.api.ChannelsGetFullChannel(ctx, &tg.InputChannel{
+			ChannelID:  groupID,
+			AccessHash: accessHash,
+		})
+		return err
+	}, 5, 1*time.Second)
+	if err != nil {
+		return 0, err
+	}
+
+	channel, ok := full.FullChat.(*tg.ChannelFull)
+	if !ok {
+		return 0, errors.New("unexpected full chat type")
+	}
+	return channel.Pts, nil
+}
+
+// isIndexMessage reports whether the message holds an index of the topic.
+func isIndexMessage(m *tg.Message) bool {
+	var meta domain.FileMeta
+	if err := json.Unmarshal([]byte(m.Message), &meta); err != nil {
+		return false
+	}
+	return meta.HasFlag(domain.FlagIndex)
+}
+
+// messagesOf returns the messages of a history or search result.
+func messagesOf(res tg.MessagesMessagesClass) []tg.MessageClass {
+	switch r := res.(type) {
+	case *tg.MessagesChannelMessages:
+		return r.Messages
+	case *tg.MessagesMessagesSlice:
+		return r.Messages
+	case *tg.MessagesMessages:
+		return r.Messages
+	}
+	return nil
+}
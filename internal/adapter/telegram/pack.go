@@ -0,0 +1,91 @@
+package telegram
+
+import (
+	"context"
+	"io"
+	"log"
+	"strconv"
+
+	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/cache"
+	"tg-blobsync/internal/pkg/pack"
+)
+
+// packBucket holds the cached pack indexes, keyed by message ID.
+const packBucket = "packs"
+
+// SetCache sets the cache used to avoid downloading the index of the same
+// pack on every listing.
+func (t *TelegramClient) SetCache(store *cache.Store) {
+	t.cache = store
+}
+
+// expandPack returns one entry per file bundled in the given pack message.
+// Only the beginning of the pack is downloaded, up to the end of its index.
+// Packs never change once sent, so their index is cached by message ID.
+func (t *TelegramClient) expandPack(ctx context.Context, groupID int64, msg listedMessage) []domain.RemoteFile {
+	packFile := msg.file
+	key := strconv.Itoa(packFile.MessageID)
+	var index []pack.Entry
+	if t.cache == nil || !t.cache.Get(packBucket, key, &index) {
+		var err error
+		index, err = t.readPackIndex(ctx, groupID, msg)
+		if err != nil {
+			log.Printf("[!] Ignoring unreadable pack %s: %v", packFile.Meta.Path, err)
+			return nil
+		}
+		if t.cache != nil {
+			t.cache.Put(packBucket, key, index)
+		}
+	}
+
+	files := make([]domain.RemoteFile, 0, len(index))
+	for _, e := range index {
+		meta := e.Meta
+		// Members are stored by the run storing their pack
+		if meta.Host == "" && meta.RunID == "" {
+			meta.Host, meta.Tool, meta.RunID = packFile.Meta.Host, packFile.Meta.Tool, packFile.Meta.RunID
+		}
+		files = append(files, domain.RemoteFile{
+			Meta:      meta,
+			MessageID: packFile.MessageID,
+			Size:      e.Size,
+			Pack: &domain.RemotePack{
+				MessageID: packFile.MessageID,
+				Size:      packFile.Size,
+				Path:      packFile.Meta.Path,
+				Member:    e.Name,
+			},
+		})
+	}
+	return files
+}
+
+func (t *TelegramClient) readPackIndex(ctx context.Context, groupID int64, msg listedMessage) ([]pack.Entry, error) {
+	d := msg.doc
+	if d == nil {
+		// Listings read from the topic index don't carry the documents
+		docs, err := t.getDocuments(ctx, groupID, []int{msg.file.MessageID})
+		if err != nil {
+			return nil, err
+		}
+		d = docs[0]
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := t.downloader.Download(t.transfer, d.AsInputDocumentFileLocation()).Stream(ctx, pw)
+		pw.CloseWithError(err)
+	}()
+	// Closing the reader stops the download once the index has been read
+	defer pr.Close()
+
+	r, err := pack.NewReader(pr)
+	if err != nil {
+		return nil, err
+	}
+	return r.Index, nil
+}
@@ -0,0 +1,120 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"tg-blobsync/internal/pkg/clock"
+	"tg-blobsync/internal/pkg/ratelimit"
+
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+)
+
+const (
+	// minPartDeadline and maxPartDeadline bound the time given to a single
+	// upload part before it is considered stalled.
+	minPartDeadline = 30 * time.Second
+	maxPartDeadline = 10 * time.Minute
+	// partDeadlineFactor is how many times its expected duration a part may take.
+	partDeadlineFactor = 4
+	// partAttempts bounds the number of times a stalled part is sent.
+	partAttempts = 5
+)
+
+// partClient sends upload parts with a deadline adapted to the throughput
+// measured on the previous parts. A part stuck on a dead connection is sent
+// again on its own, instead of failing an upload that may have been running
+// for hours: parts are idempotent, so nothing else needs to be redone.
+type partClient struct {
+	rpc     *tg.Client
+	limiter *ratelimit.Limiter
+	clock   clock.Clock
+
+	mu   sync.Mutex
+	rate float64 // bytes per second of a single part, exponentially weighted
+}
+
+func newPartClient(rpc *tg.Client, limiter *ratelimit.Limiter, c clock.Clock) *partClient {
+	return &partClient{rpc: rpc, limiter: limiter, clock: c}
+}
+
+func (c *partClient) UploadSaveFilePart(ctx context.Context, request *tg.UploadSaveFilePartRequest) (bool, error) {
+	return c.send(ctx, request.FilePart, len(request.Bytes), func(ctx context.Context) (bool, error) {
+		return c.rpc.UploadSaveFilePart(ctx, request)
+	})
+}
+
+func (c *partClient) UploadSaveBigFilePart(ctx context.Context, request *tg.UploadSaveBigFilePartRequest) (bool, error) {
+	return c.send(ctx, request.FilePart, len(request.Bytes), func(ctx context.Context) (bool, error) {
+		return c.rpc.UploadSaveBigFilePart(ctx, request)
+	})
+}
+
+func (c *partClient) send(ctx context.Context, part, size int, call func(ctx context.Context) (bool, error)) (bool, error) {
+	if err := c.limiter.Wait(ctx, size); err != nil {
+		return false, err
+	}
+	for attempt := 1; ; attempt++ {
+		deadline := c.deadline(size)
+		partCtx, cancel := context.WithTimeout(ctx, deadline)
+		start := c.clock.Now()
+		ok, err := call(partCtx)
+		cancel()
+		if err == nil {
+			c.observe(size, clock.Since(c.clock, start))
+			return ok, nil
+		}
+
+		// Errors returned by Telegram aren't fixed by sending the part again
+		if _, rpcErr := tgerr.As(err); rpcErr || ctx.Err() != nil || attempt == partAttempts {
+			return false, err
+		}
+		if errors.Is(partCtx.Err(), context.DeadlineExceeded) {
+			// The link is slower than measured so far
+			c.slowDown(size, deadline)
+			log.Printf("[!] Upload part %d stalled for %s, sending it again (attempt %d/%d)", part, deadline.Round(time.Second), attempt+1, partAttempts)
+		} else {
+			log.Printf("[!] Upload part %d failed, sending it again (attempt %d/%d): %v", part, attempt+1, partAttempts, err)
+		}
+	}
+}
+
+// deadline returns the time given to a part of the given size.
+func (c *partClient) deadline(size int) time.Duration {
+	c.mu.Lock()
+	rate := c.rate
+	c.mu.Unlock()
+	if rate <= 0 {
+		return maxPartDeadline
+	}
+	expected := time.Duration(float64(size) / rate * float64(time.Second))
+	return min(max(partDeadlineFactor*expected, minPartDeadline), maxPartDeadline)
+}
+
+// observe records the time taken by a part sent successfully.
+func (c *partClient) observe(size int, elapsed time.Duration) {
+	if elapsed <= 0 {
+		return
+	}
+	rate := float64(size) / elapsed.Seconds()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rate <= 0 {
+		c.rate = rate
+		return
+	}
+	c.rate = 0.8*c.rate + 0.2*rate
+}
+
+// slowDown lowers the measured throughput after a part exceeded its
+// deadline, so that the next attempt is given more time.
+func (c *partClient) slowDown(size int, deadline time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rate = min(c.rate, float64(size)/deadline.Seconds()) / 2
+}
@@ -0,0 +1,123 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"tg-blobsync/internal/pkg/clock"
+)
+
+// partSize is the size of the parts sent by the uploader.
+const partSize = 512 * 1024
+
+func TestPartDeadline(t *testing.T) {
+	tests := []struct {
+		name string
+		rate float64 // bytes per second
+		want time.Duration
+	}{
+		{name: "nothing measured yet", rate: 0, want: maxPartDeadline},
+		{name: "fast link", rate: 10 * 1024 * 1024, want: minPartDeadline},
+		{name: "16 KB/s", rate: 16 * 1024, want: 128 * time.Second},
+		{name: "4 KB/s", rate: 4 * 1024, want: 512 * time.Second},
+		{name: "1 KB/s", rate: 1024, want: maxPartDeadline},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &partClient{rate: tt.rate}
+			if got := c.deadline(partSize); got != tt.want {
+				t.Errorf("deadline() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// slowPart returns a part call taking elapsed on clk.
+func slowPart(clk *clock.Fake, elapsed time.Duration) func(ctx context.Context) (bool, error) {
+	return func(ctx context.Context) (bool, error) {
+		clk.Advance(elapsed)
+		return true, nil
+	}
+}
+
+func TestPartDeadlineFollowsSlowParts(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	c := newPartClient(nil, nil, clk)
+
+	// 512 KB in 32 seconds: 16 KB/s
+	if _, err := c.send(context.Background(), 0, partSize, slowPart(clk, 32*time.Second)); err != nil {
+		t.Fatalf("send() error = %v", err)
+	}
+	if got, want := c.deadline(partSize), 128*time.Second; got != want {
+		t.Errorf("deadline() after a part at 16 KB/s = %s, want %s", got, want)
+	}
+
+	// The link gets slower: the deadline grows with it, up to the maximum
+	for i := 1; i <= 20; i++ {
+		if _, err := c.send(context.Background(), i, partSize, slowPart(clk, 256*time.Second)); err != nil {
+			t.Fatalf("send() error = %v", err)
+		}
+	}
+	if got := c.deadline(partSize); got != maxPartDeadline {
+		t.Errorf("deadline() after parts at 2 KB/s = %s, want %s", got, maxPartDeadline)
+	}
+}
+
+func TestPartSlowDown(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	c := newPartClient(nil, nil, clk)
+	c.observe(partSize, 4*time.Second) // 128 KB/s
+
+	deadline := c.deadline(partSize)
+	if deadline != minPartDeadline {
+		t.Fatalf("deadline() = %s, want %s", deadline, minPartDeadline)
+	}
+
+	// A part stalled for its whole deadline: the rate can't be above what
+	// would have sent it in time, and is halved for the next attempt
+	c.slowDown(partSize, deadline)
+	wantRate := float64(partSize) / deadline.Seconds() / 2
+	if c.rate != wantRate {
+		t.Errorf("rate after slowDown() = %.0f B/s, want %.0f B/s", c.rate, wantRate)
+	}
+	if got, want := c.deadline(partSize), 4*2*deadline; got != want {
+		t.Errorf("deadline() after slowDown() = %s, want %s", got, want)
+	}
+
+	// Stalling again keeps slowing down, up to the maximum deadline
+	c.slowDown(partSize, c.deadline(partSize))
+	c.slowDown(partSize, c.deadline(partSize))
+	if got := c.deadline(partSize); got != maxPartDeadline {
+		t.Errorf("deadline() after stalls = %s, want %s", got, maxPartDeadline)
+	}
+}
+
+func TestPartFailureDoesNotSlowDown(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	c := newPartClient(nil, nil, clk)
+	c.observe(partSize, 32*time.Second)
+	rate := c.rate
+
+	// A part failing before its deadline is sent again at the same pace
+	attempts := 0
+	_, err := c.send(context.Background(), 0, partSize, func(ctx context.Context) (bool, error) {
+		attempts++
+		if attempts == 1 {
+			return false, errors.New("connection reset")
+		}
+		clk.Advance(32 * time.Second)
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("send() error = %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("send() made %d attempts, want 2", attempts)
+	}
+	if c.rate != rate {
+		t.Errorf("rate after a failed part = %.0f B/s, want %.0f B/s", c.rate, rate)
+	}
+}
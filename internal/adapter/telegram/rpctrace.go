@@ -0,0 +1,136 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+)
+
+// rpcStats is the activity of a single API method over the run.
+type rpcStats struct {
+	calls    int
+	errors   int
+	sent     int64
+	received int64
+	elapsed  time.Duration
+}
+
+// rpcTrace records the API methods invoked, when enabled by SetDebugRPC.
+type rpcTrace struct {
+	enabled bool
+	mu      sync.Mutex
+	methods map[string]*rpcStats
+}
+
+// SetDebugRPC logs every API request with its duration and the size of its
+// payload and response, and a per-method summary on Close. Only method names
+// and sizes are logged, never the parameters, which may hold secrets such as
+// login codes. It must be called before Start.
+func (t *TelegramClient) SetDebugRPC(enabled bool) {
+	t.rpc.enabled = enabled
+}
+
+// rpcTracer is the middleware feeding the trace. It sits below the flood
+// waiter, so that every attempt is recorded along with its FLOOD_WAIT.
+func (t *TelegramClient) rpcTracer() telegram.Middleware {
+	return telegram.MiddlewareFunc(func(next tg.Invoker) telegram.InvokeFunc {
+		return func(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+			if !t.rpc.enabled {
+				return next.Invoke(ctx, input, output)
+			}
+			start := time.Now()
+			err := next.Invoke(ctx, input, output)
+			elapsed := time.Since(start)
+			var received int64
+			if err == nil {
+				received = encodedSize(output)
+			}
+			t.rpc.record(methodName(input), encodedSize(input), received, elapsed, err)
+			return err
+		}
+	})
+}
+
+func (r *rpcTrace) record(method string, sent, received int64, elapsed time.Duration, err error) {
+	status := "ok"
+	if err != nil {
+		status = "error"
+		if rpcErr, ok := tgerr.As(err); ok {
+			status = rpcErr.Type
+		}
+	}
+	log.Printf("[rpc] %s %s sent %d B, received %d B in %s", method, status, sent, received, elapsed.Round(time.Millisecond))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.methods == nil {
+		r.methods = make(map[string]*rpcStats)
+	}
+	s := r.methods[method]
+	if s == nil {
+		s = &rpcStats{}
+		r.methods[method] = s
+	}
+	s.calls++
+	if err != nil {
+		s.errors++
+	}
+	s.sent += sent
+	s.received += received
+	s.elapsed += elapsed
+}
+
+// logSummary logs the activity per method, the most called first.
+func (r *rpcTrace) logSummary() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.enabled || len(r.methods) == 0 {
+		return
+	}
+	methods := make([]string, 0, len(r.methods))
+	for m := range r.methods {
+		methods = append(methods, m)
+	}
+	sort.Slice(methods, func(i, j int) bool {
+		a, b := r.methods[methods[i]], r.methods[methods[j]]
+		if a.calls != b.calls {
+			return a.calls > b.calls
+		}
+		return methods[i] < methods[j]
+	})
+
+	log.Printf("RPC Summary:")
+	for _, m := range methods {
+		s := r.methods[m]
+		log.Printf("  %-36s %6d calls %4d errors  sent %9s  received %9s  %s total", m, s.calls, s.errors, formatSize(s.sent), formatSize(s.received), s.elapsed.Round(time.Millisecond))
+	}
+}
+
+// methodName returns the API name of a request, such as messages.getHistory.
+func methodName(input bin.Encoder) string {
+	if named, ok := input.(interface{ TypeName() string }); ok {
+		return named.TypeName()
+	}
+	return fmt.Sprintf("%T", input)
+}
+
+// encodedSize returns the size of the serialized form of v, 0 if unknown.
+func encodedSize(v any) int64 {
+	enc, ok := v.(bin.Encoder)
+	if !ok {
+		return 0
+	}
+	var b bin.Buffer
+	if err := enc.Encode(&b); err != nil {
+		return 0
+	}
+	return int64(b.Len())
+}
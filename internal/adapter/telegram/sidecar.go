@@ -0,0 +1,132 @@
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"time"
+	"unicode/utf16"
+
+	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/retry"
+
+	"github.com/gotd/td/telegram/message"
+	"github.com/gotd/td/telegram/message/styling"
+	"github.com/gotd/td/telegram/uploader"
+	"github.com/gotd/td/tg"
+)
+
+// maxCaption is the length of the longest caption Telegram accepts, in
+// UTF-16 code units.
+const maxCaption = 1024
+
+// captionReserve is the room left in a caption for the fields set on every
+// message once it is known to fit: the part index and checksums.
+const captionReserve = 160
+
+// sidecarPath is the path in the caption of the sidecar documents.
+const sidecarPath = ".tgblobsync/meta.json"
+
+// sidecarBucket holds the cached sidecar metadata, keyed by message ID.
+const sidecarBucket = "sidecars"
+
+// fitCaption returns the metadata to store in the captions of a file: meta
+// itself when it fits, or else a pointer to a sidecar document holding it,
+// sent to the topic first.
+func (t *TelegramClient) fitCaption(ctx context.Context, inputPeer tg.InputPeerClass, topicID int64, meta domain.FileMeta) (domain.FileMeta, error) {
+	meta.Sidecar = 0
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return domain.FileMeta{}, fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+	if len(utf16.Encode([]rune(string(data))))+captionReserve <= maxCaption {
+		return meta, nil
+	}
+
+	sum := md5.Sum(data)
+	captionBytes, err := json.Marshal(domain.FileMeta{Path: sidecarPath, Checksum: hex.EncodeToString(sum[:]), Flags: domain.FlagSidecar})
+	if err != nil {
+		return domain.FileMeta{}, fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+
+	var msgID int
+	err = retry.WithRetry(ctx, "SendSidecar: "+meta.Path, func() error {
+		u, err := uploader.NewUploader(t.parts).FromBytes(ctx, path.Base(sidecarPath), data)
+		if err != nil {
+			return fmt.Errorf("failed to upload raw content: %w", err)
+		}
+		updates, err := t.sender.To(inputPeer).
+			Reply(int(topicID)).
+			Media(ctx, message.UploadedDocument(u, styling.Plain(string(captionBytes))).
+				MIME("application/json").
+				Filename(path.Base(sidecarPath)),
+			)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if msgID, ok = sentMessageID(updates); !ok {
+			return errors.New("no message ID in the response")
+		}
+		return nil
+	}, 5, 1*time.Second)
+	if err != nil {
+		return domain.FileMeta{}, fmt.Errorf("failed to send metadata sidecar: %w", err)
+	}
+	log.Printf("[*] Metadata of %s too long for a caption, stored in message %d", meta.Path, msgID)
+
+	return domain.FileMeta{
+		Checksum:  meta.Checksum,
+		Algorithm: meta.Algorithm,
+		ModTime:   meta.ModTime,
+		Flags:     meta.Flags,
+		Parts:     meta.Parts,
+		PartSize:  meta.PartSize,
+		Sidecar:   msgID,
+	}, nil
+}
+
+// resolveSidecar returns the whole metadata of a message whose caption
+// points to a sidecar, along with the fields of the caption telling its
+// parts apart and its flags, which may have been edited since. Sidecars
+// never change once sent, so they are cached by message ID.
+func (t *TelegramClient) resolveSidecar(ctx context.Context, groupID int64, meta domain.FileMeta) (domain.FileMeta, error) {
+	key := strconv.Itoa(meta.Sidecar)
+	var full domain.FileMeta
+	if t.cache == nil || !t.cache.Get(sidecarBucket, key, &full) {
+		docs, err := t.getDocuments(ctx, groupID, []int{meta.Sidecar})
+		if err != nil {
+			return domain.FileMeta{}, err
+		}
+		var buf bytes.Buffer
+		if _, err := t.downloader.Download(t.transfer, docs[0].AsInputDocumentFileLocation()).Stream(ctx, &buf); err != nil {
+			return domain.FileMeta{}, fmt.Errorf("failed to download metadata sidecar: %w", err)
+		}
+		if err := json.Unmarshal(buf.Bytes(), &full); err != nil {
+			return domain.FileMeta{}, fmt.Errorf("invalid metadata sidecar: %w", err)
+		}
+		if full.Path == "" {
+			return domain.FileMeta{}, errors.New("invalid metadata sidecar: no path")
+		}
+		if t.cache != nil {
+			t.cache.Put(sidecarBucket, key, full)
+		}
+	}
+
+	full.Part = meta.Part
+	full.PartChecksum = meta.PartChecksum
+	full.Flags = meta.Flags
+	full.Sidecar = meta.Sidecar
+	// Set after the sidecar was sent when computed during the upload
+	if meta.Checksum != "" {
+		full.Checksum = meta.Checksum
+	}
+	return full, nil
+}
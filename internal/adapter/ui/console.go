@@ -3,12 +3,16 @@ package ui
 import (
 	"errors"
 	"fmt"
+	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/checksum"
+	"tg-blobsync/internal/pkg/clock"
 	"time"
 
 	"github.com/manifoldco/promptui"
@@ -23,6 +27,9 @@ type ConsoleUI struct {
 	totalFiles     int
 	startedFiles   int
 	completedFiles int
+	resumeAt       time.Time // end of the current rate limit pause
+	counting       bool      // a countdown is being displayed
+	clock          clock.Clock
 	mu             sync.Mutex
 }
 
@@ -34,9 +41,16 @@ func NewConsoleUI(nonInteractive bool) *ConsoleUI {
 	return &ConsoleUI{
 		progress:       p,
 		nonInteractive: nonInteractive,
+		clock:          clock.Real,
 	}
 }
 
+// SetClock sets the clock transfer speeds and rate limit pauses are
+// measured on.
+func (u *ConsoleUI) SetClock(c clock.Clock) {
+	u.clock = c
+}
+
 func (u *ConsoleUI) SetTotalFiles(total int) {
 	u.mu.Lock()
 	defer u.mu.Unlock()
@@ -63,7 +77,8 @@ func (u *ConsoleUI) Start(name string, total int64) domain.ProgressTask {
 		return &nonInteractiveTask{
 			name:      displayName,
 			total:     total,
-			startTime: time.Now(),
+			startTime: u.clock.Now(),
+			clock:     u.clock,
 			onComplete: func() {
 				u.mu.Lock()
 				u.completedFiles++
@@ -72,7 +87,14 @@ func (u *ConsoleUI) Start(name string, total int64) domain.ProgressTask {
 		}
 	}
 
-	bar := u.progress.AddBar(total,
+	task := &mpbTask{
+		onComplete: func() {
+			u.mu.Lock()
+			u.completedFiles++
+			u.mu.Unlock()
+		},
+	}
+	task.bar = u.progress.AddBar(total,
 		mpb.PrependDecorators(
 			decor.Name(displayName, decor.WC{W: len(displayName) + 1}),
 			decor.Counters(decor.SizeB1024(0), "% .2f / % .2f", decor.WCSyncSpace),
@@ -82,16 +104,15 @@ func (u *ConsoleUI) Start(name string, total int64) domain.ProgressTask {
 				decor.Percentage(decor.WCSyncSpace), "done",
 			),
 			decor.AverageSpeed(decor.SizeB1024(0), "% .2f", decor.WCSyncSpace),
+			decor.Any(func(decor.Statistics) string {
+				if task.stalled.Load() {
+					return " stalled"
+				}
+				return ""
+			}),
 		),
 	)
-	return &mpbTask{
-		bar: bar,
-		onComplete: func() {
-			u.mu.Lock()
-			u.completedFiles++
-			u.mu.Unlock()
-		},
-	}
+	return task
 }
 
 func (u *ConsoleUI) Wait() {
@@ -103,76 +124,243 @@ func (u *ConsoleUI) Wait() {
 	u.progress = mpb.New(mpb.WithWidth(64))
 }
 
+// RateLimited shows a countdown while requests are paused by Telegram rate
+// limits. Overlapping pauses share the same countdown.
+func (u *ConsoleUI) RateLimited(wait time.Duration) {
+	resumeAt := u.clock.Now().Add(wait)
+
+	u.mu.Lock()
+	if resumeAt.Before(u.resumeAt) {
+		u.mu.Unlock()
+		return
+	}
+	u.resumeAt = resumeAt
+	counting := u.counting
+	u.counting = true
+	progress := u.progress
+	u.mu.Unlock()
+
+	if u.nonInteractive {
+		fmt.Printf("Rate limited by Telegram, resuming in %s\n", wait.Round(time.Second))
+		u.mu.Lock()
+		u.counting = false
+		u.mu.Unlock()
+		return
+	}
+	if counting {
+		// The running countdown picks up the new deadline
+		return
+	}
+
+	bar := progress.New(0, mpb.NopStyle(),
+		mpb.PrependDecorators(
+			decor.Any(func(decor.Statistics) string {
+				u.mu.Lock()
+				remaining := u.resumeAt.Sub(u.clock.Now())
+				u.mu.Unlock()
+				return fmt.Sprintf("rate limited, resuming in %s", max(remaining, 0).Round(time.Second))
+			}),
+		),
+	)
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			u.mu.Lock()
+			done := !u.clock.Now().Before(u.resumeAt)
+			if done {
+				u.counting = false
+			}
+			u.mu.Unlock()
+			if done {
+				bar.Abort(true)
+				return
+			}
+		}
+	}()
+}
+
 func (u *ConsoleUI) ConfirmSync(plan domain.SyncPlan) (bool, error) {
+	_, confirmed, err := u.confirm(plan, false)
+	return confirmed, err
+}
+
+// ConfirmItems is like ConfirmSync, but also lets the user toggle the items
+// of the plan, returning the plan of those left selected.
+func (u *ConsoleUI) ConfirmItems(plan domain.SyncPlan) (domain.SyncPlan, bool, error) {
+	return u.confirm(plan, true)
+}
+
+func (u *ConsoleUI) confirm(plan domain.SyncPlan, selectable bool) (domain.SyncPlan, bool, error) {
 	if u.nonInteractive {
-		return true, nil
+		return plan, true, nil
 	}
 
+	skipped := make([]bool, len(plan.Items))
 	for {
+		items := []string{"Start Transfer", "Show Detailed Changes"}
+		if selectable {
+			items = append(items, "Select Items")
+		}
+		items = append(items, "Cancel/Exit")
+
+		approved := selectedItems(plan, skipped)
+		label := "Action Required"
+		if approved.Summary.Total < plan.Summary.Total {
+			label = fmt.Sprintf("Action Required (%d of %d items selected)", approved.Summary.Total, plan.Summary.Total)
+		}
 		prompt := promptui.Select{
-			Label: "Action Required",
-			Items: []string{
-				"Start Transfer",
-				"Show Detailed Changes",
-				"Cancel/Exit",
-			},
+			Label: label,
+			Items: items,
 		}
 
-		idx, _, err := prompt.Run()
+		_, choice, err := prompt.Run()
 		if err != nil {
-			return false, err
+			return domain.SyncPlan{}, false, err
 		}
 
-		switch idx {
-		case 0: // Start Transfer
-			return true, nil
-		case 1: // Show Detailed Changes
-			u.showDetailedChanges(plan)
-		case 2: // Cancel/Exit
-			return false, nil
+		switch choice {
+		case "Start Transfer":
+			return approved, true, nil
+		case "Show Detailed Changes":
+			u.showDetailedChanges(approved)
+		case "Select Items":
+			if err := u.selectItems(plan, skipped); err != nil {
+				return domain.SyncPlan{}, false, err
+			}
+		case "Cancel/Exit":
+			return domain.SyncPlan{}, false, nil
 		}
 	}
 }
 
+// selectItems lets the user toggle the items of plan until "Done" is
+// chosen, recording in skipped those deselected.
+func (u *ConsoleUI) selectItems(plan domain.SyncPlan, skipped []bool) error {
+	cursor, scroll := 0, 0
+	for {
+		items := make([]string, 0, len(plan.Items)+1)
+		items = append(items, "Done")
+		for i, item := range plan.Items {
+			box := "[x]"
+			if skipped[i] {
+				box = "[ ]"
+			}
+			_, actionName := actionLabel(item)
+			line := fmt.Sprintf("%s %-18s %s", box, actionName, item.Path)
+			if why := item.Why(); why != "" {
+				line += " (" + why + ")"
+			}
+			items = append(items, line)
+		}
+
+		prompt := promptui.Select{
+			Label: "Toggle Items (Enter), then Done",
+			Items: items,
+			Size:  15,
+			Searcher: func(input string, index int) bool {
+				return strings.Contains(strings.ToLower(items[index]), strings.ToLower(input))
+			},
+		}
+		idx, _, err := prompt.RunCursorAt(cursor, scroll)
+		if err != nil {
+			return err
+		}
+		if idx == 0 {
+			return nil
+		}
+		skipped[idx-1] = !skipped[idx-1]
+		cursor, scroll = idx, prompt.ScrollPosition()
+	}
+}
+
+// selectedItems returns the plan of the items of plan not skipped.
+func selectedItems(plan domain.SyncPlan, skipped []bool) domain.SyncPlan {
+	var items []domain.SyncItem
+	for i, item := range plan.Items {
+		if !skipped[i] {
+			items = append(items, item)
+		}
+	}
+	return domain.NewSyncPlan(items)
+}
+
+// PromptAdoptPath asks the path to give a document adopted, proposed by
+// default. Without a terminal, the proposed path is used.
+func (u *ConsoleUI) PromptAdoptPath(m domain.RemoteMessage, proposed string) (string, error) {
+	if u.nonInteractive {
+		return proposed, nil
+	}
+	fmt.Printf("\nMessage %d: %s (%s), sent %s\n", m.ID, orNone(m.FileName), formatSize(m.Size), time.Unix(m.Date, 0).Format("2006-01-02 15:04"))
+	if caption := strings.TrimSpace(m.Caption); caption != "" {
+		fmt.Printf("  Caption: %s\n", caption)
+	}
+	prompt := promptui.Prompt{
+		Label:     "Path (empty to skip)",
+		Default:   proposed,
+		AllowEdit: true,
+	}
+	p, err := prompt.Run()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(p), nil
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(no file name)"
+	}
+	return s
+}
+
+// ChooseRecovery asks what to do with a message whose metadata is damaged.
+// Without a terminal, the message is left untouched.
+func (u *ConsoleUI) ChooseRecovery(m domain.RemoteMessage, recovered *domain.FileMeta, problem string) (domain.RecoveryAction, error) {
+	if u.nonInteractive {
+		return domain.RecoverySkip, nil
+	}
+
+	fmt.Printf("\nMessage %d: %s\n", m.ID, problem)
+	fmt.Printf("  Document: %s (%s), sent %s\n", m.FileName, formatSize(m.Size), time.Unix(m.Date, 0).Format("2006-01-02 15:04"))
+	fmt.Printf("  Caption:  %s\n", m.Caption)
+	actions := []domain.RecoveryAction{domain.RecoveryDelete, domain.RecoverySkip}
+	items := []string{"Delete the message", "Leave it untouched"}
+	if recovered != nil {
+		modTime := time.Unix(recovered.ModTime, 0).Format("2006-01-02 15:04")
+		sum := recovered.Checksum
+		if sum == "" {
+			sum = "computed by downloading it"
+		}
+		fmt.Printf("  Recovered: path %s, modified %s, %s %s\n", recovered.Path, modTime, checksum.Name(recovered.Algorithm), sum)
+		actions = append([]domain.RecoveryAction{domain.RecoveryAdopt}, actions...)
+		items = append([]string{"Adopt it with the recovered metadata"}, items...)
+	} else {
+		fmt.Println("  No metadata could be recovered")
+	}
+
+	prompt := promptui.Select{
+		Label: "Action Required",
+		Items: items,
+	}
+	idx, _, err := prompt.Run()
+	if err != nil {
+		return "", err
+	}
+	return actions[idx], nil
+}
+
 func (u *ConsoleUI) showDetailedChanges(plan domain.SyncPlan) {
 	fmt.Println("\n--- Detailed Changes ---")
 
 	fmt.Println("\nActions:")
 	for _, item := range plan.Items {
-		symbol := "?"
-		actionName := ""
-
-		switch item.Action {
-		case domain.ActionUpload:
-			if item.RemoteFile != nil {
-				symbol = "[*] Update"
-				actionName = "Upload (update)"
-			} else {
-				symbol = "[+] New   "
-				actionName = "Upload (new)"
-			}
-		case domain.ActionDownload:
-			if item.LocalFile != nil {
-				symbol = "[*] Update"
-				actionName = "Download (update)"
-			} else {
-				symbol = "[v] New   "
-				actionName = "Download (new)"
-			}
-		case domain.ActionDeleteRemote:
-			symbol = "[-] Delete"
-			actionName = "Delete Remote"
-		case domain.ActionDeleteLocal:
-			symbol = "[-] Delete"
-			actionName = "Delete Local"
-		case domain.ActionSkip:
-			symbol = "[.] Skip  "
-			actionName = "Skip"
-		}
+		symbol, actionName := actionLabel(item)
 
 		reasonStr := ""
-		if item.Reason != "" {
-			reasonStr = fmt.Sprintf(" (%s)", item.Reason)
+		if why := item.Why(); why != "" {
+			reasonStr = fmt.Sprintf(" (%s)", why)
 		}
 
 		fmt.Printf("  %s %-40s %-20s %s\n", symbol, item.Path, actionName, reasonStr)
@@ -180,11 +368,43 @@ func (u *ConsoleUI) showDetailedChanges(plan domain.SyncPlan) {
 	fmt.Println("------------------------")
 }
 
+// actionLabel returns the symbol and the name of the action of an item.
+func actionLabel(item domain.SyncItem) (symbol, actionName string) {
+	switch item.Action {
+	case domain.ActionUpload:
+		if item.RemoteFile != nil {
+			return "[*] Update", "Upload (update)"
+		}
+		return "[+] New   ", "Upload (new)"
+	case domain.ActionDownload:
+		if item.LocalFile != nil {
+			return "[*] Update", "Download (update)"
+		}
+		return "[v] New   ", "Download (new)"
+	case domain.ActionDeleteRemote:
+		return "[-] Delete", "Delete Remote"
+	case domain.ActionDeleteLocal:
+		return "[-] Delete", "Delete Local"
+	case domain.ActionMarkDeleted:
+		return "[-] Pending", "Mark Deleted"
+	case domain.ActionUnmarkDeleted:
+		return "[*] Keep  ", "Unmark Deleted"
+	case domain.ActionSkip:
+		return "[.] Skip  ", "Skip"
+	}
+	return "?", ""
+}
+
 type mpbTask struct {
 	bar        *mpb.Bar
+	stalled    atomic.Bool
 	onComplete func()
 }
 
+func (t *mpbTask) SetStalled(stalled bool) {
+	t.stalled.Store(stalled)
+}
+
 func (t *mpbTask) Increment(n int) {
 	t.bar.IncrBy(n)
 }
@@ -209,6 +429,7 @@ type nonInteractiveTask struct {
 	total      int64
 	current    int64
 	startTime  time.Time
+	clock      clock.Clock
 	onComplete func()
 }
 
@@ -221,7 +442,7 @@ func (t *nonInteractiveTask) SetCurrent(current int64) {
 }
 
 func (t *nonInteractiveTask) Complete() {
-	elapsed := time.Since(t.startTime).Seconds()
+	elapsed := clock.Since(t.clock, t.startTime).Seconds()
 	speed := float64(t.current) / elapsed
 	fmt.Printf("Finished: %s | Size: %s | Speed: %s/s\n",
 		t.name,
@@ -237,6 +458,12 @@ func (t *nonInteractiveTask) Abort() {
 	fmt.Printf("Failed: %s (Transfer aborted due to error)\n", t.name)
 }
 
+func (t *nonInteractiveTask) SetStalled(stalled bool) {
+	if stalled {
+		fmt.Printf("Stalled: %s (no data received)\n", t.name)
+	}
+}
+
 func formatSize(b int64) string {
 	const unit = 1024
 	if b < unit {
@@ -393,44 +620,21 @@ func (u *ConsoleUI) BrowseFiles(files []domain.RemoteFile) error {
 
 	currentDir := ""
 	for {
-		// Filter items in current directory
-		type dirInfo struct {
-			Size  int64
-			IsDir bool
+		// Subdirectories of the current directory, and its files
+		totals := domain.DirTotals(files)
+		items := make(map[string]int64) // name -> size
+		for dir, total := range totals {
+			if dir != "" && domain.ParentDir(dir) == currentDir {
+				items[path.Base(dir)] = total.Size
+			}
 		}
-		items := make(map[string]*dirInfo) // name -> info
 		var filesInDir []domain.RemoteFile
-		var currentDirTotalSize int64
-
 		for _, f := range files {
-			path := filepath.ToSlash(f.Meta.Path)
-			if currentDir == "" {
-				parts := strings.Split(path, "/")
-				if len(parts) > 1 {
-					if _, ok := items[parts[0]]; !ok {
-						items[parts[0]] = &dirInfo{IsDir: true}
-					}
-					items[parts[0]].Size += f.Size
-				} else {
-					filesInDir = append(filesInDir, f)
-				}
-				currentDirTotalSize += f.Size
-			} else {
-				if strings.HasPrefix(path, currentDir+"/") {
-					relPath := strings.TrimPrefix(path, currentDir+"/")
-					parts := strings.Split(relPath, "/")
-					if len(parts) > 1 {
-						if _, ok := items[parts[0]]; !ok {
-							items[parts[0]] = &dirInfo{IsDir: true}
-						}
-						items[parts[0]].Size += f.Size
-					} else {
-						filesInDir = append(filesInDir, f)
-					}
-					currentDirTotalSize += f.Size
-				}
+			if domain.ParentDir(filepath.ToSlash(f.Meta.Path)) == currentDir {
+				filesInDir = append(filesInDir, f)
 			}
 		}
+		currentDirTotalSize := totals[currentDir].Size
 
 		type menuEntry struct {
 			Label   string
@@ -452,8 +656,7 @@ func (u *ConsoleUI) BrowseFiles(files []domain.RemoteFile) error {
 		sort.Strings(sortedDirs)
 
 		for _, d := range sortedDirs {
-			info := items[d]
-			label := fmt.Sprintf("\U0001F4C1 %-30s %10s", d, formatSize(info.Size))
+			label := fmt.Sprintf("\U0001F4C1 %-30s %10s", d, formatSize(items[d]))
 			menu = append(menu, menuEntry{Label: label, IsDir: true, DirName: d})
 		}
 
@@ -531,6 +734,17 @@ func (u *ConsoleUI) BrowseFiles(files []domain.RemoteFile) error {
 			if f.Meta.Flags != "" {
 				fmt.Printf("Flags:    %s\n", f.Meta.Flags)
 			}
+			if len(f.Meta.Tags) > 0 {
+				var tags []string
+				for k, v := range f.Meta.Tags {
+					tags = append(tags, k+"="+v)
+				}
+				sort.Strings(tags)
+				fmt.Printf("Tags:     %s\n", strings.Join(tags, ", "))
+			}
+			if len(f.Chunks) > 0 {
+				fmt.Printf("Parts:    %d\n", len(f.Chunks))
+			}
 			fmt.Printf("MsgID:    %d\n", f.MessageID)
 			fmt.Printf("--------------------\n\n")
 
@@ -3,49 +3,235 @@ package config
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path"
 	"strconv"
+	"strings"
+	"time"
+
+	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/checksum"
+	"tg-blobsync/internal/pkg/glob"
+	"tg-blobsync/internal/pkg/pipeline"
 )
 
 // CLIConfig holds the configuration parsed from command line arguments.
 type CLIConfig struct {
-	Command        string
-	AppID          int
-	AppHash        string
-	SessionPath    string
-	GroupID        int64
-	TopicID        int64
-	DirPath        string
-	SubDir         string
-	Workers        int
-	UploadThreads  int
-	SkipMD5        bool
-	NonInteractive bool
+	Command           string
+	AppID             int
+	AppHash           string
+	SessionPath       string
+	Profile           string
+	StateDir          string
+	GroupID           int64
+	TopicID           int64
+	DirPath           string
+	SubDir            string
+	RemoteGlob        string
+	FromHost          string
+	Workers           int
+	UploadThreads     []ThreadClass
+	Connections       int
+	BWLimit           int64
+	DailyUploadWarn   int64
+	DailyUploadLimit  int64
+	Debug             bool
+	DebugRPC          bool
+	ChunkSize         int64
+	PackThreshold     int64
+	PackSize          int64
+	SkipMD5           bool
+	Hash              string // Checksum algorithm, see the checksum package
+	HashWorkers       int
+	HashOnUpload      bool
+	NonInteractive    bool
+	NoDaemon          bool
+	WaitOnline        time.Duration
+	StallTimeout      time.Duration
+	NoCache           bool
+	NoIndex           bool
+	Resume            bool
+	Tags              map[string]string
+	Rules             []domain.FileRule
+	Retention         []domain.RetentionRule
+	ByUpload          bool
+	KeepDaily         int
+	RemotePath        string
+	Recursive         bool
+	Format            string
+	Name              string
+	MinSize           int64
+	MaxSize           int64
+	NewerThan         time.Duration
+	Sizes             bool
+	MaxDepth          int
+	KeepWeekly        int
+	KeepMonthly       int
+	OlderThan         time.Duration
+	DeleteGrace       time.Duration
+	Force             bool
+	NoDelete          bool
+	MaxDelete         int
+	MaxDeletePercent  int
+	PruneAfterVerify  bool
+	PlanOut           string
+	Roots             []domain.SyncRoot
+	RequireMarker     string
+	Verify            bool
+	Remote            bool
+	Dedup             bool
+	Sample            int
+	SizeCap           int64
+	MaxDuration       time.Duration
+	Repair            bool
+	Malformed         string
+	Mapping           string
+	DryRun            bool
+	Garbage           bool
+	Collect           bool
+	UnsafePaths       string
+	CaseConflicts     string
+	KeepVersions      int
+	Pipeline          pipeline.Pipeline
+	Version           int
+	At                time.Time
+	MirrorDir         string
+	HardlinkDupes     bool
+	TrashTopicID      int64
+	TrashRetention    time.Duration
+	BackupDir         string
+	MetricsFile       string
+	ReportFile        string
+	NiceIO            bool
+	ReconcileInterval time.Duration
+	WatchBackend      string
+	PollInterval      time.Duration
+	Args              []string
 }
 
 // ParseCLI parses command line arguments and environment variables.
 func ParseCLI(appIDDef string, appHashDef string) (*CLIConfig, error) {
-	if len(os.Args) < 2 {
-		return nil, fmt.Errorf("usage: tgblobsync <command> [flags]\nCommands: push, pull, list")
+	return ParseArgs(os.Args[1:], appIDDef, appHashDef, flag.ExitOnError)
+}
+
+// ParseArgs parses the given command line, command first, as ParseCLI
+// does. With flag.ContinueOnError, invalid flags are returned as errors
+// without printing the usage, as the daemon does for the commands it runs.
+func ParseArgs(cmdArgs []string, appIDDef string, appHashDef string, errorHandling flag.ErrorHandling) (*CLIConfig, error) {
+	if len(cmdArgs) < 1 {
+		return nil, fmt.Errorf("usage: tgblobsync <command> [flags]\nCommands: push, pull, watch, list, get, put, rm, mv, du, tree, find, hash, explain, history, restore, undelete, tag, meta, archive, recall, repair, verify, fsck, gc, expire, dupes, adopt, snapshot, status, apply, daemon")
 	}
 
-	cmd := os.Args[1]
-	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	cmd := cmdArgs[0]
+	fs := flag.NewFlagSet(cmd, errorHandling)
+	if errorHandling == flag.ContinueOnError {
+		fs.SetOutput(io.Discard)
+	}
 
 	cfg := &CLIConfig{Command: cmd}
 
+	fs.StringVar(&cfg.Profile, "profile", DefaultProfile, "Name of the profile whose defaults and state are used")
 	fs.Int64Var(&cfg.GroupID, "group-id", 0, "ID of the Supergroup")
 	fs.Int64Var(&cfg.TopicID, "topic-id", 0, "ID of the Topic")
 	fs.StringVar(&cfg.DirPath, "dir", "", "Path to the directory to sync (required for push/pull)")
+	fs.Var(&rootsValue{target: &cfg.Roots}, "root", "On push, a local directory and the remote prefix it is pushed under, instead of --dir (e.g. /etc=configs, repeatable)")
 	fs.StringVar(&cfg.SubDir, "sub-dir", "", "Synchronize only a specific subdirectory within the topic")
+	fs.StringVar(&cfg.FromHost, "from-host", "", "On pull, only download and prune the files uploaded from the machine of this host name")
+	fs.StringVar(&cfg.RemoteGlob, "remote-glob", "", "On pull, only download and prune the paths matching this glob (e.g. 'photos/**/*.jpg')")
 	fs.IntVar(&cfg.Workers, "workers", 1, "Number of concurrent files")
-	fs.IntVar(&cfg.UploadThreads, "upload-threads", 8, "Number of parallel threads for a single file upload")
+	fs.Var(newThreadClassesValue(&cfg.UploadThreads, "8M=1,256M=4,8"), "upload-threads", "Number of parallel threads for a single file upload, optionally by size class (e.g. 8M=1,256M=4,8)")
+	fs.IntVar(&cfg.Connections, "connections", 1, "Number of connections shared by all transfers (1 uses the main connection)")
+	fs.Var(newSizeValue(&cfg.DailyUploadWarn, 0), "daily-upload-warn", "Warn once the account uploaded more than this today, across runs (e.g. 50G, 0 for no warning)")
+	fs.Var(newSizeValue(&cfg.DailyUploadLimit, 0), "daily-upload-limit", "Leave for the next run the uploads passing this many bytes uploaded by the account today (e.g. 100G, 0 for no limit)")
+	fs.Var(newSizeValue(&cfg.BWLimit, 0), "bwlimit", "Limit the combined upload and download throughput, in bytes per second (e.g. 5M, 0 for no limit)")
+	fs.Var(newSizeValue(&cfg.ChunkSize, 2000<<20), "chunk-size", "Files larger than this are split into several messages (e.g. 1G)")
+	fs.Var(newSizeValue(&cfg.PackThreshold, 0), "pack-threshold", "On push, bundle files smaller than this into packs (e.g. 64K, 0 to disable)")
+	fs.Var(newSizeValue(&cfg.PackSize, 16<<20), "pack-size", "Maximum size of a pack")
 	fs.BoolVar(&cfg.SkipMD5, "skip-md5", false, "Skip MD5 calculation and use modification time instead")
-	fs.BoolVar(&cfg.NonInteractive, "non-interactive", false, "Disable interactive UI and progress bars")
+	fs.IntVar(&cfg.HashWorkers, "hash-workers", 1, "Number of local files checksummed concurrently while scanning (more suit SSDs, 1 suits spinning disks)")
+	fs.BoolVar(&cfg.HashOnUpload, "hash-on-upload", false, "On push, checksum new files while uploading them instead of reading them beforehand (their content is never reused from other remote files)")
+	fs.StringVar(&cfg.Hash, "hash", "md5", "Checksum algorithm of local files and of the files uploaded: md5, sha256 or xxh64")
+	fs.BoolVar(&cfg.NoCache, "no-cache", false, "Don't use nor update the cache of local checksums and remote pack indexes")
+	fs.BoolVar(&cfg.NoIndex, "no-index", false, "Don't use nor update the file index pinned in the topic")
+	fs.BoolVar(&cfg.Debug, "debug", false, "Log diagnostic details such as the setup time of each transfer, and a timing summary at the end of the run")
+	fs.BoolVar(&cfg.DebugRPC, "debug-rpc", false, "Log every Telegram API request with its duration and payload size, and a per-method summary")
+	fs.BoolVar(&cfg.Resume, "resume", false, "On push, resume the interrupted push instead of planning a new one")
+	fs.BoolVar(&cfg.Verify, "verify", true, "On pull, checksum the downloaded files and download them again on mismatch")
+	fs.BoolVar(&cfg.Remote, "remote", false, "On dupes, report the contents uploaded more than once across the topics of the group")
+	fs.BoolVar(&cfg.Dedup, "dedup", false, "On dupes --remote, replace the duplicates with references to a single upload")
+	fs.IntVar(&cfg.Sample, "sample", 100, "On verify, check this percentage of the remote files, drawn at random")
+	fs.Var(newSizeValue(&cfg.SizeCap, 0), "size-cap", "On verify, download at most this many bytes (e.g. 10G, 0 for no cap)")
+	fs.BoolVar(&cfg.Repair, "repair", false, "On fsck, delete the stale messages and quarantine the damaged ones")
+	fs.StringVar(&cfg.Mapping, "mapping", "", "On adopt, a JSON file giving the path of the documents to adopt, by message ID or file name")
+	fs.StringVar(&cfg.Malformed, "malformed", "ask", "On fsck --repair, what to do with the messages whose metadata is malformed: ask, adopt (with the metadata recovered), delete or skip")
+	fs.Var(&pipelineValue{target: &cfg.Pipeline}, "pipeline", "On push, watch and put, the transforms applied to the content of the uploaded files, in order (e.g. gzip)")
+	fs.IntVar(&cfg.KeepVersions, "keep-versions", 0, "On push, watch and put, keep this many old versions of updated files instead of deleting them")
+	fs.Int64Var(&cfg.TrashTopicID, "trash-topic", 0, "On push, watch and rm, move the remote files deleted to this topic instead of deleting them; on undelete, the topic to restore from")
+	fs.Var(&durationValue{target: &cfg.TrashRetention}, "trash-retention", "Empty the trash of the files deleted longer than this ago (e.g. 30d, 0 to keep them forever)")
+	fs.StringVar(&cfg.BackupDir, "backup-dir", "", "On pull, move the local files overwritten or deleted to this directory, keeping their relative path")
+	fs.BoolVar(&cfg.HardlinkDupes, "hardlink-dupes", false, "On pull, download the files with the same content once, linking the others to it (reflinks where supported, hard links otherwise)")
+	fs.StringVar(&cfg.MirrorDir, "mirror-dir", "", "On pull, copy the contents already downloaded to this directory instead of downloading them, and store the others there")
+	fs.IntVar(&cfg.Version, "version", -1, "On restore, the version number of the file to restore (see history)")
+	fs.Var(&timestampValue{target: &cfg.At}, "at", "On restore, restore the version current at this time (e.g. 2024-06-01 18:30)")
+	fs.StringVar(&cfg.CaseConflicts, "case-conflicts", "abort", "On pull to a case-insensitive filesystem, what to do with remote paths differing only by case: abort, rename or ignore")
+	fs.StringVar(&cfg.UnsafePaths, "unsafe-paths", "skip", "On pull, what to do with remote paths holding control characters or invalid UTF-8: skip, escape or keep")
+	fs.BoolVar(&cfg.DryRun, "dry-run", false, "On gc, expire, snapshot prune and du --collect, only report the messages to delete without deleting them")
+	fs.BoolVar(&cfg.Garbage, "garbage", false, "On du, also report the space taken by the messages no listing uses, and what deletes them")
+	fs.BoolVar(&cfg.Collect, "collect", false, "On du, report the space as --garbage does, then delete what gc deletes")
+	fs.BoolVar(&cfg.Recursive, "recursive", false, "On rm, also remove the files under the given directories")
+	fs.StringVar(&cfg.Format, "format", "", "The output format: text (default) or json on du and find; table, json or csv on list (default: the interactive browser, or table with --non-interactive)")
+	fs.StringVar(&cfg.Name, "name", "", "On find, select the files whose name matches this glob, or whose path does if it holds a slash (e.g. '*.iso')")
+	fs.Var(newSizeValue(&cfg.MinSize, 0), "min-size", "On find, select the files at least this large (e.g. 1G)")
+	fs.Var(newSizeValue(&cfg.MaxSize, 0), "max-size", "On find, select the files at most this large (e.g. 10M)")
+	fs.Var(&durationValue{target: &cfg.NewerThan}, "newer-than", "On find, select the files modified within this long (e.g. 30d)")
+	fs.BoolVar(&cfg.Sizes, "sizes", false, "On tree, show the size of files and the total of directories")
+	fs.IntVar(&cfg.MaxDepth, "max-depth", 0, "On tree, descend at most this many levels (0 for no limit)")
+	fs.StringVar(&cfg.RemotePath, "remote-path", "", "On put, the remote path to upload to (required when reading from standard input)")
+	fs.IntVar(&cfg.KeepDaily, "keep-daily", 0, "On snapshot prune, keep the newest snapshot of each of the last N days (default 7 when no --keep-* is set)")
+	fs.IntVar(&cfg.KeepWeekly, "keep-weekly", 0, "On snapshot prune, keep the newest snapshot of each of the last N weeks (default 4 when no --keep-* is set)")
+	fs.IntVar(&cfg.KeepMonthly, "keep-monthly", 0, "On snapshot prune, keep the newest snapshot of each of the last N months (default 12 when no --keep-* is set)")
+	fs.BoolVar(&cfg.ByUpload, "by-upload", false, "On expire, measure the age of files from their upload instead of their modification time")
+	fs.StringVar(&cfg.MetricsFile, "metrics-file", "", "Write the outcome of the run to this file for the node_exporter textfile collector (e.g. /var/lib/node_exporter/tgblobsync.prom)")
+	fs.StringVar(&cfg.ReportFile, "report-file", "", "Write a JSON summary of the run to this file")
+	fs.BoolVar(&cfg.NiceIO, "nice-io", false, "Transfer one file at a time at low CPU and I/O priority, to keep the desktop responsive")
+	fs.BoolVar(&cfg.NonInteractive, "non-interactive", false, "Disable interactive UI and progress bars; the command is run by the daemon when one is running")
+	cfg.StallTimeout = 2 * time.Minute
+	fs.Var(&durationValue{target: &cfg.StallTimeout}, "stall-timeout", "Abort and retry a download receiving no data for this long (0 to wait forever)")
+	fs.Var(&durationValue{target: &cfg.WaitOnline}, "wait-online", "With --non-interactive, when Telegram is unreachable, hash the local files and keep trying to connect for this long before failing (e.g. 2h)")
+	fs.BoolVar(&cfg.NoDaemon, "no-daemon", false, "Connect to Telegram even when a daemon is running, instead of running the command through it")
+	fs.Var(&durationValue{target: &cfg.OlderThan}, "older-than", "Archive, or on expire delete, files not modified for this long; on find, select them (e.g. 90d)")
+	fs.StringVar(&cfg.RequireMarker, "require-marker", "", "Abort push, pull and watch unless this file exists in --dir (e.g. .tgblobsync-root)")
+	fs.Var(&durationValue{target: &cfg.DeleteGrace}, "delete-grace", "On push and watch, mark remote files deleted locally as pending and only delete them after this long (e.g. 7d, 0 to delete right away)")
+	fs.BoolVar(&cfg.NoDelete, "no-delete", false, "On push, pull, watch and status, never delete files missing on the other side, only transfer new and updated ones")
+	fs.IntVar(&cfg.MaxDelete, "max-delete", 0, "On push and pull, abort when the plan deletes more than this many files (0 for no limit)")
+	fs.IntVar(&cfg.MaxDeletePercent, "max-delete-percent", 0, "On push and pull, abort when the plan deletes more than this percentage of the files (0 for no limit)")
+	fs.StringVar(&cfg.PlanOut, "plan-out", "", "On push, pull and status push|pull, write the plan to this file instead of executing it, for apply")
+	fs.BoolVar(&cfg.PruneAfterVerify, "prune-after-verify", false, "On push and watch, only delete remote files, replaced versions included, once every upload is found intact in a new listing")
+	fs.BoolVar(&cfg.Force, "force", false, "On push and watch, delete remote files even when the local directory looks unmounted or empty")
+	fs.Var(&durationValue{target: &cfg.MaxDuration}, "max-duration", "On push and pull, stop starting transfers after this long and leave the rest for the next run (e.g. 2h)")
+	cfg.ReconcileInterval = time.Hour
+	fs.Var(&durationValue{target: &cfg.ReconcileInterval}, "reconcile-interval", "In watch mode, rescan the directory this often to catch missed changes (0 to disable)")
+	fs.StringVar(&cfg.WatchBackend, "watch-backend", "inotify", "Change detection of watch mode: inotify, or poll for network filesystems")
+	cfg.PollInterval = 10 * time.Second
+	fs.Var(&durationValue{target: &cfg.PollInterval}, "poll-interval", "How often the poll watch backend scans the directory")
+	fs.Var(&tagsValue{target: &cfg.Tags}, "tag", "key=value tag applied to uploaded files on push and put, or filter on pull, status, list, du, tree and find (repeatable)")
+
+	args, err := parseInterspersed(fs, cmdArgs[1:])
+	if err != nil {
+		return nil, err
+	}
+	cfg.Args = args
 
-	if err := fs.Parse(os.Args[2:]); err != nil {
+	if err := validateProfileName(cfg.Profile); err != nil {
 		return nil, err
 	}
+	if err := applyProfile(fs, cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Hash, err = checksum.Parse(cfg.Hash); err != nil {
+		return nil, fmt.Errorf("invalid --hash: %w", err)
+	}
 
 	// Validate App Credentials
 	appIDStr := os.Getenv("APP_ID")
@@ -61,7 +247,6 @@ func ParseCLI(appIDDef string, appHashDef string) (*CLIConfig, error) {
 		return nil, fmt.Errorf("AppID and AppHash must be provided via ldflags or env vars (APP_ID/APP_HASH)")
 	}
 
-	var err error
 	cfg.AppID, err = strconv.Atoi(appIDStr)
 	if err != nil {
 		return nil, fmt.Errorf("invalid AppID: %v", err)
@@ -73,16 +258,374 @@ func ParseCLI(appIDDef string, appHashDef string) (*CLIConfig, error) {
 		return nil, fmt.Errorf("failed to get session path: %v", err)
 	}
 
+	if cfg.HashWorkers < 1 {
+		return nil, fmt.Errorf("--hash-workers must be at least 1")
+	}
+	if cfg.ChunkSize < 512*1024 {
+		return nil, fmt.Errorf("--chunk-size must be at least 512K")
+	}
+	if cfg.PackThreshold > 0 && cfg.PackSize > cfg.ChunkSize {
+		return nil, fmt.Errorf("--pack-size must not exceed --chunk-size")
+	}
+
 	// Command specific validation
-	if (cmd == "push" || cmd == "pull") && cfg.DirPath == "" {
-		return nil, fmt.Errorf("--dir is required for push/pull commands")
+	// snapshot restore checks out an older state of the topic, as pull does
+	pull := cmd == "pull" || (cmd == "snapshot" && len(cfg.Args) > 0 && cfg.Args[0] == "restore")
+	if len(cfg.Roots) > 0 {
+		if cmd != "push" {
+			return nil, fmt.Errorf("--root is only supported by the push command")
+		}
+		if cfg.DirPath != "" || cfg.SubDir != "" || cfg.Resume {
+			return nil, fmt.Errorf("--root can't be combined with --dir, --sub-dir nor --resume")
+		}
+		if err := validateRoots(cfg.Roots); err != nil {
+			return nil, err
+		}
+	}
+	if (cmd == "push" && len(cfg.Roots) == 0 || pull || cmd == "status" || cmd == "watch" || cmd == "archive" || cmd == "recall" || cmd == "repair" || (cmd == "dupes" && !cfg.Remote)) && cfg.DirPath == "" {
+		return nil, fmt.Errorf("--dir is required for %s command", cmd)
+	}
+	if cmd == "archive" && cfg.OlderThan <= 0 {
+		return nil, fmt.Errorf("--older-than is required for the archive command")
+	}
+	if cfg.WatchBackend != "inotify" && cfg.WatchBackend != "poll" {
+		return nil, fmt.Errorf("invalid --watch-backend: %q (expected inotify or poll)", cfg.WatchBackend)
+	}
+	if cfg.CaseConflicts != "abort" && cfg.CaseConflicts != "rename" && cfg.CaseConflicts != "ignore" {
+		return nil, fmt.Errorf("invalid --case-conflicts: %q (expected abort, rename or ignore)", cfg.CaseConflicts)
+	}
+	if cfg.UnsafePaths != "skip" && cfg.UnsafePaths != "escape" && cfg.UnsafePaths != "keep" {
+		return nil, fmt.Errorf("invalid --unsafe-paths: %q (expected skip, escape or keep)", cfg.UnsafePaths)
+	}
+	if cfg.NoDelete && cmd != "push" && !pull && cmd != "watch" && cmd != "status" {
+		return nil, fmt.Errorf("--no-delete is only supported by the push, pull, watch, status and snapshot restore commands")
+	}
+	if cfg.MaxDelete < 0 || cfg.MaxDeletePercent < 0 || cfg.MaxDeletePercent > 100 {
+		return nil, fmt.Errorf("--max-delete must not be negative, and --max-delete-percent must be between 0 and 100")
+	}
+	if (cfg.MaxDelete > 0 || cfg.MaxDeletePercent > 0) && cmd != "push" && !pull {
+		return nil, fmt.Errorf("--max-delete and --max-delete-percent are only supported by the push, pull and snapshot restore commands")
+	}
+	if cfg.PlanOut != "" {
+		if cmd != "push" && cmd != "pull" && !(cmd == "status" && len(cfg.Args) == 1) {
+			return nil, fmt.Errorf("--plan-out is only supported by the push, pull, status push and status pull commands")
+		}
+		if len(cfg.Roots) > 0 || cfg.Resume {
+			return nil, fmt.Errorf("--plan-out can't be combined with --root nor --resume")
+		}
+	}
+	if cmd == "apply" && len(cfg.Args) != 1 {
+		return nil, fmt.Errorf("usage: tgblobsync apply [flags] <plan.json>")
+	}
+	if cfg.PruneAfterVerify && cmd != "push" && cmd != "watch" {
+		return nil, fmt.Errorf("--prune-after-verify is only supported by the push and watch commands")
+	}
+	if cfg.BackupDir != "" && !pull {
+		return nil, fmt.Errorf("--backup-dir is only supported by the pull and snapshot restore commands")
+	}
+	if cfg.HardlinkDupes && !pull {
+		return nil, fmt.Errorf("--hardlink-dupes is only supported by the pull and snapshot restore commands")
+	}
+	if cfg.MirrorDir != "" && !pull {
+		return nil, fmt.Errorf("--mirror-dir is only supported by the pull and snapshot restore commands")
+	}
+	if cfg.FromHost != "" && !pull {
+		return nil, fmt.Errorf("--from-host is only supported by the pull and snapshot restore commands")
+	}
+	if cfg.RemoteGlob != "" {
+		if !pull {
+			return nil, fmt.Errorf("--remote-glob is only supported by the pull and snapshot restore commands")
+		}
+		if err := glob.Validate(cfg.RemoteGlob); err != nil {
+			return nil, fmt.Errorf("invalid --remote-glob %q: %w", cfg.RemoteGlob, err)
+		}
+	}
+	routed := false
+	for _, rule := range cfg.Rules {
+		routed = routed || rule.TopicID != 0
+		if rule.Match == "" && rule.Mime == "" {
+			return nil, fmt.Errorf("rule without match nor mime pattern in profile %s", cfg.Profile)
+		}
+		if err := glob.Validate(rule.Match); rule.Match != "" && err != nil {
+			return nil, fmt.Errorf("invalid rule pattern %q in profile %s", rule.Match, cfg.Profile)
+		}
+		if _, err := path.Match(rule.Mime, ""); err != nil {
+			return nil, fmt.Errorf("invalid rule mime pattern %q in profile %s", rule.Mime, cfg.Profile)
+		}
+		if rule.Pipeline != nil {
+			if _, err := pipeline.Parse(*rule.Pipeline); err != nil {
+				return nil, fmt.Errorf("invalid pipeline of rule %q in profile %s: %w", rule.Match+rule.Mime, cfg.Profile, err)
+			}
+		}
+		if rule.MaxAge == "" {
+			continue
+		}
+		if rule.Match == "" {
+			return nil, fmt.Errorf("the max_age of a rule requires a match pattern, in profile %s", cfg.Profile)
+		}
+		maxAge, err := ParseDuration(rule.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_age of rule %q in profile %s: %w", rule.Match, cfg.Profile, err)
+		}
+		cfg.Retention = append(cfg.Retention, domain.RetentionRule{Match: rule.Match, MaxAge: maxAge})
+	}
+	if routed && cmd == "watch" {
+		return nil, fmt.Errorf("the watch command doesn't support rules routing files to other topics")
+	}
+	if routed && cfg.PlanOut != "" {
+		return nil, fmt.Errorf("--plan-out doesn't support rules routing files to other topics")
+	}
+	if cmd == "expire" && len(cfg.Args) > 0 {
+		// Patterns given on the command line replace the rules of the profile
+		if cfg.OlderThan <= 0 {
+			return nil, fmt.Errorf("--older-than is required for the expire command with patterns")
+		}
+		cfg.Retention = nil
+		for _, pattern := range cfg.Args {
+			if err := glob.Validate(pattern); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+			cfg.Retention = append(cfg.Retention, domain.RetentionRule{Match: pattern, MaxAge: cfg.OlderThan})
+		}
+	}
+	if cmd == "expire" && len(cfg.Retention) == 0 {
+		return nil, fmt.Errorf("usage: tgblobsync expire --older-than <age> [flags] <path or glob>... (or rules with max_age in the profile)")
+	}
+	if cfg.ByUpload && cmd != "expire" {
+		return nil, fmt.Errorf("--by-upload is only supported by the expire command")
+	}
+	if (cfg.Remote || cfg.Dedup) && cmd != "dupes" {
+		return nil, fmt.Errorf("--remote and --dedup are only supported by the dupes command")
+	}
+	if cfg.Repair && cmd != "fsck" {
+		return nil, fmt.Errorf("--repair is only supported by the fsck command")
+	}
+	switch cfg.Malformed {
+	case "ask", "adopt", "delete", "skip":
+	default:
+		return nil, fmt.Errorf("invalid --malformed: %q (expected ask, adopt, delete or skip)", cfg.Malformed)
+	}
+	if cfg.Mapping != "" && cmd != "adopt" {
+		return nil, fmt.Errorf("--mapping is only supported by the adopt command")
+	}
+	if cfg.Malformed != "ask" && !cfg.Repair {
+		return nil, fmt.Errorf("--malformed requires fsck --repair")
+	}
+	prune := cmd == "snapshot" && len(cfg.Args) > 0 && cfg.Args[0] == "prune"
+	if cfg.DryRun && cmd != "gc" && cmd != "expire" && !prune && !(cmd == "du" && cfg.Collect) {
+		return nil, fmt.Errorf("--dry-run is only supported by the gc, expire, snapshot prune and du --collect commands")
+	}
+	if cfg.KeepDaily < 0 || cfg.KeepWeekly < 0 || cfg.KeepMonthly < 0 {
+		return nil, fmt.Errorf("--keep-daily, --keep-weekly and --keep-monthly must not be negative")
+	}
+	if keep := cfg.KeepDaily + cfg.KeepWeekly + cfg.KeepMonthly; keep > 0 && !prune {
+		return nil, fmt.Errorf("--keep-daily, --keep-weekly and --keep-monthly are only supported by the snapshot prune command")
+	} else if keep == 0 && prune {
+		// Grandfather-father-son rotation, as offered by common backup tools
+		cfg.KeepDaily, cfg.KeepWeekly, cfg.KeepMonthly = 7, 4, 12
+	}
+	if cfg.DailyUploadLimit > 0 && cfg.DailyUploadWarn > cfg.DailyUploadLimit {
+		return nil, fmt.Errorf("--daily-upload-warn must not be above --daily-upload-limit")
+	}
+	if cfg.KeepVersions < 0 {
+		return nil, fmt.Errorf("--keep-versions must not be negative")
+	}
+	if cfg.Sample < 1 || cfg.Sample > 100 {
+		return nil, fmt.Errorf("--sample must be between 1 and 100")
+	}
+	if cfg.Dedup && !cfg.Remote {
+		return nil, fmt.Errorf("--dedup requires --remote")
+	}
+	if cmd == "history" && len(cfg.Args) != 1 {
+		return nil, fmt.Errorf("usage: tgblobsync history [flags] <path>")
+	}
+	if cmd == "get" && (len(cfg.Args) < 1 || len(cfg.Args) > 2) {
+		return nil, fmt.Errorf("usage: tgblobsync get [flags] <remote-path> [destination]")
+	}
+	if cmd == "rm" && len(cfg.Args) == 0 {
+		return nil, fmt.Errorf("usage: tgblobsync rm [flags] <path or glob>...")
+	}
+	if cfg.Recursive && cmd != "rm" {
+		return nil, fmt.Errorf("--recursive is only supported by the rm command")
+	}
+	if cmd == "mv" && len(cfg.Args) != 2 {
+		return nil, fmt.Errorf("usage: tgblobsync mv [flags] <source> <destination>")
+	}
+	if cmd == "du" && len(cfg.Args) > 1 {
+		return nil, fmt.Errorf("usage: tgblobsync du [flags] [directory]")
+	}
+	if (cfg.Garbage || cfg.Collect) && cmd != "du" {
+		return nil, fmt.Errorf("--garbage and --collect are only supported by the du command")
+	}
+	if cmd == "tree" && len(cfg.Args) > 1 {
+		return nil, fmt.Errorf("usage: tgblobsync tree [flags] [directory]")
+	}
+	if cfg.MaxDepth < 0 {
+		return nil, fmt.Errorf("--max-depth must not be negative")
+	}
+	if (cfg.Sizes || cfg.MaxDepth > 0) && cmd != "tree" {
+		return nil, fmt.Errorf("--sizes and --max-depth are only supported by the tree command")
+	}
+	if cmd == "find" && len(cfg.Args) > 1 {
+		return nil, fmt.Errorf("usage: tgblobsync find [flags] [directory]")
+	}
+	if (cfg.Name != "" || cfg.MinSize > 0 || cfg.MaxSize > 0 || cfg.NewerThan > 0) && cmd != "find" {
+		return nil, fmt.Errorf("--name, --min-size, --max-size and --newer-than are only supported by the find command")
+	}
+	if err := glob.Validate(cfg.Name); err != nil {
+		return nil, fmt.Errorf("invalid --name %q: %w", cfg.Name, err)
+	}
+	switch {
+	case cfg.Format == "":
+	case cmd == "du" || cmd == "find":
+		if cfg.Format != "text" && cfg.Format != "json" {
+			return nil, fmt.Errorf("invalid --format %q: must be text or json", cfg.Format)
+		}
+	case cmd == "list":
+		if cfg.Format != "table" && cfg.Format != "json" && cfg.Format != "csv" {
+			return nil, fmt.Errorf("invalid --format %q: must be table, json or csv", cfg.Format)
+		}
+	default:
+		return nil, fmt.Errorf("--format is only supported by the list, du and find commands")
+	}
+	if cmd == "explain" && len(cfg.Args) != 1 {
+		return nil, fmt.Errorf("usage: tgblobsync explain [flags] <path>")
+	}
+	if cmd == "hash" && len(cfg.Args) == 0 {
+		return nil, fmt.Errorf("usage: tgblobsync hash [flags] <path>...")
+	}
+	if cmd == "put" && (len(cfg.Args) < 1 || len(cfg.Args) > 2) {
+		return nil, fmt.Errorf("usage: tgblobsync put [flags] <local-file | -> [remote-path]")
+	}
+	if cfg.RemotePath != "" {
+		if cmd != "put" {
+			return nil, fmt.Errorf("--remote-path is only supported by the put command")
+		}
+		if len(cfg.Args) > 1 {
+			return nil, fmt.Errorf("--remote-path and a positional remote path are mutually exclusive")
+		}
+		cfg.Args = append(cfg.Args, cfg.RemotePath)
+	}
+	if cmd == "put" && cfg.Args[0] == "-" && (len(cfg.Args) < 2 || strings.HasSuffix(cfg.Args[1], "/")) {
+		return nil, fmt.Errorf("put from standard input requires a remote file path (--remote-path)")
+	}
+	if cmd == "restore" && (len(cfg.Args) < 1 || len(cfg.Args) > 2) {
+		return nil, fmt.Errorf("usage: tgblobsync restore [flags] <path> [destination]")
+	}
+	if (cfg.Version >= 0 || !cfg.At.IsZero()) && cmd != "restore" {
+		return nil, fmt.Errorf("--version and --at are only supported by the restore command")
+	}
+	if cfg.Version >= 0 && !cfg.At.IsZero() {
+		return nil, fmt.Errorf("--version and --at are mutually exclusive")
+	}
+	if cmd == "undelete" && (len(cfg.Args) != 1 || cfg.TrashTopicID == 0) {
+		return nil, fmt.Errorf("usage: tgblobsync undelete --trash-topic <ID> [flags] <path or glob>")
+	}
+	if cmd == "undelete" {
+		if err := glob.Validate(cfg.Args[0]); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", cfg.Args[0], err)
+		}
+	}
+	if cfg.TrashTopicID != 0 && cfg.TrashTopicID == cfg.TopicID {
+		return nil, fmt.Errorf("--trash-topic must differ from --topic-id")
+	}
+	if cmd == "snapshot" && !(len(cfg.Args) == 2 && (cfg.Args[0] == "create" || cfg.Args[0] == "restore")) && !(len(cfg.Args) == 1 && (cfg.Args[0] == "list" || cfg.Args[0] == "prune")) {
+		return nil, fmt.Errorf("usage: tgblobsync snapshot [flags] create <name> | list | restore --dir <dir> <name> | prune")
+	}
+	if cmd == "status" && !(len(cfg.Args) == 0 || (len(cfg.Args) == 1 && (cfg.Args[0] == "push" || cfg.Args[0] == "pull"))) {
+		return nil, fmt.Errorf("usage: tgblobsync status --dir <dir> [flags] [push | pull]")
+	}
+	if cmd == "tag" && len(cfg.Args) < 2 {
+		return nil, fmt.Errorf("usage: tgblobsync tag [flags] <path> <key=value>...")
+	}
+	if cmd == "meta" && (len(cfg.Args) < 3 || cfg.Args[0] != "set") {
+		return nil, fmt.Errorf("usage: tgblobsync meta [flags] set <path> <mtime|flags|tag.<key>=value>...")
 	}
 
-	if cfg.NonInteractive {
-		if cfg.GroupID == 0 || cfg.TopicID == 0 {
+	if cfg.WaitOnline > 0 && !cfg.NonInteractive {
+		return nil, fmt.Errorf("--wait-online requires --non-interactive")
+	}
+	if cmd == "daemon" && len(cfg.Args) > 0 {
+		return nil, fmt.Errorf("usage: tgblobsync daemon [flags]")
+	}
+
+	if cfg.NonInteractive && cmd != "hash" && cmd != "daemon" {
+		if cfg.GroupID == 0 || (cfg.TopicID == 0 && !(cmd == "dupes" && cfg.Remote)) {
 			return nil, fmt.Errorf("--group-id and --topic-id are required in non-interactive mode")
 		}
 	}
 
 	return cfg, nil
 }
+
+// applyProfile fills the options not given on the command line with the
+// values saved in the selected profile.
+func applyProfile(fs *flag.FlagSet, cfg *CLIConfig) error {
+	profiles, err := LoadProfiles()
+	if err != nil {
+		return fmt.Errorf("failed to load profiles: %v", err)
+	}
+
+	profile, ok := profiles[cfg.Profile]
+	if !ok {
+		if cfg.Profile != DefaultProfile {
+			return fmt.Errorf("profile %q not found", cfg.Profile)
+		}
+		return nil
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	if !set["group-id"] {
+		cfg.GroupID = profile.GroupID
+	}
+	if !set["topic-id"] {
+		cfg.TopicID = profile.TopicID
+	}
+	// Roots replace the directory of the profile on push, unless one is given
+	if !set["root"] && !set["dir"] && cfg.Command == "push" {
+		cfg.Roots = profile.Roots
+	}
+	if !set["dir"] && len(cfg.Roots) == 0 {
+		cfg.DirPath = profile.Dir
+	}
+	if !set["sub-dir"] && len(cfg.Roots) == 0 {
+		cfg.SubDir = profile.SubDir
+	}
+	if !set["hash"] && profile.Hash != "" {
+		cfg.Hash = profile.Hash
+	}
+	if !set["trash-topic"] {
+		cfg.TrashTopicID = profile.TrashTopicID
+	}
+	if !set["pipeline"] && profile.Pipeline != "" {
+		if cfg.Pipeline, err = pipeline.Parse(profile.Pipeline); err != nil {
+			return fmt.Errorf("invalid pipeline in profile %q: %w", cfg.Profile, err)
+		}
+	}
+	if !set["tag"] && (cfg.Command == "push" || cfg.Command == "watch" || cfg.Command == "put") {
+		cfg.Tags = profile.Tags
+	}
+	cfg.Rules = profile.Rules
+	return nil
+}
+
+// parseInterspersed parses flags appearing anywhere among the positional
+// arguments, which the flag package alone stops at, and returns the latter.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
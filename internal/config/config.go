@@ -1,10 +1,19 @@
 package config
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"tg-blobsync/internal/domain"
 )
 
+// DefaultProfile is the profile used when --profile is not given.
+const DefaultProfile = "default"
+
 // AppConfig holds the application configuration.
 type AppConfig struct {
 	AppID      int
@@ -12,18 +21,130 @@ type AppConfig struct {
 	SessionDir string
 }
 
-// GetSessionPath returns the path to the session file.
-func GetSessionPath() (string, error) {
+// Profile holds the saved defaults of a named sync target.
+// Profiles are read from profiles.json in the configuration directory.
+type Profile struct {
+	GroupID int64  `json:"group_id,omitempty"`
+	TopicID int64  `json:"topic_id,omitempty"`
+	Dir     string `json:"dir,omitempty"`
+	SubDir  string `json:"sub_dir,omitempty"`
+
+	// TrashTopicID is the topic receiving the remote files deleted by push.
+	TrashTopicID int64 `json:"trash_topic_id,omitempty"`
+
+	// Tags are attached to every file uploaded by push.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// Pipeline is the comma separated list of transforms applied to the
+	// content of the files uploaded, such as "gzip".
+	Pipeline string `json:"pipeline,omitempty"`
+
+	// Rules set how files are handled by path, the first matching one applying.
+	Rules []domain.FileRule `json:"rules,omitempty"`
+
+	// Roots are pushed in place of Dir, each under its own prefix.
+	Roots []domain.SyncRoot `json:"roots,omitempty"`
+
+	// Hash is the checksum algorithm of the files uploaded: md5, sha256
+	// or xxh64.
+	Hash string `json:"hash,omitempty"`
+}
+
+// GetConfigDir returns the directory holding the session, profiles and state.
+func GetConfigDir() (string, error) {
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return "", err
 	}
 
-	sessionDir := filepath.Join(home, ".tg_blobsync")
+	configDir := filepath.Join(home, ".tg_blobsync")
 
-	if err := os.MkdirAll(sessionDir, 0700); err != nil {
+	if err := os.MkdirAll(configDir, 0700); err != nil {
+		return "", err
+	}
+
+	return configDir, nil
+}
+
+// GetSessionPath returns the path to the session file.
+func GetSessionPath() (string, error) {
+	sessionDir, err := GetConfigDir()
+	if err != nil {
 		return "", err
 	}
 
 	return filepath.Join(sessionDir, "session.json"), nil
 }
+
+// GetDaemonSocketPath returns the path to the socket the daemon listens on.
+func GetDaemonSocketPath() (string, error) {
+	configDir, err := GetConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(configDir, "daemon.sock"), nil
+}
+
+// GetUploadCountsPath returns the path to the file counting the bytes
+// uploaded by the account every day.
+func GetUploadCountsPath() (string, error) {
+	configDir, err := GetConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(configDir, "uploads.json"), nil
+}
+
+// LoadProfiles reads the profiles file. A missing file yields no profiles.
+func LoadProfiles() (map[string]Profile, error) {
+	configDir, err := GetConfigDir()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(configDir, "profiles.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]Profile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := make(map[string]Profile)
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("invalid profiles file: %w", err)
+	}
+	return profiles, nil
+}
+
+// GetStateDir returns the directory where caches, journals and other
+// persistent state of a profile/target pair are stored. Every profile and
+// every group/topic gets its own directory so that state never leaks
+// between targets.
+func GetStateDir(profile string, groupID, topicID int64) (string, error) {
+	if err := validateProfileName(profile); err != nil {
+		return "", err
+	}
+
+	configDir, err := GetConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	stateDir := filepath.Join(configDir, "state", profile, fmt.Sprintf("%d_%d", groupID, topicID))
+
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return "", err
+	}
+
+	return stateDir, nil
+}
+
+func validateProfileName(profile string) error {
+	if profile == "" || profile == "." || profile == ".." || strings.ContainsAny(profile, `/\`) {
+		return fmt.Errorf("invalid profile name: %q", profile)
+	}
+	return nil
+}
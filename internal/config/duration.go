@@ -0,0 +1,54 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseDuration parses a duration like time.ParseDuration, additionally
+// accepting a single day ("d") or week ("w") suffix, e.g. "90d" or "2w".
+func ParseDuration(s string) (time.Duration, error) {
+	str := strings.TrimSpace(s)
+	var unit time.Duration
+	switch {
+	case strings.HasSuffix(str, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(str, "w"):
+		unit = 7 * 24 * time.Hour
+	default:
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %q", s)
+		}
+		return d, nil
+	}
+
+	value, err := strconv.ParseFloat(str[:len(str)-1], 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid duration: %q", s)
+	}
+	return time.Duration(value * float64(unit)), nil
+}
+
+// durationValue implements flag.Value for durations accepted by ParseDuration.
+type durationValue struct {
+	target *time.Duration
+}
+
+func (v *durationValue) String() string {
+	if v == nil || v.target == nil {
+		return "0s"
+	}
+	return v.target.String()
+}
+
+func (v *durationValue) Set(s string) error {
+	d, err := ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*v.target = d
+	return nil
+}
@@ -0,0 +1,29 @@
+package config
+
+import (
+	"strings"
+
+	"tg-blobsync/internal/pkg/pipeline"
+)
+
+// pipelineValue implements flag.Value for a comma separated list of
+// pipeline stages.
+type pipelineValue struct {
+	target *pipeline.Pipeline
+}
+
+func (v *pipelineValue) String() string {
+	if v == nil || v.target == nil {
+		return ""
+	}
+	return strings.Join(v.target.Names(), ",")
+}
+
+func (v *pipelineValue) Set(s string) error {
+	p, err := pipeline.Parse(s)
+	if err != nil {
+		return err
+	}
+	*v.target = p
+	return nil
+}
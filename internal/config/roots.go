@@ -0,0 +1,55 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"tg-blobsync/internal/domain"
+)
+
+// rootsValue implements flag.Value for repeatable dir=prefix roots.
+type rootsValue struct {
+	target *[]domain.SyncRoot
+}
+
+func (v *rootsValue) String() string {
+	if v == nil || v.target == nil {
+		return ""
+	}
+	var roots []string
+	for _, r := range *v.target {
+		roots = append(roots, r.Dir+"="+r.Prefix)
+	}
+	return strings.Join(roots, ",")
+}
+
+func (v *rootsValue) Set(s string) error {
+	// Local paths are more likely to hold a '=' than remote prefixes
+	i := strings.LastIndex(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("invalid root %q, expected dir=prefix", s)
+	}
+	*v.target = append(*v.target, domain.SyncRoot{Dir: s[:i], Prefix: s[i+1:]})
+	return nil
+}
+
+// validateRoots normalizes the prefixes of roots, and checks that every root
+// has a directory and a prefix of its own, none being under another: the
+// files of a prefix belong to a single root, which alone may delete them.
+func validateRoots(roots []domain.SyncRoot) error {
+	for i := range roots {
+		r := &roots[i]
+		r.Prefix = strings.Trim(path.Clean("/"+filepath.ToSlash(r.Prefix)), "/")
+		if r.Dir == "" || r.Prefix == "" {
+			return fmt.Errorf("invalid root %s=%s: both a directory and a remote prefix are required", r.Dir, r.Prefix)
+		}
+		for _, other := range roots[:i] {
+			if other.Prefix == r.Prefix || strings.HasPrefix(r.Prefix, other.Prefix+"/") || strings.HasPrefix(other.Prefix, r.Prefix+"/") {
+				return fmt.Errorf("roots %s and %s overlap: their prefixes %s and %s must be disjoint", other.Dir, r.Dir, other.Prefix, r.Prefix)
+			}
+		}
+	}
+	return nil
+}
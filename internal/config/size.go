@@ -0,0 +1,64 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseSize parses a human readable byte size such as "512K", "5M" or "2G".
+// Suffixes are binary multiples; a trailing "B" or "iB" is accepted.
+func ParseSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(str, "IB")
+	str = strings.TrimSuffix(str, "B")
+
+	multiplier := int64(1)
+	if n := len(str); n > 0 {
+		switch str[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			str = str[:n-1]
+		}
+	}
+
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// sizeValue implements flag.Value for byte sizes.
+type sizeValue struct {
+	target *int64
+}
+
+func newSizeValue(target *int64, def int64) *sizeValue {
+	*target = def
+	return &sizeValue{target: target}
+}
+
+func (v *sizeValue) String() string {
+	if v == nil || v.target == nil {
+		return "0"
+	}
+	return strconv.FormatInt(*v.target, 10)
+}
+
+func (v *sizeValue) Set(s string) error {
+	size, err := ParseSize(s)
+	if err != nil {
+		return err
+	}
+	*v.target = size
+	return nil
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ParseTag parses a "key=value" tag. An empty value is allowed.
+func ParseTag(s string) (string, string, error) {
+	key, value, ok := strings.Cut(s, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return "", "", fmt.Errorf("invalid tag %q, expected key=value", s)
+	}
+	return key, value, nil
+}
+
+// tagsValue implements flag.Value for repeatable key=value tags.
+type tagsValue struct {
+	target *map[string]string
+}
+
+func (v *tagsValue) String() string {
+	if v == nil || v.target == nil {
+		return ""
+	}
+	var pairs []string
+	for k, val := range *v.target {
+		pairs = append(pairs, k+"="+val)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (v *tagsValue) Set(s string) error {
+	key, value, err := ParseTag(s)
+	if err != nil {
+		return err
+	}
+	if *v.target == nil {
+		*v.target = make(map[string]string)
+	}
+	(*v.target)[key] = value
+	return nil
+}
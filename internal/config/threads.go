@@ -0,0 +1,86 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ThreadClass is the number of upload threads used for files smaller than
+// Below. The last class applies to every larger file and has Below set to 0.
+type ThreadClass struct {
+	Below   int64
+	Threads int
+}
+
+// ParseThreadClasses parses upload thread counts by size class, such as
+// "8M=1,256M=4,8": 1 thread under 8M, 4 under 256M and 8 above. A single
+// number applies to files of any size.
+func ParseThreadClasses(s string) ([]ThreadClass, error) {
+	var classes []ThreadClass
+	parts := strings.Split(s, ",")
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		var class ThreadClass
+		threads := part
+		if size, count, ok := strings.Cut(part, "="); ok {
+			below, err := ParseSize(size)
+			if err != nil || below == 0 {
+				return nil, fmt.Errorf("invalid upload threads %q: bad size %q", s, size)
+			}
+			if len(classes) > 0 && below <= classes[len(classes)-1].Below {
+				return nil, fmt.Errorf("invalid upload threads %q: sizes must be increasing", s)
+			}
+			class.Below = below
+			threads = count
+		} else if i != len(parts)-1 {
+			return nil, fmt.Errorf("invalid upload threads %q: only the last class can omit the size", s)
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(threads))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid upload threads %q: bad thread count %q", s, threads)
+		}
+		class.Threads = n
+		classes = append(classes, class)
+	}
+
+	if classes[len(classes)-1].Below != 0 {
+		return nil, fmt.Errorf("invalid upload threads %q: the last class must omit the size", s)
+	}
+	return classes, nil
+}
+
+// threadClassesValue implements flag.Value for upload thread classes.
+type threadClassesValue struct {
+	target *[]ThreadClass
+}
+
+func newThreadClassesValue(target *[]ThreadClass, def string) *threadClassesValue {
+	*target, _ = ParseThreadClasses(def)
+	return &threadClassesValue{target: target}
+}
+
+func (v *threadClassesValue) String() string {
+	if v == nil || v.target == nil {
+		return ""
+	}
+	var parts []string
+	for _, c := range *v.target {
+		if c.Below == 0 {
+			parts = append(parts, strconv.Itoa(c.Threads))
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%d=%d", c.Below, c.Threads))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (v *threadClassesValue) Set(s string) error {
+	classes, err := ParseThreadClasses(s)
+	if err != nil {
+		return err
+	}
+	*v.target = classes
+	return nil
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// timestampLayouts are the layouts accepted by ParseTimestamp, besides RFC 3339.
+var timestampLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// ParseTimestamp parses an RFC 3339 timestamp, or a date with an optional
+// time of day in local time, e.g. "2024-06-01" or "2024-06-01 18:30".
+func ParseTimestamp(s string) (time.Time, error) {
+	str := strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return t, nil
+	}
+	for _, layout := range timestampLayouts {
+		if t, err := time.ParseInLocation(layout, str, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp: %q", s)
+}
+
+// timestampValue implements flag.Value for timestamps accepted by ParseTimestamp.
+type timestampValue struct {
+	target *time.Time
+}
+
+func (v *timestampValue) String() string {
+	if v == nil || v.target == nil || v.target.IsZero() {
+		return ""
+	}
+	return v.target.Format(time.RFC3339)
+}
+
+func (v *timestampValue) Set(s string) error {
+	t, err := ParseTimestamp(s)
+	if err != nil {
+		return err
+	}
+	*v.target = t
+	return nil
+}
@@ -1,27 +1,329 @@
 package domain
 
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Metadata flags, stored comma separated in FileMeta.Flags.
+const (
+	// FlagEmptyFile marks a 0-byte file stored as a 1-byte dummy document.
+	FlagEmptyFile = "EMPTY_FILE"
+	// FlagArchived marks a file moved to remote-only storage by archive.
+	FlagArchived = "ARCHIVED"
+	// FlagPack marks a message bundling several small files, see RemotePack.
+	FlagPack = "PACK"
+	// FlagIndex marks the message holding the file listing of a topic.
+	FlagIndex = "INDEX"
+	// FlagPendingDelete marks a file deleted locally, kept until the grace
+	// period started at FileMeta.DeletedAt is over.
+	FlagPendingDelete = "PENDING_DELETE"
+	// FlagQuarantined marks a message found damaged by fsck, ignored since.
+	FlagQuarantined = "QUARANTINED"
+	// FlagSuperseded marks an older version of a file, kept by
+	// --keep-versions after an update and ignored by listings.
+	FlagSuperseded = "SUPERSEDED"
+	// FlagTrashed marks a file moved to the trash topic when deleted, at
+	// FileMeta.DeletedAt.
+	FlagTrashed = "TRASHED"
+	// FlagSnapshot marks the manifest of a snapshot, a listing of the files
+	// of the topic at the time it was taken.
+	FlagSnapshot = "SNAPSHOT"
+	// FlagSidecar marks a document holding the metadata of a file that
+	// doesn't fit in its caption, see FileMeta.Sidecar.
+	FlagSidecar = "SIDECAR"
+)
+
+// TempMarker is part of the name of every temporary file created next to the
+// synced files. Files whose name holds it are reserved to the tool: they are
+// never synced, whichever run created them.
+const TempMarker = ".tgblobsync."
+
+// PartSuffix is appended to the name of a file being downloaded, until it is
+// complete. The name is the same for every run, so that any run can resume it.
+const PartSuffix = TempMarker + "part"
+
+// IsTempFile reports whether the file at the given slash separated path is
+// a temporary file of the tool.
+func IsTempFile(path string) bool {
+	return strings.Contains(path[strings.LastIndex(path, "/")+1:], TempMarker)
+}
+
+// NormalizePath returns path in Unicode normalization form C, in which
+// Linux tools usually write names, while macOS decomposes accented letters.
+// Paths that aren't valid UTF-8 are returned unchanged.
+func NormalizePath(path string) string {
+	if !utf8.ValidString(path) {
+		return path
+	}
+	return norm.NFC.String(path)
+}
+
 // FileMeta represents the metadata stored in the caption of the Telegram message.
 type FileMeta struct {
 	Path     string `json:"p"`
 	Checksum string `json:"m,omitempty"`
 	ModTime  int64  `json:"t,omitempty"`
 	Flags    string `json:"f,omitempty"`
+
+	// Algorithm is the algorithm of Checksum, empty for MD5 (see the
+	// checksum package).
+	Algorithm string `json:"ha,omitempty"`
+
+	// Tags are arbitrary user defined key/value labels.
+	Tags map[string]string `json:"g,omitempty"`
+
+	// DeletedAt is when the file was marked FlagPendingDelete or
+	// FlagTrashed (Unix seconds).
+	DeletedAt int64 `json:"dt,omitempty"`
+
+	// Version counts the updates of the path, starting from 0.
+	Version int `json:"v,omitempty"`
+
+	// Pipeline names the transforms applied to the content before upload,
+	// in order, such as "gzip". Downloads undo them in reverse order.
+	Pipeline []string `json:"x,omitempty"`
+	// ContentSize is the size of the content before Pipeline.
+	ContentSize int64 `json:"cs,omitempty"`
+
+	// Chunk manifest, set only on files split across several messages.
+	Part     int   `json:"pi,omitempty"` // 0-based index of this part
+	Parts    int   `json:"pn,omitempty"` // Total number of parts
+	PartSize int64 `json:"ps,omitempty"` // Size of every part but the last
+	// PartChecksum is the checksum of the content of this part, with
+	// Algorithm, checked on download before the next part is read.
+	PartChecksum string `json:"pc,omitempty"`
+
+	// Origin of the upload, to tell which machine and run stored the file.
+	Host  string `json:"oh,omitempty"` // host name of the machine
+	Tool  string `json:"ov,omitempty"` // version of the tool
+	RunID string `json:"or,omitempty"` // ID of the run
+
+	// Sidecar is the message of the document holding the whole metadata,
+	// when it is too long for a caption. The caption then only keeps the
+	// fields telling the parts apart and the flags.
+	Sidecar int `json:"sc,omitempty"`
+}
+
+// fileMetaFields has the fields of FileMeta without its JSON methods.
+type fileMetaFields FileMeta
+
+// fileMetaJSON is the JSON form of FileMeta. JSON strings can only carry
+// valid UTF-8, so other paths are stored base64 encoded in PathBase64, with
+// a readable approximation in Path.
+type fileMetaJSON struct {
+	fileMetaFields
+	PathBase64 string `json:"pb,omitempty"`
+}
+
+func (m FileMeta) MarshalJSON() ([]byte, error) {
+	out := fileMetaJSON{fileMetaFields: fileMetaFields(m)}
+	if !utf8.ValidString(m.Path) {
+		out.Path = strings.ToValidUTF8(m.Path, "\uFFFD")
+		out.PathBase64 = base64.StdEncoding.EncodeToString([]byte(m.Path))
+	}
+	return json.Marshal(out)
+}
+
+func (m *FileMeta) UnmarshalJSON(data []byte) error {
+	var in fileMetaJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	if in.PathBase64 != "" {
+		path, err := base64.StdEncoding.DecodeString(in.PathBase64)
+		if err != nil {
+			return fmt.Errorf("invalid encoded path: %w", err)
+		}
+		in.Path = string(path)
+	} else {
+		// The same name may have been uploaded decomposed from macOS
+		in.Path = NormalizePath(in.Path)
+	}
+	*m = FileMeta(in.fileMetaFields)
+	return nil
+}
+
+// HasFlag reports whether the given flag is set.
+func (m FileMeta) HasFlag(flag string) bool {
+	for _, f := range strings.Split(m.Flags, ",") {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// SetFlag adds the given flag.
+func (m *FileMeta) SetFlag(flag string) {
+	if m.HasFlag(flag) {
+		return
+	}
+	if m.Flags == "" {
+		m.Flags = flag
+	} else {
+		m.Flags += "," + flag
+	}
+}
+
+// ClearFlag removes the given flag.
+func (m *FileMeta) ClearFlag(flag string) {
+	var kept []string
+	for _, f := range strings.Split(m.Flags, ",") {
+		if f != "" && f != flag {
+			kept = append(kept, f)
+		}
+	}
+	m.Flags = strings.Join(kept, ",")
+}
+
+// IsChunked reports whether the metadata describes one part of a chunked file.
+func (m FileMeta) IsChunked() bool {
+	return m.Parts > 1
+}
+
+// MatchesTags reports whether the metadata carries all the given tags.
+func (m FileMeta) MatchesTags(filter map[string]string) bool {
+	for k, v := range filter {
+		if value, ok := m.Tags[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
 }
 
 // RemoteFile represents a file stored on Telegram.
+// For chunked files MessageID refers to the first part, Size is the size of
+// the whole file and Chunks lists every part in order.
+// For packed files MessageID refers to the pack message, which may hold
+// other files as well: use Pack to tell them apart.
 type RemoteFile struct {
 	Meta      FileMeta
 	MessageID int
 	Size      int64
+	Chunks    []RemoteChunk
+	Pack      *RemotePack
+	// DocumentID identifies the stored content (of the first part), shared
+	// by the messages copied from one another. 0 when unknown.
+	DocumentID int64
+}
+
+// RemotePack locates a file stored inside a pack message.
+type RemotePack struct {
+	MessageID int
+	Size      int64  // Size of the whole pack
+	Path      string // Path of the pack message itself
+	Member    string // Name of the file inside the pack
+}
+
+// RemoteChunk represents one part of a chunked file.
+type RemoteChunk struct {
+	MessageID int
+	Size      int64
+	// Checksum is the checksum of the part, empty when uploaded before
+	// parts carried one.
+	Checksum string
+}
+
+// ContentSize returns the size of the file content, which differs from the
+// size stored when the content went through a pipeline.
+func (f RemoteFile) ContentSize() int64 {
+	if len(f.Meta.Pipeline) > 0 {
+		return f.Meta.ContentSize
+	}
+	return f.Size
+}
+
+// MessageIDs returns the IDs of all the messages holding the file content.
+func (f RemoteFile) MessageIDs() []int {
+	if len(f.Chunks) == 0 {
+		return []int{f.MessageID}
+	}
+	ids := make([]int, 0, len(f.Chunks))
+	for _, c := range f.Chunks {
+		ids = append(ids, c.MessageID)
+	}
+	return ids
+}
+
+// RemoteMessage is a document message of a topic, whatever its caption.
+type RemoteMessage struct {
+	ID         int
+	Caption    string
+	Meta       *FileMeta // nil when the caption holds no metadata
+	FileName   string    // from the document attributes
+	Size       int64
+	DocumentID int64
+	Date       int64 // Unix seconds
 }
 
 // LocalFile represents a file on the local filesystem.
 type LocalFile struct {
-	Path     string // Relative path
-	Checksum string
-	ModTime  int64
-	Size     int64
-	AbsPath  string // Absolute path for internal use
+	Path      string // Relative path
+	Checksum  string
+	Algorithm string // Algorithm of Checksum, see FileMeta
+	ModTime   int64
+	Size      int64
+	AbsPath   string // Absolute path for internal use
+	Tags      map[string]string
+	Flags     string // Metadata flags to store on upload
+	Version   int    // Metadata version to store on upload
+	DeletedAt int64  // Deletion time to store on upload, see FlagTrashed
+
+	// Pipeline names the transforms the content at AbsPath went through,
+	// whose size before them is ContentSize, to store on upload.
+	Pipeline    []string
+	ContentSize int64
+}
+
+// FileRule sets how the files matching a glob pattern are handled. Patterns
+// without a slash are matched against the file name only, so that "*.iso"
+// applies in every directory.
+type FileRule struct {
+	Match string `json:"match,omitempty"`
+	// Mime matches the MIME type of the file, as told by its extension,
+	// such as "image/*". A rule with both patterns needs both to match.
+	Mime string `json:"mime,omitempty"`
+	// Skip leaves the matching files out of every sync, in both directions.
+	Skip bool `json:"skip,omitempty"`
+	// Pack, when set, overrides whether the matching files may be packed.
+	Pack *bool `json:"pack,omitempty"`
+	// Pipeline, when set, overrides the transforms applied to the content
+	// of the matching files on upload, such as "gzip". Empty uploads them
+	// as they are.
+	Pipeline *string `json:"pipeline,omitempty"`
+	// Priority orders the transfers: higher ones are started first.
+	Priority int `json:"priority,omitempty"`
+	// Tags are attached to the matching files on upload.
+	Tags map[string]string `json:"tags,omitempty"`
+	// MaxAge is the age after which expire deletes the matching remote
+	// files, such as "30d". Empty keeps them forever.
+	MaxAge string `json:"max_age,omitempty"`
+	// TopicID routes the matching files to another topic of the group than
+	// the one synced.
+	TopicID int64 `json:"topic_id,omitempty"`
+}
+
+// SyncRoot is a local directory pushed under a remote prefix, along with
+// other roots, into the same topic. Rules apply on top of those of the
+// profile, their patterns being relative to the root.
+type SyncRoot struct {
+	Dir    string     `json:"dir"`
+	Prefix string     `json:"prefix"`
+	Rules  []FileRule `json:"rules,omitempty"`
+}
+
+// RetentionRule sets the age after which the remote files matching a glob
+// pattern are deleted by expire. Patterns match as in FileRule.
+type RetentionRule struct {
+	Match  string
+	MaxAge time.Duration
 }
 
 // Group represents a Telegram Supergroup.
@@ -45,15 +347,94 @@ const (
 	ActionDeleteRemote SyncActionType = "DELETE_REMOTE"
 	ActionDeleteLocal  SyncActionType = "DELETE_LOCAL"
 	ActionSkip         SyncActionType = "SKIP"
+	// ActionMarkDeleted and ActionUnmarkDeleted set and clear FlagPendingDelete.
+	ActionMarkDeleted   SyncActionType = "MARK_DELETED"
+	ActionUnmarkDeleted SyncActionType = "UNMARK_DELETED"
 )
 
+// SyncReason tells why an item is part of a plan.
+type SyncReason string
+
+const (
+	ReasonNew               SyncReason = "NEW"
+	ReasonNewRemote         SyncReason = "NEW_REMOTE"
+	ReasonChecksum          SyncReason = "CHECKSUM_MISMATCH"
+	ReasonSize              SyncReason = "SIZE_CHANGED"
+	ReasonModTime           SyncReason = "MODTIME_CHANGED"
+	ReasonBackLocally       SyncReason = "BACK_LOCALLY"
+	ReasonDeletedLocally    SyncReason = "DELETED_LOCALLY"
+	ReasonPendingDelete     SyncReason = "PENDING_DELETE"
+	ReasonGraceOver         SyncReason = "GRACE_OVER"
+	ReasonDeletedRemotely   SyncReason = "DELETED_REMOTELY"
+	ReasonMissingRemotely   SyncReason = "MISSING_REMOTELY"
+	ReasonCorruptedRemotely SyncReason = "CORRUPTED_REMOTELY"
+	ReasonCorruptedLocally  SyncReason = "CORRUPTED_LOCALLY"
+	ReasonArchived          SyncReason = "ARCHIVED"
+	ReasonRecalled          SyncReason = "RECALLED"
+	ReasonRemoved           SyncReason = "REMOVED"
+)
+
+var reasonText = map[SyncReason]string{
+	ReasonNew:               "New file",
+	ReasonNewRemote:         "New remote file",
+	ReasonChecksum:          "Checksum mismatch",
+	ReasonSize:              "Size changed",
+	ReasonModTime:           "Modification time changed",
+	ReasonBackLocally:       "Back locally",
+	ReasonDeletedLocally:    "Deleted locally",
+	ReasonPendingDelete:     "Deleted locally, pending",
+	ReasonGraceOver:         "Deleted locally, grace period over",
+	ReasonDeletedRemotely:   "Deleted remotely",
+	ReasonMissingRemotely:   "Missing remotely",
+	ReasonCorruptedRemotely: "Corrupted remotely",
+	ReasonCorruptedLocally:  "Corrupted locally",
+	ReasonArchived:          "Archived",
+	ReasonRecalled:          "Recalled",
+	ReasonRemoved:           "Removed by rm",
+}
+
+// String returns a readable description of the reason.
+func (r SyncReason) String() string {
+	if text, ok := reasonText[r]; ok {
+		return text
+	}
+	return string(r)
+}
+
 // SyncItem represents a single file synchronization task.
 type SyncItem struct {
 	Path       string
 	Action     SyncActionType
 	LocalFile  *LocalFile
 	RemoteFile *RemoteFile
-	Reason     string
+	Reason     SyncReason
+	// Detail gives the specifics of Reason, such as the checksums that differ.
+	Detail string
+
+	// Source is a remote file with the same content as LocalFile, whose
+	// documents are reused instead of uploading it again.
+	Source *RemoteFile
+}
+
+// Why describes the reason of the item along with its detail, such as
+// "Checksum mismatch: local 1a2b3c4d… vs remote 5e6f7a8b…".
+func (i SyncItem) Why() string {
+	if i.Reason == "" {
+		return i.Detail
+	}
+	if i.Detail == "" {
+		return i.Reason.String()
+	}
+	return i.Reason.String() + ": " + i.Detail
+}
+
+// AddDetail appends a detail to those of the item.
+func (i *SyncItem) AddDetail(detail string) {
+	if i.Detail == "" {
+		i.Detail = detail
+	} else {
+		i.Detail += ", " + detail
+	}
 }
 
 // SyncPlan represents the complete set of actions to synchronize files.
@@ -62,6 +443,26 @@ type SyncPlan struct {
 	Summary SyncSummary
 }
 
+// NewSyncPlan returns the plan of items, with their summary.
+func NewSyncPlan(items []SyncItem) SyncPlan {
+	plan := SyncPlan{Items: items}
+	for _, item := range items {
+		switch {
+		case item.Action == ActionSkip:
+		case item.Action == ActionDeleteRemote || item.Action == ActionDeleteLocal || item.Action == ActionMarkDeleted:
+			plan.Summary.ToDelete++
+		case item.Action == ActionUpload && item.RemoteFile == nil:
+			plan.Summary.ToUpload++
+		case item.Action == ActionDownload && item.LocalFile == nil:
+			plan.Summary.ToDownload++
+		default:
+			plan.Summary.ToUpdate++
+		}
+	}
+	plan.Summary.Total = len(items)
+	return plan
+}
+
 // SyncSummary contains the counts of actions in a plan.
 type SyncSummary struct {
 	ToUpload   int
@@ -2,9 +2,18 @@ package domain
 
 import (
 	"context"
+	"errors"
 	"io"
 )
 
+// ErrNotFound is returned by BlobStorage when a message or its document no
+// longer exists.
+var ErrNotFound = errors.New("not found")
+
+// ErrUploadLimit is returned by BlobStorage when an upload would pass the
+// daily upload limit of the account.
+var ErrUploadLimit = errors.New("daily upload limit reached")
+
 // ProgressTracker defines the interface for tracking file transfer progress.
 type ProgressTracker interface {
 	SetTotalFiles(total int)
@@ -17,6 +26,37 @@ type SyncConfirmer interface {
 	ConfirmSync(plan SyncPlan) (bool, error)
 }
 
+// ItemConfirmer is a SyncConfirmer also letting the user leave items out of
+// a plan: it returns the plan of the items approved.
+type ItemConfirmer interface {
+	ConfirmItems(plan SyncPlan) (SyncPlan, bool, error)
+}
+
+// RecoveryAction is what to do with a message whose metadata is damaged.
+type RecoveryAction string
+
+const (
+	// RecoveryAdopt replaces the metadata with the one recovered.
+	RecoveryAdopt RecoveryAction = "adopt"
+	// RecoveryDelete deletes the message.
+	RecoveryDelete RecoveryAction = "delete"
+	// RecoverySkip leaves the message untouched.
+	RecoverySkip RecoveryAction = "skip"
+)
+
+// RecoveryChooser asks what to do with a message whose metadata is damaged.
+// recovered is the metadata that adopting it would store, nil when none
+// could be recovered.
+type RecoveryChooser interface {
+	ChooseRecovery(m RemoteMessage, recovered *FileMeta, problem string) (RecoveryAction, error)
+}
+
+// AdoptPrompter asks the path to give a document adopted, proposed being
+// the default. An empty path leaves the document alone.
+type AdoptPrompter interface {
+	PromptAdoptPath(m RemoteMessage, proposed string) (string, error)
+}
+
 // UserInterface combines progress tracking and confirmation.
 type UserInterface interface {
 	ProgressTracker
@@ -30,6 +70,46 @@ type ProgressTask interface {
 	Abort()
 }
 
+// StallAwareTask is a ProgressTask showing when its transfer is stalled,
+// waiting for data that doesn't come.
+type StallAwareTask interface {
+	SetStalled(stalled bool)
+}
+
+type progressTaskKey struct{}
+
+// WithProgressTask returns a context whose transfers report their progress
+// to task. The caller owns task: BlobStorage only moves it forward, and
+// leaves completing or aborting it to the caller.
+func WithProgressTask(ctx context.Context, task ProgressTask) context.Context {
+	if task == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, progressTaskKey{}, task)
+}
+
+// ProgressTaskFrom returns the task set by WithProgressTask, nil if none.
+func ProgressTaskFrom(ctx context.Context) ProgressTask {
+	task, _ := ctx.Value(progressTaskKey{}).(ProgressTask)
+	return task
+}
+
+type uploadChecksumKey struct{}
+
+// WithUploadChecksum returns a context asking UploadFile to checksum a file
+// uploaded without a checksum as it reads it, instead of the file being read
+// once more beforehand. The checksum is stored in the metadata and in *sum.
+func WithUploadChecksum(ctx context.Context, sum *string) context.Context {
+	return context.WithValue(ctx, uploadChecksumKey{}, sum)
+}
+
+// UploadChecksumFrom returns the destination set by WithUploadChecksum, nil
+// if none.
+func UploadChecksumFrom(ctx context.Context) *string {
+	sum, _ := ctx.Value(uploadChecksumKey{}).(*string)
+	return sum
+}
+
 // BlobStorage defines the interface for interacting with the remote storage (Telegram).
 type BlobStorage interface {
 	// Auth & Selection
@@ -38,21 +118,48 @@ type BlobStorage interface {
 
 	// File Operations
 	ListFiles(ctx context.Context, groupID int64, topicID int64) ([]RemoteFile, error)
+	ListMessages(ctx context.Context, groupID int64, topicID int64) ([]RemoteMessage, error)
 	UploadFile(ctx context.Context, groupID int64, topicID int64, file LocalFile) error
-	DeleteFile(ctx context.Context, groupID int64, topicID int64, messageID int) error
-	DownloadFile(ctx context.Context, groupID int64, topicID int64, messageID int, fileName string, size int64) (io.ReadCloser, error)
+	CopyFile(ctx context.Context, groupID int64, topicID int64, source RemoteFile, file LocalFile) error
+	DeleteFile(ctx context.Context, groupID int64, topicID int64, messageIDs ...int) error
+	DownloadFile(ctx context.Context, groupID int64, topicID int64, messageID int, fileName string, size int64, offset int64) (io.ReadCloser, error)
+	UpdateFileMeta(ctx context.Context, groupID int64, topicID int64, file RemoteFile, meta FileMeta) error
+	SaveIndex(ctx context.Context, groupID int64, topicID int64) error
 
 	// Lifecycle
 	Close() error
+	// SetProgressTracker sets where the transfers started without a task of
+	// their own (see WithProgressTask) report their progress.
 	SetProgressTracker(tracker ProgressTracker)
 }
 
 // FileSystem defines the interface for interacting with the local filesystem.
 type FileSystem interface {
 	ListFiles(root string, skipMD5 bool) ([]LocalFile, error)
+	StatFile(root, relPath string, skipMD5 bool) (LocalFile, error)
 	ReadFile(path string) (io.ReadCloser, error)
 	WriteFile(path string, data io.Reader) error
+	AppendFile(path string, data io.Reader) error
+	TruncateFile(path string, size int64) error
+	ReflinkFile(src, dst string) error
+	LinkFile(src, dst string) error
+	CaseInsensitive(dir string) bool
+	RenameFile(oldPath, newPath string) error
 	SetModTime(path string, modTime int64) error
 	DeleteFile(path string) error
 	EnsureDir(path string) error
 }
+
+// ChecksumCache is a FileSystem caching the checksums of its files.
+type ChecksumCache interface {
+	// RememberChecksum caches the checksum of file calculated elsewhere,
+	// unless the file changed since it was listed.
+	RememberChecksum(file LocalFile, checksum string)
+}
+
+// FileWatcher reports changes to the files under a local directory.
+type FileWatcher interface {
+	// Watch sends the paths, relative to root, of the files and directories
+	// created, modified, moved or deleted until ctx is done.
+	Watch(ctx context.Context, root string) (<-chan string, error)
+}
@@ -0,0 +1,40 @@
+package domain
+
+import (
+	"path"
+	"strings"
+)
+
+// DirTotal is the total size and number of the remote files under a
+// virtual directory, at any depth.
+type DirTotal struct {
+	Size  int64
+	Files int
+}
+
+// DirTotals adds up the files under every virtual directory of their paths,
+// keyed by directory path, "" being the root.
+func DirTotals(files []RemoteFile) map[string]DirTotal {
+	totals := make(map[string]DirTotal)
+	for _, f := range files {
+		for dir := ParentDir(f.Meta.Path); ; dir = ParentDir(dir) {
+			t := totals[dir]
+			t.Size += f.Size
+			t.Files++
+			totals[dir] = t
+			if dir == "" {
+				break
+			}
+		}
+	}
+	return totals
+}
+
+// ParentDir returns the virtual directory holding p, "" being the root.
+func ParentDir(p string) string {
+	dir := path.Dir(strings.Trim(p, "/"))
+	if dir == "." || dir == "/" {
+		return ""
+	}
+	return dir
+}
@@ -0,0 +1,124 @@
+// Package cache implements a small persistent key/value store organized in
+// buckets. The whole store is kept in memory and saved to a single file.
+package cache
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+)
+
+// Store is a persistent key/value store. It is safe for concurrent use.
+type Store struct {
+	mu      sync.Mutex
+	path    string
+	buckets map[string]map[string][]byte
+	dirty   bool
+}
+
+// Open loads the store saved at path. A missing or unreadable file yields
+// an empty store: its content can always be rebuilt.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:    path,
+		buckets: make(map[string]map[string][]byte),
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cache: %w", err)
+	}
+	defer f.Close()
+
+	if err := gob.NewDecoder(f).Decode(&s.buckets); err != nil {
+		log.Printf("[!] Warning: discarding unreadable cache %s: %v", path, err)
+		s.buckets = make(map[string]map[string][]byte)
+	}
+	return s, nil
+}
+
+// Get decodes the value stored under key into v and reports whether it was found.
+func (s *Store) Get(bucket, key string, v any) bool {
+	s.mu.Lock()
+	data, ok := s.buckets[bucket][key]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	return json.Unmarshal(data, v) == nil
+}
+
+// Put stores v under key.
+func (s *Store) Put(bucket, key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[bucket]
+	if !ok {
+		b = make(map[string][]byte)
+		s.buckets[bucket] = b
+	}
+	b[key] = data
+	s.dirty = true
+	return nil
+}
+
+// Keys returns the keys of bucket, in no particular order.
+func (s *Store) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Delete removes key.
+func (s *Store) Delete(bucket, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buckets[bucket][key]; ok {
+		delete(s.buckets[bucket], key)
+		s.dirty = true
+	}
+}
+
+// Save writes the store to disk if it changed since it was loaded.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to save cache: %w", err)
+	}
+	if err := gob.NewEncoder(f).Encode(s.buckets); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to save cache: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to save cache: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to save cache: %w", err)
+	}
+	s.dirty = false
+	return nil
+}
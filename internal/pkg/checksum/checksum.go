@@ -0,0 +1,55 @@
+// Package checksum computes the content checksums stored in file metadata,
+// with the algorithm selected by --hash.
+package checksum
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Algorithms as stored in file metadata. MD5 is stored as an empty string,
+// as are the files uploaded before other algorithms were supported.
+const (
+	MD5    = ""
+	SHA256 = "sha256"
+	XXH64  = "xxh64"
+)
+
+// Parse returns the algorithm of the given name: md5, sha256 or xxh64.
+func Parse(name string) (string, error) {
+	switch name {
+	case "md5":
+		return MD5, nil
+	case SHA256, XXH64:
+		return name, nil
+	default:
+		return "", fmt.Errorf("unsupported checksum algorithm %q (expected md5, sha256 or xxh64)", name)
+	}
+}
+
+// Name returns the display name of an algorithm.
+func Name(algorithm string) string {
+	if algorithm == MD5 {
+		return "md5"
+	}
+	return algorithm
+}
+
+// New returns a hash of the given algorithm, whose sum in hex is the
+// checksum.
+func New(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case MD5:
+		return md5.New(), nil
+	case SHA256:
+		return sha256.New(), nil
+	case XXH64:
+		return xxhash.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+}
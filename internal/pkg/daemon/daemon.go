@@ -0,0 +1,173 @@
+// Package daemon runs commands on behalf of short-lived invocations, over a
+// unix socket, so that they share a single connection kept open by the
+// daemon instead of connecting and authenticating every time.
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// Request is a command line run by the daemon, in the working directory of
+// the invocation.
+type Request struct {
+	Args []string `json:"args"`
+	Cwd  string   `json:"cwd"`
+}
+
+// frame is a message from the daemon: a chunk of standard output or error,
+// or the outcome of the command once Done.
+type frame struct {
+	Stdout []byte `json:"o,omitempty"`
+	Stderr []byte `json:"e,omitempty"`
+	Done   bool   `json:"done,omitempty"`
+	Err    string `json:"err,omitempty"`
+}
+
+// Handler runs a request, writing its output to stdout and stderr. ctx is
+// cancelled when the invocation goes away.
+type Handler func(ctx context.Context, req Request, stdout, stderr io.Writer) error
+
+// Serve listens on socket and runs the requests received with handle until
+// ctx is done, one at a time: the others wait for their turn. A socket left
+// by a daemon that is no longer running is replaced.
+func Serve(ctx context.Context, socket string, handle Handler) error {
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close()
+		return fmt.Errorf("a daemon is already listening on %s", socket)
+	}
+	if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", socket, err)
+	}
+	defer ln.Close()
+	// The session is as good as the account: only its owner may use it
+	if err := os.Chmod(socket, 0600); err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	var mu sync.Mutex
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			serveConn(ctx, conn, &mu, handle)
+		}()
+	}
+}
+
+func serveConn(ctx context.Context, conn net.Conn, mu *sync.Mutex, handle Handler) {
+	var req Request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Nothing else is sent by the invocation: a read returns when it is gone
+	go func() {
+		io.Copy(io.Discard, conn)
+		cancel()
+	}()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+
+	w := &frameWriter{enc: json.NewEncoder(conn)}
+	err := handle(ctx, req, w.stream(false), w.stream(true))
+	done := frame{Done: true}
+	if err != nil {
+		done.Err = err.Error()
+	}
+	w.write(done)
+}
+
+// frameWriter sends frames, from any goroutine.
+type frameWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (w *frameWriter) write(f frame) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.enc.Encode(f)
+}
+
+func (w *frameWriter) stream(stderr bool) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		f := frame{Stdout: p}
+		if stderr {
+			f = frame{Stderr: p}
+		}
+		if err := w.write(f); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// ErrNotRunning is returned by Call when no daemon listens on the socket.
+var ErrNotRunning = errors.New("daemon not running")
+
+// Call runs req on the daemon listening on socket, copying its output to
+// stdout and stderr, and returns the error of the command.
+func Call(socket string, req Request, stdout, stderr io.Writer) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return ErrNotRunning
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return fmt.Errorf("failed to send the command to the daemon: %w", err)
+	}
+
+	dec := json.NewDecoder(conn)
+	for {
+		var f frame
+		if err := dec.Decode(&f); err != nil {
+			return fmt.Errorf("lost the connection to the daemon: %w", err)
+		}
+		switch {
+		case f.Done && f.Err != "":
+			return errors.New(f.Err)
+		case f.Done:
+			return nil
+		case f.Stderr != nil:
+			stderr.Write(f.Stderr)
+		default:
+			stdout.Write(f.Stdout)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+//go:build linux
+
+// Package lowprio lowers the CPU and I/O priority of the process, so that
+// background syncs leave the disk and the processor to interactive use.
+package lowprio
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const (
+	// ioprio_set(2) arguments, not exported by the syscall package
+	ioprioWhoPgrp   = 2
+	ioprioClassIdle = 3
+	ioprioClassBits = 13
+
+	niceness = 10
+)
+
+// Apply moves the process to the idle I/O scheduling class and lowers its
+// CPU priority. Both apply to every thread of the process group, as Linux
+// sets them per thread and the Go runtime has already started several.
+func Apply() error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoPgrp, 0, ioprioClassIdle<<ioprioClassBits); errno != 0 {
+		return fmt.Errorf("failed to set the I/O priority: %w", errno)
+	}
+	if err := syscall.Setpriority(syscall.PRIO_PGRP, 0, niceness); err != nil {
+		return fmt.Errorf("failed to set the CPU priority: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+// Package lowprio lowers the CPU and I/O priority of the process, so that
+// background syncs leave the disk and the processor to interactive use.
+package lowprio
+
+import "errors"
+
+// Apply is only supported on Linux.
+func Apply() error {
+	return errors.New("low priority I/O is only supported on Linux")
+}
@@ -0,0 +1,145 @@
+// Package pack implements the bundle format used to store many small files
+// in a single Telegram message: a tar archive whose first member is a JSON
+// index describing the files that follow.
+package pack
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"tg-blobsync/internal/domain"
+	"time"
+)
+
+const indexName = ".tgblobsync-pack.json"
+
+// Entry describes a file stored in a pack.
+type Entry struct {
+	Name string          `json:"n"` // Name of the tar member
+	Meta domain.FileMeta `json:"m"`
+	Size int64           `json:"s"`
+}
+
+// Member is a file to be written into a pack.
+type Member struct {
+	Meta domain.FileMeta
+	Size int64
+	Open func() (io.ReadCloser, error)
+}
+
+// Write writes a pack holding the given members to w.
+func Write(w io.Writer, members []Member) error {
+	index := make([]Entry, len(members))
+	for i, m := range members {
+		index[i] = Entry{
+			Name: fmt.Sprintf("%06d", i),
+			Meta: m.Meta,
+			Size: m.Size,
+		}
+	}
+
+	indexBytes, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("failed to marshal pack index: %w", err)
+	}
+
+	tw := tar.NewWriter(w)
+	if err := writeMember(tw, indexName, int64(len(indexBytes)), 0, func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(indexBytes)), nil
+	}); err != nil {
+		return err
+	}
+
+	for i, m := range members {
+		if err := writeMember(tw, index[i].Name, m.Size, m.Meta.ModTime, m.Open); err != nil {
+			return fmt.Errorf("failed to pack %s: %w", m.Meta.Path, err)
+		}
+	}
+	return tw.Close()
+}
+
+func writeMember(tw *tar.Writer, name string, size, modTime int64, open func() (io.ReadCloser, error)) error {
+	hdr := &tar.Header{
+		Name: name,
+		Mode: 0644,
+		Size: size,
+	}
+	if modTime > 0 {
+		hdr.ModTime = time.Unix(modTime, 0)
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// The size is recorded in the index upfront, so the content must match it
+	n, err := io.CopyN(tw, rc, size)
+	if err != nil {
+		return fmt.Errorf("short read (%d of %d bytes): %w", n, size, err)
+	}
+	return nil
+}
+
+// Reader reads the members of a pack sequentially.
+type Reader struct {
+	tr    *tar.Reader
+	Index []Entry
+}
+
+// NewReader reads the index of the pack and returns a Reader positioned on
+// its first member.
+func NewReader(r io.Reader) (*Reader, error) {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pack index: %w", err)
+	}
+	if hdr.Name != indexName {
+		return nil, errors.New("not a pack: index not found")
+	}
+
+	var index []Entry
+	if err := json.NewDecoder(tr).Decode(&index); err != nil {
+		return nil, fmt.Errorf("invalid pack index: %w", err)
+	}
+	return &Reader{tr: tr, Index: index}, nil
+}
+
+// Next advances to the next member and returns its index entry and content,
+// or io.EOF at the end of the pack.
+func (r *Reader) Next() (Entry, io.Reader, error) {
+	hdr, err := r.tr.Next()
+	if err != nil {
+		return Entry{}, nil, err
+	}
+	for _, e := range r.Index {
+		if e.Name == hdr.Name {
+			return e, r.tr, nil
+		}
+	}
+	return Entry{}, nil, fmt.Errorf("pack member %s not in index", hdr.Name)
+}
+
+// Find advances to the member with the given name and returns its content.
+func (r *Reader) Find(name string) (io.Reader, error) {
+	for {
+		e, content, err := r.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("pack member %s not found", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if e.Name == name {
+			return content, nil
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Package pipeline implements the transforms applied to the content of a
+// file before it is uploaded, such as compression. A pipeline is an ordered
+// list of stages, recorded by name in the metadata of the file so that
+// downloads undo them in reverse order. Splitting into parts is always the
+// last step, done by the upload itself on the transformed content.
+package pipeline
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Stage is a reversible transform of a stream of content.
+type Stage interface {
+	// Name identifies the stage in the metadata. It must never change.
+	Name() string
+	// Encode returns a writer transforming what is written to it into w.
+	// Closing it flushes the transform, but doesn't close w.
+	Encode(w io.Writer) (io.WriteCloser, error)
+	// Decode returns a reader undoing the transform of what is read from r.
+	Decode(r io.Reader) (io.ReadCloser, error)
+}
+
+var stages = map[string]Stage{}
+
+// Register makes a stage available to Parse and Lookup by its name.
+func Register(s Stage) {
+	stages[s.Name()] = s
+}
+
+func init() {
+	Register(gzipStage{})
+}
+
+// Names returns the names of the stages available, sorted.
+func Names() []string {
+	names := make([]string, 0, len(stages))
+	for name := range stages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Pipeline is an ordered list of stages, the first applied first.
+type Pipeline []Stage
+
+// Parse returns the pipeline of the comma separated stage names in spec,
+// such as "gzip". An empty spec is an empty pipeline.
+func Parse(spec string) (Pipeline, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	return Lookup(strings.Split(spec, ","))
+}
+
+// Lookup returns the pipeline of the given stage names, as recorded in the
+// metadata of a file.
+func Lookup(names []string) (Pipeline, error) {
+	p := make(Pipeline, 0, len(names))
+	for _, name := range names {
+		s, ok := stages[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown pipeline stage %q (available: %s)", name, strings.Join(Names(), ", "))
+		}
+		p = append(p, s)
+	}
+	return p, nil
+}
+
+// Names returns the names of the stages of the pipeline, in order.
+func (p Pipeline) Names() []string {
+	if len(p) == 0 {
+		return nil
+	}
+	names := make([]string, len(p))
+	for i, s := range p {
+		names[i] = s.Name()
+	}
+	return names
+}
+
+// Encode returns a writer passing what is written to it through every stage
+// in order, into w. It must be closed to flush the stages; w is left open.
+func (p Pipeline) Encode(w io.Writer) (io.WriteCloser, error) {
+	if len(p) == 0 {
+		return nopWriteCloser{w}, nil
+	}
+	var chain writers
+	for i := len(p) - 1; i >= 0; i-- {
+		sw, err := p[i].Encode(w)
+		if err != nil {
+			chain.Close()
+			return nil, fmt.Errorf("%s: %w", p[i].Name(), err)
+		}
+		// The first stage is written to, and closed, first
+		chain = append(writers{sw}, chain...)
+		w = sw
+	}
+	return chain, nil
+}
+
+// Decode returns a reader undoing every stage of the pipeline, the last
+// first, on what is read from r. Closing it doesn't close r.
+func (p Pipeline) Decode(r io.Reader) (io.ReadCloser, error) {
+	if len(p) == 0 {
+		return io.NopCloser(r), nil
+	}
+	var chain readers
+	for i := len(p) - 1; i >= 0; i-- {
+		sr, err := p[i].Decode(r)
+		if err != nil {
+			chain.Close()
+			return nil, fmt.Errorf("%s: %w", p[i].Name(), err)
+		}
+		chain = append(chain, sr)
+		r = sr
+	}
+	return chain, nil
+}
+
+// writers are the writers of the stages of a pipeline, the first stage first.
+type writers []io.WriteCloser
+
+func (ws writers) Write(b []byte) (int, error) {
+	return ws[0].Write(b)
+}
+
+func (ws writers) Close() error {
+	var first error
+	for _, w := range ws {
+		if err := w.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// readers are the readers of the stages of a pipeline, the first stage last.
+type readers []io.ReadCloser
+
+func (rs readers) Read(b []byte) (int, error) {
+	return rs[len(rs)-1].Read(b)
+}
+
+func (rs readers) Close() error {
+	var first error
+	for i := len(rs) - 1; i >= 0; i-- {
+		if err := rs[i].Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// gzipStage compresses the content with gzip.
+type gzipStage struct{}
+
+func (gzipStage) Name() string { return "gzip" }
+
+func (gzipStage) Encode(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipStage) Decode(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
@@ -0,0 +1,105 @@
+// Package promfile writes metrics in the Prometheus text exposition format,
+// to files read by the textfile collector of node_exporter.
+package promfile
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Metric is a single sample, along with the description of its family.
+// Samples of the same family must be consecutive and share Help and Type.
+type Metric struct {
+	Name   string
+	Help   string
+	Type   string // gauge or counter
+	Labels map[string]string
+	Value  float64
+}
+
+// Write replaces the file at path with the given metrics. The file is
+// written aside and renamed, so that the collector never reads it half written.
+func Write(path string, metrics []Metric) error {
+	var b strings.Builder
+	family := ""
+	for _, m := range metrics {
+		if m.Name != family {
+			family = m.Name
+			fmt.Fprintf(&b, "# HELP %s %s\n", m.Name, m.Help)
+			fmt.Fprintf(&b, "# TYPE %s %s\n", m.Name, m.Type)
+		}
+		b.WriteString(m.Name)
+		if len(m.Labels) > 0 {
+			keys := make([]string, 0, len(m.Labels))
+			for k := range m.Labels {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			pairs := make([]string, 0, len(keys))
+			for _, k := range keys {
+				pairs = append(pairs, fmt.Sprintf("%s=%s", k, strconv.Quote(m.Labels[k])))
+			}
+			b.WriteString("{" + strings.Join(pairs, ",") + "}")
+		}
+		fmt.Fprintf(&b, " %s\n", strconv.FormatFloat(m.Value, 'g', -1, 64))
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+	// CreateTemp restricts the file to its owner, the collector may run as another user
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+	return nil
+}
+
+// Read returns the value of the first sample of the named family in the file
+// at path. A missing file or family yields false.
+func Read(path, name string) (float64, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Label values may hold spaces, the value never does
+		i := strings.LastIndex(line, " ")
+		if i < 0 {
+			continue
+		}
+		series, value := line[:i], line[i+1:]
+		if family, _, _ := strings.Cut(series, "{"); family != name {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return 0, false
+		}
+		return v, true
+	}
+	return 0, false
+}
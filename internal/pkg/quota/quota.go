@@ -0,0 +1,164 @@
+// Package quota counts the bytes uploaded by the account every day, across
+// runs, so that uploads can be held back before reaching volumes Telegram
+// may take for abuse of the account.
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"tg-blobsync/internal/pkg/clock"
+)
+
+// keepDays is the number of days whose counts are kept in the file.
+const keepDays = 31
+
+// Counter counts the bytes uploaded every day in a file shared by all the
+// runs of the account, warning once the soft limit is passed and refusing
+// uploads beyond the hard one. Zero limits don't limit anything, and a nil
+// Counter doesn't count anything. It is safe for concurrent use.
+type Counter struct {
+	mu     sync.Mutex
+	path   string
+	soft   int64
+	hard   int64
+	days   map[string]int64 // bytes uploaded per day, YYYY-MM-DD in local time
+	warned bool
+	clock  clock.Clock
+}
+
+// Open loads the counts saved at path. A missing or unreadable file counts
+// nothing uploaded yet.
+func Open(path string, soft, hard int64) (*Counter, error) {
+	c := &Counter{path: path, soft: soft, hard: hard, clock: clock.Real}
+	days, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	c.days = days
+	return c, nil
+}
+
+// SetClock sets the clock telling the day uploads are counted on.
+func (c *Counter) SetClock(clk clock.Clock) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock = clk
+}
+
+func (c *Counter) load() (map[string]int64, error) {
+	days := make(map[string]int64)
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return days, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload counts: %w", err)
+	}
+	if err := json.Unmarshal(data, &days); err != nil {
+		log.Printf("[!] Warning: discarding unreadable upload counts %s: %v", c.path, err)
+		return make(map[string]int64), nil
+	}
+	return days, nil
+}
+
+func (c *Counter) today() string {
+	return c.clock.Now().Format("2006-01-02")
+}
+
+// Today returns the bytes uploaded today.
+func (c *Counter) Today() int64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.days[c.today()]
+}
+
+// Limits returns the soft and hard limits.
+func (c *Counter) Limits() (soft, hard int64) {
+	if c == nil {
+		return 0, 0
+	}
+	return c.soft, c.hard
+}
+
+// Fits reports whether n more bytes can be uploaded today without passing
+// the hard limit.
+func (c *Counter) Fits(n int64) bool {
+	if c == nil || c.hard <= 0 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.days[c.today()]+n <= c.hard
+}
+
+// Add counts n bytes uploaded today, saving the counts. The counts of
+// the other runs since the last save are merged in first.
+func (c *Counter) Add(n int64) {
+	if c == nil || n <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	today := c.today()
+	if days, err := c.load(); err == nil {
+		c.days = days
+	}
+	c.days[today] += n
+	if err := c.save(); err != nil {
+		log.Printf("[!] Warning: failed to save upload counts: %v", err)
+	}
+
+	if used := c.days[today]; c.soft > 0 && used > c.soft && !c.warned {
+		c.warned = true
+		log.Printf("[!] Uploaded %s today, over the soft limit of %s", formatSize(used), formatSize(c.soft))
+	}
+}
+
+// save writes the counts of the last keepDays days.
+func (c *Counter) save() error {
+	days := make([]string, 0, len(c.days))
+	for day := range c.days {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	for _, day := range days[:max(len(days)-keepDays, 0)] {
+		delete(c.days, day)
+	}
+
+	data, err := json.Marshal(c.days)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+func formatSize(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "KMGTPE"[exp])
+}
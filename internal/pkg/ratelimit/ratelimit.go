@@ -0,0 +1,68 @@
+// Package ratelimit limits the combined throughput of concurrent transfers.
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"tg-blobsync/internal/pkg/clock"
+)
+
+// burst is how long unused capacity is kept, so that short pauses between
+// transfers don't push the average below the limit.
+const burst = time.Second
+
+// Limiter shares a throughput limit among concurrent transfers. A nil
+// Limiter doesn't limit anything.
+type Limiter struct {
+	mu    sync.Mutex
+	rate  float64   // bytes per second
+	next  time.Time // when the bytes reserved so far are within the limit
+	clock clock.Clock
+}
+
+// New returns a limiter of bytesPerSecond, or nil when it is not positive.
+func New(bytesPerSecond int64) *Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &Limiter{rate: float64(bytesPerSecond), clock: clock.Real}
+}
+
+// SetClock sets the clock the limit is measured and waited on.
+func (l *Limiter) SetClock(c clock.Clock) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clock = c
+}
+
+// Wait blocks until n more bytes can be transferred within the limit.
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	clk := l.clock
+	now := clk.Now()
+	if l.next.Before(now.Add(-burst)) {
+		l.next = now.Add(-burst)
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	wait := l.next.Sub(now)
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-clk.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
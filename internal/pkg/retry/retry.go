@@ -5,32 +5,93 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"math/rand/v2"
+	"sync"
 	"time"
+
+	"tg-blobsync/internal/pkg/clock"
+
+	"github.com/gotd/td/tgerr"
+)
+
+// maxFloodWaits bounds the number of FLOOD_WAITs slept on per operation.
+// They don't count as failed attempts.
+const maxFloodWaits = 10
+
+var (
+	notifierMu   sync.RWMutex
+	waitNotifier func(wait time.Duration)
+
+	// clk and random drive the delays, see SetClock and SetRand
+	sourceMu sync.Mutex
+	clk      clock.Clock = clock.Real
+	random   *rand.Rand
 )
 
 // Operation represents a function that can be retried.
 type Operation func() error
 
-// WithRetry executes the given operation with exponential backoff.
+// SetWaitNotifier sets a function informed whenever an operation is paused
+// for a FLOOD_WAIT, so that the UI doesn't appear frozen in the meantime.
+func SetWaitNotifier(notify func(wait time.Duration)) {
+	notifierMu.Lock()
+	defer notifierMu.Unlock()
+	waitNotifier = notify
+}
+
+// SetClock sets the clock the delays between attempts are waited on.
+func SetClock(c clock.Clock) {
+	sourceMu.Lock()
+	defer sourceMu.Unlock()
+	clk = c
+}
+
+// SetRand sets the source of the jitter of the delays, for a fixed seed to
+// give a fixed schedule; nil restores the default source.
+func SetRand(r *rand.Rand) {
+	sourceMu.Lock()
+	defer sourceMu.Unlock()
+	random = r
+}
+
+// Jitter extends d by a random amount of up to a tenth of it plus half a
+// second, so that workers paused together don't resume together.
+func Jitter(d time.Duration) time.Duration {
+	n := int64(d/10 + 500*time.Millisecond)
+	sourceMu.Lock()
+	defer sourceMu.Unlock()
+	if random != nil {
+		return d + time.Duration(random.Int64N(n))
+	}
+	return d + time.Duration(rand.Int64N(n))
+}
+
+// Backoff returns the delay before the given attempt, from the second one:
+// baseDelay, doubled at every attempt after it, before Jitter.
+func Backoff(attempt int, baseDelay time.Duration) time.Duration {
+	return time.Duration(math.Pow(2, float64(attempt-2))) * baseDelay
+}
+
+// after waits d on the clock set by SetClock.
+func after(d time.Duration) <-chan time.Time {
+	sourceMu.Lock()
+	c := clk
+	sourceMu.Unlock()
+	return c.After(d)
+}
+
+// WithRetry executes the given operation with exponential backoff. When
+// Telegram answers with a FLOOD_WAIT, the operation is repeated after the
+// mandated duration instead.
 func WithRetry(ctx context.Context, name string, op Operation, maxRetries int, baseDelay time.Duration) error {
 	var lastErr error
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		if attempt > 1 {
-			delay := time.Duration(math.Pow(2, float64(attempt-2))) * baseDelay
-			log.Printf("[!] Retry %d/%d for %s after %v...", attempt, maxRetries, name, delay)
-			select {
-			case <-time.After(delay):
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-		}
-
+	floodWaits := 0
+	for attempt := 1; attempt <= maxRetries; {
 		err := op()
 		if err == nil {
 			return nil
 		}
 		lastErr = err
-		log.Printf("[!] Error during %s (attempt %d/%d): %v", name, attempt, maxRetries, err)
 
 		// Don't retry if the parent context is cancelled or deadline exceeded.
 		// If the error is context.Canceled but ctx.Err() is nil, it means
@@ -38,6 +99,38 @@ func WithRetry(ctx context.Context, name string, op Operation, maxRetries int, b
 		if ctx.Err() != nil {
 			return ctx.Err()
 		}
+
+		var delay time.Duration
+		if wait, ok := tgerr.AsFloodWait(err); ok && floodWaits < maxFloodWaits {
+			floodWaits++
+			delay = Jitter(wait)
+			notifyWait(name, delay)
+		} else {
+			log.Printf("[!] Error during %s (attempt %d/%d): %v", name, attempt, maxRetries, err)
+			if attempt == maxRetries {
+				break
+			}
+			attempt++
+			delay = Jitter(Backoff(attempt, baseDelay))
+			log.Printf("[!] Retry %d/%d for %s after %v...", attempt, maxRetries, name, delay.Round(time.Millisecond))
+		}
+
+		select {
+		case <-after(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 	return fmt.Errorf("%s failed after %d attempts: %w", name, maxRetries, lastErr)
 }
+
+func notifyWait(name string, wait time.Duration) {
+	notifierMu.RLock()
+	notify := waitNotifier
+	notifierMu.RUnlock()
+	if notify != nil {
+		notify(wait)
+	} else {
+		log.Printf("[!] Rate limited during %s, retrying in %v", name, wait.Round(time.Second))
+	}
+}
@@ -0,0 +1,215 @@
+package usecase
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/retry"
+	"time"
+)
+
+// maxAdoptedCaption is the length of the original captions kept as a tag by
+// adopt; longer ones would not fit in the metadata.
+const maxAdoptedCaption = 200
+
+// Adopter brings the documents sent to a topic by other means, which carry
+// no metadata, into the files synced by the tool.
+type Adopter struct {
+	storage  domain.BlobStorage
+	skipMD5  bool
+	mapping  map[string]AdoptTarget
+	prompter domain.AdoptPrompter
+}
+
+func NewAdopter(storage domain.BlobStorage, skipMD5 bool) *Adopter {
+	return &Adopter{
+		storage: storage,
+		skipMD5: skipMD5,
+	}
+}
+
+// AdoptTarget is the metadata given to an adopted document. Zero fields
+// keep the defaults of Adopt.
+type AdoptTarget struct {
+	Path    string            `json:"path"`
+	ModTime int64             `json:"mtime,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
+// UnmarshalJSON also accepts a plain string, as the path.
+func (t *AdoptTarget) UnmarshalJSON(data []byte) error {
+	var p string
+	if err := json.Unmarshal(data, &p); err == nil {
+		*t = AdoptTarget{Path: p}
+		return nil
+	}
+	type plain AdoptTarget
+	return json.Unmarshal(data, (*plain)(t))
+}
+
+// LoadAdoptMapping reads a mapping file for SetMapping: a JSON object whose
+// keys are message IDs or document file names, and whose values are paths
+// or AdoptTarget objects.
+func LoadAdoptMapping(file string) (map[string]AdoptTarget, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mapping: %w", err)
+	}
+	var mapping map[string]AdoptTarget
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("invalid mapping %s: %w", file, err)
+	}
+	return mapping, nil
+}
+
+// SetMapping makes Adopt give the documents the metadata of their entry in
+// mapping, by message ID first and by file name otherwise. Documents without
+// an entry, or with an empty path, are left alone.
+func (a *Adopter) SetMapping(mapping map[string]AdoptTarget) {
+	a.mapping = mapping
+}
+
+// SetPrompter makes Adopt ask the path of every document, when there is no
+// mapping.
+func (a *Adopter) SetPrompter(prompter domain.AdoptPrompter) {
+	a.prompter = prompter
+}
+
+// Adopt gives metadata to the documents of the topic without any: by
+// default their path is their file name under dir, their modification time
+// the date of their message, and their checksum is computed by downloading
+// them unless MD5 is skipped. A plain text caption is kept as the "caption"
+// tag.
+func (a *Adopter) Adopt(ctx context.Context, groupID, topicID int64, dir string) error {
+	dir = strings.Trim(path.Clean("/"+strings.ReplaceAll(dir, "\\", "/")), "/")
+
+	messages, err := a.storage.ListMessages(ctx, groupID, topicID)
+	if err != nil {
+		return fmt.Errorf("failed to list messages: %w", err)
+	}
+
+	taken := make(map[string]bool)
+	for _, m := range messages {
+		if m.Meta != nil {
+			taken[m.Meta.Path] = true
+		}
+	}
+
+	adopted := 0
+	for _, m := range messages {
+		// Malformed metadata is left to fsck
+		if m.Meta != nil || strings.HasPrefix(strings.TrimSpace(m.Caption), "{") {
+			continue
+		}
+		target, ok, err := a.target(m, dir)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		p := strings.Trim(path.Clean("/"+strings.ReplaceAll(target.Path, "\\", "/")), "/")
+		if p == "" || unsafePath(p) {
+			log.Printf("[!] Skipping message %d: invalid path %q", m.ID, target.Path)
+			continue
+		}
+		if taken[p] {
+			log.Printf("[!] Skipping message %d: %s is already taken, rename the document first", m.ID, p)
+			continue
+		}
+
+		meta := domain.FileMeta{Path: p, ModTime: m.Date, Tags: target.Tags}
+		if target.ModTime > 0 {
+			meta.ModTime = target.ModTime
+		}
+		if caption := strings.TrimSpace(m.Caption); caption != "" && len(caption) <= maxAdoptedCaption {
+			if meta.Tags == nil {
+				meta.Tags = make(map[string]string)
+			}
+			if _, set := meta.Tags["caption"]; !set {
+				meta.Tags["caption"] = caption
+			}
+		}
+		if !a.skipMD5 {
+			meta.Checksum, err = messageChecksum(ctx, a.storage, groupID, topicID, m, p)
+			if err != nil {
+				return fmt.Errorf("failed to checksum %s: %w", p, err)
+			}
+		}
+
+		if err := a.storage.UpdateFileMeta(ctx, groupID, topicID, domain.RemoteFile{MessageID: m.ID}, meta); err != nil {
+			return fmt.Errorf("failed to adopt %s: %w", p, err)
+		}
+		taken[p] = true
+		adopted++
+		log.Printf("[+] Adopted: %s (message %d)", p, m.ID)
+	}
+
+	log.Printf("Adopted %d documents", adopted)
+	return nil
+}
+
+// target returns the metadata to give a document: its entry in the mapping,
+// if set, or its file name under dir, confirmed by the prompter, if set.
+// False means that the document is left alone.
+func (a *Adopter) target(m domain.RemoteMessage, dir string) (AdoptTarget, bool, error) {
+	if a.mapping != nil {
+		target, ok := a.mapping[strconv.Itoa(m.ID)]
+		if !ok && m.FileName != "" {
+			target, ok = a.mapping[m.FileName]
+		}
+		if !ok || target.Path == "" {
+			log.Printf("[*] Skipping message %d (%s): not in the mapping", m.ID, orDash(m.FileName))
+			return AdoptTarget{}, false, nil
+		}
+		return target, true, nil
+	}
+
+	var proposed string
+	if m.FileName != "" {
+		proposed = path.Join(dir, path.Base(strings.ReplaceAll(m.FileName, "\\", "/")))
+	}
+	if a.prompter != nil {
+		p, err := a.prompter.PromptAdoptPath(m, proposed)
+		if err != nil {
+			return AdoptTarget{}, false, err
+		}
+		proposed = p
+	}
+	if proposed == "" {
+		if m.FileName == "" {
+			log.Printf("[!] Skipping message %d: document without a file name", m.ID)
+		}
+		return AdoptTarget{}, false, nil
+	}
+	return AdoptTarget{Path: proposed}, true, nil
+}
+
+// messageChecksum downloads the document of a message and returns its MD5.
+func messageChecksum(ctx context.Context, storage domain.BlobStorage, groupID, topicID int64, m domain.RemoteMessage, name string) (string, error) {
+	var sum string
+	err := retry.WithRetry(ctx, "Checksum: "+name, func() error {
+		rc, err := storage.DownloadFile(ctx, groupID, topicID, m.ID, name, m.Size, 0)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		h := md5.New()
+		if _, err := io.Copy(h, rc); err != nil {
+			return err
+		}
+		sum = hex.EncodeToString(h.Sum(nil))
+		return nil
+	}, 5, 1*time.Second)
+	return sum, err
+}
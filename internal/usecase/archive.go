@@ -0,0 +1,264 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"tg-blobsync/internal/domain"
+	"time"
+)
+
+// Archiver moves old local files to remote-only storage and brings them back.
+type Archiver struct {
+	fs      domain.FileSystem
+	storage domain.BlobStorage
+	workers int
+	ui      domain.UserInterface
+	skipMD5 bool
+	subDir  string
+}
+
+func NewArchiver(
+	fs domain.FileSystem,
+	storage domain.BlobStorage,
+	workers int,
+	ui domain.UserInterface,
+	skipMD5 bool,
+) *Archiver {
+	return &Archiver{
+		fs:      fs,
+		storage: storage,
+		workers: workers,
+		ui:      ui,
+		skipMD5: skipMD5,
+	}
+}
+
+func (a *Archiver) SetSubDir(subDir string) {
+	a.subDir = subDir
+}
+
+// Archive uploads the local files not modified for more than olderThan,
+// marks their remote copy as archived and deletes them locally.
+// A local file is only deleted once its remote copy is confirmed up to date
+// and flagged, so that a later push never prunes it.
+func (a *Archiver) Archive(ctx context.Context, rootDir string, groupID, topicID int64, olderThan time.Duration) error {
+	log.Println("Starting archive...")
+
+	scanner := NewScanner(a.fs, a.storage, a.subDir, a.skipMD5)
+
+	localFiles, err := scanner.ScanLocal(rootDir)
+	if err != nil {
+		return err
+	}
+
+	remoteFiles, err := scanner.ScanRemote(ctx, groupID, topicID)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-olderThan).Unix()
+	candidates := make(map[string]domain.LocalFile)
+	for path, f := range localFiles {
+		if f.ModTime < cutoff {
+			candidates[path] = f
+		}
+	}
+
+	if len(candidates) == 0 {
+		log.Println("Nothing to archive.")
+		return nil
+	}
+
+	// Upload what is missing or outdated remotely, never pruning anything
+	d := &differ{skipMD5: a.skipMD5}
+	var uploads domain.SyncPlan
+	for _, item := range d.DiffPush(candidates, remoteFiles).Items {
+		if item.Action != domain.ActionUpload {
+			continue
+		}
+		uploads.Items = append(uploads.Items, item)
+		if item.RemoteFile != nil {
+			uploads.Summary.ToUpdate++
+		} else {
+			uploads.Summary.ToUpload++
+		}
+	}
+	uploads.Summary.Total = len(uploads.Items)
+
+	// The confirmation covers the local deletions as well
+	confirmPlan := uploads
+	for path, f := range candidates {
+		confirmPlan.Items = append(confirmPlan.Items, domain.SyncItem{
+			Path:      path,
+			Action:    domain.ActionDeleteLocal,
+			LocalFile: &f,
+			Reason:    domain.ReasonArchived,
+		})
+		confirmPlan.Summary.ToDelete++
+	}
+	confirmPlan.Summary.Total = len(confirmPlan.Items)
+
+	log.Printf("Archive Summary:")
+	log.Printf("  Candidates:   %d", len(candidates))
+	log.Printf("  To Upload:    %d", uploads.Summary.ToUpload)
+	log.Printf("  To Update:    %d", uploads.Summary.ToUpdate)
+
+	if a.ui != nil {
+		confirmed, err := a.ui.ConfirmSync(confirmPlan)
+		if err != nil {
+			return err
+		}
+		if !confirmed {
+			log.Println("Archive cancelled by user.")
+			return nil
+		}
+	}
+
+	var ui domain.UserInterface
+	if a.ui != nil {
+		ui = preconfirmedUI{a.ui}
+	}
+	executor := NewExecutor(a.fs, a.storage, a.workers, ui)
+	executor.SetScope(a.subDir)
+	if err := executor.Execute(ctx, uploads, rootDir, groupID, topicID); err != nil {
+		return err
+	}
+
+	// Re-list to pick up the messages just uploaded
+	remoteFiles, err = scanner.ScanRemote(ctx, groupID, topicID)
+	if err != nil {
+		return err
+	}
+
+	archived := 0
+	deleteLocal := func(path string) {
+		log.Printf("[-] Archived: %s", path)
+		if err := a.fs.DeleteFile(filepath.Join(rootDir, path)); err != nil {
+			log.Printf("Error deleting archived file %s: %v", path, err)
+			return
+		}
+		archived++
+	}
+
+	// Packed files are flagged together once their packs are rewritten
+	var edits packEdits
+	var packed []string
+	for path, localFile := range candidates {
+		remoteFile, ok := remoteFiles[path]
+		if !ok || d.shouldUpdate(localFile, remoteFile) {
+			log.Printf("[!] Warning: remote copy of %s not confirmed, keeping it locally", path)
+			continue
+		}
+
+		meta := remoteFile.Meta
+		meta.SetFlag(domain.FlagArchived)
+		if remoteFile.Pack != nil {
+			edits.Update(remoteFile, meta)
+			packed = append(packed, path)
+			continue
+		}
+		if err := a.storage.UpdateFileMeta(ctx, groupID, topicID, remoteFile, meta); err != nil {
+			log.Printf("[!] Warning: failed to mark %s as archived, keeping it locally: %v", path, err)
+			continue
+		}
+		deleteLocal(path)
+	}
+
+	if err := edits.Apply(ctx, a.storage, groupID, topicID); err != nil {
+		log.Printf("[!] Warning: failed to mark packed files as archived, keeping them locally: %v", err)
+	} else {
+		for _, path := range packed {
+			deleteLocal(path)
+		}
+	}
+
+	log.Printf("Archived %d of %d files.", archived, len(candidates))
+	return nil
+}
+
+// Recall downloads the archived files at path (a file or a virtual
+// directory; empty for everything) and clears their archived flag.
+func (a *Archiver) Recall(ctx context.Context, rootDir string, groupID, topicID int64, path string) error {
+	log.Println("Starting recall...")
+
+	scanner := NewScanner(a.fs, a.storage, a.subDir, a.skipMD5)
+
+	remoteFiles, err := scanner.ScanRemote(ctx, groupID, topicID)
+	if err != nil {
+		return err
+	}
+
+	prefix := strings.Trim(filepath.ToSlash(path), "/")
+
+	var plan domain.SyncPlan
+	for p, f := range remoteFiles {
+		if !f.Meta.HasFlag(domain.FlagArchived) {
+			continue
+		}
+		if prefix != "" && p != prefix && !strings.HasPrefix(p, prefix+"/") {
+			continue
+		}
+		plan.Items = append(plan.Items, domain.SyncItem{
+			Path:       p,
+			Action:     domain.ActionDownload,
+			RemoteFile: &f,
+			Reason:     domain.ReasonRecalled,
+		})
+		plan.Summary.ToDownload++
+	}
+	plan.Summary.Total = len(plan.Items)
+
+	if plan.Summary.Total == 0 {
+		return fmt.Errorf("no archived files found at %q", path)
+	}
+
+	if a.ui != nil {
+		confirmed, err := a.ui.ConfirmSync(plan)
+		if err != nil {
+			return err
+		}
+		if !confirmed {
+			log.Println("Recall cancelled by user.")
+			return nil
+		}
+	}
+
+	var ui domain.UserInterface
+	if a.ui != nil {
+		ui = preconfirmedUI{a.ui}
+	}
+	executor := NewExecutor(a.fs, a.storage, a.workers, ui)
+	executor.SetScope(a.subDir)
+	if err := executor.Execute(ctx, plan, rootDir, groupID, topicID); err != nil {
+		return err
+	}
+
+	var edits packEdits
+	for _, item := range plan.Items {
+		meta := item.RemoteFile.Meta
+		meta.ClearFlag(domain.FlagArchived)
+		if item.RemoteFile.Pack != nil {
+			edits.Update(*item.RemoteFile, meta)
+			continue
+		}
+		if err := a.storage.UpdateFileMeta(ctx, groupID, topicID, *item.RemoteFile, meta); err != nil {
+			log.Printf("[!] Warning: failed to clear archived flag of %s: %v", item.Path, err)
+		}
+	}
+	if err := edits.Apply(ctx, a.storage, groupID, topicID); err != nil {
+		log.Printf("[!] Warning: failed to clear archived flag of packed files: %v", err)
+	}
+	return nil
+}
+
+// preconfirmedUI wraps a UserInterface whose plan has already been confirmed.
+type preconfirmedUI struct {
+	domain.UserInterface
+}
+
+func (u preconfirmedUI) ConfirmSync(plan domain.SyncPlan) (bool, error) {
+	return true, nil
+}
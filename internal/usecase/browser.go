@@ -2,17 +2,27 @@ package usecase
 
 import (
 	"context"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
 	"tg-blobsync/internal/domain"
+	"time"
 )
 
 type FileBrowser interface {
 	ListAndBrowse(ctx context.Context, groupID, topicID int64) error
+	ListTo(ctx context.Context, w io.Writer, groupID, topicID int64, format string) error
+	SetTagFilter(filter map[string]string)
 }
 
 type browser struct {
-	storage domain.BlobStorage
-	ui      BrowseUI
+	storage   domain.BlobStorage
+	ui        BrowseUI
+	tagFilter map[string]string
 }
 
 // BrowseUI defines the interface required by the browser use case for interaction
@@ -27,15 +37,96 @@ func NewBrowser(storage domain.BlobStorage, ui BrowseUI) FileBrowser {
 	}
 }
 
+// SetTagFilter restricts the listing to files carrying all the given tags.
+func (b *browser) SetTagFilter(filter map[string]string) {
+	b.tagFilter = filter
+}
+
 func (b *browser) ListAndBrowse(ctx context.Context, groupID, topicID int64) error {
-	files, err := b.storage.ListFiles(ctx, groupID, topicID)
+	files, err := b.list(ctx, groupID, topicID)
 	if err != nil {
-		return fmt.Errorf("failed to list files: %w", err)
+		return err
 	}
-
 	if len(files) == 0 {
 		return fmt.Errorf("no files found in this topic")
 	}
 
 	return b.ui.BrowseFiles(files)
 }
+
+// ListTo writes the listing to w instead of browsing it, sorted by path, in
+// the given format: table, json or csv. Each file comes with its size,
+// checksum, modification time and message ID.
+func (b *browser) ListTo(ctx context.Context, w io.Writer, groupID, topicID int64, format string) error {
+	files, err := b.list(ctx, groupID, topicID)
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Meta.Path < files[j].Meta.Path
+	})
+
+	switch format {
+	case "json":
+		entries := make([]listEntry, 0, len(files))
+		for _, f := range files {
+			entries = append(entries, newListEntry(f))
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"path", "size", "checksum", "mtime", "message_id"})
+		for _, f := range files {
+			e := newListEntry(f)
+			cw.Write([]string{e.Path, strconv.FormatInt(e.Size, 10), e.Checksum, e.ModTime.Format(time.RFC3339), strconv.Itoa(e.MessageID)})
+		}
+		cw.Flush()
+		return cw.Error()
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "PATH\tSIZE\tCHECKSUM\tMODIFIED\tMESSAGE")
+		for _, f := range files {
+			e := newListEntry(f)
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\n", e.Path, formatSize(e.Size), orDash(e.Checksum), e.ModTime.Format("2006-01-02 15:04"), e.MessageID)
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown listing format: %s", format)
+}
+
+// list returns the remote files of the topic passing the tag filter.
+func (b *browser) list(ctx context.Context, groupID, topicID int64) ([]domain.RemoteFile, error) {
+	files, err := b.storage.ListFiles(ctx, groupID, topicID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	filtered := files[:0]
+	for _, f := range files {
+		if !isSnapshot(f) && f.Meta.MatchesTags(b.tagFilter) {
+			filtered = append(filtered, f)
+		}
+	}
+	return filtered, nil
+}
+
+// listEntry is a file of a listing written by ListTo.
+type listEntry struct {
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	Checksum  string    `json:"checksum,omitempty"`
+	ModTime   time.Time `json:"mtime"`
+	MessageID int       `json:"message_id"`
+}
+
+func newListEntry(f domain.RemoteFile) listEntry {
+	return listEntry{
+		Path:      f.Meta.Path,
+		Size:      f.ContentSize(),
+		Checksum:  f.Meta.Checksum,
+		ModTime:   time.Unix(f.Meta.ModTime, 0),
+		MessageID: f.MessageID,
+	}
+}
@@ -0,0 +1,193 @@
+package usecase
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/checksum"
+	"tg-blobsync/internal/pkg/pipeline"
+)
+
+// openRemote returns a reader over the whole content of a remote file,
+// transparently reassembling chunked files and extracting packed ones.
+func openRemote(ctx context.Context, storage domain.BlobStorage, groupID, topicID int64, file *domain.RemoteFile) (io.ReadCloser, error) {
+	return openRemoteAt(ctx, storage, groupID, topicID, file, 0)
+}
+
+// openRemoteAt is like openRemote, but skips the first offset bytes of the
+// content. Packed files, and those whose content went through a pipeline,
+// can only be read from the start.
+func openRemoteAt(ctx context.Context, storage domain.BlobStorage, groupID, topicID int64, file *domain.RemoteFile, offset int64) (io.ReadCloser, error) {
+	if len(file.Meta.Pipeline) == 0 {
+		return openStored(ctx, storage, groupID, topicID, file, offset)
+	}
+	if offset != 0 {
+		return nil, fmt.Errorf("cannot resume transformed file %s", file.Meta.Path)
+	}
+	p, err := pipeline.Lookup(file.Meta.Pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", file.Meta.Path, err)
+	}
+	rc, err := openStored(ctx, storage, groupID, topicID, file, 0)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := p.Decode(rc)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("cannot read %s: %w", file.Meta.Path, err)
+	}
+	return decodedReader{ReadCloser: decoded, stored: rc}, nil
+}
+
+// decodedReader reads the content of a file through its pipeline, closing
+// the stored content along with the pipeline.
+type decodedReader struct {
+	io.ReadCloser
+	stored io.Closer
+}
+
+func (r decodedReader) Close() error {
+	err := r.ReadCloser.Close()
+	if storedErr := r.stored.Close(); err == nil {
+		err = storedErr
+	}
+	return err
+}
+
+// openStored returns a reader over the content of a remote file as stored,
+// skipping its first offset bytes.
+func openStored(ctx context.Context, storage domain.BlobStorage, groupID, topicID int64, file *domain.RemoteFile, offset int64) (io.ReadCloser, error) {
+	if file.Pack != nil {
+		if offset != 0 {
+			return nil, fmt.Errorf("cannot resume packed file %s", file.Meta.Path)
+		}
+		return openPacked(ctx, storage, groupID, topicID, file)
+	}
+	if len(file.Chunks) == 0 {
+		return storage.DownloadFile(ctx, groupID, topicID, file.MessageID, file.Meta.Path, file.Size, offset)
+	}
+
+	// Skip the chunks entirely before offset
+	next := 0
+	var start int64
+	for next < len(file.Chunks) && offset >= file.Chunks[next].Size {
+		offset -= file.Chunks[next].Size
+		start += file.Chunks[next].Size
+		next++
+	}
+	return &chunkReader{
+		ctx:     ctx,
+		storage: storage,
+		groupID: groupID,
+		topicID: topicID,
+		file:    file,
+		next:    next,
+		offset:  offset,
+		start:   start,
+	}, nil
+}
+
+// partMismatchError is returned by a chunkReader reading a part whose
+// content doesn't match its checksum. The content read before the part is
+// fine: only the part needs to be downloaded again.
+type partMismatchError struct {
+	path     string
+	part     int
+	parts    int
+	offset   int64 // of the part in the stored content
+	got      string
+	expected string
+}
+
+func (e *partMismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch for part %d/%d of %s: got %s, expected %s", e.part+1, e.parts, e.path, e.got, e.expected)
+}
+
+// chunkReader streams the parts of a chunked remote file one after the other,
+// starting each download only when the previous part has been consumed.
+// Every part read from its start is checked against its checksum.
+type chunkReader struct {
+	ctx     context.Context
+	storage domain.BlobStorage
+	groupID int64
+	topicID int64
+	file    *domain.RemoteFile
+	next    int
+	offset  int64 // bytes to skip in the next chunk
+	start   int64 // offset of the next chunk in the stored content
+	current io.ReadCloser
+	hash    hash.Hash // of the current chunk, nil when not checked
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.next >= len(r.file.Chunks) {
+				return 0, io.EOF
+			}
+			chunk := r.file.Chunks[r.next]
+			name := fmt.Sprintf("%s [%d/%d]", r.file.Meta.Path, r.next+1, len(r.file.Chunks))
+			rc, err := r.storage.DownloadFile(r.ctx, r.groupID, r.topicID, chunk.MessageID, name, chunk.Size, r.offset)
+			if err != nil {
+				return 0, err
+			}
+			r.current = rc
+			r.hash = nil
+			if chunk.Checksum != "" && r.offset == 0 {
+				r.hash, _ = checksum.New(r.file.Meta.Algorithm)
+			}
+			r.next++
+			r.offset = 0
+		}
+
+		n, err := r.current.Read(p)
+		if r.hash != nil {
+			r.hash.Write(p[:n])
+		}
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if err := r.checkChunk(); err != nil {
+				return n, err
+			}
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// checkChunk compares the checksum of the chunk just read with the expected
+// one, and moves start past it.
+func (r *chunkReader) checkChunk() error {
+	chunk := r.file.Chunks[r.next-1]
+	start := r.start
+	r.start += chunk.Size
+	if r.hash == nil {
+		return nil
+	}
+	if sum := hex.EncodeToString(r.hash.Sum(nil)); sum != chunk.Checksum {
+		return &partMismatchError{
+			path:     r.file.Meta.Path,
+			part:     r.next - 1,
+			parts:    len(r.file.Chunks),
+			offset:   start,
+			got:      sum,
+			expected: chunk.Checksum,
+		}
+	}
+	return nil
+}
+
+func (r *chunkReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
@@ -1,16 +1,24 @@
 package usecase
 
 import (
+	"fmt"
 	"tg-blobsync/internal/domain"
+	"time"
 )
 
 type SyncDiffer interface {
 	DiffPush(local map[string]domain.LocalFile, remote map[string]domain.RemoteFile) domain.SyncPlan
 	DiffPull(local map[string]domain.LocalFile, remote map[string]domain.RemoteFile) domain.SyncPlan
+	SetDeleteGrace(grace time.Duration)
+	SetNoDelete(noDelete bool)
+	SetRetained(files []domain.RemoteFile)
 }
 
 type differ struct {
-	skipMD5 bool
+	skipMD5     bool
+	deleteGrace time.Duration
+	noDelete    bool
+	retained    []domain.RemoteFile
 }
 
 func NewDiffer(skipMD5 bool) SyncDiffer {
@@ -19,10 +27,38 @@ func NewDiffer(skipMD5 bool) SyncDiffer {
 	}
 }
 
+// SetDeleteGrace makes DiffPush mark the remote files deleted locally as
+// pending delete, and only delete them once they have been missing for grace.
+// A zero grace deletes them right away.
+func (d *differ) SetDeleteGrace(grace time.Duration) {
+	d.deleteGrace = grace
+}
+
+// SetNoDelete leaves out of the plans the files missing on the other side,
+// so that push and pull only ever add and update files.
+func (d *differ) SetNoDelete(noDelete bool) {
+	d.noDelete = noDelete
+}
+
+// SetRetained makes DiffPush reuse the content of the given old versions,
+// still stored, for the uploads with the same content as one of them, such
+// as a file reverted to a previous version.
+func (d *differ) SetRetained(files []domain.RemoteFile) {
+	d.retained = files
+}
+
 func (d *differ) DiffPush(local map[string]domain.LocalFile, remote map[string]domain.RemoteFile) domain.SyncPlan {
 	var items []domain.SyncItem
 	summary := domain.SyncSummary{}
 
+	duplicates := duplicateIndex(remote)
+	// The current files are reused first: old versions may be deleted
+	for _, f := range d.retained {
+		if _, ok := duplicates[f.Meta.Checksum]; !ok {
+			duplicates[f.Meta.Checksum] = f
+		}
+	}
+
 	// Check local files (Upload or Update)
 	for path, localFile := range local {
 		remoteFile, exists := remote[path]
@@ -34,14 +70,21 @@ func (d *differ) DiffPush(local map[string]domain.LocalFile, remote map[string]d
 
 		if !exists {
 			item.Action = domain.ActionUpload
-			item.Reason = "New file"
+			item.Reason = domain.ReasonNew
+			setSource(&item, duplicates)
 			items = append(items, item)
 			summary.ToUpload++
 		} else {
 			item.RemoteFile = &remoteFile
-			if d.shouldUpdate(localFile, remoteFile) {
+			if reason, detail := d.changed(localFile, remoteFile); reason != "" {
 				item.Action = domain.ActionUpload
-				item.Reason = "Changed"
+				item.Reason, item.Detail = reason, detail
+				setSource(&item, duplicates)
+				items = append(items, item)
+				summary.ToUpdate++
+			} else if remoteFile.Meta.HasFlag(domain.FlagPendingDelete) {
+				item.Action = domain.ActionUnmarkDeleted
+				item.Reason = domain.ReasonBackLocally
 				items = append(items, item)
 				summary.ToUpdate++
 			}
@@ -50,14 +93,15 @@ func (d *differ) DiffPush(local map[string]domain.LocalFile, remote map[string]d
 
 	// Check remote files (Delete)
 	for path, remoteFile := range remote {
+		// Archived files are remote-only by design
+		if remoteFile.Meta.HasFlag(domain.FlagArchived) {
+			continue
+		}
 		if _, exists := local[path]; !exists {
-			items = append(items, domain.SyncItem{
-				Path:       path,
-				Action:     domain.ActionDeleteRemote,
-				RemoteFile: &remoteFile,
-				Reason:     "Deleted locally",
-			})
-			summary.ToDelete++
+			if item, ok := d.deletion(path, remoteFile); ok {
+				items = append(items, item)
+				summary.ToDelete++
+			}
 		}
 	}
 
@@ -71,6 +115,11 @@ func (d *differ) DiffPull(local map[string]domain.LocalFile, remote map[string]d
 
 	// Check remote files (Download or Update)
 	for path, remoteFile := range remote {
+		// Archived files are only brought back by recall, and files pending
+		// delete are neither restored nor deleted locally
+		if remoteFile.Meta.HasFlag(domain.FlagArchived) || remoteFile.Meta.HasFlag(domain.FlagPendingDelete) {
+			continue
+		}
 		localFile, exists := local[path]
 
 		item := domain.SyncItem{
@@ -80,14 +129,14 @@ func (d *differ) DiffPull(local map[string]domain.LocalFile, remote map[string]d
 
 		if !exists {
 			item.Action = domain.ActionDownload
-			item.Reason = "New remote file"
+			item.Reason = domain.ReasonNewRemote
 			items = append(items, item)
 			summary.ToDownload++
 		} else {
 			item.LocalFile = &localFile
-			if d.shouldUpdate(localFile, remoteFile) {
+			if reason, detail := d.changed(localFile, remoteFile); reason != "" {
 				item.Action = domain.ActionDownload
-				item.Reason = "Changed remote"
+				item.Reason, item.Detail = reason, detail
 				items = append(items, item)
 				summary.ToUpdate++
 			}
@@ -96,12 +145,12 @@ func (d *differ) DiffPull(local map[string]domain.LocalFile, remote map[string]d
 
 	// Check local files (Delete)
 	for path, localFile := range local {
-		if _, exists := remote[path]; !exists {
+		if _, exists := remote[path]; !exists && !d.noDelete {
 			items = append(items, domain.SyncItem{
 				Path:      path,
 				Action:    domain.ActionDeleteLocal,
 				LocalFile: &localFile,
-				Reason:    "Deleted remotely",
+				Reason:    domain.ReasonDeletedRemotely,
 			})
 			summary.ToDelete++
 		}
@@ -111,15 +160,122 @@ func (d *differ) DiffPull(local map[string]domain.LocalFile, remote map[string]d
 	return domain.SyncPlan{Items: items, Summary: summary}
 }
 
+// deletion returns the item handling a remote file deleted locally, if any:
+// with a grace period, it is first marked pending delete and only deleted
+// by a later run, once the grace period is over.
+func (d *differ) deletion(path string, remoteFile domain.RemoteFile) (domain.SyncItem, bool) {
+	item := domain.SyncItem{
+		Path:       path,
+		Action:     domain.ActionDeleteRemote,
+		RemoteFile: &remoteFile,
+		Reason:     domain.ReasonDeletedLocally,
+	}
+	if d.noDelete {
+		return domain.SyncItem{}, false
+	}
+	if d.deleteGrace <= 0 {
+		return item, true
+	}
+	if !remoteFile.Meta.HasFlag(domain.FlagPendingDelete) {
+		item.Action = domain.ActionMarkDeleted
+		item.Reason = domain.ReasonPendingDelete
+		item.Detail = "deleted for good after " + d.deleteGrace.String()
+		return item, true
+	}
+	if time.Since(time.Unix(remoteFile.Meta.DeletedAt, 0)) < d.deleteGrace {
+		return domain.SyncItem{}, false
+	}
+	item.Reason = domain.ReasonGraceOver
+	item.Detail = "missing since " + formatTime(remoteFile.Meta.DeletedAt)
+	return item, true
+}
+
 func (d *differ) shouldUpdate(local domain.LocalFile, remote domain.RemoteFile) bool {
-	if d.skipMD5 {
-		remoteSize := remote.Size
-		if remote.Meta.Flags == "EMPTY_FILE" {
-			remoteSize = 0
-		}
+	reason, _ := d.changed(local, remote)
+	return reason != ""
+}
+
+// changed tells why a local file and its remote copy differ, along with the
+// detail of the difference. An empty reason means that they don't.
+func (d *differ) changed(local domain.LocalFile, remote domain.RemoteFile) (domain.SyncReason, string) {
+	remoteSize := remote.ContentSize()
+	if remote.Meta.HasFlag(domain.FlagEmptyFile) {
+		remoteSize = 0
+	}
+	sizes := fmt.Sprintf("local %s vs remote %s", formatSize(local.Size), formatSize(remoteSize))
+
+	// Files uploaded before --hash changed are compared as without checksums,
+	// until uploaded again
+	if d.skipMD5 || local.Algorithm != remote.Meta.Algorithm {
 		// Compare ModTime and Size
-		return remote.Meta.ModTime != local.ModTime || remoteSize != local.Size
+		if remoteSize != local.Size {
+			return domain.ReasonSize, sizes
+		}
+		if remote.Meta.ModTime != local.ModTime {
+			return domain.ReasonModTime, fmt.Sprintf("local %s vs remote %s", formatTime(local.ModTime), formatTime(remote.Meta.ModTime))
+		}
+		return "", ""
 	}
+
 	// Compare Checksum
-	return remote.Meta.Checksum != local.Checksum
+	if sameChecksum(local, remote) {
+		return "", ""
+	}
+	detail := fmt.Sprintf("local %s vs remote %s", shortChecksum(local.Checksum), shortChecksum(remote.Meta.Checksum))
+	if remoteSize != local.Size {
+		detail += ", size " + sizes
+	}
+	return domain.ReasonChecksum, detail
+}
+
+// sameChecksum reports whether a local file and a remote one have the same
+// checksum, of the same algorithm.
+func sameChecksum(local domain.LocalFile, remote domain.RemoteFile) bool {
+	return local.Algorithm == remote.Meta.Algorithm && local.Checksum == remote.Meta.Checksum
+}
+
+// shortChecksum abbreviates a checksum for display.
+func shortChecksum(checksum string) string {
+	if checksum == "" {
+		return "none"
+	}
+	if len(checksum) <= 8 {
+		return checksum
+	}
+	return checksum[:8] + "…"
+}
+
+// formatTime formats a Unix time for display.
+func formatTime(t int64) string {
+	return time.Unix(t, 0).Format("2006-01-02 15:04:05")
+}
+
+// duplicateIndex indexes by checksum the remote files whose documents can
+// be reused for a local file with the same content.
+func duplicateIndex(remote map[string]domain.RemoteFile) map[string]domain.RemoteFile {
+	index := make(map[string]domain.RemoteFile)
+	for _, f := range remote {
+		if f.Meta.Checksum == "" || f.Pack != nil || f.Meta.HasFlag(domain.FlagEmptyFile) {
+			continue
+		}
+		index[f.Meta.Checksum] = f
+	}
+	return index
+}
+
+// setSource makes an upload reuse a remote file with the same content, if any.
+func setSource(item *domain.SyncItem, duplicates map[string]domain.RemoteFile) {
+	if item.LocalFile.Checksum == "" {
+		return
+	}
+	source, ok := duplicates[item.LocalFile.Checksum]
+	if !ok || !sameChecksum(*item.LocalFile, source) || source.ContentSize() != item.LocalFile.Size {
+		return
+	}
+	item.Source = &source
+	if source.Meta.HasFlag(domain.FlagSuperseded) {
+		item.AddDetail(fmt.Sprintf("same content as version %d of %s", source.Meta.Version, source.Meta.Path))
+		return
+	}
+	item.AddDetail("same content as " + source.Meta.Path)
 }
@@ -0,0 +1,214 @@
+package usecase
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"tg-blobsync/internal/domain"
+	"time"
+)
+
+// DirUsage is the space taken by the remote files under a virtual
+// directory, "" being the root of the topic.
+type DirUsage struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	Files int    `json:"files"`
+}
+
+// GarbageUsage is the space taken by a kind of messages no listing uses,
+// which can be reclaimed.
+type GarbageUsage struct {
+	Kind     string `json:"kind"`
+	Size     int64  `json:"size"`
+	Messages int    `json:"messages"`
+	// ReclaimedBy tells what deletes them, "" when nothing does: messages
+	// are quarantined for inspection.
+	ReclaimedBy string `json:"reclaimed_by"`
+}
+
+// Kinds of garbage, in the order reported.
+const (
+	GarbageStale       = "stale versions"
+	GarbageOrphaned    = "orphaned parts"
+	GarbageSuperseded  = "superseded versions"
+	GarbageTombstones  = "expired tombstones"
+	GarbageQuarantined = "quarantined"
+)
+
+// DiskUsage adds up the remote files of a topic per virtual directory.
+type DiskUsage struct {
+	storage        domain.BlobStorage
+	tagFilter      map[string]string
+	deleteGrace    time.Duration
+	trashRetention time.Duration
+}
+
+func NewDiskUsage(storage domain.BlobStorage) *DiskUsage {
+	return &DiskUsage{storage: storage}
+}
+
+// SetTagFilter restricts the files added up to those carrying all the given tags.
+func (d *DiskUsage) SetTagFilter(filter map[string]string) {
+	d.tagFilter = filter
+}
+
+// SetRetention sets how long the files pending deletion and those in the
+// trash are kept, telling the tombstones Garbage counts as expired.
+func (d *DiskUsage) SetRetention(deleteGrace, trashRetention time.Duration) {
+	d.deleteGrace = deleteGrace
+	d.trashRetention = trashRetention
+}
+
+// Garbage adds up the messages of the topic no listing uses: the stale
+// versions and orphaned parts gc deletes, the superseded versions kept by
+// --keep-versions, the tombstones past their retention, deleted by the next
+// push, and the messages quarantined by fsck. Every kind is returned, even
+// when empty.
+func (d *DiskUsage) Garbage(ctx context.Context, groupID, topicID int64) ([]GarbageUsage, error) {
+	messages, err := d.storage.ListMessages(ctx, groupID, topicID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list messages: %w", err)
+	}
+
+	garbage := []GarbageUsage{
+		{Kind: GarbageStale, ReclaimedBy: "gc"},
+		{Kind: GarbageOrphaned, ReclaimedBy: "gc"},
+		{Kind: GarbageSuperseded, ReclaimedBy: "--keep-versions"},
+		{Kind: GarbageTombstones, ReclaimedBy: "push"},
+		{Kind: GarbageQuarantined},
+	}
+	add := func(kind string, m domain.RemoteMessage) {
+		for i := range garbage {
+			if garbage[i].Kind == kind {
+				garbage[i].Messages++
+				garbage[i].Size += m.Size
+			}
+		}
+	}
+
+	for _, issue := range checkMessages(messages).Issues {
+		for _, m := range issue.Messages {
+			switch issue.Status {
+			case FsckDuplicate:
+				add(GarbageStale, m)
+			case FsckIncomplete, FsckOrphaned:
+				add(GarbageOrphaned, m)
+			}
+		}
+	}
+
+	now := time.Now()
+	for _, m := range messages {
+		switch {
+		case m.Meta == nil:
+		case m.Meta.HasFlag(domain.FlagQuarantined):
+			add(GarbageQuarantined, m)
+		case m.Meta.HasFlag(domain.FlagSuperseded):
+			add(GarbageSuperseded, m)
+		case m.Meta.HasFlag(domain.FlagPendingDelete):
+			if d.deleteGrace <= 0 || now.Sub(time.Unix(m.Meta.DeletedAt, 0)) >= d.deleteGrace {
+				add(GarbageTombstones, m)
+			}
+		case m.Meta.HasFlag(domain.FlagTrashed):
+			if d.trashRetention > 0 && now.Sub(time.Unix(m.Meta.DeletedAt, 0)) > d.trashRetention {
+				add(GarbageTombstones, m)
+			}
+		}
+	}
+	return garbage, nil
+}
+
+// Usage returns the usage of dir and of every directory under it, each
+// directory after its subdirectories, as du lists them.
+func (d *DiskUsage) Usage(ctx context.Context, groupID, topicID int64, dir string) ([]DirUsage, error) {
+	dir = strings.Trim(filepath.ToSlash(dir), "/")
+	files, err := d.storage.ListFiles(ctx, groupID, topicID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+	filtered := files[:0]
+	for _, f := range files {
+		if !isSnapshot(f) && f.Meta.MatchesTags(d.tagFilter) {
+			filtered = append(filtered, f)
+		}
+	}
+
+	totals := domain.DirTotals(filtered)
+	if _, ok := totals[dir]; !ok {
+		if dir != "" {
+			return nil, fmt.Errorf("remote directory not found: %s", dir)
+		}
+		// An empty topic still has a total
+		totals[dir] = domain.DirTotal{}
+	}
+	var usage []DirUsage
+	for p, t := range totals {
+		if p == dir || dir == "" || strings.HasPrefix(p, dir+"/") {
+			usage = append(usage, DirUsage{Path: p, Size: t.Size, Files: t.Files})
+		}
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		return usageKey(usage[i].Path) < usageKey(usage[j].Path)
+	})
+	return usage, nil
+}
+
+// usageKey sorts directories by path, each after its subdirectories.
+func usageKey(p string) string {
+	if p == "" {
+		return "\xff"
+	}
+	return p + "/\xff"
+}
+
+// WriteUsage writes a usage listing to w, one directory per line with its
+// size and number of files, or as a JSON array. With garbage, the space it
+// takes follows the listing, one kind per line along with what deletes it,
+// the JSON array becoming the "usage" of an object also holding "garbage".
+func WriteUsage(w io.Writer, usage []DirUsage, garbage []GarbageUsage, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if garbage != nil {
+			return enc.Encode(struct {
+				Usage   []DirUsage     `json:"usage"`
+				Garbage []GarbageUsage `json:"garbage"`
+			}{usage, garbage})
+		}
+		return enc.Encode(usage)
+	}
+	for _, u := range usage {
+		p := u.Path
+		if p == "" {
+			p = "/"
+		}
+		if _, err := fmt.Fprintf(w, "%10s %8d  %s\n", formatSize(u.Size), u.Files, p); err != nil {
+			return err
+		}
+	}
+	if garbage == nil {
+		return nil
+	}
+
+	if _, err := fmt.Fprintf(w, "\nReclaimable:\n"); err != nil {
+		return err
+	}
+	var total int64
+	for _, g := range garbage {
+		by := "kept for inspection"
+		if g.ReclaimedBy != "" {
+			by = "deleted by " + g.ReclaimedBy
+		}
+		if _, err := fmt.Fprintf(w, "%10s %8d  %s (%s)\n", formatSize(g.Size), g.Messages, g.Kind, by); err != nil {
+			return err
+		}
+		total += g.Size
+	}
+	_, err := fmt.Fprintf(w, "%10s %8s  total\n", formatSize(total), "")
+	return err
+}
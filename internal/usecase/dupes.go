@@ -0,0 +1,294 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"tg-blobsync/internal/domain"
+)
+
+// DupeStatus is the remote storage status of a local duplicate.
+type DupeStatus string
+
+const (
+	// DupeStored: the remote copy at the same path has the same content.
+	DupeStored DupeStatus = "stored"
+	// DupeChanged: the remote copy at the same path has a different content.
+	DupeChanged DupeStatus = "changed"
+	// DupeNotPushed: there is no remote copy at the same path.
+	DupeNotPushed DupeStatus = "not pushed"
+)
+
+// DupeFile is a file of a DupeSet.
+type DupeFile struct {
+	Path   string
+	Status DupeStatus
+}
+
+// DupeSet is a set of local files with identical content.
+type DupeSet struct {
+	Checksum string
+	Size     int64
+	Files    []DupeFile
+	// Stored reports whether the content is stored remotely, at any path:
+	// pushing another copy reuses it instead of uploading it again.
+	Stored bool
+}
+
+// DupeReport is the outcome of a duplicate search.
+type DupeReport struct {
+	Sets []DupeSet
+	// Wasted is the space taken by all the copies but one of every set.
+	Wasted int64
+}
+
+// DupeFinder reports the local files with identical content.
+type DupeFinder struct {
+	fs      domain.FileSystem
+	storage domain.BlobStorage
+	subDir  string
+}
+
+func NewDupeFinder(fs domain.FileSystem, storage domain.BlobStorage) *DupeFinder {
+	return &DupeFinder{fs: fs, storage: storage}
+}
+
+func (d *DupeFinder) SetSubDir(subDir string) {
+	d.subDir = subDir
+}
+
+// FindLocal groups the local files by checksum, along with the status of
+// their remote copy. Only the files sharing their size with another one are
+// checksummed.
+func (d *DupeFinder) FindLocal(ctx context.Context, rootDir string, groupID, topicID int64) (*DupeReport, error) {
+	log.Println("Looking for duplicate files...")
+
+	scanner := NewScanner(d.fs, d.storage, d.subDir, true)
+
+	localFiles, err := scanner.ScanLocal(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteFiles, err := scanner.ScanRemote(ctx, groupID, topicID)
+	if err != nil {
+		return nil, err
+	}
+
+	bySize := make(map[int64][]string)
+	for path, f := range localFiles {
+		if f.Size > 0 {
+			bySize[f.Size] = append(bySize[f.Size], path)
+		}
+	}
+
+	byChecksum := make(map[string][]domain.LocalFile)
+	for _, paths := range bySize {
+		if len(paths) < 2 {
+			continue
+		}
+		for _, path := range paths {
+			f, err := d.fs.StatFile(rootDir, path, false)
+			if err != nil {
+				return nil, fmt.Errorf("failed to checksum %s: %w", path, err)
+			}
+			byChecksum[f.Checksum] = append(byChecksum[f.Checksum], f)
+		}
+	}
+
+	stored := make(map[string]bool)
+	for _, f := range remoteFiles {
+		if f.Meta.Checksum != "" {
+			stored[f.Meta.Checksum] = true
+		}
+	}
+
+	report := &DupeReport{}
+	for checksum, files := range byChecksum {
+		if len(files) < 2 {
+			continue
+		}
+		set := DupeSet{Checksum: checksum, Size: files[0].Size, Stored: stored[checksum]}
+		for _, f := range files {
+			status := DupeNotPushed
+			if remote, ok := remoteFiles[f.Path]; ok {
+				status = DupeChanged
+				if remote.Meta.Checksum == checksum {
+					status = DupeStored
+				}
+			}
+			set.Files = append(set.Files, DupeFile{Path: f.Path, Status: status})
+		}
+		sort.Slice(set.Files, func(i, j int) bool {
+			return set.Files[i].Path < set.Files[j].Path
+		})
+		report.Sets = append(report.Sets, set)
+		report.Wasted += set.Size * int64(len(set.Files)-1)
+	}
+
+	// Largest waste first
+	sort.Slice(report.Sets, func(i, j int) bool {
+		wi := report.Sets[i].Size * int64(len(report.Sets[i].Files)-1)
+		wj := report.Sets[j].Size * int64(len(report.Sets[j].Files)-1)
+		if wi != wj {
+			return wi > wj
+		}
+		return report.Sets[i].Files[0].Path < report.Sets[j].Files[0].Path
+	})
+
+	for _, set := range report.Sets {
+		remote := "not stored remotely"
+		if set.Stored {
+			remote = "stored remotely"
+		}
+		log.Printf("[*] %d copies of %s (checksum %s, %s):", len(set.Files), formatSize(set.Size), set.Checksum, remote)
+		for _, f := range set.Files {
+			log.Printf("      %s [%s]", f.Path, f.Status)
+		}
+	}
+	log.Printf("Duplicates Summary:")
+	log.Printf("  Duplicate sets:    %d", len(report.Sets))
+	log.Printf("  Reclaimable space: %s", formatSize(report.Wasted))
+	return report, nil
+}
+
+// RemoteDupeFile is a file of a RemoteDupeSet, in the topic TopicID.
+type RemoteDupeFile struct {
+	TopicID int64
+	Topic   string
+	File    domain.RemoteFile
+}
+
+// RemoteDupeSet is a set of remote files with identical content, stored by
+// Uploads distinct uploads rather than as references to a single one.
+type RemoteDupeSet struct {
+	Checksum string
+	Size     int64
+	Files    []RemoteDupeFile
+	Uploads  int
+}
+
+// RemoteDupeReport is the outcome of a remote duplicate search.
+type RemoteDupeReport struct {
+	Sets []RemoteDupeSet
+	// Wasted is the space taken by all the uploads but one of every set.
+	Wasted int64
+}
+
+// FindRemote groups the remote files of every topic of the group by
+// checksum, and reports the contents uploaded more than once. Packed files,
+// which can't be replaced on their own, are left out.
+func (d *DupeFinder) FindRemote(ctx context.Context, groupID int64) (*RemoteDupeReport, error) {
+	log.Println("Looking for duplicate remote files...")
+
+	topics, err := d.storage.ListTopics(ctx, groupID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list topics: %w", err)
+	}
+
+	byChecksum := make(map[string][]RemoteDupeFile)
+	for _, topic := range topics {
+		files, err := d.storage.ListFiles(ctx, groupID, topic.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list files of topic %s: %w", topic.Title, err)
+		}
+		for _, f := range files {
+			if f.Meta.Checksum == "" || f.Pack != nil || f.Meta.HasFlag(domain.FlagEmptyFile) || isSnapshot(f) {
+				continue
+			}
+			byChecksum[f.Meta.Checksum] = append(byChecksum[f.Meta.Checksum], RemoteDupeFile{TopicID: topic.ID, Topic: topic.Title, File: f})
+		}
+	}
+
+	report := &RemoteDupeReport{}
+	for checksum, files := range byChecksum {
+		uploads := make(map[int64]bool)
+		count := 0
+		for _, f := range files {
+			// Without its document, a file is assumed to be an upload of its own
+			if f.File.DocumentID == 0 || !uploads[f.File.DocumentID] {
+				uploads[f.File.DocumentID] = true
+				count++
+			}
+		}
+		if count < 2 {
+			continue
+		}
+
+		// Oldest first: it is the one kept by Dedup
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].File.MessageID < files[j].File.MessageID
+		})
+		set := RemoteDupeSet{Checksum: checksum, Size: files[0].File.Size, Files: files, Uploads: count}
+		report.Sets = append(report.Sets, set)
+		report.Wasted += set.Size * int64(count-1)
+	}
+
+	sort.Slice(report.Sets, func(i, j int) bool {
+		wi := report.Sets[i].Size * int64(report.Sets[i].Uploads-1)
+		wj := report.Sets[j].Size * int64(report.Sets[j].Uploads-1)
+		if wi != wj {
+			return wi > wj
+		}
+		return report.Sets[i].Checksum < report.Sets[j].Checksum
+	})
+
+	for _, set := range report.Sets {
+		log.Printf("[*] %d uploads of %s (checksum %s):", set.Uploads, formatSize(set.Size), set.Checksum)
+		for _, f := range set.Files {
+			log.Printf("      %s: %s [message %d]", f.Topic, f.File.Meta.Path, f.File.MessageID)
+		}
+	}
+	log.Printf("Remote Duplicates Summary:")
+	log.Printf("  Duplicate sets:    %d", len(report.Sets))
+	log.Printf("  Reclaimable space: %s", formatSize(report.Wasted))
+	return report, nil
+}
+
+// Dedup replaces the duplicates of a report by references to the oldest
+// upload of their content, which Telegram then stores only once. The
+// metadata of every file is kept.
+func (d *DupeFinder) Dedup(ctx context.Context, groupID int64, report *RemoteDupeReport) error {
+	replaced := 0
+	for _, set := range report.Sets {
+		source := set.Files[0].File
+		for _, f := range set.Files[1:] {
+			if f.File.DocumentID != 0 && f.File.DocumentID == source.DocumentID {
+				continue
+			}
+
+			file := domain.LocalFile{
+				Path:      f.File.Meta.Path,
+				Checksum:  f.File.Meta.Checksum,
+				Algorithm: f.File.Meta.Algorithm,
+				ModTime:   f.File.Meta.ModTime,
+				Size:      f.File.Size,
+				Tags:      f.File.Meta.Tags,
+				Flags:     f.File.Meta.Flags,
+			}
+			if err := d.storage.CopyFile(ctx, groupID, f.TopicID, source, file); err != nil {
+				return fmt.Errorf("failed to replace %s: %w", f.File.Meta.Path, err)
+			}
+			if err := d.storage.DeleteFile(ctx, groupID, f.TopicID, f.File.MessageIDs()...); err != nil {
+				return fmt.Errorf("failed to delete the duplicate of %s: %w", f.File.Meta.Path, err)
+			}
+			replaced++
+		}
+	}
+	log.Printf("[+] Replaced %d duplicates with references", replaced)
+	return nil
+}
+
+func formatSize(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "KMGTPE"[exp])
+}
@@ -2,11 +2,23 @@ package usecase
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"maps"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/checksum"
+	"tg-blobsync/internal/pkg/pack"
+	"tg-blobsync/internal/pkg/pipeline"
 	"tg-blobsync/internal/pkg/retry"
 	"time"
 
@@ -15,13 +27,56 @@ import (
 
 type SyncExecutor interface {
 	Execute(ctx context.Context, plan domain.SyncPlan, rootDir string, groupID, topicID int64) error
+	SetTags(tags map[string]string)
+	SetPacking(threshold, maxSize int64)
+	SetJournal(file string)
+	SetVerify(verify bool)
+	SetDeadline(deadline time.Time)
+	SetRules(rules []domain.FileRule)
+	SetKeepVersions(n int)
+	SetPipeline(p pipeline.Pipeline)
+	SetMirror(dir string)
+	SetTrash(topicID int64)
+	SetBackupDir(dir string)
+	SetStats(stats *Stats)
+	SetScope(prefix string)
+	SetPruneAfterVerify(verify bool)
+	SetHashOnUpload(hash bool)
+	SetLinkDupes(link bool)
 }
 
 type executor struct {
-	fs      domain.FileSystem
-	storage domain.BlobStorage
-	workers int
-	ui      domain.UserInterface
+	fs            domain.FileSystem
+	storage       domain.BlobStorage
+	workers       int
+	ui            domain.UserInterface
+	tags          map[string]string
+	packThreshold int64
+	packSize      int64
+	edits         packEdits
+	journalFile   string
+	journal       *journal
+	verify        bool
+	deadline      time.Time
+	rules         fileRules
+	keepVersions  int
+	pipeline      pipeline.Pipeline
+	mirror        mirror
+	trash         trash
+	backupDir     string
+	stats         *Stats
+	scope         string
+	pruneAfter    bool
+	hashOnUpload  bool
+	linkDupes     bool
+	skipped       atomic.Int64 // items not started before the deadline
+	overLimit     atomic.Int64 // uploads refused by the daily upload limit
+	completed     atomic.Int64
+	// Completed items whose changes are only applied with the pack edits
+	mu           sync.Mutex
+	pendingEdits []string
+	superseded   map[string]bool   // paths whose old version was kept
+	uploaded     []domain.SyncItem // uploads to verify before pruning
 }
 
 func NewExecutor(fs domain.FileSystem, storage domain.BlobStorage, workers int, ui domain.UserInterface) SyncExecutor {
@@ -33,17 +88,177 @@ func NewExecutor(fs domain.FileSystem, storage domain.BlobStorage, workers int,
 		storage: storage,
 		workers: workers,
 		ui:      ui,
+		verify:  true,
 	}
 }
 
+// SetTags sets the tags attached to uploaded files, on top of the tags
+// already carried by the version being replaced.
+func (e *executor) SetTags(tags map[string]string) {
+	e.tags = tags
+}
+
+// SetPacking enables bundling the uploaded files smaller than threshold
+// into packs of at most maxSize bytes. A zero threshold disables packing.
+func (e *executor) SetPacking(threshold, maxSize int64) {
+	if maxSize <= 0 {
+		maxSize = defaultPackSize
+	}
+	e.packThreshold = threshold
+	e.packSize = maxSize
+}
+
+// SetJournal makes Execute record the plan and its progress in file, so
+// that an interrupted run can be resumed.
+func (e *executor) SetJournal(file string) {
+	e.journalFile = file
+}
+
+// SetVerify sets whether downloaded files are checksummed and compared with
+// their metadata before being moved into place. It is enabled by default.
+func (e *executor) SetVerify(verify bool) {
+	e.verify = verify
+}
+
+// SetDeadline makes Execute stop starting transfers at deadline: those in
+// flight are completed, while the others and the deletions are left for the
+// next run. A zero deadline sets no limit.
+func (e *executor) SetDeadline(deadline time.Time) {
+	e.deadline = deadline
+}
+
+// SetRules sets the rules deciding the packing, priority, tags and
+// pipeline of the transferred files.
+func (e *executor) SetRules(rules []domain.FileRule) {
+	e.rules = rules
+}
+
+// SetKeepVersions makes uploads keep up to n versions replaced by an update,
+// flagged superseded, instead of deleting them. Packed versions are always
+// deleted.
+func (e *executor) SetKeepVersions(n int) {
+	e.keepVersions = n
+}
+
+// SetPipeline makes uploads pass the content of the files through p, and
+// record it in their metadata. Packed and empty files are stored as is.
+func (e *executor) SetPipeline(p pipeline.Pipeline) {
+	e.pipeline = p
+}
+
+// SetMirror makes downloads copy the contents already stored in the mirror
+// directory dir instead of downloading them, and store the others there.
+// The mirror is only used when downloads are verified.
+func (e *executor) SetMirror(dir string) {
+	e.mirror = mirror{fs: e.fs, dir: dir}
+}
+
+// SetTrash makes remote deletions move the files to the trash topic topicID
+// instead. Packed files are always deleted. A zero topicID disables it.
+func (e *executor) SetTrash(topicID int64) {
+	e.trash = trash{storage: e.storage, topicID: topicID}
+}
+
+// SetBackupDir makes downloads and local deletions move the local files they
+// overwrite or delete to dir, under the same relative path.
+func (e *executor) SetBackupDir(dir string) {
+	e.backupDir = dir
+}
+
+// SetLinkDupes makes the downloads of a content downloaded by another item
+// of the plan link to it rather than download it again.
+func (e *executor) SetLinkDupes(link bool) {
+	e.linkDupes = link
+}
+
+// SetScope makes Execute refuse plans uploading, updating or deleting any
+// remote file outside prefix, "" being the whole topic. The scanners already
+// keep other files out of the plans: this guards against a plan built by
+// mistake from the wrong scope.
+func (e *executor) SetScope(prefix string) {
+	e.scope = strings.Trim(filepath.ToSlash(prefix), "/")
+}
+
+// SetPruneAfterVerify defers every remote deletion, of the files deleted
+// locally and of the versions replaced by uploads alike, until the topic has
+// been listed again and every upload found there with the right checksum
+// and size. When one isn't, nothing is deleted.
+func (e *executor) SetPruneAfterVerify(verify bool) {
+	e.pruneAfter = verify
+}
+
+// SetHashOnUpload makes the files planned for upload without a checksum be
+// checksummed while they are uploaded, rather than read once more for it.
+func (e *executor) SetHashOnUpload(hash bool) {
+	e.hashOnUpload = hash
+}
+
+// checkScope returns an error naming the first item of plan writing to a
+// remote path outside the scope.
+func (e *executor) checkScope(plan domain.SyncPlan) error {
+	if e.scope == "" {
+		return nil
+	}
+	for _, item := range plan.Items {
+		paths := []string{item.Path}
+		if item.LocalFile != nil && item.Action == domain.ActionUpload {
+			paths = append(paths, item.LocalFile.Path)
+		}
+		if item.RemoteFile != nil && item.Action != domain.ActionDownload {
+			paths = append(paths, item.RemoteFile.Meta.Path)
+		}
+		for _, p := range paths {
+			if !underPrefix(e.scope, filepath.ToSlash(p)) {
+				return fmt.Errorf("refusing to run a plan touching %s, outside of the scope %s/", p, e.scope)
+			}
+		}
+	}
+	return nil
+}
+
+// underPrefix reports whether the remote path p is prefix or under it.
+func underPrefix(prefix, p string) bool {
+	return prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// SetStats sets where the processed items are counted.
+func (e *executor) SetStats(stats *Stats) {
+	e.stats = stats
+}
+
+// outOfTime reports whether the deadline passed, counting n items as skipped if so.
+func (e *executor) outOfTime(n int) bool {
+	if e.deadline.IsZero() || time.Now().Before(e.deadline) {
+		return false
+	}
+	e.skipped.Add(int64(n))
+	return true
+}
+
 func (e *executor) Execute(ctx context.Context, plan domain.SyncPlan, rootDir string, groupID, topicID int64) error {
 	if plan.Summary.Total == 0 {
 		log.Println("Everything is up to date.")
 		return nil
 	}
+	if err := e.checkScope(plan); err != nil {
+		return err
+	}
 
 	// User Confirmation
-	if e.ui != nil {
+	if confirmer, ok := e.ui.(domain.ItemConfirmer); ok {
+		approved, confirmed, err := confirmer.ConfirmItems(plan)
+		if err != nil {
+			return err
+		}
+		if !confirmed || approved.Summary.Total == 0 {
+			log.Println("Sync cancelled by user.")
+			return nil
+		}
+		if left := plan.Summary.Total - approved.Summary.Total; left > 0 {
+			log.Printf("[*] Leaving out %d items deselected", left)
+		}
+		plan = approved
+	} else if e.ui != nil {
 		confirmed, err := e.ui.ConfirmSync(plan)
 		if err != nil {
 			return err
@@ -58,34 +273,152 @@ func (e *executor) Execute(ctx context.Context, plan domain.SyncPlan, rootDir st
 		e.ui.SetTotalFiles(plan.Summary.Total)
 	}
 
-	// Separate Deletions from Transfer tasks
+	if e.journalFile != "" {
+		absRoot, _ := filepath.Abs(rootDir)
+		j, err := createJournal(e.journalFile, journalHeader{
+			Root:    absRoot,
+			GroupID: groupID,
+			TopicID: topicID,
+			Items:   plan.Items,
+		})
+		if err != nil {
+			log.Printf("[!] Warning: %v", err)
+		}
+		e.journal = j
+		defer func() {
+			if err := e.journal.Close(); err != nil {
+				log.Printf("[!] Warning: %v", err)
+			}
+		}()
+	}
+
+	// Separate Deletions from Transfer tasks, and the transfers going
+	// through packs from the others
 	var transferTasks []domain.SyncItem
 	var deleteTasks []domain.SyncItem
+	var packUploads []domain.SyncItem
+	packDownloads := make(map[int][]domain.SyncItem)
 
 	for _, item := range plan.Items {
-		if item.Action == domain.ActionDeleteRemote || item.Action == domain.ActionDeleteLocal {
+		switch {
+		case item.Action == domain.ActionDeleteRemote || item.Action == domain.ActionDeleteLocal:
 			deleteTasks = append(deleteTasks, item)
-		} else {
+		case item.Action == domain.ActionUpload && item.LocalFile != nil && item.Source == nil && item.LocalFile.Size < e.packThreshold && e.rules.CanPack(item.Path):
+			packUploads = append(packUploads, item)
+		case item.Action == domain.ActionDownload && item.RemoteFile != nil && item.RemoteFile.Pack != nil:
+			packDownloads[item.RemoteFile.Pack.MessageID] = append(packDownloads[item.RemoteFile.Pack.MessageID], item)
+		default:
 			transferTasks = append(transferTasks, item)
 		}
 	}
 
+	// Downloads of the same content are linked to the first, once it is done
+	var dupes map[string][]domain.SyncItem
+	if e.linkDupes {
+		transferTasks, dupes = groupDupes(transferTasks)
+	}
+
+	// Higher priorities first, in plan order otherwise
+	if len(e.rules) > 0 {
+		sort.SliceStable(transferTasks, func(i, j int) bool {
+			return e.rules.For(transferTasks[i].Path).Priority > e.rules.For(transferTasks[j].Path).Priority
+		})
+	}
+
 	// Execute Transfers (Upload/Download)
+	transferStart := time.Now()
 	g, gCtx := errgroup.WithContext(ctx)
 	g.SetLimit(e.workers)
+	workers := make(chan int, e.workers)
+	for i := range e.workers {
+		workers <- i
+	}
+	e.stats.setWorkers(e.workers)
+
+	// Items not started when the transfers stopped
+	var pending []domain.SyncItem
 
 	for _, item := range transferTasks {
 		if gCtx.Err() != nil {
-			break
+			pending = append(pending, item)
+			continue
 		}
 
 		item := item // capture loop var
 		g.Go(func() error {
-			return e.processItem(gCtx, item, rootDir, groupID, topicID)
+			return e.onWorker(workers, transferStart, func() error {
+				if e.outOfTime(1) {
+					return nil
+				}
+				if err := e.processItem(gCtx, item, rootDir, groupID, topicID); err != nil {
+					if errors.Is(err, domain.ErrUploadLimit) {
+						e.overLimit.Add(1)
+						return nil
+					}
+					e.failed(ctx, append([]domain.SyncItem{item}, dupes[item.Path]...), err)
+					return err
+				}
+				e.stats.record(item)
+				e.complete(item)
+				for i, dup := range dupes[item.Path] {
+					if err := e.linkDupe(gCtx, item, dup, rootDir, groupID, topicID); err != nil {
+						e.failed(ctx, dupes[item.Path][i:], err)
+						return err
+					}
+				}
+				return nil
+			})
+		})
+	}
+
+	for _, items := range groupPacks(packUploads, e.packSize) {
+		if gCtx.Err() != nil {
+			pending = append(pending, items...)
+			continue
+		}
+		g.Go(func() error {
+			return e.onWorker(workers, transferStart, func() error {
+				if e.outOfTime(len(items)) {
+					return nil
+				}
+				err := e.uploadPacked(gCtx, items, groupID, topicID)
+				if errors.Is(err, domain.ErrUploadLimit) {
+					e.overLimit.Add(int64(len(items)))
+					return nil
+				}
+				if err != nil {
+					e.failed(ctx, items, err)
+				}
+				return err
+			})
+		})
+	}
+
+	for _, items := range packDownloads {
+		if gCtx.Err() != nil {
+			pending = append(pending, items...)
+			continue
+		}
+		g.Go(func() error {
+			return e.onWorker(workers, transferStart, func() error {
+				if e.outOfTime(len(items)) {
+					return nil
+				}
+				err := e.downloadPacked(gCtx, items, rootDir, groupID, topicID)
+				if err != nil {
+					e.failed(ctx, items, err)
+				}
+				return err
+			})
 		})
 	}
 
-	if err := g.Wait(); err != nil {
+	err := g.Wait()
+	e.stats.addTransferTime(time.Since(transferStart))
+	if err != nil {
+		if ctx.Err() != nil {
+			e.interrupted(plan, append(pending, deleteTasks...))
+		}
 		return err
 	}
 
@@ -93,16 +426,113 @@ func (e *executor) Execute(ctx context.Context, plan domain.SyncPlan, rootDir st
 		e.ui.Wait()
 	}
 
+	if e.pruneAfter && len(e.uploaded) > 0 {
+		if err := e.verifyUploads(ctx, groupID, topicID); err != nil {
+			var kept int
+			for _, item := range deleteTasks {
+				if item.Action == domain.ActionDeleteRemote {
+					kept++
+				}
+			}
+			log.Printf("[!] Not deleting %d remote files nor %d replaced versions", kept, len(e.uploaded))
+			return err
+		}
+		for _, item := range e.uploaded {
+			e.deleteOldVersion(ctx, item, groupID, topicID)
+		}
+	}
+
+	// Deleting is only safe once everything else was done
+	if limited := e.overLimit.Load(); limited > 0 {
+		e.stats.add(StatSkipped, int(limited)+len(deleteTasks), 0)
+		log.Printf("[!] Daily upload limit reached: %d uploads and %d deletions left for the next run", limited, len(deleteTasks))
+		deleteTasks = nil
+	}
+	if e.skipped.Load() > 0 || (len(deleteTasks) > 0 && e.outOfTime(0)) {
+		skipped := e.skipped.Load() + int64(len(deleteTasks))
+		e.stats.add(StatSkipped, int(skipped), 0)
+		deleteTasks = nil
+		if e.journal != nil {
+			log.Printf("[!] Time budget exhausted: %d items left, run push --resume to carry on", skipped)
+		} else {
+			log.Printf("[!] Time budget exhausted: %d items left for the next run", skipped)
+		}
+	}
+
 	// Execute Deletions
 	for _, item := range deleteTasks {
 		if err := e.processItem(ctx, item, rootDir, groupID, topicID); err != nil {
 			log.Printf("Error processing delete for %s: %v", item.Path, err)
+			e.stats.fail(1, itemSize(item), err)
+			continue
+		}
+		e.stats.record(item)
+		e.complete(item)
+	}
+
+	if len(e.superseded) > 0 {
+		if err := pruneVersions(ctx, e.storage, groupID, topicID, e.superseded, e.keepVersions); err != nil {
+			log.Printf("[!] Warning: %v", err)
+		}
+	}
+
+	// Rewrite the packs whose files were deleted or replaced
+	if err := e.edits.Apply(ctx, e.storage, groupID, topicID); err != nil {
+		log.Printf("Warning: %v", err)
+	} else {
+		for _, path := range e.pendingEdits {
+			e.journal.Done(path)
 		}
 	}
 
 	return nil
 }
 
+// failed records the items of a failed transfer, or as skipped when the
+// run was interrupted.
+func (e *executor) failed(ctx context.Context, items []domain.SyncItem, err error) {
+	if ctx.Err() != nil {
+		e.stats.add(StatSkipped, len(items), itemsSize(items))
+		return
+	}
+	e.stats.fail(len(items), itemsSize(items), err)
+}
+
+// interrupted reports what an interrupted run left undone: the items
+// pending, never started, and those stopped midway.
+func (e *executor) interrupted(plan domain.SyncPlan, pending []domain.SyncItem) {
+	e.stats.add(StatSkipped, len(pending), itemsSize(pending))
+	done := e.completed.Load()
+	log.Printf("[!] Interrupted: %d of %d items done, %d left", done, plan.Summary.Total, int64(plan.Summary.Total)-done)
+	if e.journal != nil {
+		log.Printf("[*] Run push --resume to carry on")
+	}
+}
+
+// onWorker runs a transfer task on a free worker, recording how long it
+// waited for one since the transfers started, and how long it kept it busy.
+func (e *executor) onWorker(workers chan int, queued time.Time, task func() error) error {
+	worker := <-workers
+	defer func() { workers <- worker }()
+	start := time.Now()
+	e.stats.addQueueWait(start.Sub(queued))
+	defer func() { e.stats.addWorkerBusy(worker, time.Since(start)) }()
+	return task()
+}
+
+// complete records a completed item in the journal. Items relying on a
+// pack edit are only recorded once the packs have been rewritten.
+func (e *executor) complete(item domain.SyncItem) {
+	e.completed.Add(1)
+	if item.RemoteFile != nil && item.RemoteFile.Pack != nil && item.Action != domain.ActionDownload {
+		e.mu.Lock()
+		e.pendingEdits = append(e.pendingEdits, item.Path)
+		e.mu.Unlock()
+		return
+	}
+	e.journal.Done(item.Path)
+}
+
 func (e *executor) processItem(ctx context.Context, item domain.SyncItem, rootDir string, groupID, topicID int64) error {
 	switch item.Action {
 	case domain.ActionUpload:
@@ -113,27 +543,400 @@ func (e *executor) processItem(ctx context.Context, item domain.SyncItem, rootDi
 		return e.deleteRemote(ctx, item, groupID, topicID)
 	case domain.ActionDeleteLocal:
 		return e.deleteLocal(item, rootDir)
+	case domain.ActionMarkDeleted, domain.ActionUnmarkDeleted:
+		return e.markDeleted(ctx, item, groupID, topicID)
 	}
 	return nil
 }
 
+// markDeleted sets or clears the pending delete flag of a remote file.
+func (e *executor) markDeleted(ctx context.Context, item domain.SyncItem, groupID, topicID int64) error {
+	if item.RemoteFile == nil {
+		return fmt.Errorf("remote file is nil for %s", item.Path)
+	}
+	meta := item.RemoteFile.Meta
+	if item.Action == domain.ActionMarkDeleted {
+		log.Printf("[-] Marking remote file as pending delete: %s", item.Path)
+		meta.SetFlag(domain.FlagPendingDelete)
+		meta.DeletedAt = time.Now().Unix()
+	} else {
+		log.Printf("[*] Keeping remote file back locally: %s", item.Path)
+		meta.ClearFlag(domain.FlagPendingDelete)
+		meta.DeletedAt = 0
+	}
+
+	if item.RemoteFile.Pack != nil {
+		e.edits.Update(*item.RemoteFile, meta)
+		return nil
+	}
+	return retry.WithRetry(ctx, "UpdateMeta: "+item.Path, func() error {
+		return e.storage.UpdateFileMeta(ctx, groupID, topicID, *item.RemoteFile, meta)
+	}, 5, 1*time.Second)
+}
+
 func (e *executor) upload(ctx context.Context, item domain.SyncItem, groupID, topicID int64) error {
 	if item.LocalFile == nil {
 		return fmt.Errorf("local file is nil for upload: %s", item.Path)
 	}
 
-	err := e.storage.UploadFile(ctx, groupID, topicID, *item.LocalFile)
+	file := *item.LocalFile
+	file.Tags = e.uploadTags(item)
+	file.Version = nextVersion(item)
+
+	if item.Source != nil {
+		err := e.storage.CopyFile(ctx, groupID, topicID, *item.Source, file)
+		if err == nil {
+			e.replaced(ctx, item, groupID, topicID)
+			return nil
+		}
+		log.Printf("[!] Warning: failed to reuse %s for %s, uploading it: %v", item.Source.Meta.Path, item.Path, err)
+	}
+
+	pl := e.rules.Pipeline(item.Path, e.pipeline)
+	var sum string
+	if e.hashOnUpload && file.Checksum == "" {
+		if len(pl) > 0 || file.Size == 0 {
+			// The checksum is of the content, not of what is uploaded
+			contentSum, err := e.checksum(file)
+			if err != nil {
+				return fmt.Errorf("error checksumming file %s: %w", item.Path, err)
+			}
+			file.Checksum = contentSum
+		} else {
+			ctx = domain.WithUploadChecksum(ctx, &sum)
+		}
+	}
+
+	if len(pl) > 0 && file.Size > 0 {
+		encoded, err := e.encode(file, pl)
+		if err != nil {
+			return fmt.Errorf("error transforming file %s: %w", item.Path, err)
+		}
+		defer os.Remove(encoded.AbsPath)
+		file = encoded
+	}
+
+	task := e.startTask(item.Path, file.Size)
+	err := e.storage.UploadFile(domain.WithProgressTask(ctx, task), groupID, topicID, file)
+	finishTask(task, err)
 	if err != nil {
 		return fmt.Errorf("error uploading file %s: %w", item.Path, err)
 	}
+	if sum != "" {
+		local := *item.LocalFile
+		local.Checksum = sum
+		item.LocalFile = &local
+		e.rememberChecksum(local)
+	}
+
+	e.replaced(ctx, item, groupID, topicID)
+	return nil
+}
+
+// checksum calculates the checksum of a local file and caches it.
+func (e *executor) checksum(file domain.LocalFile) (string, error) {
+	sum, err := fileChecksum(e.fs, file.AbsPath, file.Algorithm)
+	if err != nil {
+		return "", err
+	}
+	file.Checksum = sum
+	e.rememberChecksum(file)
+	return sum, nil
+}
 
-	// If it was an update (RemoteFile exists), delete the old version on Telegram
+// rememberChecksum caches the checksum of file if the filesystem caches them.
+func (e *executor) rememberChecksum(file domain.LocalFile) {
+	if c, ok := e.fs.(domain.ChecksumCache); ok {
+		c.RememberChecksum(file, file.Checksum)
+	}
+}
+
+// startTask returns the progress handle of a transfer of total bytes, nil
+// without a UI. It is handed to the storage with the context of the
+// transfer, and finished with finishTask.
+func (e *executor) startTask(name string, total int64) domain.ProgressTask {
+	if e.ui == nil {
+		return nil
+	}
+	return e.ui.Start(name, total)
+}
+
+// finishTask completes task, or aborts it if its transfer failed.
+func finishTask(task domain.ProgressTask, err error) {
+	switch {
+	case task == nil:
+	case err != nil:
+		task.Abort()
+	default:
+		task.Complete()
+	}
+}
+
+// encode passes the content of file through pl into a temporary file,
+// returned in its place for upload. The upload must know the size of what
+// it sends beforehand, and may have to send it again.
+func (e *executor) encode(file domain.LocalFile, pl pipeline.Pipeline) (domain.LocalFile, error) {
+	src, err := os.Open(file.AbsPath)
+	if err != nil {
+		return file, err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp("", "tgblobsync-pipeline-*")
+	if err != nil {
+		return file, err
+	}
+	w, err := pl.Encode(tmp)
+	if err == nil {
+		_, err = io.Copy(w, src)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	info, statErr := os.Stat(tmp.Name())
+	if err == nil {
+		err = statErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return file, err
+	}
+
+	names := pl.Names()
+	log.Printf("[*] Transformed %s (%s): %s -> %s", file.Path, strings.Join(names, ", "), formatSize(file.Size), formatSize(info.Size()))
+	file.Pipeline = names
+	file.ContentSize = file.Size
+	file.Size = info.Size()
+	file.AbsPath = tmp.Name()
+	return file, nil
+}
+
+// uploadTags returns the tags of the new version of an uploaded file.
+func (e *executor) uploadTags(item domain.SyncItem) map[string]string {
+	rule := e.rules.For(item.Path)
+	if item.RemoteFile == nil && len(e.tags) == 0 && len(rule.Tags) == 0 {
+		return item.LocalFile.Tags
+	}
+	tags := make(map[string]string)
 	if item.RemoteFile != nil {
-		log.Printf("[*] Deleting old version of: %s", item.Path)
-		err := e.storage.DeleteFile(ctx, groupID, topicID, item.RemoteFile.MessageID)
+		maps.Copy(tags, item.RemoteFile.Meta.Tags)
+	}
+	maps.Copy(tags, rule.Tags)
+	maps.Copy(tags, e.tags)
+	return tags
+}
+
+// replaced handles the version replaced by a successful upload, if any:
+// deleted right away, or once verified with SetPruneAfterVerify.
+func (e *executor) replaced(ctx context.Context, item domain.SyncItem, groupID, topicID int64) {
+	if !e.pruneAfter {
+		e.deleteOldVersion(ctx, item, groupID, topicID)
+		return
+	}
+	e.mu.Lock()
+	e.uploaded = append(e.uploaded, item)
+	e.mu.Unlock()
+}
+
+// verifyUploads lists the topic again and checks that every upload made is
+// listed under its path with the checksum and size of the local file.
+func (e *executor) verifyUploads(ctx context.Context, groupID, topicID int64) error {
+	log.Printf("[*] Verifying %d uploads before deleting anything", len(e.uploaded))
+	var files []domain.RemoteFile
+	err := retry.WithRetry(ctx, "List", func() error {
+		var err error
+		files, err = e.storage.ListFiles(ctx, groupID, topicID)
+		return err
+	}, 5, 1*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to list remote files for verification: %w", err)
+	}
+	// The newest file of a path comes first
+	listed := make(map[string]domain.RemoteFile)
+	for _, f := range files {
+		p := filepath.ToSlash(f.Meta.Path)
+		if _, ok := listed[p]; !ok {
+			listed[p] = f
+		}
+	}
+
+	failed := 0
+	for _, item := range e.uploaded {
+		local := item.LocalFile
+		remote, ok := listed[filepath.ToSlash(local.Path)]
+		var problem string
+		switch {
+		case !ok:
+			problem = "not listed"
+		case local.Checksum != "" && !sameChecksum(*local, remote):
+			problem = fmt.Sprintf("checksum %s, expected %s", shortChecksum(remote.Meta.Checksum), shortChecksum(local.Checksum))
+		case remote.ContentSize() != local.Size:
+			problem = fmt.Sprintf("size %d, expected %d", remote.ContentSize(), local.Size)
+		case item.RemoteFile != nil && remote.MessageID == item.RemoteFile.MessageID:
+			problem = "still listed as the old version"
+		default:
+			continue
+		}
+		failed++
+		log.Printf("[!] Upload not verified: %s (%s)", item.Path, problem)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d uploads could not be verified", failed, len(e.uploaded))
+	}
+	log.Printf("[+] Verified %d uploads", len(e.uploaded))
+	return nil
+}
+
+// deleteOldVersion deletes the version replaced by an upload, if any.
+// Packed versions are dropped when their pack is rewritten at the end.
+func (e *executor) deleteOldVersion(ctx context.Context, item domain.SyncItem, groupID, topicID int64) {
+	if item.RemoteFile == nil {
+		return
+	}
+	if item.RemoteFile.Pack != nil {
+		e.edits.Remove(*item.RemoteFile)
+		return
+	}
+	if e.keepVersions > 0 {
+		e.supersede(ctx, item, groupID, topicID)
+		return
+	}
+	log.Printf("[*] Deleting old version of: %s", item.Path)
+	err := e.storage.DeleteFile(ctx, groupID, topicID, item.RemoteFile.MessageIDs()...)
+	if err != nil {
+		log.Printf("Warning: failed to delete old version of %s: %v", item.Path, err)
+	}
+}
+
+// uploadPacked uploads the given small files bundled in a single pack.
+func (e *executor) uploadPacked(ctx context.Context, items []domain.SyncItem, groupID, topicID int64) error {
+	members := make([]pack.Member, 0, len(items))
+	for _, item := range items {
+		local := item.LocalFile
+		if e.hashOnUpload && local.Checksum == "" {
+			// Small files: reading them once more costs little
+			sum, err := e.checksum(*local)
+			if err != nil {
+				return fmt.Errorf("error checksumming file %s: %w", item.Path, err)
+			}
+			copied := *local
+			copied.Checksum = sum
+			local = &copied
+		}
+		members = append(members, pack.Member{
+			Meta: domain.FileMeta{
+				Path:      local.Path,
+				Checksum:  local.Checksum,
+				Algorithm: local.Algorithm,
+				ModTime:   local.ModTime,
+				Tags:      e.uploadTags(item),
+				Version:   nextVersion(item),
+			},
+			Size: local.Size,
+			Open: func() (io.ReadCloser, error) {
+				return e.fs.ReadFile(local.AbsPath)
+			},
+		})
+	}
+
+	err := retry.WithRetry(ctx, fmt.Sprintf("Pack: %d files", len(items)), func() error {
+		return uploadPack(ctx, e.storage, groupID, topicID, members)
+	}, 5, 1*time.Second)
+	if err != nil {
+		return fmt.Errorf("error uploading pack: %w", err)
+	}
+
+	for _, item := range items {
+		log.Printf("[+] Packed: %s", item.Path)
+		e.replaced(ctx, item, groupID, topicID)
+		e.stats.record(item)
+		e.complete(item)
+	}
+	return nil
+}
+
+// downloadPacked downloads a pack once and extracts the given files from it.
+func (e *executor) downloadPacked(ctx context.Context, items []domain.SyncItem, rootDir string, groupID, topicID int64) error {
+	packRef := items[0].RemoteFile.Pack
+
+	operation := func() error {
+		wanted := make(map[string]domain.SyncItem, len(items))
+		for _, item := range items {
+			wanted[item.RemoteFile.Pack.Member] = item
+		}
+
+		rc, err := e.storage.DownloadFile(ctx, groupID, topicID, packRef.MessageID, packRef.Path, packRef.Size, 0)
+		if err != nil {
+			return fmt.Errorf("error downloading pack %s: %w", packRef.Path, err)
+		}
+		defer rc.Close()
+
+		r, err := pack.NewReader(rc)
 		if err != nil {
-			log.Printf("Warning: failed to delete old version of %s: %v", item.Path, err)
+			return fmt.Errorf("error reading pack %s: %w", packRef.Path, err)
 		}
+
+		for len(wanted) > 0 {
+			entry, content, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("error reading pack %s: %w", packRef.Path, err)
+			}
+			item, ok := wanted[entry.Name]
+			if !ok {
+				continue
+			}
+			delete(wanted, entry.Name)
+
+			// Unpacking can't be resumed: keep clear of the files of other runs
+			fullPath := filepath.Join(rootDir, item.Path)
+			partPath := fmt.Sprintf("%s%s%d.tmp", fullPath, domain.TempMarker, os.Getpid())
+			h, err := checksum.New(item.RemoteFile.Meta.Algorithm)
+			if err != nil {
+				return fmt.Errorf("can't verify %s: %w", item.Path, err)
+			}
+			if e.verify {
+				content = io.TeeReader(content, h)
+			}
+			if err := e.fs.WriteFile(partPath, content); err != nil {
+				e.fs.DeleteFile(partPath)
+				return fmt.Errorf("error writing file %s: %w", item.Path, err)
+			}
+			if sum := hex.EncodeToString(h.Sum(nil)); e.verify && item.RemoteFile.Meta.Checksum != "" && sum != item.RemoteFile.Meta.Checksum {
+				e.fs.DeleteFile(partPath)
+				return fmt.Errorf("checksum mismatch for unpacked file %s: got %s, expected %s", item.Path, sum, item.RemoteFile.Meta.Checksum)
+			}
+			if err := e.backup(rootDir, item.Path); err != nil {
+				return err
+			}
+			if err := e.fs.RenameFile(partPath, fullPath); err != nil {
+				return fmt.Errorf("error writing file %s: %w", item.Path, err)
+			}
+			if item.RemoteFile.Meta.ModTime > 0 {
+				if err := e.fs.SetModTime(fullPath, item.RemoteFile.Meta.ModTime); err != nil {
+					log.Printf("[!] Warning: failed to set modification time for %s: %v", item.Path, err)
+				}
+			}
+			log.Printf("[+] Unpacked: %s", item.Path)
+		}
+
+		for _, item := range wanted {
+			return fmt.Errorf("file %s not found in pack %s", item.Path, packRef.Path)
+		}
+		return nil
+	}
+
+	if err := retry.WithRetry(ctx, "Pull: "+packRef.Path, operation, 5, 1*time.Second); err != nil {
+		return err
+	}
+	for _, item := range items {
+		e.stats.record(item)
+		e.complete(item)
 	}
 	return nil
 }
@@ -147,8 +950,11 @@ func (e *executor) download(ctx context.Context, item domain.SyncItem, rootDir s
 	fullPath := filepath.Join(rootDir, item.Path)
 
 	operation := func() error {
-		if remoteFile.Meta.Flags == "EMPTY_FILE" {
+		if remoteFile.Meta.HasFlag(domain.FlagEmptyFile) {
 			log.Printf("[*] Restoring empty file: %s", item.Path)
+			if err := e.backup(rootDir, item.Path); err != nil {
+				return err
+			}
 			if err := e.fs.WriteFile(fullPath, strings.NewReader("")); err != nil {
 				return fmt.Errorf("error creating empty file %s: %w", item.Path, err)
 			}
@@ -158,13 +964,76 @@ func (e *executor) download(ctx context.Context, item domain.SyncItem, rootDir s
 			return nil
 		}
 
-		rc, err := e.storage.DownloadFile(ctx, groupID, topicID, remoteFile.MessageID, remoteFile.Meta.Path, remoteFile.Size)
-		if err != nil {
-			return fmt.Errorf("error downloading file %s: %w", item.Path, err)
+		// Download next to the destination, carrying on from what an
+		// interrupted download left. Without verifying a checksum, a leftover
+		// can't be told from a different version of the file, so it is discarded.
+		partPath := fullPath + domain.PartSuffix
+		var offset int64
+		resumable := remoteFile.Pack == nil && len(remoteFile.Meta.Pipeline) == 0 && e.verify && remoteFile.Meta.Checksum != ""
+		if resumable {
+			if part, err := e.fs.StatFile(rootDir, item.Path+domain.PartSuffix, true); err == nil && part.Size < remoteFile.ContentSize() {
+				offset = part.Size
+			}
 		}
-		defer rc.Close()
 
-		if err := e.fs.WriteFile(fullPath, rc); err != nil {
+		sum := remoteFile.Meta.Checksum
+		fromMirror := offset == 0 && e.verify && e.mirror.fetch(sum, partPath)
+		if fromMirror {
+			log.Printf("[*] Copying from the mirror: %s", item.Path)
+		} else {
+			// A pack is reported on its own: its size isn't the file's
+			var task domain.ProgressTask
+			if remoteFile.Pack == nil {
+				task = e.startTask(item.Path, remoteFile.Size)
+				if task != nil {
+					task.SetCurrent(offset)
+				}
+			}
+			rc, err := openRemoteAt(domain.WithProgressTask(ctx, task), e.storage, groupID, topicID, remoteFile, offset)
+			if err != nil {
+				finishTask(task, err)
+				return fmt.Errorf("error downloading file %s: %w", item.Path, err)
+			}
+			defer rc.Close()
+
+			if offset > 0 {
+				err = e.fs.AppendFile(partPath, rc)
+			} else {
+				err = e.fs.WriteFile(partPath, rc)
+			}
+			finishTask(task, err)
+			var mismatch *partMismatchError
+			if errors.As(err, &mismatch) {
+				// The parts before the corrupt one are fine: only it is downloaded again
+				log.Printf("[!] Part %d/%d of %s is corrupt, downloading it again", mismatch.part+1, mismatch.parts, item.Path)
+				if !resumable || e.fs.TruncateFile(partPath, mismatch.offset) != nil {
+					e.fs.DeleteFile(partPath)
+				}
+				return err
+			}
+			if err != nil {
+				// What was downloaded is kept for the next run, if it can use it
+				if !resumable {
+					e.fs.DeleteFile(partPath)
+				}
+				return fmt.Errorf("error writing file %s: %w", item.Path, err)
+			}
+		}
+		if err := e.verifyPart(rootDir, item.Path, remoteFile); err != nil {
+			e.fs.DeleteFile(partPath)
+			if fromMirror {
+				// Download it on the next attempt
+				e.mirror.evict(sum)
+			}
+			return err
+		}
+		if !fromMirror && e.verify {
+			e.mirror.store(sum, partPath)
+		}
+		if err := e.backup(rootDir, item.Path); err != nil {
+			return err
+		}
+		if err := e.fs.RenameFile(partPath, fullPath); err != nil {
 			return fmt.Errorf("error writing file %s: %w", item.Path, err)
 		}
 
@@ -180,16 +1049,118 @@ func (e *executor) download(ctx context.Context, item domain.SyncItem, rootDir s
 	return retry.WithRetry(ctx, "Pull: "+item.Path, operation, 5, 1*time.Second)
 }
 
+// verifyPart checks the downloaded content of path against its remote copy:
+// its size, and its checksum unless verification is disabled.
+func (e *executor) verifyPart(rootDir, path string, remoteFile *domain.RemoteFile) error {
+	part, err := e.fs.StatFile(rootDir, path+domain.PartSuffix, true)
+	if err != nil {
+		return fmt.Errorf("error checking file %s: %w", path, err)
+	}
+	if part.Size != remoteFile.ContentSize() {
+		return fmt.Errorf("downloaded %d bytes of %s instead of %d", part.Size, path, remoteFile.ContentSize())
+	}
+	if !e.verify || remoteFile.Meta.Checksum == "" {
+		return nil
+	}
+	// The remote file may have been uploaded with another --hash
+	sum, err := fileChecksum(e.fs, part.AbsPath, remoteFile.Meta.Algorithm)
+	if err != nil {
+		return fmt.Errorf("error checking file %s: %w", path, err)
+	}
+	if sum != remoteFile.Meta.Checksum {
+		return fmt.Errorf("checksum mismatch for downloaded file %s: got %s, expected %s", path, sum, remoteFile.Meta.Checksum)
+	}
+	return nil
+}
+
+// fileChecksum reads the file at path and returns its checksum with the
+// given algorithm.
+func fileChecksum(localFS domain.FileSystem, path, algorithm string) (string, error) {
+	h, err := checksum.New(algorithm)
+	if err != nil {
+		return "", err
+	}
+	rc, err := localFS.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	if _, err := io.Copy(h, rc); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func (e *executor) deleteRemote(ctx context.Context, item domain.SyncItem, groupID, topicID int64) error {
 	if item.RemoteFile == nil {
 		return fmt.Errorf("remote file is nil for delete: %s", item.Path)
 	}
-	log.Printf("[-] Deleting remote file: %s", item.Path)
-	return e.storage.DeleteFile(ctx, groupID, topicID, item.RemoteFile.MessageID)
+	if item.RemoteFile.Pack != nil {
+		log.Printf("[-] Deleting remote file: %s", item.Path)
+		e.edits.Remove(*item.RemoteFile)
+		return nil
+	}
+	if e.trash.topicID != 0 {
+		log.Printf("[-] Moving remote file to the trash: %s", item.Path)
+		if err := e.trash.move(ctx, groupID, *item.RemoteFile); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("[-] Deleting remote file: %s", item.Path)
+	}
+	return e.storage.DeleteFile(ctx, groupID, topicID, item.RemoteFile.MessageIDs()...)
 }
 
 func (e *executor) deleteLocal(item domain.SyncItem, rootDir string) error {
 	log.Printf("[-] Deleting local file: %s", item.Path)
+	if e.backupDir != "" {
+		return e.backup(rootDir, item.Path)
+	}
 	fullPath := filepath.Join(rootDir, item.Path)
 	return e.fs.DeleteFile(fullPath)
 }
+
+// backup moves the local file at path to the backup directory, if any,
+// before it is overwritten or deleted. A missing file is ignored.
+func (e *executor) backup(rootDir, path string) error {
+	if e.backupDir == "" {
+		return nil
+	}
+	local, err := e.fs.StatFile(rootDir, path, true)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error backing up %s: %w", path, err)
+	}
+
+	src := filepath.Join(rootDir, path)
+	dest := filepath.Join(e.backupDir, filepath.FromSlash(path))
+	if err := e.fs.EnsureDir(filepath.Dir(dest)); err != nil {
+		return fmt.Errorf("error backing up %s: %w", path, err)
+	}
+	if err := e.fs.RenameFile(src, dest); err != nil {
+		// The backup directory may be on another filesystem
+		if err := e.copyFile(src, dest, local.ModTime); err != nil {
+			return fmt.Errorf("error backing up %s: %w", path, err)
+		}
+		if err := e.fs.DeleteFile(src); err != nil {
+			return fmt.Errorf("error backing up %s: %w", path, err)
+		}
+	}
+	log.Printf("[*] Backed up: %s", path)
+	return nil
+}
+
+// copyFile copies the local file src to dest, with the given modification time.
+func (e *executor) copyFile(src, dest string, modTime int64) error {
+	r, err := e.fs.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := e.fs.WriteFile(dest, r); err != nil {
+		return err
+	}
+	return e.fs.SetModTime(dest, modTime)
+}
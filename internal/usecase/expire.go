@@ -0,0 +1,151 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"tg-blobsync/internal/domain"
+	"time"
+)
+
+// Expirer deletes the remote files older than the age set by retention
+// rules, turning a topic into a rolling window of recent files.
+type Expirer struct {
+	storage  domain.BlobStorage
+	dryRun   bool
+	byUpload bool
+}
+
+func NewExpirer(storage domain.BlobStorage) *Expirer {
+	return &Expirer{storage: storage}
+}
+
+// SetDryRun makes Expire only report what it would delete.
+func (x *Expirer) SetDryRun(dryRun bool) {
+	x.dryRun = dryRun
+}
+
+// SetByUpload makes Expire measure the age of files from their upload
+// instead of their modification time.
+func (x *Expirer) SetByUpload(byUpload bool) {
+	x.byUpload = byUpload
+}
+
+// retentionFor returns the rule applying to path, the first matching one.
+func retentionFor(rules []domain.RetentionRule, p string) (domain.RetentionRule, bool) {
+	for _, rule := range rules {
+		if rule.Match != "" && matchRule(rule.Match, p) {
+			return rule, true
+		}
+	}
+	return domain.RetentionRule{}, false
+}
+
+// Expire deletes the current files of the topic older than the age of the
+// rule matching them, along with their superseded versions uploaded before
+// then. Superseded versions are aged by their upload date.
+func (x *Expirer) Expire(ctx context.Context, groupID, topicID int64, rules []domain.RetentionRule) error {
+	log.Println("Looking for expired files...")
+
+	messages, err := x.storage.ListMessages(ctx, groupID, topicID)
+	if err != nil {
+		return fmt.Errorf("failed to list messages: %w", err)
+	}
+	uploaded := make(map[int]int64, len(messages))
+	for _, m := range messages {
+		uploaded[m.ID] = m.Date
+	}
+
+	files, err := x.storage.ListFiles(ctx, groupID, topicID)
+	if err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+
+	now := time.Now()
+	var edits packEdits
+	var expired, versions int
+	var size int64
+	for _, f := range files {
+		if isSnapshot(f) {
+			continue
+		}
+		rule, ok := retentionFor(rules, f.Meta.Path)
+		if !ok || rule.MaxAge <= 0 {
+			continue
+		}
+		age := f.Meta.ModTime
+		if x.byUpload || age == 0 {
+			age = uploaded[f.MessageID]
+		}
+		if age == 0 || now.Sub(time.Unix(age, 0)) < rule.MaxAge {
+			continue
+		}
+
+		expired++
+		size += f.Size
+		if x.dryRun {
+			log.Printf("[*] Would expire %s (%s)", f.Meta.Path, formatTime(age))
+			continue
+		}
+		log.Printf("[-] Expiring %s (%s)", f.Meta.Path, formatTime(age))
+		if f.Pack != nil {
+			edits.Remove(f)
+			continue
+		}
+		if err := x.storage.DeleteFile(ctx, groupID, topicID, f.MessageIDs()...); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", f.Meta.Path, err)
+		}
+	}
+
+	// Superseded versions, grouped like pruneVersions does
+	old := make(map[string]map[versionKey]*supersededVersion)
+	for _, m := range messages {
+		if m.Meta == nil || !m.Meta.HasFlag(domain.FlagSuperseded) {
+			continue
+		}
+		if rule, ok := retentionFor(rules, m.Meta.Path); !ok || rule.MaxAge <= 0 || now.Sub(time.Unix(m.Date, 0)) < rule.MaxAge {
+			continue
+		}
+		byVersion := old[m.Meta.Path]
+		if byVersion == nil {
+			byVersion = make(map[versionKey]*supersededVersion)
+			old[m.Meta.Path] = byVersion
+		}
+		key := versionKey{version: m.Meta.Version, checksum: m.Meta.Checksum, modTime: m.Meta.ModTime}
+		v := byVersion[key]
+		if v == nil {
+			v = &supersededVersion{}
+			byVersion[key] = v
+		}
+		v.messages = append(v.messages, m)
+	}
+	for path, byVersion := range old {
+		for _, v := range byVersion {
+			versions++
+			for _, m := range v.messages {
+				size += m.Size
+			}
+			if x.dryRun {
+				log.Printf("[*] Would delete old version %d of: %s", v.messages[0].Meta.Version, path)
+				continue
+			}
+			log.Printf("[-] Deleting old version %d of: %s", v.messages[0].Meta.Version, path)
+			if err := x.storage.DeleteFile(ctx, groupID, topicID, messageIDsOf(v.messages)...); err != nil {
+				return fmt.Errorf("failed to delete old version of %s: %w", path, err)
+			}
+		}
+	}
+
+	if err := edits.Apply(ctx, x.storage, groupID, topicID); err != nil {
+		return err
+	}
+
+	log.Printf("Expire Summary:")
+	log.Printf("  Files expired:    %d", expired)
+	log.Printf("  Old versions:     %d", versions)
+	log.Printf("  Reclaimed space:  %s", formatSize(size))
+	if x.dryRun && expired+versions > 0 {
+		log.Printf("Dry run: nothing was deleted")
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package usecase
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/checksum"
+	"time"
+)
+
+// checksumCache is implemented by the filesystems caching checksums.
+type checksumCache interface {
+	CachedChecksum(path string) (string, bool)
+}
+
+// Explainer reports everything known about a single path, and what push
+// and pull would do with it, to debug unexpected transfers.
+type Explainer struct {
+	fs          domain.FileSystem
+	storage     domain.BlobStorage
+	skipMD5     bool
+	rules       fileRules
+	stateDir    string
+	deleteGrace time.Duration
+}
+
+func NewExplainer(fs domain.FileSystem, storage domain.BlobStorage, skipMD5 bool) *Explainer {
+	return &Explainer{fs: fs, storage: storage, skipMD5: skipMD5}
+}
+
+// SetRules sets the file rules push and pull would apply.
+func (x *Explainer) SetRules(rules []domain.FileRule) {
+	x.rules = rules
+}
+
+// SetStateDir sets the state directory holding the journal of an
+// interrupted push, if any.
+func (x *Explainer) SetStateDir(dir string) {
+	x.stateDir = dir
+}
+
+// SetDeleteGrace sets the grace period push would apply to deletions.
+func (x *Explainer) SetDeleteGrace(grace time.Duration) {
+	x.deleteGrace = grace
+}
+
+// Explain logs the local file at path under rootDir (skipped if empty), its
+// cached checksum, the remote file at path, its state in the journal of an
+// interrupted push, and the decisions of push and pull about it.
+func (x *Explainer) Explain(ctx context.Context, rootDir string, groupID, topicID int64, path string) error {
+	path = strings.Trim(filepath.ToSlash(path), "/")
+	log.Printf("Explain %s:", path)
+
+	local := make(map[string]domain.LocalFile)
+	if rootDir == "" {
+		log.Printf("  Local:    no --dir given")
+	} else {
+		// Looked up before hashing, which refreshes the cache
+		cached, hasCached := "", false
+		if cache, ok := x.fs.(checksumCache); ok {
+			cached, hasCached = cache.CachedChecksum(filepath.Join(rootDir, filepath.FromSlash(path)))
+		}
+		f, err := x.fs.StatFile(rootDir, path, x.skipMD5)
+		switch {
+		case err == nil:
+			local[path] = f
+			log.Printf("  Local:    %s, %s, modified %s, %s %s", f.AbsPath, formatSize(f.Size), formatTime(f.ModTime), checksum.Name(f.Algorithm), orDash(f.Checksum))
+			switch {
+			case hasCached && cached != f.Checksum && !x.skipMD5:
+				log.Printf("  Cache:    %s %s (stale, see hash)", checksum.Name(f.Algorithm), cached)
+			case hasCached:
+				log.Printf("  Cache:    %s %s", checksum.Name(f.Algorithm), cached)
+			default:
+				log.Printf("  Cache:    no valid entry")
+			}
+		case errors.Is(err, fs.ErrNotExist):
+			log.Printf("  Local:    not found in %s", rootDir)
+		default:
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+	}
+
+	files, err := x.storage.ListFiles(ctx, groupID, topicID)
+	if err != nil {
+		return fmt.Errorf("failed to list remote files: %w", err)
+	}
+	remote := make(map[string]domain.RemoteFile)
+	for _, f := range files {
+		if f.Meta.Path != path || isSnapshot(f) {
+			continue
+		}
+		// Keep first (newest), as the scanner does
+		if _, exists := remote[path]; !exists {
+			remote[path] = f
+		}
+	}
+	if f, ok := remote[path]; ok {
+		log.Printf("  Remote:   message %d, version %d, %s, modified %s, %s %s", f.MessageID, f.Meta.Version, formatSize(f.Size), formatTime(f.Meta.ModTime), checksum.Name(f.Meta.Algorithm), orDash(f.Meta.Checksum))
+		switch {
+		case f.Pack != nil:
+			log.Printf("  Stored:   in pack %s (message %d)", f.Pack.Path, f.Pack.MessageID)
+		case len(f.Chunks) > 0:
+			log.Printf("  Stored:   in %d parts", len(f.Chunks))
+		}
+		if len(f.Meta.Pipeline) > 0 {
+			log.Printf("  Pipeline: %s, %s stored as %s", strings.Join(f.Meta.Pipeline, ", "), formatSize(f.Meta.ContentSize), formatSize(f.Size))
+		}
+		if f.Meta.Flags != "" {
+			log.Printf("  Flags:    %s", f.Meta.Flags)
+		}
+		if len(f.Meta.Tags) > 0 {
+			log.Printf("  Tags:     %s", formatTags(f.Meta.Tags))
+		}
+		if f.Meta.Host != "" || f.Meta.RunID != "" {
+			log.Printf("  Origin:   uploaded from %s by tgblobsync %s, run %s", orDash(f.Meta.Host), orDash(f.Meta.Tool), orDash(f.Meta.RunID))
+		}
+		if caption, err := json.Marshal(f.Meta); err == nil {
+			log.Printf("  Caption:  %s", caption)
+		}
+	} else {
+		log.Printf("  Remote:   not found (see history for older versions)")
+	}
+
+	if x.stateDir != "" {
+		header, done, err := loadJournal(filepath.Join(x.stateDir, pushJournalFile))
+		if err != nil {
+			return err
+		}
+		for _, item := range journalItems(header) {
+			if item.Path != path {
+				continue
+			}
+			state := "pending"
+			if done[path] {
+				state = "done"
+			}
+			log.Printf("  Journal:  %s in the interrupted push (%s)", strings.ToLower(string(item.Action)), state)
+		}
+	}
+
+	switch {
+	case x.rules.Skip(path):
+		log.Printf("  Decision: skipped by a file rule, left out of every sync")
+	case rootDir == "":
+		log.Printf("  Decision: unknown without --dir")
+	default:
+		differ := NewDiffer(x.skipMD5)
+		differ.SetDeleteGrace(x.deleteGrace)
+		logDecision("Push", differ.DiffPush(local, remote))
+		logDecision("Pull", NewDiffer(x.skipMD5).DiffPull(local, remote))
+	}
+	return nil
+}
+
+// logDecision logs what a single-path plan does.
+func logDecision(op string, plan domain.SyncPlan) {
+	if len(plan.Items) == 0 {
+		log.Printf("  %-10sup to date", op+":")
+		return
+	}
+	item := plan.Items[0]
+	log.Printf("  %-10s%s: %s", op+":", strings.ToLower(string(item.Action)), item.Why())
+}
+
+// journalItems returns the items of a journal, none if there is no journal.
+func journalItems(header *journalHeader) []domain.SyncItem {
+	if header == nil {
+		return nil
+	}
+	return header.Items
+}
+
+// formatTags formats tags as sorted key=value pairs, "-" when there are none.
+func formatTags(tags map[string]string) string {
+	if len(tags) == 0 {
+		return "-"
+	}
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
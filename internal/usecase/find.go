@@ -0,0 +1,100 @@
+package usecase
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"tg-blobsync/internal/domain"
+	"time"
+)
+
+// FindFilter selects remote files. Zero fields select every file.
+type FindFilter struct {
+	// Name is a glob matching the file name, or the whole path when it
+	// holds a slash, as the patterns of rules do.
+	Name    string
+	MinSize int64
+	MaxSize int64
+	// NewerThan and OlderThan bound the age of the files, from their
+	// modification time.
+	NewerThan time.Duration
+	OlderThan time.Duration
+	Tags      map[string]string
+}
+
+// FoundFile is a remote file selected by Find.
+type FoundFile struct {
+	Path    string            `json:"path"`
+	Size    int64             `json:"size"`
+	ModTime time.Time         `json:"mtime"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
+// Finder searches the remote files of a topic.
+type Finder struct {
+	storage domain.BlobStorage
+}
+
+func NewFinder(storage domain.BlobStorage) *Finder {
+	return &Finder{storage: storage}
+}
+
+// Find returns the remote files under dir, "" being the root of the topic,
+// selected by filter, sorted by path.
+func (f *Finder) Find(ctx context.Context, groupID, topicID int64, dir string, filter FindFilter) ([]FoundFile, error) {
+	dir = strings.Trim(filepath.ToSlash(dir), "/")
+	files, err := NewScanner(nil, f.storage, dir, false).ScanRemote(ctx, groupID, topicID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var found []FoundFile
+	var size int64
+	for p, file := range files {
+		modTime := time.Unix(file.Meta.ModTime, 0)
+		switch {
+		case filter.Name != "" && !matchRule(filter.Name, p):
+		case filter.MinSize > 0 && file.ContentSize() < filter.MinSize:
+		case filter.MaxSize > 0 && file.ContentSize() > filter.MaxSize:
+		case filter.NewerThan > 0 && now.Sub(modTime) > filter.NewerThan:
+		case filter.OlderThan > 0 && now.Sub(modTime) < filter.OlderThan:
+		case !file.Meta.MatchesTags(filter.Tags):
+		default:
+			found = append(found, FoundFile{Path: p, Size: file.ContentSize(), ModTime: modTime, Tags: file.Meta.Tags})
+			size += file.ContentSize()
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Path < found[j].Path
+	})
+
+	log.Printf("Find Summary:")
+	log.Printf("  Remote files: %d", len(files))
+	log.Printf("  Matched:      %d (%s)", len(found), formatSize(size))
+	return found, nil
+}
+
+// WriteFound writes the files found to w, one path per line, or as a JSON
+// array.
+func WriteFound(w io.Writer, found []FoundFile, asJSON bool) error {
+	if asJSON {
+		if found == nil {
+			found = []FoundFile{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(found)
+	}
+	for _, f := range found {
+		if _, err := fmt.Fprintln(w, f.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,451 @@
+package usecase
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/checksum"
+)
+
+// FsckStatus classifies a problem found by the Checker.
+type FsckStatus string
+
+const (
+	// FsckMalformed: a caption looks like metadata but can't be used.
+	FsckMalformed FsckStatus = "MALFORMED"
+	// FsckDuplicate: an older version of a path, hidden by a newer one.
+	FsckDuplicate FsckStatus = "DUPLICATE"
+	// FsckIncomplete: the parts of a chunked file missing some of the others.
+	FsckIncomplete FsckStatus = "INCOMPLETE"
+	// FsckSizeMismatch: a document whose size contradicts its metadata.
+	FsckSizeMismatch FsckStatus = "SIZE_MISMATCH"
+	// FsckUnnormalized: a caption whose path isn't in Unicode form NFC.
+	FsckUnnormalized FsckStatus = "UNNORMALIZED"
+	// FsckOrphaned: metadata sidecars no caption points to any more.
+	FsckOrphaned FsckStatus = "ORPHANED"
+)
+
+// FsckIssue is a single problem found by the Checker, along with the
+// messages involved.
+type FsckIssue struct {
+	Path     string
+	Status   FsckStatus
+	Detail   string
+	Messages []domain.RemoteMessage
+}
+
+// FsckReport is the outcome of a metadata check.
+type FsckReport struct {
+	Checked int
+	Issues  []FsckIssue
+}
+
+// Checker checks the consistency of the messages of a topic with their
+// metadata, and repairs it.
+type Checker struct {
+	storage   domain.BlobStorage
+	malformed domain.RecoveryAction
+	chooser   domain.RecoveryChooser
+}
+
+func NewChecker(storage domain.BlobStorage) *Checker {
+	return &Checker{storage: storage}
+}
+
+// SetMalformed sets what Repair does with the messages whose metadata is
+// malformed, once recovered as well as possible. An empty action asks
+// chooser for each of them, leaving them untouched without a chooser.
+func (c *Checker) SetMalformed(action domain.RecoveryAction, chooser domain.RecoveryChooser) {
+	c.malformed = action
+	c.chooser = chooser
+}
+
+// fsckFile is a complete version of a path, made of one or more messages.
+type fsckFile struct {
+	newest   int
+	messages []domain.RemoteMessage
+}
+
+// Check walks the whole history of the topic and reports the messages that
+// are malformed, shadowed by a newer version, left by an incomplete chunked
+// upload, of an unexpected size or whose path isn't normalized, and the
+// metadata sidecars no longer used.
+func (c *Checker) Check(ctx context.Context, groupID, topicID int64) (*FsckReport, error) {
+	log.Println("Checking topic metadata...")
+
+	report, err := c.check(ctx, groupID, topicID)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Fsck Summary:")
+	log.Printf("  Messages checked: %d", report.Checked)
+	log.Printf("  Issues found:     %d", len(report.Issues))
+	for _, issue := range report.Issues {
+		log.Printf("  [%s] %s: %s (messages %v)", issue.Status, issue.Path, issue.Detail, messageIDsOf(issue.Messages))
+	}
+	return report, nil
+}
+
+// check builds the report of Check, without logging it.
+func (c *Checker) check(ctx context.Context, groupID, topicID int64) (*FsckReport, error) {
+	messages, err := c.storage.ListMessages(ctx, groupID, topicID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list messages: %w", err)
+	}
+	return checkMessages(messages), nil
+}
+
+// checkMessages builds the report of Check from the messages of the topic.
+func checkMessages(messages []domain.RemoteMessage) *FsckReport {
+	report := &FsckReport{}
+	byPath := make(map[string][]fsckFile)
+	chunked := make(map[chunkSetKey][]domain.RemoteMessage)
+	var sidecars []domain.RemoteMessage
+	pointed := make(map[int]bool)
+
+	for _, m := range messages {
+		if m.Meta == nil {
+			// Foreign documents are not ours to check
+			if strings.HasPrefix(strings.TrimSpace(m.Caption), "{") {
+				report.Issues = append(report.Issues, FsckIssue{Status: FsckMalformed, Detail: "unparsable caption", Messages: []domain.RemoteMessage{m}})
+			}
+			continue
+		}
+		meta := *m.Meta
+		if meta.HasFlag(domain.FlagSidecar) {
+			sidecars = append(sidecars, m)
+			continue
+		}
+		if meta.Sidecar != 0 {
+			pointed[meta.Sidecar] = true
+		}
+		if meta.HasFlag(domain.FlagQuarantined) || meta.HasFlag(domain.FlagSuperseded) || meta.HasFlag(domain.FlagPack) {
+			continue
+		}
+		report.Checked++
+		if stored, ok := captionPath(m.Caption); ok && stored != meta.Path {
+			report.Issues = append(report.Issues, FsckIssue{Path: meta.Path, Status: FsckUnnormalized, Detail: fmt.Sprintf("stored as %+q", stored), Messages: []domain.RemoteMessage{m}})
+		}
+
+		if meta.Checksum == "" && meta.ModTime == 0 {
+			report.Issues = append(report.Issues, FsckIssue{Path: meta.Path, Status: FsckMalformed, Detail: "no checksum nor modification time", Messages: []domain.RemoteMessage{m}})
+			continue
+		}
+
+		if !meta.IsChunked() {
+			if meta.HasFlag(domain.FlagEmptyFile) && m.Size != 1 {
+				report.Issues = append(report.Issues, FsckIssue{Path: meta.Path, Status: FsckSizeMismatch, Detail: fmt.Sprintf("empty file stored as %d bytes", m.Size), Messages: []domain.RemoteMessage{m}})
+				continue
+			}
+			byPath[meta.Path] = append(byPath[meta.Path], fsckFile{newest: m.ID, messages: []domain.RemoteMessage{m}})
+			continue
+		}
+
+		if meta.Part < 0 || meta.Part >= meta.Parts || meta.PartSize <= 0 {
+			report.Issues = append(report.Issues, FsckIssue{Path: meta.Path, Status: FsckMalformed, Detail: fmt.Sprintf("invalid part %d of %d", meta.Part, meta.Parts), Messages: []domain.RemoteMessage{m}})
+			continue
+		}
+		key := chunkSetKey{path: meta.Path, checksum: meta.Checksum, modTime: meta.ModTime, parts: meta.Parts}
+		chunked[key] = append(chunked[key], m)
+	}
+
+	for key, parts := range chunked {
+		byPart := make(map[int]domain.RemoteMessage)
+		var stale []domain.RemoteMessage
+		var detail string
+		for _, m := range parts {
+			if _, dup := byPart[m.Meta.Part]; dup {
+				// Newest first: the part already seen wins
+				stale = append(stale, m)
+				continue
+			}
+			byPart[m.Meta.Part] = m
+			last := m.Meta.Part == key.parts-1
+			if (!last && m.Size != m.Meta.PartSize) || (last && (m.Size <= 0 || m.Size > m.Meta.PartSize)) {
+				detail = fmt.Sprintf("part %d is %d bytes, part size %d", m.Meta.Part, m.Size, m.Meta.PartSize)
+			}
+		}
+		if len(stale) > 0 {
+			report.Issues = append(report.Issues, FsckIssue{Path: key.path, Status: FsckDuplicate, Detail: "parts sent twice", Messages: stale})
+		}
+
+		complete := make([]domain.RemoteMessage, 0, len(byPart))
+		for _, m := range byPart {
+			complete = append(complete, m)
+		}
+		switch {
+		case len(byPart) < key.parts:
+			report.Issues = append(report.Issues, FsckIssue{Path: key.path, Status: FsckIncomplete, Detail: fmt.Sprintf("%d of %d parts", len(byPart), key.parts), Messages: complete})
+		case detail != "":
+			report.Issues = append(report.Issues, FsckIssue{Path: key.path, Status: FsckSizeMismatch, Detail: detail, Messages: complete})
+		default:
+			newest := 0
+			for _, m := range complete {
+				newest = max(newest, m.ID)
+			}
+			byPath[key.path] = append(byPath[key.path], fsckFile{newest: newest, messages: complete})
+		}
+	}
+
+	var orphans []domain.RemoteMessage
+	for _, m := range sidecars {
+		if !pointed[m.ID] {
+			orphans = append(orphans, m)
+		}
+	}
+	if len(orphans) > 0 {
+		report.Issues = append(report.Issues, FsckIssue{Path: orphans[0].Meta.Path, Status: FsckOrphaned, Detail: fmt.Sprintf("%d metadata sidecars of no file", len(orphans)), Messages: orphans})
+	}
+
+	for path, files := range byPath {
+		if len(files) < 2 {
+			continue
+		}
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].newest > files[j].newest
+		})
+		var shadowed []domain.RemoteMessage
+		for _, f := range files[1:] {
+			shadowed = append(shadowed, f.messages...)
+		}
+		report.Issues = append(report.Issues, FsckIssue{Path: path, Status: FsckDuplicate, Detail: fmt.Sprintf("%d older versions", len(files)-1), Messages: shadowed})
+	}
+
+	sort.Slice(report.Issues, func(i, j int) bool {
+		if report.Issues[i].Path != report.Issues[j].Path {
+			return report.Issues[i].Path < report.Issues[j].Path
+		}
+		return report.Issues[i].Status < report.Issues[j].Status
+	})
+	return report
+}
+
+// Repair fixes the issues of a report: shadowed versions, incomplete
+// uploads and orphaned sidecars are deleted, since the listing never uses
+// them, while the files of an unexpected size are quarantined, so that the
+// next push uploads them again. The captions of unnormalized paths are
+// rewritten in form NFC. Malformed messages are adopted, deleted or left
+// untouched as set by SetMalformed.
+func (c *Checker) Repair(ctx context.Context, report *FsckReport, groupID, topicID int64) error {
+	var taken map[string]bool
+	// Messages deleted or quarantined, whose caption needs no other change
+	done := make(map[int]bool)
+	for _, issue := range report.Issues {
+		switch issue.Status {
+		case FsckDuplicate, FsckIncomplete, FsckOrphaned:
+			log.Printf("[-] Deleting %s messages of %s: %v", strings.ToLower(string(issue.Status)), issue.Path, messageIDsOf(issue.Messages))
+			if err := c.storage.DeleteFile(ctx, groupID, topicID, messageIDsOf(issue.Messages)...); err != nil {
+				return fmt.Errorf("failed to delete messages of %s: %w", issue.Path, err)
+			}
+			for _, m := range issue.Messages {
+				done[m.ID] = true
+			}
+		case FsckUnnormalized:
+			for _, m := range issue.Messages {
+				if done[m.ID] {
+					continue
+				}
+				log.Printf("[*] Normalizing path of %s (message %d)", issue.Path, m.ID)
+				if err := c.storage.UpdateFileMeta(ctx, groupID, topicID, domain.RemoteFile{Meta: *m.Meta, MessageID: m.ID}, *m.Meta); err != nil {
+					return fmt.Errorf("failed to normalize %s: %w", issue.Path, err)
+				}
+			}
+		case FsckSizeMismatch:
+			log.Printf("[*] Quarantining %s", issue.Path)
+			for _, m := range issue.Messages {
+				meta := *m.Meta
+				meta.SetFlag(domain.FlagQuarantined)
+				if err := c.storage.UpdateFileMeta(ctx, groupID, topicID, domain.RemoteFile{Meta: *m.Meta, MessageID: m.ID}, meta); err != nil {
+					return fmt.Errorf("failed to quarantine %s: %w", issue.Path, err)
+				}
+				done[m.ID] = true
+			}
+		case FsckMalformed:
+			if taken == nil {
+				files, err := NewScanner(nil, c.storage, "", false).ScanRemote(ctx, groupID, topicID)
+				if err != nil {
+					return err
+				}
+				taken = make(map[string]bool, len(files))
+				for p := range files {
+					taken[p] = true
+				}
+			}
+			for _, m := range issue.Messages {
+				if err := c.recover(ctx, m, issue.Detail, taken, groupID, topicID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// recover adopts, deletes or leaves untouched a malformed message, whose
+// problem is given, as set by SetMalformed. Adopting it stores the metadata
+// recovered from its caption and document, the checksum being computed by
+// downloading it if needed.
+func (c *Checker) recover(ctx context.Context, m domain.RemoteMessage, problem string, taken map[string]bool, groupID, topicID int64) error {
+	recovered := recoverMeta(m, taken)
+	action := c.malformed
+	if action == "" {
+		action = domain.RecoverySkip
+		if c.chooser != nil {
+			var err error
+			if action, err = c.chooser.ChooseRecovery(m, recovered, problem); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch {
+	case action == domain.RecoveryDelete:
+		log.Printf("[-] Deleting malformed message %d", m.ID)
+		if err := c.storage.DeleteFile(ctx, groupID, topicID, m.ID); err != nil {
+			return fmt.Errorf("failed to delete message %d: %w", m.ID, err)
+		}
+	case action == domain.RecoveryAdopt && recovered != nil:
+		meta := *recovered
+		if meta.Checksum == "" {
+			sum, err := messageChecksum(ctx, c.storage, groupID, topicID, m, meta.Path)
+			if err != nil {
+				return fmt.Errorf("failed to checksum %s: %w", meta.Path, err)
+			}
+			meta.Checksum = sum
+		}
+		if err := c.storage.UpdateFileMeta(ctx, groupID, topicID, domain.RemoteFile{MessageID: m.ID}, meta); err != nil {
+			return fmt.Errorf("failed to adopt %s: %w", meta.Path, err)
+		}
+		taken[meta.Path] = true
+		log.Printf("[+] Adopted: %s (message %d)", meta.Path, m.ID)
+	case action == domain.RecoveryAdopt:
+		log.Printf("[!] Leaving malformed message %d untouched: no metadata could be recovered", m.ID)
+	default:
+		log.Printf("[!] Leaving malformed message %d untouched", m.ID)
+	}
+	return nil
+}
+
+// captionPath returns the path stored in a metadata caption, as written
+// before the normalization the parsed metadata goes through, or false for
+// the paths stored base64 encoded, which are never normalized, and those
+// stored in a sidecar.
+func captionPath(caption string) (string, bool) {
+	var stored struct {
+		Path       string `json:"p"`
+		PathBase64 string `json:"pb"`
+	}
+	if err := json.Unmarshal([]byte(caption), &stored); err != nil || stored.PathBase64 != "" || stored.Path == "" {
+		return "", false
+	}
+	return stored.Path, true
+}
+
+// captionField matches a field of a metadata caption, whose value is a
+// string or an integer, even in a truncated caption.
+var captionField = regexp.MustCompile(`"(p|m|t|v)":("(?:[^"\\]|\\.)*"|-?[0-9]+)`)
+
+// partName matches the document names of the parts of a chunked file.
+var partName = regexp.MustCompile(`\.part[0-9]{3}$`)
+
+// recoverMeta returns the metadata of a malformed message, recovered from
+// what can still be read of its caption, its document name and date, or
+// nil if the message can't be adopted: a single part of a chunked file, a
+// transformed content, or a path taken by another file. The checksum is only
+// kept when valid.
+func recoverMeta(m domain.RemoteMessage, taken map[string]bool) *domain.FileMeta {
+	var meta domain.FileMeta
+	if m.Meta != nil {
+		meta = *m.Meta
+	} else {
+		if strings.Contains(m.Caption, `"x":`) || strings.Contains(m.Caption, `"pn":`) {
+			return nil
+		}
+		// Fields come first: later matches may be the keys of tags
+		seen := make(map[string]bool)
+		for _, match := range captionField.FindAllStringSubmatch(m.Caption, -1) {
+			if seen[match[1]] {
+				continue
+			}
+			seen[match[1]] = true
+			switch match[1] {
+			case "p":
+				json.Unmarshal([]byte(match[2]), &meta.Path)
+			case "m":
+				json.Unmarshal([]byte(match[2]), &meta.Checksum)
+			case "t":
+				json.Unmarshal([]byte(match[2]), &meta.ModTime)
+			case "v":
+				json.Unmarshal([]byte(match[2]), &meta.Version)
+			}
+		}
+	}
+	if meta.Parts > 0 || len(meta.Pipeline) > 0 {
+		return nil
+	}
+
+	recovered := domain.FileMeta{
+		Path:      strings.Trim(filepath.ToSlash(meta.Path), "/"),
+		Checksum:  meta.Checksum,
+		Algorithm: meta.Algorithm,
+		ModTime:   meta.ModTime,
+		Version:   meta.Version,
+		Tags:      meta.Tags,
+	}
+	if recovered.Path == "" {
+		name := path.Base(strings.ReplaceAll(m.FileName, "\\", "/"))
+		if m.FileName == "" || partName.MatchString(name) {
+			return nil
+		}
+		recovered.Path = name
+	}
+	if taken[recovered.Path] || !filepath.IsLocal(filepath.FromSlash(recovered.Path)) || unsafePath(recovered.Path) {
+		return nil
+	}
+	if recovered.ModTime <= 0 {
+		recovered.ModTime = m.Date
+	}
+	if h, err := checksum.New(recovered.Algorithm); err != nil || !validChecksum(recovered.Checksum, h.Size()) {
+		// Adoption computes an MD5 instead
+		recovered.Checksum, recovered.Algorithm = "", checksum.MD5
+	}
+	if meta.HasFlag(domain.FlagEmptyFile) {
+		// The document is a dummy byte, not the content
+		recovered.SetFlag(domain.FlagEmptyFile)
+		sum := md5.Sum(nil)
+		recovered.Checksum, recovered.Algorithm = hex.EncodeToString(sum[:]), checksum.MD5
+	}
+	return &recovered
+}
+
+// validChecksum reports whether sum is the hex encoding of a size bytes checksum.
+func validChecksum(sum string, size int) bool {
+	_, err := hex.DecodeString(sum)
+	return err == nil && len(sum) == 2*size
+}
+
+// chunkSetKey identifies the parts belonging to the same upload of a chunked file.
+type chunkSetKey struct {
+	path     string
+	checksum string
+	modTime  int64
+	parts    int
+}
+
+func messageIDsOf(messages []domain.RemoteMessage) []int {
+	ids := make([]int, 0, len(messages))
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
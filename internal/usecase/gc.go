@@ -0,0 +1,81 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"tg-blobsync/internal/domain"
+)
+
+// Collector deletes the messages no listing ever uses: the older versions
+// left when deleting them after an update failed, the parts of interrupted
+// chunked uploads, and the metadata sidecars of files deleted or edited.
+type Collector struct {
+	checker *Checker
+	storage domain.BlobStorage
+	dryRun  bool
+}
+
+func NewCollector(storage domain.BlobStorage) *Collector {
+	return &Collector{checker: NewChecker(storage), storage: storage}
+}
+
+// SetDryRun makes Collect only report what it would delete.
+func (c *Collector) SetDryRun(dryRun bool) {
+	c.dryRun = dryRun
+}
+
+// Collect keeps the newest complete version of every path of the topic and
+// deletes the messages of the others.
+func (c *Collector) Collect(ctx context.Context, groupID, topicID int64) error {
+	log.Println("Collecting stale messages...")
+
+	report, err := c.checker.check(ctx, groupID, topicID)
+	if err != nil {
+		return err
+	}
+
+	var messages, paths int
+	var size int64
+	for _, issue := range report.Issues {
+		if issue.Status != FsckDuplicate && issue.Status != FsckIncomplete && issue.Status != FsckOrphaned {
+			continue
+		}
+		paths++
+		messages += len(issue.Messages)
+		for _, m := range issue.Messages {
+			size += m.Size
+		}
+
+		ids := messageIDsOf(issue.Messages)
+		if c.dryRun {
+			log.Printf("[*] Would delete %s messages of %s: %v", issueKind(issue.Status), issue.Path, ids)
+			continue
+		}
+		log.Printf("[-] Deleting %s messages of %s: %v", issueKind(issue.Status), issue.Path, ids)
+		if err := c.storage.DeleteFile(ctx, groupID, topicID, ids...); err != nil {
+			return fmt.Errorf("failed to delete messages of %s: %w", issue.Path, err)
+		}
+	}
+
+	log.Printf("GC Summary:")
+	log.Printf("  Messages checked: %d", report.Checked)
+	log.Printf("  Paths affected:   %d", paths)
+	log.Printf("  Stale messages:   %d", messages)
+	log.Printf("  Reclaimed space:  %s", formatSize(size))
+	if c.dryRun && messages > 0 {
+		log.Printf("Dry run: nothing was deleted")
+	}
+	return nil
+}
+
+// issueKind describes the stale messages of an issue.
+func issueKind(status FsckStatus) string {
+	switch status {
+	case FsckIncomplete:
+		return "incomplete"
+	case FsckOrphaned:
+		return "orphaned"
+	}
+	return "older"
+}
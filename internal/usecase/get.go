@@ -0,0 +1,103 @@
+package usecase
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/checksum"
+	"tg-blobsync/internal/pkg/retry"
+	"time"
+)
+
+// Getter downloads single remote files, without planning a whole sync.
+type Getter struct {
+	fs      domain.FileSystem
+	storage domain.BlobStorage
+	stats   *Stats
+}
+
+func NewGetter(fs domain.FileSystem, storage domain.BlobStorage) *Getter {
+	return &Getter{fs: fs, storage: storage}
+}
+
+// SetStats makes Get count the file it downloads.
+func (g *Getter) SetStats(stats *Stats) {
+	g.stats = stats
+}
+
+// Get downloads the current version of path to dest, replacing it if it
+// exists. The path is looked up in the listing, read from the index when
+// there is one.
+func (g *Getter) Get(ctx context.Context, groupID, topicID int64, path, dest string) error {
+	path = strings.Trim(filepath.ToSlash(path), "/")
+	files, err := g.storage.ListFiles(ctx, groupID, topicID)
+	if err != nil {
+		return fmt.Errorf("failed to list remote files: %w", err)
+	}
+
+	var file *domain.RemoteFile
+	for i, f := range files {
+		if f.Meta.Path == path && !isSnapshot(f) {
+			file = &files[i]
+			break
+		}
+	}
+	if file == nil {
+		return fmt.Errorf("remote file not found: %s", path)
+	}
+
+	log.Printf("[*] Downloading %s (%s) to %s", path, formatSize(file.Size), dest)
+	if err := downloadTo(ctx, g.fs, g.storage, groupID, topicID, file, dest); err != nil {
+		g.stats.fail(1, file.Size, err)
+		return err
+	}
+	g.stats.add(StatDownloaded, 1, file.Size)
+	log.Printf("[+] Downloaded: %s", dest)
+	return nil
+}
+
+// downloadTo writes the content of a remote file to dest, through a part
+// file renamed once its checksum is verified, and sets its modification time.
+func downloadTo(ctx context.Context, fs domain.FileSystem, storage domain.BlobStorage, groupID, topicID int64, file *domain.RemoteFile, dest string) error {
+	path := file.Meta.Path
+	partPath := dest + domain.PartSuffix
+	h, err := checksum.New(file.Meta.Algorithm)
+	if err != nil {
+		return fmt.Errorf("can't verify %s: %w", path, err)
+	}
+	if file.Meta.HasFlag(domain.FlagEmptyFile) {
+		err = fs.WriteFile(partPath, strings.NewReader(""))
+	} else {
+		err = retry.WithRetry(ctx, "Download: "+path, func() error {
+			rc, err := openRemote(ctx, storage, groupID, topicID, file)
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+			h.Reset()
+			return fs.WriteFile(partPath, io.TeeReader(rc, h))
+		}, 5, 1*time.Second)
+	}
+	if err != nil {
+		fs.DeleteFile(partPath)
+		return fmt.Errorf("failed to download %s: %w", path, err)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); file.Meta.Checksum != "" && sum != file.Meta.Checksum {
+		fs.DeleteFile(partPath)
+		return fmt.Errorf("checksum mismatch for downloaded file %s: got %s, expected %s", path, sum, file.Meta.Checksum)
+	}
+	if err := fs.RenameFile(partPath, dest); err != nil {
+		return fmt.Errorf("failed to download %s: %w", path, err)
+	}
+	if file.Meta.ModTime > 0 {
+		if err := fs.SetModTime(dest, file.Meta.ModTime); err != nil {
+			log.Printf("[!] Warning: failed to set modification time for %s: %v", dest, err)
+		}
+	}
+	return nil
+}
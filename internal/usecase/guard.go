@@ -0,0 +1,49 @@
+package usecase
+
+import (
+	"fmt"
+
+	"tg-blobsync/internal/domain"
+)
+
+// pruneGuardMin is the number of remote deletions below which a push is never
+// considered suspicious.
+const pruneGuardMin = 100
+
+// checkPrune refuses deletions that look caused by a missing source rather
+// than by the user, such as an unmounted disk leaving an empty mount point:
+// every remote file missing locally, or more than half of them.
+func checkPrune(local int, remote map[string]domain.RemoteFile, deletions int) error {
+	if deletions == 0 {
+		return nil
+	}
+	live := 0
+	for _, f := range remote {
+		if !f.Meta.HasFlag(domain.FlagArchived) {
+			live++
+		}
+	}
+	if local > 0 && (deletions < pruneGuardMin || deletions*2 <= live) {
+		return nil
+	}
+	return fmt.Errorf("refusing to delete %d of %d remote files, as the local directory (%d files) may be unmounted or emptied by mistake: check it, or use --force to delete them anyway", deletions, live, local)
+}
+
+// deleteLimit caps the deletions of a sync, set by the user. Zero fields
+// don't limit anything.
+type deleteLimit struct {
+	max     int
+	percent int
+}
+
+// check refuses more deletions than the limit, out of total files on the
+// side they would be deleted from.
+func (l deleteLimit) check(deletions, total int) error {
+	if l.max > 0 && deletions > l.max {
+		return fmt.Errorf("refusing to delete %d files, more than --max-delete %d: check the plan, or raise the limit", deletions, l.max)
+	}
+	if l.percent > 0 && total > 0 && deletions*100 > total*l.percent {
+		return fmt.Errorf("refusing to delete %d of %d files, more than --max-delete-percent %d%%: check the plan, or raise the limit", deletions, total, l.percent)
+	}
+	return nil
+}
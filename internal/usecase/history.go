@@ -0,0 +1,225 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/checksum"
+	"time"
+)
+
+// VersionStatus tells how a stored version of a path relates to the listing.
+type VersionStatus string
+
+const (
+	// VersionCurrent: the version listed for the path.
+	VersionCurrent VersionStatus = "current"
+	// VersionSuperseded: an older version kept by --keep-versions.
+	VersionSuperseded VersionStatus = "superseded"
+	// VersionQuarantined: a version found damaged by fsck.
+	VersionQuarantined VersionStatus = "quarantined"
+	// VersionIncomplete: the parts of an interrupted chunked upload.
+	VersionIncomplete VersionStatus = "incomplete"
+	// VersionStale: an older version whose deletion failed, left for gc.
+	VersionStale VersionStatus = "stale"
+)
+
+// FileVersion is a version of a remote path, as stored in the topic.
+type FileVersion struct {
+	File   domain.RemoteFile
+	Date   int64 // upload date, Unix seconds
+	Status VersionStatus
+	newest int // ID of the newest message of the version
+}
+
+// Historian lists and restores the stored versions of remote paths.
+type Historian struct {
+	fs      domain.FileSystem
+	storage domain.BlobStorage
+}
+
+func NewHistorian(fs domain.FileSystem, storage domain.BlobStorage) *Historian {
+	return &Historian{fs: fs, storage: storage}
+}
+
+// History lists every version of path still stored in the topic, newest
+// first. Older versions packed with other files are not kept, so only the
+// current one may be packed.
+func (h *Historian) History(ctx context.Context, groupID, topicID int64, path string) ([]FileVersion, error) {
+	path = strings.Trim(filepath.ToSlash(path), "/")
+	versions, err := h.versions(ctx, groupID, topicID, path)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("remote file not found: %s", path)
+	}
+
+	log.Printf("History of %s:", path)
+	for _, v := range versions {
+		date := "-"
+		if v.Date > 0 {
+			date = time.Unix(v.Date, 0).Format("2006-01-02 15:04:05")
+		}
+		log.Printf("  v%-3d message %-8d %s  %10s  %s %s  [%s]", v.File.Meta.Version, v.File.MessageID, date, formatSize(v.File.Size), checksum.Name(v.File.Meta.Algorithm), orDash(v.File.Meta.Checksum), v.Status)
+	}
+	log.Printf("  Versions stored: %d", len(versions))
+	return versions, nil
+}
+
+// versions builds the list of History, without logging it.
+func (h *Historian) versions(ctx context.Context, groupID, topicID int64, path string) ([]FileVersion, error) {
+	messages, err := h.storage.ListMessages(ctx, groupID, topicID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list messages: %w", err)
+	}
+	files, err := h.storage.ListFiles(ctx, groupID, topicID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list remote files: %w", err)
+	}
+
+	var current *domain.RemoteFile
+	for _, f := range files {
+		if f.Meta.Path == path {
+			current = &f
+			break
+		}
+	}
+
+	type versionSet struct {
+		version FileVersion
+		parts   map[int]domain.RemoteMessage
+		newest  int
+	}
+	sets := make(map[chunkSetKey]*versionSet)
+	var order []chunkSetKey
+	for _, m := range messages {
+		if m.Meta == nil || m.Meta.Path != path || m.Meta.HasFlag(domain.FlagPack) {
+			continue
+		}
+		key := chunkSetKey{path: path, checksum: m.Meta.Checksum, modTime: m.Meta.ModTime, parts: m.Meta.Parts}
+		if !m.Meta.IsChunked() {
+			// Unchunked versions stand alone, even with the same content
+			key.parts = -m.ID
+		}
+		set := sets[key]
+		if set == nil {
+			set = &versionSet{parts: make(map[int]domain.RemoteMessage)}
+			sets[key] = set
+			order = append(order, key)
+		}
+		if _, dup := set.parts[m.Meta.Part]; !dup {
+			set.parts[m.Meta.Part] = m
+		}
+		set.newest = max(set.newest, m.ID)
+	}
+
+	var versions []FileVersion
+	for _, key := range order {
+		set := sets[key]
+		first, ok := set.parts[0]
+		if !ok {
+			for _, m := range set.parts {
+				first = m
+				break
+			}
+		}
+		meta := *first.Meta
+		meta.Part = 0
+		file := domain.RemoteFile{Meta: meta, MessageID: first.ID, DocumentID: first.DocumentID}
+		for i := 0; i < meta.Parts && meta.IsChunked(); i++ {
+			if part, ok := set.parts[i]; ok {
+				file.Chunks = append(file.Chunks, domain.RemoteChunk{MessageID: part.ID, Size: part.Size, Checksum: part.Meta.PartChecksum})
+			}
+		}
+		for _, part := range set.parts {
+			file.Size += part.Size
+		}
+		if meta.HasFlag(domain.FlagEmptyFile) {
+			file.Size = 0
+		}
+
+		v := FileVersion{File: file, Date: first.Date, newest: set.newest}
+		switch {
+		case current != nil && current.Pack == nil && current.MessageID == file.MessageID:
+			v.File = *current
+			v.Status = VersionCurrent
+		case meta.HasFlag(domain.FlagSuperseded):
+			v.Status = VersionSuperseded
+		case meta.HasFlag(domain.FlagQuarantined):
+			v.Status = VersionQuarantined
+		case meta.IsChunked() && len(set.parts) < meta.Parts:
+			v.Status = VersionIncomplete
+		default:
+			v.Status = VersionStale
+		}
+		versions = append(versions, v)
+	}
+
+	if current != nil && current.Pack != nil {
+		v := FileVersion{File: *current, Status: VersionCurrent, newest: current.MessageID}
+		for _, m := range messages {
+			if m.ID == current.Pack.MessageID {
+				v.Date = m.Date
+				break
+			}
+		}
+		versions = append(versions, v)
+	}
+
+	// Message IDs grow with time, while dates only have a one second resolution
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].newest > versions[j].newest
+	})
+	return versions, nil
+}
+
+// Restore downloads a version of path to dest, which must not exist: the
+// given version number if not negative, else the version current at the
+// given time if not zero, else the current one.
+func (h *Historian) Restore(ctx context.Context, groupID, topicID int64, path string, version int, at time.Time, dest string) error {
+	path = strings.Trim(filepath.ToSlash(path), "/")
+	versions, err := h.versions(ctx, groupID, topicID, path)
+	if err != nil {
+		return err
+	}
+
+	var chosen *FileVersion
+	for i, v := range versions {
+		if v.Status == VersionIncomplete || v.Status == VersionQuarantined {
+			continue
+		}
+		if (version >= 0 && v.File.Meta.Version == version) ||
+			(version < 0 && !at.IsZero() && v.Date <= at.Unix()) ||
+			(version < 0 && at.IsZero()) {
+			chosen = &versions[i]
+			break
+		}
+	}
+	switch {
+	case chosen != nil:
+	case version >= 0:
+		return fmt.Errorf("version %d of %s not found", version, path)
+	case !at.IsZero():
+		return fmt.Errorf("no version of %s stored before %s", path, at.Format(time.RFC3339))
+	default:
+		return fmt.Errorf("remote file not found: %s", path)
+	}
+
+	if _, err := h.fs.StatFile(filepath.Dir(dest), filepath.Base(dest), true); err == nil {
+		return fmt.Errorf("destination %s already exists", dest)
+	}
+
+	file := chosen.File
+	log.Printf("[*] Restoring version %d of %s (%s) to %s", file.Meta.Version, path, chosen.Status, dest)
+
+	if err := downloadTo(ctx, h.fs, h.storage, groupID, topicID, &file, dest); err != nil {
+		return err
+	}
+	log.Printf("[+] Restored: %s", dest)
+	return nil
+}
@@ -0,0 +1,128 @@
+package usecase
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+
+	"tg-blobsync/internal/domain"
+)
+
+// pushJournalFile is the name of the journal of the last push, in the state dir.
+const pushJournalFile = "push_journal.jsonl"
+
+// journalHeader is the first line of a journal: the plan being executed and
+// what it was computed for.
+type journalHeader struct {
+	Root    string            `json:"root"`
+	GroupID int64             `json:"group_id"`
+	TopicID int64             `json:"topic_id"`
+	SubDir  string            `json:"sub_dir,omitempty"`
+	Items   []domain.SyncItem `json:"items"`
+}
+
+// journalEntry is a line recording a completed item.
+type journalEntry struct {
+	Done string `json:"done"`
+}
+
+// journal records the plan of a sync and its completed items as they go, so
+// that an interrupted sync can be resumed without planning it again.
+type journal struct {
+	mu      sync.Mutex
+	file    string
+	f       *os.File
+	pending int // items not completed yet
+}
+
+// createJournal starts the journal of the given plan, replacing any previous one.
+func createJournal(file string, header journalHeader) (*journal, error) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create journal: %w", err)
+	}
+	if err := json.NewEncoder(f).Encode(header); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write journal: %w", err)
+	}
+	return &journal{file: file, f: f, pending: len(header.Items)}, nil
+}
+
+// loadJournal reads the journal saved in file and returns its header along
+// with the paths of the completed items. A missing journal yields nil.
+func loadJournal(file string) (*journalHeader, map[string]bool, error) {
+	f, err := os.Open(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<30)
+	if !scanner.Scan() {
+		return nil, nil, fmt.Errorf("failed to read journal %s: %w", file, errors.Join(scanner.Err(), errors.New("empty journal")))
+	}
+	var header journalHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse journal %s: %w", file, err)
+	}
+
+	done := make(map[string]bool)
+	for scanner.Scan() {
+		var entry journalEntry
+		// A crash may leave a truncated last line, whose item is simply redone
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			break
+		}
+		done[entry.Done] = true
+	}
+	return &header, done, nil
+}
+
+// Done records that the item at path was completed. A nil journal records nothing.
+func (j *journal) Done(path string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return
+	}
+	if err := json.NewEncoder(j.f).Encode(journalEntry{Done: path}); err != nil {
+		log.Printf("[!] Warning: failed to update journal: %v", err)
+		return
+	}
+	j.pending--
+}
+
+// Close closes the journal, and deletes it once every item was completed.
+func (j *journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Close()
+	j.f = nil
+	if err != nil {
+		return fmt.Errorf("failed to close journal: %w", err)
+	}
+	if j.pending <= 0 {
+		if err := os.Remove(j.file); err != nil {
+			return fmt.Errorf("failed to remove journal: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package usecase
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"tg-blobsync/internal/domain"
+)
+
+// dupeKey identifies a content downloaded by several items of a plan.
+type dupeKey struct {
+	algorithm string
+	checksum  string
+	size      int64
+}
+
+// groupDupes keeps the first download of every content among items, and
+// returns the other downloads of the same content by path of the one kept.
+// Packed and empty files, and those without a checksum, are always kept.
+func groupDupes(items []domain.SyncItem) ([]domain.SyncItem, map[string][]domain.SyncItem) {
+	first := make(map[dupeKey]string)
+	dupes := make(map[string][]domain.SyncItem)
+	kept := items[:0:0]
+	for _, item := range items {
+		f := item.RemoteFile
+		if item.Action != domain.ActionDownload || f == nil || f.Pack != nil || f.Meta.Checksum == "" || f.Meta.HasFlag(domain.FlagEmptyFile) {
+			kept = append(kept, item)
+			continue
+		}
+		key := dupeKey{algorithm: f.Meta.Algorithm, checksum: f.Meta.Checksum, size: f.ContentSize()}
+		if path, ok := first[key]; ok {
+			dupes[path] = append(dupes[path], item)
+			continue
+		}
+		first[key] = item.Path
+		kept = append(kept, item)
+	}
+	return kept, dupes
+}
+
+// linkDupe writes item as a reflink of source, just downloaded with the same
+// content, or else as a hard link to it, downloading it when neither works.
+// Hard links share their modification time, which is left to the source.
+func (e *executor) linkDupe(ctx context.Context, source, item domain.SyncItem, rootDir string, groupID, topicID int64) error {
+	sourcePath := filepath.Join(rootDir, source.Path)
+	fullPath := filepath.Join(rootDir, item.Path)
+	partPath := fullPath + domain.PartSuffix
+
+	e.fs.DeleteFile(partPath)
+	how := "reflink"
+	err := e.fs.ReflinkFile(sourcePath, partPath)
+	if err != nil {
+		how = "hard link"
+		err = e.fs.LinkFile(sourcePath, partPath)
+	}
+	if err == nil {
+		if err = e.backup(rootDir, item.Path); err == nil {
+			err = e.fs.RenameFile(partPath, fullPath)
+		}
+	}
+	if err != nil {
+		e.fs.DeleteFile(partPath)
+		log.Printf("[!] Can't link %s to %s, downloading it: %v", item.Path, source.Path, err)
+		if err := e.download(ctx, item, rootDir, groupID, topicID); err != nil {
+			return err
+		}
+		e.stats.record(item)
+		e.complete(item)
+		return nil
+	}
+
+	if how == "reflink" && item.RemoteFile.Meta.ModTime > 0 {
+		if err := e.fs.SetModTime(fullPath, item.RemoteFile.Meta.ModTime); err != nil {
+			log.Printf("[!] Warning: failed to set modification time for %s: %v", item.Path, err)
+		}
+	}
+	log.Printf("[+] Linked: %s (%s to %s)", item.Path, how, source.Path)
+	// Nothing was transferred
+	e.stats.add(StatDownloaded, 1, 0)
+	e.complete(item)
+	return nil
+}
@@ -0,0 +1,129 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"path/filepath"
+	"strings"
+	"tg-blobsync/internal/domain"
+	"time"
+)
+
+// editableFlags are the flags MetaEditor may set and clear. The others tell
+// what a message holds, or hide it from the listings meta set works on.
+var editableFlags = []string{domain.FlagArchived, domain.FlagPendingDelete}
+
+// MetaEdit is a change to the metadata of a remote file. Nil fields are
+// left as they are.
+type MetaEdit struct {
+	ModTime *int64
+	// Flags replaces the editable flags of the file, see editableFlags.
+	Flags *[]string
+	// Tags are set on the file, those with an empty value being removed.
+	Tags map[string]string
+}
+
+// MetaEditor edits the metadata stored in the caption of remote files, to
+// repair bad entries without uploading their content again.
+type MetaEditor struct {
+	storage domain.BlobStorage
+}
+
+func NewMetaEditor(storage domain.BlobStorage) *MetaEditor {
+	return &MetaEditor{storage: storage}
+}
+
+// Set applies edit to the metadata of the remote file at path.
+func (m *MetaEditor) Set(ctx context.Context, groupID, topicID int64, path string, edit MetaEdit) error {
+	path = strings.Trim(filepath.ToSlash(path), "/")
+	files, err := NewScanner(nil, m.storage, "", false).ScanRemote(ctx, groupID, topicID)
+	if err != nil {
+		return err
+	}
+	file, ok := files[path]
+	if !ok {
+		return fmt.Errorf("remote file not found: %s", path)
+	}
+
+	meta := file.Meta
+	if edit.ModTime != nil {
+		if *edit.ModTime <= 0 {
+			return fmt.Errorf("invalid modification time: %d", *edit.ModTime)
+		}
+		meta.ModTime = *edit.ModTime
+	}
+	if edit.Flags != nil {
+		for _, flag := range *edit.Flags {
+			if !editable(flag) {
+				return fmt.Errorf("flag %s can't be edited (editable flags: %s)", flag, strings.Join(editableFlags, ", "))
+			}
+		}
+		for _, flag := range editableFlags {
+			meta.ClearFlag(flag)
+		}
+		for _, flag := range *edit.Flags {
+			meta.SetFlag(flag)
+		}
+		// The grace period of a pending delete starts now
+		switch {
+		case meta.HasFlag(domain.FlagPendingDelete) && !file.Meta.HasFlag(domain.FlagPendingDelete):
+			meta.DeletedAt = time.Now().Unix()
+		case !meta.HasFlag(domain.FlagPendingDelete):
+			meta.DeletedAt = 0
+		}
+	}
+	if len(edit.Tags) > 0 {
+		meta.Tags = make(map[string]string)
+		maps.Copy(meta.Tags, file.Meta.Tags)
+		for k, v := range edit.Tags {
+			if v == "" {
+				delete(meta.Tags, k)
+			} else {
+				meta.Tags[k] = v
+			}
+		}
+		if len(meta.Tags) == 0 {
+			meta.Tags = nil
+		}
+	}
+
+	changes := metaChanges(file.Meta, meta)
+	if len(changes) == 0 {
+		log.Printf("Metadata of %s is unchanged", path)
+		return nil
+	}
+	if err := updateRemoteMeta(ctx, m.storage, groupID, topicID, file, meta); err != nil {
+		return fmt.Errorf("failed to update metadata of %s: %w", path, err)
+	}
+	log.Printf("[*] Updated metadata of: %s", path)
+	for _, c := range changes {
+		log.Printf("  %s", c)
+	}
+	return nil
+}
+
+func editable(flag string) bool {
+	for _, f := range editableFlags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// metaChanges describes the fields edited from old to new.
+func metaChanges(old, new domain.FileMeta) []string {
+	var changes []string
+	if old.ModTime != new.ModTime {
+		changes = append(changes, fmt.Sprintf("mtime: %s -> %s", formatTime(old.ModTime), formatTime(new.ModTime)))
+	}
+	if old.Flags != new.Flags {
+		changes = append(changes, fmt.Sprintf("flags: %s -> %s", orDash(old.Flags), orDash(new.Flags)))
+	}
+	if !maps.Equal(old.Tags, new.Tags) {
+		changes = append(changes, fmt.Sprintf("tags: %s -> %s", formatTags(old.Tags), formatTags(new.Tags)))
+	}
+	return changes
+}
@@ -0,0 +1,83 @@
+package usecase
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"tg-blobsync/internal/domain"
+)
+
+// mirror is a local store of downloaded contents keyed by checksum, shared
+// by the pulls of a host, or of the hosts mounting it from a NAS. A zero
+// mirror stores nothing.
+type mirror struct {
+	fs  domain.FileSystem
+	dir string
+}
+
+// path returns where the content with the given checksum is stored.
+func (m mirror) path(checksum string) string {
+	return filepath.Join(m.dir, checksum[:2], checksum)
+}
+
+func (m mirror) usable(checksum string) bool {
+	return m.dir != "" && len(checksum) > 2
+}
+
+// fetch copies the content with the given checksum to dest, and reports
+// whether the mirror had it.
+func (m mirror) fetch(checksum, dest string) bool {
+	if !m.usable(checksum) {
+		return false
+	}
+	src, err := m.fs.ReadFile(m.path(checksum))
+	if err != nil {
+		return false
+	}
+	defer src.Close()
+	if err := m.fs.WriteFile(dest, src); err != nil {
+		log.Printf("[!] Warning: failed to copy %s from the mirror: %v", checksum, err)
+		m.fs.DeleteFile(dest)
+		return false
+	}
+	return true
+}
+
+// store copies the verified content of src to the mirror. The copy is
+// renamed into place once complete, so that concurrent pulls never read it
+// half written.
+func (m mirror) store(checksum, src string) {
+	if !m.usable(checksum) {
+		return
+	}
+	if err := m.copy(checksum, src); err != nil {
+		log.Printf("[!] Warning: failed to store %s in the mirror: %v", checksum, err)
+	}
+}
+
+func (m mirror) copy(checksum, src string) error {
+	r, err := m.fs.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	dest := m.path(checksum)
+	tmp := fmt.Sprintf("%s%s%d.tmp", dest, domain.TempMarker, os.Getpid())
+	if err := m.fs.WriteFile(tmp, r); err != nil {
+		m.fs.DeleteFile(tmp)
+		return err
+	}
+	return m.fs.RenameFile(tmp, dest)
+}
+
+// evict removes content found damaged from the mirror.
+func (m mirror) evict(checksum string) {
+	if !m.usable(checksum) {
+		return
+	}
+	if err := m.fs.DeleteFile(m.path(checksum)); err != nil {
+		log.Printf("[!] Warning: failed to remove %s from the mirror: %v", checksum, err)
+	}
+}
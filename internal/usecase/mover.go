@@ -0,0 +1,106 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"tg-blobsync/internal/domain"
+)
+
+// Mover renames remote files by rewriting their metadata, without
+// transferring their content.
+type Mover struct {
+	storage domain.BlobStorage
+}
+
+func NewMover(storage domain.BlobStorage) *Mover {
+	return &Mover{storage: storage}
+}
+
+// Move renames the remote file or directory src to dst. When dst ends with
+// a slash or is an existing directory, src is moved into it. Nothing is
+// renamed if any destination path is taken.
+func (m *Mover) Move(ctx context.Context, groupID, topicID int64, src, dst string) error {
+	src = strings.Trim(filepath.ToSlash(src), "/")
+	into := strings.HasSuffix(filepath.ToSlash(dst), "/")
+	dst = strings.Trim(filepath.ToSlash(dst), "/")
+	if src == "" {
+		return fmt.Errorf("refusing to move the whole topic")
+	}
+
+	files, err := NewScanner(nil, m.storage, "", false).ScanRemote(ctx, groupID, topicID)
+	if err != nil {
+		return err
+	}
+	if !into && dst != "" {
+		for p := range files {
+			if strings.HasPrefix(p, dst+"/") {
+				into = true
+				break
+			}
+		}
+	}
+	if into || dst == "" {
+		dst = path.Join(dst, path.Base(src))
+	}
+	if dst == src {
+		return fmt.Errorf("%s and %s are the same path", src, dst)
+	}
+	if strings.HasPrefix(dst, src+"/") {
+		return fmt.Errorf("cannot move %s into itself", src)
+	}
+
+	renames := make(map[string]string)
+	if _, ok := files[src]; ok {
+		renames[src] = dst
+	} else {
+		for p := range files {
+			if strings.HasPrefix(p, src+"/") {
+				renames[p] = dst + strings.TrimPrefix(p, src)
+			}
+		}
+	}
+	if len(renames) == 0 {
+		return fmt.Errorf("remote file not found: %s", src)
+	}
+	for from, to := range renames {
+		if !filepath.IsLocal(filepath.FromSlash(to)) || unsafePath(to) {
+			return fmt.Errorf("invalid destination path: %q", to)
+		}
+		if _, taken := files[to]; taken && renames[to] == "" {
+			return fmt.Errorf("cannot move %s to %s: the destination exists", from, to)
+		}
+	}
+
+	paths := make([]string, 0, len(renames))
+	for p := range renames {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var edits packEdits
+	moved := 0
+	for _, from := range paths {
+		file := files[from]
+		meta := file.Meta
+		meta.Path = renames[from]
+		if file.Pack != nil {
+			edits.Update(file, meta)
+		} else if err := m.storage.UpdateFileMeta(ctx, groupID, topicID, file, meta); err != nil {
+			return fmt.Errorf("failed to move %s: %w", from, err)
+		}
+		log.Printf("[*] Moved: %s -> %s", from, meta.Path)
+		moved++
+	}
+	if err := edits.Apply(ctx, m.storage, groupID, topicID); err != nil {
+		return err
+	}
+
+	log.Printf("Move Summary:")
+	log.Printf("  Files moved: %d", moved)
+	return nil
+}
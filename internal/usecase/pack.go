@@ -0,0 +1,220 @@
+package usecase
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/pack"
+	"time"
+)
+
+// packDir is the virtual directory holding the pack messages.
+const packDir = ".tgblobsync/packs"
+
+// defaultPackSize is the maximum size of a pack when none is configured.
+const defaultPackSize = 16 * 1024 * 1024
+
+// groupPacks splits the given uploads into groups whose total size stays
+// within maxSize, keeping files of the same directory together.
+func groupPacks(items []domain.SyncItem, maxSize int64) [][]domain.SyncItem {
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Path < items[j].Path
+	})
+
+	var groups [][]domain.SyncItem
+	var current []domain.SyncItem
+	var size int64
+	for _, item := range items {
+		if len(current) > 0 && size+item.LocalFile.Size > maxSize {
+			groups = append(groups, current)
+			current, size = nil, 0
+		}
+		current = append(current, item)
+		size += item.LocalFile.Size
+	}
+	if len(current) > 0 {
+		groups = append(groups, current)
+	}
+	return groups
+}
+
+// uploadPack writes the members into a temporary pack and uploads it.
+func uploadPack(ctx context.Context, storage domain.BlobStorage, groupID, topicID int64, members []pack.Member) error {
+	f, err := os.CreateTemp("", "tgblobsync-pack-*.tar")
+	if err != nil {
+		return fmt.Errorf("failed to create pack: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := md5.New()
+	if err := pack.Write(io.MultiWriter(f, h), members); err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to create pack: %w", err)
+	}
+
+	id := make([]byte, 4)
+	rand.Read(id)
+	now := time.Now()
+
+	packFile := domain.LocalFile{
+		Path:     path.Join(packDir, fmt.Sprintf("%s-%s.tar", now.UTC().Format("20060102T150405"), hex.EncodeToString(id))),
+		Checksum: hex.EncodeToString(h.Sum(nil)),
+		ModTime:  now.Unix(),
+		Size:     info.Size(),
+		AbsPath:  f.Name(),
+		Flags:    domain.FlagPack,
+	}
+	log.Printf("[*] Packing %d files into %s", len(members), packFile.Path)
+	return storage.UploadFile(ctx, groupID, topicID, packFile)
+}
+
+// packEdits collects the changes to packed files, so that each pack is
+// rewritten only once however many of its files are touched.
+type packEdits struct {
+	mu    sync.Mutex
+	packs map[int]*packEdit
+}
+
+type packEdit struct {
+	pack   domain.RemotePack
+	remove map[string]bool
+	meta   map[string]domain.FileMeta
+}
+
+func (p *packEdits) edit(file domain.RemoteFile) *packEdit {
+	if p.packs == nil {
+		p.packs = make(map[int]*packEdit)
+	}
+	e, ok := p.packs[file.Pack.MessageID]
+	if !ok {
+		e = &packEdit{
+			pack:   *file.Pack,
+			remove: make(map[string]bool),
+			meta:   make(map[string]domain.FileMeta),
+		}
+		p.packs[file.Pack.MessageID] = e
+	}
+	return e
+}
+
+// Remove drops the packed file from its pack.
+func (p *packEdits) Remove(file domain.RemoteFile) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.edit(file).remove[file.Pack.Member] = true
+}
+
+// Update replaces the metadata of the packed file.
+func (p *packEdits) Update(file domain.RemoteFile, meta domain.FileMeta) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.edit(file).meta[file.Pack.Member] = meta
+}
+
+// Apply rewrites every edited pack without its removed files and with the
+// updated metadata, then deletes the original pack. Packs left empty are
+// simply deleted.
+func (p *packEdits) Apply(ctx context.Context, storage domain.BlobStorage, groupID, topicID int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for id, e := range p.packs {
+		if err := e.apply(ctx, storage, groupID, topicID); err != nil {
+			return fmt.Errorf("failed to rewrite pack %s: %w", e.pack.Path, err)
+		}
+		delete(p.packs, id)
+	}
+	return nil
+}
+
+func (e *packEdit) apply(ctx context.Context, storage domain.BlobStorage, groupID, topicID int64) error {
+	rc, err := storage.DownloadFile(ctx, groupID, topicID, e.pack.MessageID, e.pack.Path, e.pack.Size, 0)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	r, err := pack.NewReader(rc)
+	if err != nil {
+		return err
+	}
+
+	var kept []pack.Member
+	for _, entry := range r.Index {
+		if e.remove[entry.Name] {
+			continue
+		}
+		meta := entry.Meta
+		if m, ok := e.meta[entry.Name]; ok {
+			meta = m
+		}
+		kept = append(kept, pack.Member{
+			Meta: meta,
+			Size: entry.Size,
+			Open: func() (io.ReadCloser, error) {
+				// Members are written in index order, so the reader only moves forward
+				content, err := r.Find(entry.Name)
+				if err != nil {
+					return nil, err
+				}
+				return io.NopCloser(content), nil
+			},
+		})
+	}
+
+	if len(kept) > 0 {
+		if err := uploadPack(ctx, storage, groupID, topicID, kept); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("[-] Deleting pack: %s", e.pack.Path)
+	return storage.DeleteFile(ctx, groupID, topicID, e.pack.MessageID)
+}
+
+// updateRemoteMeta replaces the metadata of a remote file, rewriting its
+// pack if it is packed.
+func updateRemoteMeta(ctx context.Context, storage domain.BlobStorage, groupID, topicID int64, file domain.RemoteFile, meta domain.FileMeta) error {
+	if file.Pack == nil {
+		return storage.UpdateFileMeta(ctx, groupID, topicID, file, meta)
+	}
+	var edits packEdits
+	edits.Update(file, meta)
+	return edits.Apply(ctx, storage, groupID, topicID)
+}
+
+// openPacked returns a reader over a single file of a pack.
+func openPacked(ctx context.Context, storage domain.BlobStorage, groupID, topicID int64, file *domain.RemoteFile) (io.ReadCloser, error) {
+	rc, err := storage.DownloadFile(ctx, groupID, topicID, file.Pack.MessageID, file.Pack.Path, file.Pack.Size, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := pack.NewReader(rc)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	content, err := r.Find(file.Pack.Member)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{content, rc}, nil
+}
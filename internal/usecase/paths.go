@@ -0,0 +1,189 @@
+package usecase
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"tg-blobsync/internal/domain"
+	"unicode/utf8"
+)
+
+// PathPolicy decides how Pull handles the remote paths holding control
+// characters or invalid UTF-8, which many filesystems and tools don't cope with.
+type PathPolicy string
+
+const (
+	// PathSkip leaves such files out of the pull.
+	PathSkip PathPolicy = "skip"
+	// PathEscape writes them with the offending bytes escaped as %XX.
+	PathEscape PathPolicy = "escape"
+	// PathKeep writes them as they are.
+	PathKeep PathPolicy = "keep"
+)
+
+// unsafePath reports whether path holds control characters or invalid UTF-8.
+func unsafePath(path string) bool {
+	if !utf8.ValidString(path) {
+		return true
+	}
+	return strings.IndexFunc(path, isControl) >= 0
+}
+
+// escapePath replaces the control characters and invalid UTF-8 bytes of
+// path with their %XX escape.
+func escapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); {
+		r, size := utf8.DecodeRuneInString(path[i:])
+		if (r == utf8.RuneError && size == 1) || isControl(r) {
+			fmt.Fprintf(&b, "%%%02X", path[i])
+		} else {
+			b.WriteString(path[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+// sanitizePaths applies the path policy to the remote files of a pull. Paths
+// leading out of the local directory are always skipped. The local files
+// at a skipped path are left out as well, so that they are never deleted.
+func sanitizePaths(policy PathPolicy, remote map[string]domain.RemoteFile, local map[string]domain.LocalFile) {
+	for path, f := range remote {
+		if !filepath.IsLocal(filepath.FromSlash(path)) {
+			log.Printf("[!] Skipping %q: the path leads out of the directory", path)
+			delete(remote, path)
+			delete(local, path)
+			continue
+		}
+		if policy == PathKeep || !unsafePath(path) {
+			continue
+		}
+
+		delete(remote, path)
+		if policy == PathEscape {
+			escaped := escapePath(path)
+			if _, taken := remote[escaped]; !taken {
+				remote[escaped] = f
+				continue
+			}
+		}
+		delete(local, path)
+		log.Printf("[!] Skipping %q: the path holds control characters or invalid UTF-8", path)
+	}
+}
+
+// CasePolicy decides how Pull handles the remote paths differing only by
+// case, which overwrite each other on case-insensitive filesystems.
+type CasePolicy string
+
+const (
+	// CaseAbort refuses to pull, reporting them.
+	CaseAbort CasePolicy = "abort"
+	// CaseRename pulls all but the first one under a suffixed name.
+	CaseRename CasePolicy = "rename"
+	// CaseIgnore pulls them as they are, one overwriting the others.
+	CaseIgnore CasePolicy = "ignore"
+)
+
+// resolveCaseConflicts applies the case policy to the remote files of a
+// pull into rootDir, when its filesystem ignores case. The local files are
+// then matched with the remote path they stand for whatever its case, so
+// that a file isn't deleted, or downloaded again, under another name.
+func resolveCaseConflicts(policy CasePolicy, localFS domain.FileSystem, rootDir string, remote map[string]domain.RemoteFile, local map[string]domain.LocalFile) error {
+	folded := make(map[string][]string)
+	for p := range remote {
+		key := strings.ToLower(p)
+		folded[key] = append(folded[key], p)
+	}
+	conflicts := 0
+	for _, paths := range folded {
+		if len(paths) > 1 {
+			conflicts++
+		}
+	}
+	mismatched := false
+	for p := range local {
+		if _, ok := remote[p]; !ok && len(folded[strings.ToLower(p)]) > 0 {
+			mismatched = true
+			break
+		}
+	}
+	if (conflicts == 0 && !mismatched) || !localFS.CaseInsensitive(rootDir) {
+		return nil
+	}
+
+	if conflicts > 0 && policy == CaseAbort {
+		var groups []string
+		for _, paths := range folded {
+			if len(paths) > 1 {
+				sort.Strings(paths)
+				groups = append(groups, strings.Join(paths, ", "))
+			}
+		}
+		sort.Strings(groups)
+		for _, g := range groups {
+			log.Printf("[!] Remote paths differing only by case: %s", g)
+		}
+		return fmt.Errorf("refusing to pull %d sets of remote paths differing only by case, which would overwrite each other on this case-insensitive filesystem: rename them remotely, or use --case-conflicts rename", conflicts)
+	}
+
+	for key, paths := range folded {
+		if len(paths) < 2 {
+			continue
+		}
+		sort.Strings(paths)
+		if policy == CaseIgnore {
+			log.Printf("[!] Remote paths differing only by case overwrite each other: %s", strings.Join(paths, ", "))
+			continue
+		}
+		for i, p := range paths[1:] {
+			n := i + 2
+			renamed := caseSuffixed(p, n)
+			for len(folded[strings.ToLower(renamed)]) > 0 {
+				n++
+				renamed = caseSuffixed(p, n)
+			}
+			log.Printf("[!] Pulling %s as %s: it differs from %s only by case", p, renamed, paths[0])
+			remote[renamed] = remote[p]
+			delete(remote, p)
+			folded[strings.ToLower(renamed)] = []string{renamed}
+		}
+		folded[key] = paths[:1]
+	}
+
+	for p, f := range local {
+		if _, ok := remote[p]; ok {
+			continue
+		}
+		paths := folded[strings.ToLower(p)]
+		if len(paths) == 0 {
+			continue
+		}
+		if _, taken := local[paths[0]]; taken {
+			continue
+		}
+		delete(local, p)
+		f.Path = paths[0]
+		local[paths[0]] = f
+	}
+	return nil
+}
+
+// caseSuffixed returns p with " (case n)" added to its file name, before
+// its extension.
+func caseSuffixed(p string, n int) string {
+	name := path.Base(p)
+	ext := path.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	return strings.TrimSuffix(p, ext) + fmt.Sprintf(" (case %d)", n) + ext
+}
@@ -0,0 +1,161 @@
+package usecase
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"tg-blobsync/internal/domain"
+)
+
+// savedPlan is a plan written by --plan-out for review, and executed as is
+// by apply.
+type savedPlan struct {
+	Direction string    `json:"direction"` // push or pull
+	Root      string    `json:"root"`
+	GroupID   int64     `json:"group_id"`
+	TopicID   int64     `json:"topic_id"`
+	SubDir    string    `json:"sub_dir,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// RemoteState fingerprints the files of the topic when the plan was
+	// made, see remoteState.
+	RemoteState string            `json:"remote_state"`
+	Items       []domain.SyncItem `json:"items"`
+}
+
+// SetPlanOut makes Push and Pull write their plan to file instead of
+// executing it, for Apply to execute it once reviewed.
+func (s *Synchronizer) SetPlanOut(file string) {
+	s.planOut = file
+}
+
+// savePlan writes the plan of a push or a pull to s.planOut.
+func (s *Synchronizer) savePlan(ctx context.Context, direction string, plan domain.SyncPlan, rootDir string, groupID, topicID int64) error {
+	absRoot, err := filepath.Abs(rootDir)
+	if err != nil {
+		return err
+	}
+	state, err := remoteState(ctx, s.storage, groupID, topicID)
+	if err != nil {
+		return err
+	}
+	saved := savedPlan{
+		Direction:   direction,
+		Root:        absRoot,
+		GroupID:     groupID,
+		TopicID:     topicID,
+		SubDir:      s.subDir,
+		CreatedAt:   time.Now().UTC(),
+		RemoteState: state,
+		Items:       plan.Items,
+	}
+	if saved.Items == nil {
+		saved.Items = []domain.SyncItem{}
+	}
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.planOut, data, 0600); err != nil {
+		return fmt.Errorf("failed to write plan: %w", err)
+	}
+	log.Printf("[+] Plan of %d items saved to %s: review it, then run apply %s", len(plan.Items), s.planOut, s.planOut)
+	return nil
+}
+
+// Apply executes the plan saved in file by a push or pull with --plan-out,
+// without planning again. It fails when the topic changed since the plan
+// was made, or when a local file it transfers or deletes did. rootDir, when
+// set, must be the directory the plan was made for.
+func (s *Synchronizer) Apply(ctx context.Context, file, rootDir string, groupID, topicID int64) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read plan: %w", err)
+	}
+	var saved savedPlan
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("invalid plan %s: %w", file, err)
+	}
+
+	if saved.GroupID != groupID || saved.TopicID != topicID {
+		return fmt.Errorf("the plan is for group %d, topic %d: run apply with the same settings", saved.GroupID, saved.TopicID)
+	}
+	if rootDir != "" {
+		absRoot, err := filepath.Abs(rootDir)
+		if err != nil {
+			return err
+		}
+		if absRoot != saved.Root {
+			return fmt.Errorf("the plan is for %s, not %s", saved.Root, absRoot)
+		}
+	}
+
+	state, err := remoteState(ctx, s.storage, groupID, topicID)
+	if err != nil {
+		return err
+	}
+	if state != saved.RemoteState {
+		return fmt.Errorf("the topic changed since the plan was made (%s): make a new one", saved.CreatedAt.Local().Format("2006-01-02 15:04"))
+	}
+	for _, item := range saved.Items {
+		local, err := s.fs.StatFile(saved.Root, item.Path, true)
+		if item.LocalFile == nil {
+			// A new download must not overwrite a file created since
+			if item.Action == domain.ActionDownload && err == nil {
+				return fmt.Errorf("local file %s was created since the plan was made: make a new one", item.Path)
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("local file %s changed since the plan was made: %w", item.Path, err)
+		}
+		if local.Size != item.LocalFile.Size || local.ModTime != item.LocalFile.ModTime {
+			return fmt.Errorf("local file %s changed since the plan was made: make a new one", item.Path)
+		}
+	}
+
+	plan := domain.NewSyncPlan(saved.Items)
+	log.Printf("Applying the %s plan of %s: %d items", saved.Direction, saved.CreatedAt.Local().Format("2006-01-02 15:04"), plan.Summary.Total)
+	s.subDir = saved.SubDir
+	switch saved.Direction {
+	case "push":
+		return s.push(ctx, plan, saved.Root, groupID, topicID)
+	case "pull":
+		return s.pullExecutor().Execute(ctx, plan, saved.Root, groupID, topicID)
+	default:
+		return fmt.Errorf("invalid plan %s: unknown direction %q", file, saved.Direction)
+	}
+}
+
+// remoteState fingerprints every file listed in the topic, whatever the
+// filters of the run: any upload, update, deletion or metadata change
+// since changes it.
+func remoteState(ctx context.Context, storage domain.BlobStorage, groupID, topicID int64) (string, error) {
+	files, err := storage.ListFiles(ctx, groupID, topicID)
+	if err != nil {
+		return "", fmt.Errorf("failed to list remote files: %w", err)
+	}
+	lines := make([]string, 0, len(files))
+	for _, f := range files {
+		meta, err := json.Marshal(f.Meta)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, fmt.Sprintf("%d %s", f.MessageID, meta))
+	}
+	sort.Strings(lines)
+
+	h := sha256.New()
+	for _, line := range lines {
+		fmt.Fprintln(h, line)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,154 @@
+package usecase
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/checksum"
+	"tg-blobsync/internal/pkg/pipeline"
+	"time"
+)
+
+// Putter uploads single local files, without scanning a whole directory.
+type Putter struct {
+	fs           domain.FileSystem
+	storage      domain.BlobStorage
+	tags         map[string]string
+	rules        []domain.FileRule
+	keepVersions int
+	pipeline     pipeline.Pipeline
+	algorithm    string
+	stats        *Stats
+}
+
+func NewPutter(fs domain.FileSystem, storage domain.BlobStorage) *Putter {
+	return &Putter{fs: fs, storage: storage}
+}
+
+// SetTags sets the tags attached to the uploaded file, as push does.
+func (p *Putter) SetTags(tags map[string]string) {
+	p.tags = tags
+}
+
+// SetRules sets the file rules applying to the uploaded file.
+func (p *Putter) SetRules(rules []domain.FileRule) {
+	p.rules = rules
+}
+
+// SetKeepVersions keeps the version replaced by the upload, as push does.
+func (p *Putter) SetKeepVersions(n int) {
+	p.keepVersions = n
+}
+
+// SetPipeline passes the content of the uploaded file through pl, as push does.
+func (p *Putter) SetPipeline(pl pipeline.Pipeline) {
+	p.pipeline = pl
+}
+
+// SetAlgorithm sets the checksum algorithm of the content read by
+// PutReader, which should be the one of fs.
+func (p *Putter) SetAlgorithm(algorithm string) {
+	p.algorithm = algorithm
+}
+
+// SetStats makes Put count the file it uploads.
+func (p *Putter) SetStats(stats *Stats) {
+	p.stats = stats
+}
+
+// Put uploads the local file at localPath to remotePath, replacing the
+// file stored there, if any, the way push would. A remote file with the
+// same content is left alone.
+func (p *Putter) Put(ctx context.Context, groupID, topicID int64, localPath, remotePath string) error {
+	remotePath = strings.Trim(filepath.ToSlash(remotePath), "/")
+	if !filepath.IsLocal(filepath.FromSlash(remotePath)) || unsafePath(remotePath) {
+		return fmt.Errorf("invalid remote path: %q", remotePath)
+	}
+
+	local, err := p.fs.StatFile(filepath.Dir(localPath), filepath.Base(localPath), false)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", localPath, err)
+	}
+	local.Path = remotePath
+	return p.put(ctx, groupID, topicID, local, localPath)
+}
+
+// PutReader uploads the content read from r, such as the output of a
+// command piped in, to remotePath like Put does. The content is spooled to
+// a temporary file while checksummed, since the upload must know its size
+// and checksum beforehand, and may have to be retried.
+func (p *Putter) PutReader(ctx context.Context, groupID, topicID int64, r io.Reader, remotePath string) error {
+	remotePath = strings.Trim(filepath.ToSlash(remotePath), "/")
+	if !filepath.IsLocal(filepath.FromSlash(remotePath)) || unsafePath(remotePath) {
+		return fmt.Errorf("invalid remote path: %q", remotePath)
+	}
+
+	tmp, err := os.CreateTemp("", "tgblobsync-put-*")
+	if err != nil {
+		return fmt.Errorf("failed to spool input: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	h, err := checksum.New(p.algorithm)
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to spool input: %w", err)
+	}
+
+	local := domain.LocalFile{
+		Path:      remotePath,
+		Checksum:  hex.EncodeToString(h.Sum(nil)),
+		Algorithm: p.algorithm,
+		ModTime:   time.Now().Unix(),
+		Size:      size,
+		AbsPath:   tmp.Name(),
+	}
+	return p.put(ctx, groupID, topicID, local, "standard input")
+}
+
+// put uploads local to its path, read from source.
+func (p *Putter) put(ctx context.Context, groupID, topicID int64, local domain.LocalFile, source string) error {
+	remotePath := local.Path
+	files, err := p.storage.ListFiles(ctx, groupID, topicID)
+	if err != nil {
+		return fmt.Errorf("failed to list remote files: %w", err)
+	}
+	remote := make(map[string]domain.RemoteFile)
+	for _, f := range files {
+		if f.Meta.Path != remotePath || isSnapshot(f) {
+			continue
+		}
+		// Keep first (newest), as the scanner does
+		if _, exists := remote[remotePath]; !exists {
+			remote[remotePath] = f
+		}
+	}
+
+	plan := NewDiffer(false).DiffPush(map[string]domain.LocalFile{remotePath: local}, remote)
+	if plan.Summary.Total == 0 {
+		log.Printf("%s is up to date", remotePath)
+		return nil
+	}
+	item := plan.Items[0]
+	log.Printf("[*] Uploading %s (%s) to %s: %s", source, formatSize(local.Size), remotePath, item.Why())
+
+	// Nothing to confirm: the plan holds this single file
+	executor := NewExecutor(p.fs, p.storage, 1, nil)
+	executor.SetTags(p.tags)
+	executor.SetRules(p.rules)
+	executor.SetKeepVersions(p.keepVersions)
+	executor.SetPipeline(p.pipeline)
+	executor.SetStats(p.stats)
+	return executor.Execute(ctx, plan, filepath.Dir(local.AbsPath), groupID, topicID)
+}
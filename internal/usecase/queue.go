@@ -0,0 +1,122 @@
+package usecase
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+)
+
+// changeQueue is the set of local paths waiting to be pushed by watch mode.
+// It is persisted to disk so that pending changes survive a restart.
+type changeQueue struct {
+	mu    sync.Mutex
+	file  string
+	paths map[string]uint64 // path -> sequence number of its last change
+	seq   uint64
+	dirty bool
+}
+
+// loadQueue reads the queue saved in file, if any.
+func loadQueue(file string) (*changeQueue, error) {
+	q := &changeQueue{
+		file:  file,
+		paths: make(map[string]uint64),
+	}
+
+	if file == "" {
+		return q, nil
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read watch queue: %w", err)
+	}
+
+	var paths []string
+	if err := json.Unmarshal(data, &paths); err != nil {
+		return nil, fmt.Errorf("failed to parse watch queue %s: %w", file, err)
+	}
+	q.Add(paths...)
+	q.dirty = false
+	return q, nil
+}
+
+// Add queues the given paths.
+func (q *changeQueue) Add(paths ...string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, p := range paths {
+		q.seq++
+		q.paths[p] = q.seq
+		q.dirty = true
+	}
+}
+
+// Len returns the number of queued paths.
+func (q *changeQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.paths)
+}
+
+// Snapshot returns the queued paths along with their sequence numbers.
+func (q *changeQueue) Snapshot() map[string]uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	snapshot := make(map[string]uint64, len(q.paths))
+	for p, seq := range q.paths {
+		snapshot[p] = seq
+	}
+	return snapshot
+}
+
+// Done removes the paths of a snapshot once processed, unless they changed
+// again in the meantime.
+func (q *changeQueue) Done(snapshot map[string]uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for p, seq := range snapshot {
+		if q.paths[p] == seq {
+			delete(q.paths, p)
+			q.dirty = true
+		}
+	}
+}
+
+// Save writes the queue to disk if it changed since the last save.
+// A queue without a file is kept in memory only.
+func (q *changeQueue) Save() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.dirty || q.file == "" {
+		return nil
+	}
+
+	paths := make([]string, 0, len(q.paths))
+	for p := range q.paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	data, err := json.Marshal(paths)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated queue
+	tmp := q.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to save watch queue: %w", err)
+	}
+	if err := os.Rename(tmp, q.file); err != nil {
+		return fmt.Errorf("failed to save watch queue: %w", err)
+	}
+	q.dirty = false
+	return nil
+}
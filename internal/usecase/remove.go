@@ -0,0 +1,104 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/glob"
+	"time"
+)
+
+// Remover deletes remote files by path or glob, without a local copy to
+// push the deletion from.
+type Remover struct {
+	storage   domain.BlobStorage
+	ui        domain.UserInterface
+	recursive bool
+	trash     trash
+	stats     *Stats
+}
+
+func NewRemover(storage domain.BlobStorage, ui domain.UserInterface) *Remover {
+	return &Remover{storage: storage, ui: ui}
+}
+
+// SetRecursive makes a path also match the files under it, as a directory.
+func (r *Remover) SetRecursive(recursive bool) {
+	r.recursive = recursive
+}
+
+// SetTrash moves the removed files to the trash topic instead of deleting
+// them, emptying it of the files older than retention afterwards.
+func (r *Remover) SetTrash(topicID int64, retention time.Duration) {
+	r.trash = trash{storage: r.storage, topicID: topicID, retention: retention}
+}
+
+// SetStats makes Remove count the files it deletes.
+func (r *Remover) SetStats(stats *Stats) {
+	r.stats = stats
+}
+
+// Remove deletes the remote files matching any of the given paths or globs,
+// once confirmed. A pattern matching nothing fails the whole removal, as
+// does a directory without SetRecursive.
+func (r *Remover) Remove(ctx context.Context, groupID, topicID int64, patterns []string) error {
+	files, err := NewScanner(nil, r.storage, "", false).ScanRemote(ctx, groupID, topicID)
+	if err != nil {
+		return err
+	}
+
+	matched := make(map[string]bool)
+	for _, pattern := range patterns {
+		pattern = strings.Trim(filepath.ToSlash(pattern), "/")
+		if pattern == "" {
+			return fmt.Errorf("refusing to remove the whole topic")
+		}
+		found, isDir := false, false
+		for path := range files {
+			under := strings.HasPrefix(path, pattern+"/")
+			isDir = isDir || under
+			if path == pattern || glob.Match(pattern, path) || (r.recursive && under) {
+				matched[path] = true
+				found = true
+			}
+		}
+		switch {
+		case !found && isDir:
+			return fmt.Errorf("%s is a directory, pass --recursive to remove it", pattern)
+		case !found:
+			return fmt.Errorf("no remote file matches %s", pattern)
+		}
+	}
+
+	var plan domain.SyncPlan
+	for path := range matched {
+		f := files[path]
+		plan.Items = append(plan.Items, domain.SyncItem{
+			Path:       path,
+			Action:     domain.ActionDeleteRemote,
+			RemoteFile: &f,
+			Reason:     domain.ReasonRemoved,
+		})
+	}
+	sort.Slice(plan.Items, func(i, j int) bool {
+		return plan.Items[i].Path < plan.Items[j].Path
+	})
+	plan.Summary.ToDelete = len(plan.Items)
+	plan.Summary.Total = len(plan.Items)
+
+	log.Printf("Remove Summary:")
+	log.Printf("  Remote files: %d", len(files))
+	log.Printf("  To Delete:    %d", plan.Summary.ToDelete)
+
+	executor := NewExecutor(nil, r.storage, 1, r.ui)
+	executor.SetTrash(r.trash.topicID)
+	executor.SetStats(r.stats)
+	if err := executor.Execute(ctx, plan, "", groupID, topicID); err != nil {
+		return err
+	}
+	return r.trash.purge(ctx, groupID)
+}
@@ -0,0 +1,108 @@
+package usecase
+
+import (
+	"mime"
+	"path"
+	"slices"
+	"strings"
+	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/glob"
+	"tg-blobsync/internal/pkg/pipeline"
+)
+
+// fileRules resolves the rule applying to a path: the first one matching it.
+type fileRules []domain.FileRule
+
+// For returns the rule applying to path, or a zero rule if none matches.
+func (r fileRules) For(p string) domain.FileRule {
+	for _, rule := range r {
+		if matches(rule, p) {
+			return rule
+		}
+	}
+	return domain.FileRule{}
+}
+
+// matches reports whether rule applies to path: its patterns must all match.
+func matches(rule domain.FileRule, p string) bool {
+	if rule.Match != "" && !matchRule(rule.Match, p) {
+		return false
+	}
+	if rule.Mime != "" && !matchMime(rule.Mime, p) {
+		return false
+	}
+	return rule.Match != "" || rule.Mime != ""
+}
+
+// matchMime reports whether the MIME type of path, told by its extension,
+// matches pattern, such as "image/*".
+func matchMime(pattern, p string) bool {
+	typ, _, _ := strings.Cut(mime.TypeByExtension(path.Ext(p)), ";")
+	if typ == "" {
+		return false
+	}
+	ok, _ := path.Match(pattern, strings.TrimSpace(typ))
+	return ok
+}
+
+// matchRule reports whether the rule pattern matches path: the whole path
+// for patterns holding a slash, the file name for the others.
+func matchRule(pattern, p string) bool {
+	name := p
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(p)
+	}
+	return glob.Match(pattern, name)
+}
+
+// Skip reports whether path is left out of syncs.
+func (r fileRules) Skip(p string) bool {
+	return r.For(p).Skip
+}
+
+// Topic returns the topic the file at path is routed to, def when no rule
+// routes it.
+func (r fileRules) Topic(p string, def int64) int64 {
+	if topicID := r.For(p).TopicID; topicID != 0 {
+		return topicID
+	}
+	return def
+}
+
+// HasRoutes reports whether any of rules routes files to another topic.
+func HasRoutes(rules []domain.FileRule) bool {
+	return len(routeTopics(rules, 0)) > 0
+}
+
+// routeTopics returns the topics files are routed to by rules, other than
+// def, in order.
+func routeTopics(rules []domain.FileRule, def int64) []int64 {
+	var topics []int64
+	for _, rule := range rules {
+		if rule.TopicID != 0 && rule.TopicID != def && !slices.Contains(topics, rule.TopicID) {
+			topics = append(topics, rule.TopicID)
+		}
+	}
+	return topics
+}
+
+// Pipeline returns the transforms applied to the content of the file at
+// path on upload: those of its rule when it sets them, def otherwise.
+func (r fileRules) Pipeline(p string, def pipeline.Pipeline) pipeline.Pipeline {
+	rule := r.For(p)
+	if rule.Pipeline == nil {
+		return def
+	}
+	// Checked when the rules are loaded
+	pl, err := pipeline.Parse(*rule.Pipeline)
+	if err != nil {
+		return def
+	}
+	return pl
+}
+
+// CanPack reports whether the file at path may be bundled into a pack.
+func (r fileRules) CanPack(p string) bool {
+	rule := r.For(p)
+	return rule.Pack == nil || *rule.Pack
+}
@@ -3,6 +3,7 @@ package usecase
 import (
 	"context"
 	"fmt"
+	"log"
 	"path/filepath"
 	"strings"
 	"tg-blobsync/internal/domain"
@@ -11,6 +12,10 @@ import (
 type FileScanner interface {
 	ScanLocal(rootDir string) (map[string]domain.LocalFile, error)
 	ScanRemote(ctx context.Context, groupID, topicID int64) (map[string]domain.RemoteFile, error)
+	ScanSnapshot(ctx context.Context, groupID, topicID int64, name string) (map[string]domain.RemoteFile, error)
+	SetRules(rules []domain.FileRule)
+	SetPrefix(prefix string)
+	SetRoute(topicID, defaultTopic int64)
 }
 
 type scanner struct {
@@ -18,6 +23,12 @@ type scanner struct {
 	storage domain.BlobStorage
 	subDir  string
 	skipMD5 bool
+	rules   fileRules
+	prefix  string
+	// Routing: only the files routed to topicID are seen, defaultTopic
+	// receiving those no rule routes
+	topicID      int64
+	defaultTopic int64
 }
 
 func NewScanner(fs domain.FileSystem, storage domain.BlobStorage, subDir string, skipMD5 bool) FileScanner {
@@ -33,6 +44,30 @@ func NewScanner(fs domain.FileSystem, storage domain.BlobStorage, subDir string,
 	}
 }
 
+// SetRules leaves the paths skipped by the given rules out of both scans.
+func (s *scanner) SetRules(rules []domain.FileRule) {
+	s.rules = rules
+}
+
+// SetPrefix makes ScanLocal return the local files under the remote prefix
+// they are pushed to, rather than at the root of the topic.
+func (s *scanner) SetPrefix(prefix string) {
+	s.prefix = strings.Trim(filepath.ToSlash(prefix), "/")
+}
+
+// SetRoute makes both scans only return the files the rules route to
+// topicID, defaultTopic being the topic of the files no rule routes.
+func (s *scanner) SetRoute(topicID, defaultTopic int64) {
+	s.topicID = topicID
+	s.defaultTopic = defaultTopic
+}
+
+// routedAway reports whether path belongs to another topic than the one
+// scanned.
+func (s *scanner) routedAway(p string) bool {
+	return s.defaultTopic != 0 && s.rules.Topic(p, s.defaultTopic) != s.topicID
+}
+
 func (s *scanner) ScanLocal(rootDir string) (map[string]domain.LocalFile, error) {
 	// Ensure rootDir exists
 	if err := s.fs.EnsureDir(rootDir); err != nil {
@@ -46,12 +81,24 @@ func (s *scanner) ScanLocal(rootDir string) (map[string]domain.LocalFile, error)
 
 	result := make(map[string]domain.LocalFile)
 	for _, f := range files {
-		path := filepath.ToSlash(f.Path)
+		// Remote paths are normalized as well, AbsPath keeps the name on disk
+		path := domain.NormalizePath(filepath.ToSlash(f.Path))
+		if s.prefix != "" {
+			path = s.prefix + "/" + path
+		}
+		f.Path = path
 		if s.subDir != "" {
 			if !strings.HasPrefix(path, s.subDir+"/") && path != s.subDir {
 				continue
 			}
 		}
+		if s.rules.Skip(path) || s.routedAway(path) {
+			continue
+		}
+		if other, ok := result[path]; ok {
+			log.Printf("[!] Skipping %s: same name as %s once normalized", f.AbsPath, other.AbsPath)
+			continue
+		}
 		result[path] = f
 	}
 	return result, nil
@@ -62,19 +109,40 @@ func (s *scanner) ScanRemote(ctx context.Context, groupID, topicID int64) (map[s
 	if err != nil {
 		return nil, fmt.Errorf("failed to list remote files: %w", err)
 	}
+	return s.filterRemote(files), nil
+}
 
+// ScanSnapshot is like ScanRemote, but returns the remote files recorded by
+// the snapshot name instead of the current ones.
+func (s *scanner) ScanSnapshot(ctx context.Context, groupID, topicID int64, name string) (map[string]domain.RemoteFile, error) {
+	files, err := NewSnapshotter(s.storage).Files(ctx, groupID, topicID, name)
+	if err != nil {
+		return nil, err
+	}
+	return s.filterRemote(files), nil
+}
+
+// filterRemote indexes the remote files by path, the first one of a path
+// winning, leaving out those outside the sub-directory or skipped by the rules.
+func (s *scanner) filterRemote(files []domain.RemoteFile) map[string]domain.RemoteFile {
 	result := make(map[string]domain.RemoteFile)
 	for _, f := range files {
+		if isSnapshot(f) {
+			continue
+		}
 		path := filepath.ToSlash(f.Meta.Path)
 		if s.subDir != "" {
 			if !strings.HasPrefix(path, s.subDir+"/") && path != s.subDir {
 				continue
 			}
 		}
+		if s.rules.Skip(path) || s.routedAway(path) {
+			continue
+		}
 		// Dedup: keep first (newest)
 		if _, exists := result[path]; !exists {
 			result[path] = f
 		}
 	}
-	return result, nil
+	return result
 }
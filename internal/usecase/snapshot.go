@@ -0,0 +1,374 @@
+package usecase
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"tg-blobsync/internal/domain"
+	"time"
+)
+
+// snapshotDir is the virtual directory holding the snapshot manifests.
+const snapshotDir = ".tgblobsync/snapshots"
+
+// snapshotManifest is the content of a snapshot: the remote listing of the
+// topic when it was taken.
+type snapshotManifest struct {
+	Name    string          `json:"name"`
+	Created int64           `json:"created"`
+	Files   []snapshotEntry `json:"files"`
+}
+
+// snapshotEntry is a file of a snapshot, along with the messages holding it.
+type snapshotEntry struct {
+	Meta       domain.FileMeta      `json:"m"`
+	Size       int64                `json:"s"`
+	MessageID  int                  `json:"i"`
+	Chunks     []domain.RemoteChunk `json:"c,omitempty"`
+	Pack       *domain.RemotePack   `json:"k,omitempty"`
+	DocumentID int64                `json:"d,omitempty"`
+}
+
+// Snapshot is a manifest saved by snapshot create.
+type Snapshot struct {
+	Name    string
+	Created time.Time
+	Files   int
+	Size    int64 // total size of the files
+	File    domain.RemoteFile
+}
+
+// isSnapshot reports whether a remote file is a snapshot manifest rather
+// than a synced file.
+func isSnapshot(f domain.RemoteFile) bool {
+	return f.Meta.HasFlag(domain.FlagSnapshot)
+}
+
+// Snapshotter records and lists snapshots: point-in-time references to the
+// remote files of a topic, stored as manifests in the topic itself.
+type Snapshotter struct {
+	storage domain.BlobStorage
+}
+
+func NewSnapshotter(storage domain.BlobStorage) *Snapshotter {
+	return &Snapshotter{storage: storage}
+}
+
+// validSnapshotName reports an error for names unfit for a manifest path.
+func validSnapshotName(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") || strings.IndexFunc(name, isControl) >= 0 {
+		return fmt.Errorf("invalid snapshot name %q", name)
+	}
+	return nil
+}
+
+// Create records the current remote listing of the topic as the snapshot
+// name. Only references are recorded: no content is copied.
+func (s *Snapshotter) Create(ctx context.Context, groupID, topicID int64, name string) error {
+	if err := validSnapshotName(name); err != nil {
+		return err
+	}
+
+	files, err := s.storage.ListFiles(ctx, groupID, topicID)
+	if err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+
+	manifest := snapshotManifest{Name: name, Created: time.Now().Unix()}
+	var size int64
+	seen := make(map[string]bool)
+	for _, f := range files {
+		if isSnapshot(f) {
+			if f.Meta.Path == snapshotPath(name) {
+				return fmt.Errorf("snapshot %s already exists", name)
+			}
+			continue
+		}
+		// Newest first: older copies of a path are hidden
+		if seen[f.Meta.Path] {
+			continue
+		}
+		seen[f.Meta.Path] = true
+		manifest.Files = append(manifest.Files, snapshotEntry{
+			Meta:       f.Meta,
+			Size:       f.Size,
+			MessageID:  f.MessageID,
+			Chunks:     f.Chunks,
+			Pack:       f.Pack,
+			DocumentID: f.DocumentID,
+		})
+		size += f.Size
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool {
+		return manifest.Files[i].Meta.Path < manifest.Files[j].Meta.Path
+	})
+
+	if err := s.upload(ctx, groupID, topicID, manifest); err != nil {
+		return err
+	}
+	log.Printf("[+] Snapshot %s: %d files, %s", name, len(manifest.Files), formatSize(size))
+	return nil
+}
+
+// upload writes the manifest into a temporary file and uploads it.
+func (s *Snapshotter) upload(ctx context.Context, groupID, topicID int64, manifest snapshotManifest) error {
+	f, err := os.CreateTemp("", "tgblobsync-snapshot-*.json.gz")
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := md5.New()
+	zw := gzip.NewWriter(io.MultiWriter(f, h))
+	if err := json.NewEncoder(zw).Encode(manifest); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	file := domain.LocalFile{
+		Path:     snapshotPath(manifest.Name),
+		Checksum: hex.EncodeToString(h.Sum(nil)),
+		ModTime:  manifest.Created,
+		Size:     info.Size(),
+		AbsPath:  f.Name(),
+		Flags:    domain.FlagSnapshot,
+	}
+	if err := s.storage.UploadFile(ctx, groupID, topicID, file); err != nil {
+		return fmt.Errorf("failed to save snapshot %s: %w", manifest.Name, err)
+	}
+	return nil
+}
+
+// List returns the snapshots of the topic, oldest first, and logs them.
+func (s *Snapshotter) List(ctx context.Context, groupID, topicID int64) ([]Snapshot, error) {
+	snapshots, err := s.snapshots(ctx, groupID, topicID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, snap := range snapshots {
+		log.Printf("  %-24s %s  %6d files  %s", snap.Name, snap.Created.Format("2006-01-02 15:04"), snap.Files, formatSize(snap.Size))
+	}
+	log.Printf("Snapshots Summary:")
+	log.Printf("  Snapshots: %d", len(snapshots))
+	return snapshots, nil
+}
+
+// snapshots reads the manifests of the topic, oldest first.
+func (s *Snapshotter) snapshots(ctx context.Context, groupID, topicID int64) ([]Snapshot, error) {
+	files, err := s.storage.ListFiles(ctx, groupID, topicID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+
+	var snapshots []Snapshot
+	for _, f := range files {
+		if !isSnapshot(f) {
+			continue
+		}
+		manifest, err := s.read(ctx, groupID, topicID, f)
+		if err != nil {
+			return nil, err
+		}
+		snap := Snapshot{Name: manifest.Name, Created: time.Unix(manifest.Created, 0), Files: len(manifest.Files), File: f}
+		for _, e := range manifest.Files {
+			snap.Size += e.Size
+		}
+		snapshots = append(snapshots, snap)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Created.Before(snapshots[j].Created)
+	})
+	return snapshots, nil
+}
+
+// Files returns the remote files recorded by the snapshot name. They may
+// have been deleted since.
+func (s *Snapshotter) Files(ctx context.Context, groupID, topicID int64, name string) ([]domain.RemoteFile, error) {
+	files, err := s.storage.ListFiles(ctx, groupID, topicID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+	for _, f := range files {
+		if !isSnapshot(f) || f.Meta.Path != snapshotPath(name) {
+			continue
+		}
+		manifest, err := s.read(ctx, groupID, topicID, f)
+		if err != nil {
+			return nil, err
+		}
+		result := make([]domain.RemoteFile, 0, len(manifest.Files))
+		for _, e := range manifest.Files {
+			result = append(result, domain.RemoteFile{
+				Meta:       e.Meta,
+				MessageID:  e.MessageID,
+				Size:       e.Size,
+				Chunks:     e.Chunks,
+				Pack:       e.Pack,
+				DocumentID: e.DocumentID,
+			})
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("snapshot %s not found", name)
+}
+
+// read downloads and decodes the manifest held by file.
+func (s *Snapshotter) read(ctx context.Context, groupID, topicID int64, file domain.RemoteFile) (*snapshotManifest, error) {
+	rc, err := openRemote(ctx, s.storage, groupID, topicID, &file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot %s: %w", file.Meta.Path, err)
+	}
+	defer rc.Close()
+
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot %s: %w", file.Meta.Path, err)
+	}
+	var manifest snapshotManifest
+	if err := json.NewDecoder(zr).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to read snapshot %s: %w", file.Meta.Path, err)
+	}
+	return &manifest, nil
+}
+
+// snapshotPath returns the path of the manifest of the snapshot name.
+func snapshotPath(name string) string {
+	return path.Join(snapshotDir, name+".json.gz")
+}
+
+// SnapshotPolicy sets the snapshots kept by Prune: the newest one of each of
+// the last Daily days, Weekly weeks and Monthly months holding any.
+type SnapshotPolicy struct {
+	Daily   int
+	Weekly  int
+	Monthly int
+}
+
+// keep returns the snapshots kept by the policy, given newest first.
+func (p SnapshotPolicy) keep(snapshots []Snapshot) map[string]bool {
+	kept := make(map[string]bool)
+	periods := []struct {
+		n   int
+		key func(t time.Time) string
+	}{
+		{p.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{p.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{p.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, period := range periods {
+		seen := make(map[string]bool)
+		for _, snap := range snapshots {
+			if len(seen) >= period.n {
+				break
+			}
+			key := period.key(snap.Created)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			kept[snap.Name] = true
+		}
+	}
+	return kept
+}
+
+// Prune deletes the snapshots outside the policy, then the superseded
+// versions that only they referenced. With dryRun, it only reports them.
+func (s *Snapshotter) Prune(ctx context.Context, groupID, topicID int64, policy SnapshotPolicy, dryRun bool) error {
+	snapshots, err := s.snapshots(ctx, groupID, topicID)
+	if err != nil {
+		return err
+	}
+	// Newest first
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Created.After(snapshots[j].Created)
+	})
+	kept := policy.keep(snapshots)
+
+	// Messages referenced by the snapshots kept, and by those pruned
+	referenced := make(map[int]bool)
+	orphans := make(map[int]bool)
+	var pruned []Snapshot
+	for _, snap := range snapshots {
+		manifest, err := s.read(ctx, groupID, topicID, snap.File)
+		if err != nil {
+			return err
+		}
+		refs := referenced
+		if !kept[snap.Name] {
+			refs = orphans
+			pruned = append(pruned, snap)
+		}
+		for _, e := range manifest.Files {
+			refs[e.MessageID] = true
+			for _, c := range e.Chunks {
+				refs[c.MessageID] = true
+			}
+		}
+	}
+
+	for _, snap := range pruned {
+		if dryRun {
+			log.Printf("[*] Would delete snapshot %s (%s)", snap.Name, snap.Created.Format("2006-01-02 15:04"))
+			continue
+		}
+		log.Printf("[-] Deleting snapshot %s (%s)", snap.Name, snap.Created.Format("2006-01-02 15:04"))
+		if err := s.storage.DeleteFile(ctx, groupID, topicID, snap.File.MessageIDs()...); err != nil {
+			return fmt.Errorf("failed to delete snapshot %s: %w", snap.Name, err)
+		}
+	}
+
+	// Only superseded versions go: current files are still in use
+	messages, err := s.storage.ListMessages(ctx, groupID, topicID)
+	if err != nil {
+		return fmt.Errorf("failed to list messages: %w", err)
+	}
+	var ids []int
+	var size int64
+	for _, m := range messages {
+		if m.Meta == nil || !m.Meta.HasFlag(domain.FlagSuperseded) || !orphans[m.ID] || referenced[m.ID] {
+			continue
+		}
+		ids = append(ids, m.ID)
+		size += m.Size
+		if dryRun {
+			log.Printf("[*] Would delete old version %d of: %s", m.Meta.Version, m.Meta.Path)
+		} else {
+			log.Printf("[-] Deleting old version %d of: %s", m.Meta.Version, m.Meta.Path)
+		}
+	}
+	if len(ids) > 0 && !dryRun {
+		if err := s.storage.DeleteFile(ctx, groupID, topicID, ids...); err != nil {
+			return fmt.Errorf("failed to delete old versions: %w", err)
+		}
+	}
+
+	log.Printf("Snapshot Prune Summary:")
+	log.Printf("  Snapshots kept:    %d", len(snapshots)-len(pruned))
+	log.Printf("  Snapshots deleted: %d", len(pruned))
+	log.Printf("  Old versions:      %d messages, %s", len(ids), formatSize(size))
+	if dryRun && len(pruned)+len(ids) > 0 {
+		log.Printf("Dry run: nothing was deleted")
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+package usecase
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"tg-blobsync/internal/domain"
+)
+
+// StatKind is a category of items counted by Stats.
+type StatKind string
+
+const (
+	StatUploaded   StatKind = "uploaded"
+	StatDownloaded StatKind = "downloaded"
+	StatDeleted    StatKind = "deleted"
+	// StatSkipped: items left undone for the next run: those past the
+	// --max-duration deadline, over the daily upload limit, the deletions
+	// held back by either, and those pending when the run was interrupted.
+	StatSkipped StatKind = "skipped"
+	StatFailed  StatKind = "failed"
+)
+
+// StatKinds lists the categories of Stats, in reporting order.
+var StatKinds = []StatKind{StatUploaded, StatDownloaded, StatDeleted, StatSkipped, StatFailed}
+
+// topErrors is the number of failure reasons reported.
+const topErrors = 5
+
+// StatCount is the number of items of a category and their size.
+type StatCount struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+	// Rate is the transfer rate of uploads and downloads, in bytes per second.
+	Rate float64 `json:"rate,omitempty"`
+}
+
+// ErrorCount is a reason of failure and the number of items it failed.
+type ErrorCount struct {
+	Reason string `json:"reason"`
+	Count  int    `json:"count"`
+}
+
+// StatReport is the breakdown of the items processed by a run.
+type StatReport struct {
+	Uploaded   StatCount    `json:"uploaded"`
+	Downloaded StatCount    `json:"downloaded"`
+	Deleted    StatCount    `json:"deleted"`
+	Skipped    StatCount    `json:"skipped"`
+	Failed     StatCount    `json:"failed"`
+	TopErrors  []ErrorCount `json:"top_errors,omitempty"`
+}
+
+// Stats counts the items processed by a run, by category. It is safe for
+// concurrent use, and a nil Stats counts nothing.
+type Stats struct {
+	mu       sync.Mutex
+	counts   map[StatKind]StatCount
+	errors   map[string]int
+	transfer time.Duration // wall time spent transferring
+
+	// Timings of the run, see LogTimings
+	phases      []phaseTime
+	busy        []time.Duration // per transfer worker
+	queueWait   time.Duration
+	maxWait     time.Duration
+	queued      int
+	rateLimited time.Duration
+}
+
+// phaseTime is the time spent in a step of the run, such as scanning.
+type phaseTime struct {
+	name    string
+	elapsed time.Duration
+}
+
+func NewStats() *Stats {
+	return &Stats{counts: make(map[StatKind]StatCount), errors: make(map[string]int)}
+}
+
+// Count returns the items counted in the given category.
+func (s *Stats) Count(kind StatKind) StatCount {
+	if s == nil {
+		return StatCount{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.counts[kind]
+	if (kind == StatUploaded || kind == StatDownloaded) && s.transfer > 0 {
+		c.Rate = float64(c.Bytes) / s.transfer.Seconds()
+	}
+	return c
+}
+
+// TopErrors returns the most frequent reasons of failure, most frequent first.
+func (s *Stats) TopErrors() []ErrorCount {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make([]ErrorCount, 0, len(s.errors))
+	for reason, n := range s.errors {
+		counts = append(counts, ErrorCount{Reason: reason, Count: n})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Reason < counts[j].Reason
+	})
+	return counts[:min(len(counts), topErrors)]
+}
+
+// Report returns the breakdown of the items counted so far.
+func (s *Stats) Report() StatReport {
+	return StatReport{
+		Uploaded:   s.Count(StatUploaded),
+		Downloaded: s.Count(StatDownloaded),
+		Deleted:    s.Count(StatDeleted),
+		Skipped:    s.Count(StatSkipped),
+		Failed:     s.Count(StatFailed),
+		TopErrors:  s.TopErrors(),
+	}
+}
+
+// Log logs the breakdown of the items counted so far, if any.
+func (s *Stats) Log() {
+	report := s.Report()
+	lines := []struct {
+		label string
+		count StatCount
+	}{
+		{"Uploaded:  ", report.Uploaded},
+		{"Downloaded:", report.Downloaded},
+		{"Deleted:   ", report.Deleted},
+		{"Skipped:   ", report.Skipped},
+		{"Failed:    ", report.Failed},
+	}
+	total := 0
+	for _, l := range lines {
+		total += l.count.Files
+	}
+	if total == 0 {
+		return
+	}
+
+	log.Printf("Run Summary:")
+	for _, l := range lines {
+		switch {
+		case l.count.Rate > 0:
+			log.Printf("  %s %d files, %s at %s/s", l.label, l.count.Files, formatSize(l.count.Bytes), formatSize(int64(l.count.Rate)))
+		case l.count.Bytes > 0:
+			log.Printf("  %s %d files, %s", l.label, l.count.Files, formatSize(l.count.Bytes))
+		default:
+			log.Printf("  %s %d files", l.label, l.count.Files)
+		}
+	}
+	for _, e := range report.TopErrors {
+		log.Printf("    %dx %s", e.Count, e.Reason)
+	}
+}
+
+func (s *Stats) add(kind StatKind, files int, bytes int64) {
+	if s == nil || files == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.counts[kind]
+	c.Files += files
+	c.Bytes += bytes
+	s.counts[kind] = c
+}
+
+// fail counts items failed by err. The reason recorded is the innermost
+// error, which leaves out the paths added while it was wrapped.
+func (s *Stats) fail(files int, bytes int64, err error) {
+	if s == nil || files == 0 {
+		return
+	}
+	s.add(StatFailed, files, bytes)
+	for inner := errors.Unwrap(err); inner != nil; inner = errors.Unwrap(err) {
+		err = inner
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors[err.Error()] += files
+}
+
+// addTransferTime records the wall time spent transferring, which the
+// transfer rates are measured over.
+func (s *Stats) addTransferTime(d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transfer += d
+}
+
+// addPhase records the time spent in a step of the run.
+func (s *Stats) addPhase(name string, elapsed time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.phases {
+		if s.phases[i].name == name {
+			s.phases[i].elapsed += elapsed
+			return
+		}
+	}
+	s.phases = append(s.phases, phaseTime{name: name, elapsed: elapsed})
+}
+
+// setWorkers sets the number of transfer workers of the run.
+func (s *Stats) setWorkers(n int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.busy) < n {
+		s.busy = append(s.busy, 0)
+	}
+}
+
+// addWorkerBusy records the time a transfer worker spent on a task.
+func (s *Stats) addWorkerBusy(worker int, elapsed time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if worker >= len(s.busy) {
+		return
+	}
+	s.busy[worker] += elapsed
+}
+
+// addQueueWait records the time a transfer task waited for a free worker.
+func (s *Stats) addQueueWait(wait time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queueWait += wait
+	s.maxWait = max(s.maxWait, wait)
+	s.queued++
+}
+
+// RateLimited records a pause imposed by Telegram rate limits.
+func (s *Stats) RateLimited(wait time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rateLimited += wait
+}
+
+// LogTimings logs where the time of the run went: the steps before the
+// transfers, how busy each transfer worker was, how long tasks waited for
+// one, and the pauses imposed by rate limits, along with the likely bottleneck.
+func (s *Stats) LogTimings() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.phases) == 0 && s.transfer == 0 {
+		return
+	}
+
+	log.Printf("Timing Summary:")
+	var before time.Duration
+	for _, p := range s.phases {
+		before += p.elapsed
+		log.Printf("  %-16s %s", p.name+":", p.elapsed.Round(time.Millisecond))
+	}
+	if s.transfer > 0 {
+		log.Printf("  %-16s %s", "Transfers:", s.transfer.Round(time.Millisecond))
+	}
+	var busy time.Duration
+	for i, b := range s.busy {
+		busy += b
+		if s.transfer > 0 {
+			log.Printf("    Worker %-2d %3.0f%% busy  %s", i+1, 100*b.Seconds()/s.transfer.Seconds(), bar(b.Seconds()/s.transfer.Seconds()))
+		}
+	}
+	if s.queued > 0 {
+		log.Printf("  %-16s avg %s, max %s", "Queue wait:", (s.queueWait / time.Duration(s.queued)).Round(time.Millisecond), s.maxWait.Round(time.Millisecond))
+	}
+	if s.rateLimited > 0 {
+		log.Printf("  %-16s %s", "Rate limited:", s.rateLimited.Round(time.Millisecond))
+	}
+
+	utilization := 0.0
+	if s.transfer > 0 && len(s.busy) > 0 {
+		utilization = busy.Seconds() / (s.transfer.Seconds() * float64(len(s.busy)))
+	}
+	switch {
+	case s.transfer > 0 && s.rateLimited.Seconds() > 0.2*s.transfer.Seconds():
+		log.Printf("  Likely bound by: Telegram rate limits")
+	case before > s.transfer:
+		log.Printf("  Likely bound by: scanning and hashing")
+	case utilization > 0.8:
+		log.Printf("  Likely bound by: transfer bandwidth (workers are busy, more may help)")
+	case s.transfer > 0:
+		log.Printf("  Likely bound by: too few tasks to keep the workers busy")
+	}
+}
+
+// bar draws a fraction between 0 and 1 as a bar of 20 characters.
+func bar(fraction float64) string {
+	n := int(min(max(fraction, 0), 1)*20 + 0.5)
+	return "[" + strings.Repeat("#", n) + strings.Repeat(".", 20-n) + "]"
+}
+
+// record counts an item completed by the executor.
+func (s *Stats) record(item domain.SyncItem) {
+	switch item.Action {
+	case domain.ActionUpload:
+		s.add(StatUploaded, 1, itemSize(item))
+	case domain.ActionDownload:
+		s.add(StatDownloaded, 1, itemSize(item))
+	case domain.ActionDeleteRemote, domain.ActionDeleteLocal, domain.ActionMarkDeleted:
+		s.add(StatDeleted, 1, itemSize(item))
+	}
+}
+
+// itemSize returns the size of the file an item is about.
+func itemSize(item domain.SyncItem) int64 {
+	if item.Action == domain.ActionUpload || item.Action == domain.ActionDeleteLocal {
+		if item.LocalFile != nil {
+			return item.LocalFile.Size
+		}
+	}
+	if item.RemoteFile != nil {
+		return item.RemoteFile.Size
+	}
+	return 0
+}
+
+// itemsSize returns the total size of the files of the given items.
+func itemsSize(items []domain.SyncItem) int64 {
+	var size int64
+	for _, item := range items {
+		size += itemSize(item)
+	}
+	return size
+}
@@ -0,0 +1,125 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"tg-blobsync/internal/domain"
+)
+
+// statusGroups are the groups of items printed by Status, in order.
+var statusGroups = []string{
+	"To upload",
+	"To update remotely",
+	"To delete remotely",
+	"To mark deleted remotely",
+	"To unmark deleted remotely",
+	"To download",
+	"To update locally",
+	"To delete locally",
+	"Skipped",
+}
+
+// statusGroup returns the group of statusGroups an item belongs to.
+func statusGroup(item domain.SyncItem) string {
+	switch item.Action {
+	case domain.ActionUpload:
+		if item.RemoteFile != nil {
+			return "To update remotely"
+		}
+		return "To upload"
+	case domain.ActionDownload:
+		if item.LocalFile != nil {
+			return "To update locally"
+		}
+		return "To download"
+	case domain.ActionDeleteRemote:
+		return "To delete remotely"
+	case domain.ActionDeleteLocal:
+		return "To delete locally"
+	case domain.ActionMarkDeleted:
+		return "To mark deleted remotely"
+	case domain.ActionUnmarkDeleted:
+		return "To unmark deleted remotely"
+	default:
+		return "Skipped"
+	}
+}
+
+// StatusRouted is Status for each topic files are routed to by the rules,
+// and for topicID.
+func (s *Synchronizer) StatusRouted(ctx context.Context, w io.Writer, rootDir string, groupID, topicID int64, push, pull bool) error {
+	return s.routed(topicID, func(rs *Synchronizer, routeTopic int64) error {
+		return rs.Status(ctx, w, rootDir, groupID, routeTopic, push, pull)
+	})
+}
+
+// Status writes to w what a push and a pull of rootDir would do, grouped by
+// action along with the reason of every item, without transferring nor
+// deleting anything.
+func (s *Synchronizer) Status(ctx context.Context, w io.Writer, rootDir string, groupID, topicID int64, push, pull bool) error {
+	if push {
+		plan, _, _, err := s.planPush(ctx, rootDir, groupID, topicID)
+		if err != nil {
+			return err
+		}
+		if err := writeStatus(w, "Push (local -> remote)", plan); err != nil {
+			return err
+		}
+		if s.planOut != "" && !pull {
+			return s.savePlan(ctx, "push", plan, rootDir, groupID, topicID)
+		}
+	}
+	if pull {
+		plan, _, _, err := s.planPull(ctx, rootDir, groupID, topicID)
+		if err != nil {
+			return err
+		}
+		if err := writeStatus(w, "Pull (remote -> local)", plan); err != nil {
+			return err
+		}
+		if s.planOut != "" && !push {
+			return s.savePlan(ctx, "pull", plan, rootDir, groupID, topicID)
+		}
+	}
+	return nil
+}
+
+func writeStatus(w io.Writer, title string, plan domain.SyncPlan) error {
+	if len(plan.Items) == 0 {
+		_, err := fmt.Fprintf(w, "%s: up to date\n", title)
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%s: %d changes\n", title, len(plan.Items)); err != nil {
+		return err
+	}
+
+	groups := make(map[string][]domain.SyncItem)
+	for _, item := range plan.Items {
+		g := statusGroup(item)
+		groups[g] = append(groups[g], item)
+	}
+	for _, g := range statusGroups {
+		items := groups[g]
+		if len(items) == 0 {
+			continue
+		}
+		sort.Slice(items, func(i, j int) bool {
+			return items[i].Path < items[j].Path
+		})
+		if _, err := fmt.Fprintf(w, "  %s (%d):\n", g, len(items)); err != nil {
+			return err
+		}
+		for _, item := range items {
+			line := "    " + item.Path
+			if why := item.Why(); why != "" {
+				line += " (" + why + ")"
+			}
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
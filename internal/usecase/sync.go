@@ -2,17 +2,56 @@ package usecase
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/glob"
+	"tg-blobsync/internal/pkg/pipeline"
+	"time"
 )
 
 type Synchronizer struct {
-	fs      domain.FileSystem
-	storage domain.BlobStorage
-	workers int
-	ui      domain.UserInterface
-	skipMD5 bool
-	subDir  string
+	fs            domain.FileSystem
+	storage       domain.BlobStorage
+	workers       int
+	ui            domain.UserInterface
+	skipMD5       bool
+	subDir        string
+	prefix        string
+	tags          map[string]string
+	tagFilter     map[string]string
+	fromHost      string
+	remoteGlob    string
+	stateDir      string
+	resume        bool
+	deleteGrace   time.Duration
+	noDelete      bool
+	pruneAfter    bool
+	planOut       string
+	deleteLimit   deleteLimit
+	force         bool
+	verify        bool
+	deadline      time.Time
+	packThreshold int64
+	packSize      int64
+	rules         []domain.FileRule
+	pathPolicy    PathPolicy
+	casePolicy    CasePolicy
+	keepVersions  int
+	pipeline      pipeline.Pipeline
+	mirrorDir     string
+	trash         trash
+	backupDir     string
+	linkDupes     bool
+	snapshot      string
+	stats         *Stats
+	hashOnUpload  bool
+	algorithm     string
+	routeTopic    int64
+	defaultTopic  int64
 }
 
 func NewSynchronizer(
@@ -23,11 +62,14 @@ func NewSynchronizer(
 	skipMD5 bool,
 ) *Synchronizer {
 	return &Synchronizer{
-		fs:      fs,
-		storage: storage,
-		workers: workers,
-		ui:      ui,
-		skipMD5: skipMD5,
+		fs:         fs,
+		storage:    storage,
+		workers:    workers,
+		ui:         ui,
+		skipMD5:    skipMD5,
+		verify:     true,
+		pathPolicy: PathSkip,
+		casePolicy: CaseAbort,
 	}
 }
 
@@ -35,26 +77,185 @@ func (s *Synchronizer) SetSubDir(subDir string) {
 	s.subDir = subDir
 }
 
+// SetTags sets the tags attached to every file uploaded by Push.
+func (s *Synchronizer) SetTags(tags map[string]string) {
+	s.tags = tags
+}
+
+// SetHostFilter restricts Pull to the remote files uploaded from the machine
+// of the given host name, ignoring case.
+func (s *Synchronizer) SetHostFilter(host string) {
+	s.fromHost = host
+}
+
+// SetTagFilter restricts Pull to remote files carrying all the given tags.
+// Local files without a matching remote counterpart are left untouched.
+func (s *Synchronizer) SetTagFilter(filter map[string]string) {
+	s.tagFilter = filter
+}
+
+// SetRemoteGlob restricts Pull to the paths matching pattern, relative to the
+// sub-directory: only matching remote files are downloaded and only matching
+// local files are deleted.
+func (s *Synchronizer) SetRemoteGlob(pattern string) {
+	s.remoteGlob = pattern
+}
+
+// SetStateDir sets the directory where Push keeps its journal.
+func (s *Synchronizer) SetStateDir(dir string) {
+	s.stateDir = dir
+}
+
+// SetResume makes Push resume the interrupted push recorded in the journal,
+// if any, instead of planning a new one.
+func (s *Synchronizer) SetResume(resume bool) {
+	s.resume = resume
+}
+
+// SetDeleteGrace makes Push mark the remote files deleted locally as pending
+// delete, and only delete them on a later push once grace has elapsed.
+func (s *Synchronizer) SetDeleteGrace(grace time.Duration) {
+	s.deleteGrace = grace
+}
+
+// SetNoDelete makes push and pull only upload and download files, never
+// deleting those missing on the other side.
+func (s *Synchronizer) SetNoDelete(noDelete bool) {
+	s.noDelete = noDelete
+}
+
+// SetPruneAfterVerify makes push only delete remote files, including the
+// versions replaced, once its uploads have been verified in a new listing.
+func (s *Synchronizer) SetPruneAfterVerify(verify bool) {
+	s.pruneAfter = verify
+}
+
+// SetMaxDelete aborts push and pull when they would delete more than max
+// files, or more than percent of the files on the side they delete from.
+// Zero disables either limit.
+func (s *Synchronizer) SetMaxDelete(max, percent int) {
+	s.deleteLimit = deleteLimit{max: max, percent: percent}
+}
+
+// SetForce lets Push delete remote files even when the local directory looks
+// unmounted or emptied by mistake.
+func (s *Synchronizer) SetForce(force bool) {
+	s.force = force
+}
+
+// SetVerify sets whether Pull checksums the downloaded files before moving
+// them into place.
+func (s *Synchronizer) SetVerify(verify bool) {
+	s.verify = verify
+}
+
+// SetDeadline makes Push and Pull stop starting transfers at deadline,
+// leaving the rest for the next run. A zero deadline sets no limit.
+func (s *Synchronizer) SetDeadline(deadline time.Time) {
+	s.deadline = deadline
+}
+
+// SetPacking makes Push bundle the files smaller than threshold into packs
+// of at most maxSize bytes.
+func (s *Synchronizer) SetPacking(threshold, maxSize int64) {
+	s.packThreshold = threshold
+	s.packSize = maxSize
+}
+
+// SetPathPolicy sets how Pull handles the remote paths holding control
+// characters or invalid UTF-8. They are skipped by default.
+func (s *Synchronizer) SetPathPolicy(policy PathPolicy) {
+	s.pathPolicy = policy
+}
+
+// SetPipeline makes Push pass the content of the uploaded files through p.
+func (s *Synchronizer) SetPipeline(p pipeline.Pipeline) {
+	s.pipeline = p
+}
+
+// SetKeepVersions makes Push keep up to n old versions of every updated
+// file instead of deleting them.
+func (s *Synchronizer) SetKeepVersions(n int) {
+	s.keepVersions = n
+}
+
+// SetMirror makes Pull read the contents already downloaded to the mirror
+// directory dir, keyed by checksum, and store the others there.
+func (s *Synchronizer) SetMirror(dir string) {
+	s.mirrorDir = dir
+}
+
+// SetTrash makes Push move the remote files deleted locally to the trash
+// topic topicID instead of deleting them, and empty the trash of the files
+// deleted longer than retention ago (0 to keep them forever).
+func (s *Synchronizer) SetTrash(topicID int64, retention time.Duration) {
+	s.trash = trash{storage: s.storage, topicID: topicID, retention: retention}
+}
+
+// SetBackupDir makes Pull move the local files it overwrites or deletes to
+// dir, under the same relative path.
+func (s *Synchronizer) SetBackupDir(dir string) {
+	s.backupDir = dir
+}
+
+// SetLinkDupes makes Pull download every content once, the other files
+// with the same content being linked to it.
+func (s *Synchronizer) SetLinkDupes(link bool) {
+	s.linkDupes = link
+}
+
+// SetCasePolicy sets how Pull handles the remote paths differing only by
+// case, on case-insensitive filesystems.
+func (s *Synchronizer) SetCasePolicy(policy CasePolicy) {
+	s.casePolicy = policy
+}
+
+// SetSnapshot makes Pull check out the files recorded by the snapshot name
+// instead of the current ones.
+func (s *Synchronizer) SetSnapshot(name string) {
+	s.snapshot = name
+}
+
+// SetStats sets where Push and Pull count the items they process.
+func (s *Synchronizer) SetStats(stats *Stats) {
+	s.stats = stats
+}
+
+// SetHashOnUpload makes Push only checksum beforehand the files already
+// pushed, whose checksum is compared with their remote copy: the new ones
+// are checksummed with algorithm as they are uploaded, which reads them once
+// instead of twice. Their content can't be reused from other remote files.
+func (s *Synchronizer) SetHashOnUpload(hash bool, algorithm string) {
+	s.hashOnUpload = hash && !s.skipMD5
+	s.algorithm = algorithm
+}
+
+// SetRules sets the per-path rules applied by Push and Pull.
+func (s *Synchronizer) SetRules(rules []domain.FileRule) {
+	s.rules = rules
+}
+
 func (s *Synchronizer) Push(ctx context.Context, rootDir string, groupID, topicID int64) error {
 	log.Println("Starting Push synchronization...")
 
-	// 1. Scan
-	scanner := NewScanner(s.fs, s.storage, s.subDir, s.skipMD5)
-
-	localFiles, err := scanner.ScanLocal(rootDir)
-	if err != nil {
-		return err
+	if s.resume {
+		plan, ok, err := s.resumePlan(rootDir, groupID, topicID)
+		if err != nil {
+			return err
+		}
+		if ok {
+			log.Printf("Resuming interrupted push: %d items left", plan.Summary.Total)
+			return s.push(ctx, plan, rootDir, groupID, topicID)
+		}
+		log.Println("No interrupted push to resume")
 	}
 
-	remoteFiles, err := scanner.ScanRemote(ctx, groupID, topicID)
+	// 1. Scan and diff
+	plan, localFiles, remoteFiles, err := s.planPush(ctx, rootDir, groupID, topicID)
 	if err != nil {
 		return err
 	}
 
-	// 2. Diff
-	differ := NewDiffer(s.skipMD5)
-	plan := differ.DiffPush(localFiles, remoteFiles)
-
 	log.Printf("Sync Summary (Push):")
 	log.Printf("  Local files:  %d", len(localFiles))
 	log.Printf("  Remote files: %d", len(remoteFiles))
@@ -62,32 +263,296 @@ func (s *Synchronizer) Push(ctx context.Context, rootDir string, groupID, topicI
 	log.Printf("  To Update:    %d", plan.Summary.ToUpdate)
 	log.Printf("  To Delete:    %d", plan.Summary.ToDelete)
 
-	// 3. Execute
-	executor := NewExecutor(s.fs, s.storage, s.workers, s.ui)
-	return executor.Execute(ctx, plan, rootDir, groupID, topicID)
+	if !s.force {
+		if err := checkPrune(len(localFiles), remoteFiles, plan.Summary.ToDelete); err != nil {
+			return err
+		}
+	}
+	if err := s.deleteLimit.check(plan.Summary.ToDelete, len(remoteFiles)); err != nil {
+		return err
+	}
+	if s.planOut != "" {
+		return s.savePlan(ctx, "push", plan, rootDir, groupID, topicID)
+	}
+
+	// 2. Execute
+	return s.push(ctx, plan, rootDir, groupID, topicID)
 }
 
-func (s *Synchronizer) Pull(ctx context.Context, rootDir string, groupID, topicID int64) error {
-	log.Println("Starting Pull synchronization...")
+// planPush scans both sides and returns the plan of a push, along with the
+// files it was computed from.
+func (s *Synchronizer) planPush(ctx context.Context, rootDir string, groupID, topicID int64) (domain.SyncPlan, map[string]domain.LocalFile, map[string]domain.RemoteFile, error) {
+	scanner := NewScanner(s.fs, s.storage, s.subDir, s.skipMD5 || s.hashOnUpload)
+	scanner.SetRules(s.rules)
+	scanner.SetPrefix(s.prefix)
+	scanner.SetRoute(s.routeTopic, s.defaultTopic)
 
-	// 1. Scan
-	scanner := NewScanner(s.fs, s.storage, s.subDir, s.skipMD5)
+	start := time.Now()
+	localFiles, err := scanner.ScanLocal(rootDir)
+	if err != nil {
+		return domain.SyncPlan{}, nil, nil, err
+	}
+	s.stats.addPhase("Local scan", time.Since(start))
 
-	// Note: ScanRemote is called first in original Pull, but order doesn't strictly matter
-	// unless we want to fail fast on network.
+	start = time.Now()
 	remoteFiles, err := scanner.ScanRemote(ctx, groupID, topicID)
 	if err != nil {
-		return err
+		return domain.SyncPlan{}, nil, nil, err
+	}
+	s.stats.addPhase("Remote listing", time.Since(start))
+
+	if s.hashOnUpload {
+		start = time.Now()
+		if err := s.hashPushed(localFiles, remoteFiles); err != nil {
+			return domain.SyncPlan{}, nil, nil, err
+		}
+		s.stats.addPhase("Local scan", time.Since(start))
+	}
+
+	differ := NewDiffer(s.skipMD5)
+	differ.SetDeleteGrace(s.deleteGrace)
+	differ.SetNoDelete(s.noDelete)
+	if s.keepVersions > 0 {
+		retained, err := retainedVersions(ctx, s.storage, groupID, topicID)
+		if err != nil {
+			log.Printf("[!] Warning: %v, their content won't be reused", err)
+		}
+		differ.SetRetained(retained)
 	}
+	return differ.DiffPush(localFiles, remoteFiles), localFiles, remoteFiles, nil
+}
+
+// hashPushed checksums the local files of the paths already pushed, leaving
+// the others to be checksummed as they are uploaded.
+func (s *Synchronizer) hashPushed(localFiles map[string]domain.LocalFile, remoteFiles map[string]domain.RemoteFile) error {
+	for path, f := range localFiles {
+		if _, ok := remoteFiles[path]; !ok {
+			f.Algorithm = s.algorithm
+			localFiles[path] = f
+			continue
+		}
+		hashed, err := s.fs.StatFile(filepath.Dir(f.AbsPath), filepath.Base(f.AbsPath), false)
+		if err != nil {
+			return fmt.Errorf("failed to checksum %s: %w", path, err)
+		}
+		hashed.Path = f.Path
+		localFiles[path] = hashed
+	}
+	return nil
+}
+
+// PushRoots pushes several local directories into the same topic, each
+// under its own remote prefix, one after the other. Each push only sees the
+// remote files under its prefix, so that it never deletes those of another
+// root; prefixes must be disjoint.
+func (s *Synchronizer) PushRoots(ctx context.Context, roots []domain.SyncRoot, groupID, topicID int64) error {
+	for _, root := range roots {
+		prefix := strings.Trim(filepath.ToSlash(root.Prefix), "/")
+		log.Printf("[*] Pushing %s to %s/", root.Dir, prefix)
+
+		rs := *s
+		rs.subDir = prefix
+		rs.prefix = prefix
+		rs.resume = false
+		rs.rules = append(prefixRules(root.Rules, prefix), s.rules...)
+		if err := rs.Push(ctx, root.Dir, groupID, topicID); err != nil {
+			return fmt.Errorf("failed to push %s: %w", root.Dir, err)
+		}
+	}
+	return nil
+}
+
+// PushRouted pushes rootDir to the topics its files are routed to by the
+// rules, and the files no rule routes to topicID. Every push only sees the
+// files of its topic on both sides, so that none deletes those of another.
+func (s *Synchronizer) PushRouted(ctx context.Context, rootDir string, groupID, topicID int64) error {
+	return s.routed(topicID, func(rs *Synchronizer, routeTopic int64) error {
+		return rs.Push(ctx, rootDir, groupID, routeTopic)
+	})
+}
+
+// PullRouted pulls into rootDir the files of all the topics they are routed
+// to by the rules, rebuilding the tree pushed by PushRouted.
+func (s *Synchronizer) PullRouted(ctx context.Context, rootDir string, groupID, topicID int64) error {
+	return s.routed(topicID, func(rs *Synchronizer, routeTopic int64) error {
+		return rs.Pull(ctx, rootDir, groupID, routeTopic)
+	})
+}
+
+// routed runs sync for each topic routed to, then for topicID.
+func (s *Synchronizer) routed(topicID int64, sync func(rs *Synchronizer, routeTopic int64) error) error {
+	for _, routeTopic := range append(routeTopics(s.rules, topicID), topicID) {
+		log.Printf("[*] Topic %d", routeTopic)
+
+		rs := *s
+		rs.routeTopic = routeTopic
+		rs.defaultTopic = topicID
+		rs.resume = false
+		if err := sync(&rs, routeTopic); err != nil {
+			return fmt.Errorf("failed to sync topic %d: %w", routeTopic, err)
+		}
+	}
+	return nil
+}
+
+// prefixRules returns rules with the patterns holding a slash moved under
+// prefix. The others match file names, wherever they are.
+func prefixRules(rules []domain.FileRule, prefix string) []domain.FileRule {
+	prefixed := make([]domain.FileRule, 0, len(rules))
+	for _, r := range rules {
+		if strings.Contains(r.Match, "/") {
+			r.Match = prefix + "/" + strings.TrimPrefix(r.Match, "/")
+		}
+		prefixed = append(prefixed, r)
+	}
+	return prefixed
+}
+
+// HashAhead checksums the local files a push of rootDir would see, or of
+// each of roots when set, so that the push finds their checksums cached. It
+// returns how many files were checksummed.
+func (s *Synchronizer) HashAhead(rootDir string, roots []domain.SyncRoot) (int, error) {
+	if len(roots) == 0 {
+		return s.hashScope(rootDir)
+	}
+	hashed := 0
+	for _, root := range roots {
+		prefix := strings.Trim(filepath.ToSlash(root.Prefix), "/")
+		rs := *s
+		rs.subDir = prefix
+		rs.prefix = prefix
+		rs.rules = append(prefixRules(root.Rules, prefix), s.rules...)
+		n, err := rs.hashScope(root.Dir)
+		if err != nil {
+			return hashed, err
+		}
+		hashed += n
+	}
+	return hashed, nil
+}
 
+// hashScope checksums the files of rootDir within the sub-directory and not
+// skipped by the rules.
+func (s *Synchronizer) hashScope(rootDir string) (int, error) {
+	scanner := NewScanner(s.fs, s.storage, s.subDir, true)
+	scanner.SetRules(s.rules)
+	scanner.SetPrefix(s.prefix)
 	localFiles, err := scanner.ScanLocal(rootDir)
 	if err != nil {
+		return 0, err
+	}
+	for path, f := range localFiles {
+		if _, err := s.fs.StatFile(filepath.Dir(f.AbsPath), filepath.Base(f.AbsPath), false); err != nil {
+			return 0, fmt.Errorf("failed to checksum %s: %w", path, err)
+		}
+	}
+	return len(localFiles), nil
+}
+
+// push executes a push plan, then empties the trash.
+func (s *Synchronizer) push(ctx context.Context, plan domain.SyncPlan, rootDir string, groupID, topicID int64) error {
+	if err := s.pushExecutor().Execute(ctx, plan, rootDir, groupID, topicID); err != nil {
 		return err
 	}
+	return s.trash.purge(ctx, groupID)
+}
 
-	// 2. Diff
-	differ := NewDiffer(s.skipMD5)
-	plan := differ.DiffPull(localFiles, remoteFiles)
+func (s *Synchronizer) pushExecutor() SyncExecutor {
+	executor := NewExecutor(s.fs, s.storage, s.workers, s.ui)
+	executor.SetDeadline(s.deadline)
+	executor.SetTags(s.tags)
+	executor.SetPacking(s.packThreshold, s.packSize)
+	executor.SetRules(s.rules)
+	executor.SetKeepVersions(s.keepVersions)
+	executor.SetPipeline(s.pipeline)
+	executor.SetTrash(s.trash.topicID)
+	executor.SetStats(s.stats)
+	executor.SetScope(s.subDir)
+	executor.SetPruneAfterVerify(s.pruneAfter)
+	executor.SetHashOnUpload(s.hashOnUpload)
+	if s.stateDir != "" {
+		executor.SetJournal(filepath.Join(s.stateDir, pushJournalFile))
+	}
+	return executor
+}
+
+// resumePlan returns the items of the journaled push left to do. Local files
+// modified since are checksummed again; those deleted since are skipped and
+// left to the next full push.
+func (s *Synchronizer) resumePlan(rootDir string, groupID, topicID int64) (domain.SyncPlan, bool, error) {
+	if s.stateDir == "" {
+		return domain.SyncPlan{}, false, nil
+	}
+	header, done, err := loadJournal(filepath.Join(s.stateDir, pushJournalFile))
+	if err != nil || header == nil {
+		return domain.SyncPlan{}, false, err
+	}
+
+	absRoot, err := filepath.Abs(rootDir)
+	if err != nil {
+		return domain.SyncPlan{}, false, err
+	}
+	if header.Root != absRoot || header.GroupID != groupID || header.TopicID != topicID {
+		return domain.SyncPlan{}, false, fmt.Errorf("the interrupted push was from %s to group %d, topic %d: run it again with the same settings, or without --resume", header.Root, header.GroupID, header.TopicID)
+	}
+
+	var plan domain.SyncPlan
+	for _, item := range header.Items {
+		if done[item.Path] {
+			continue
+		}
+
+		if item.Action == domain.ActionUpload && item.LocalFile != nil {
+			local, err := s.fs.StatFile(rootDir, item.Path, true)
+			if err != nil {
+				log.Printf("[!] Skipping %s: %v", item.Path, err)
+				continue
+			}
+			if local.Size != item.LocalFile.Size || local.ModTime != item.LocalFile.ModTime {
+				if local, err = s.fs.StatFile(rootDir, item.Path, s.skipMD5); err != nil {
+					log.Printf("[!] Skipping %s: %v", item.Path, err)
+					continue
+				}
+				local.Tags = item.LocalFile.Tags
+				local.Flags = item.LocalFile.Flags
+				if item.Source != nil && (local.Checksum != item.LocalFile.Checksum || local.Size != item.Source.Size) {
+					item.Source = nil
+				}
+				item.LocalFile = &local
+			}
+		}
+
+		plan.Items = append(plan.Items, item)
+		switch {
+		case item.Action == domain.ActionDeleteRemote || item.Action == domain.ActionMarkDeleted:
+			plan.Summary.ToDelete++
+		case item.RemoteFile != nil:
+			plan.Summary.ToUpdate++
+		default:
+			plan.Summary.ToUpload++
+		}
+	}
+	plan.Summary.Total = len(plan.Items)
+	if plan.Summary.Total == 0 {
+		// Interrupted after the last item was done
+		os.Remove(filepath.Join(s.stateDir, pushJournalFile))
+		return plan, false, nil
+	}
+	return plan, true, nil
+}
+
+func (s *Synchronizer) Pull(ctx context.Context, rootDir string, groupID, topicID int64) error {
+	if s.snapshot != "" {
+		log.Printf("Restoring snapshot %s...", s.snapshot)
+	} else {
+		log.Println("Starting Pull synchronization...")
+	}
+
+	// 1. Scan and diff
+	plan, localFiles, remoteFiles, err := s.planPull(ctx, rootDir, groupID, topicID)
+	if err != nil {
+		return err
+	}
 
 	log.Printf("Sync Summary (Pull):")
 	log.Printf("  Local files:  %d", len(localFiles))
@@ -96,7 +561,91 @@ func (s *Synchronizer) Pull(ctx context.Context, rootDir string, groupID, topicI
 	log.Printf("  To Update:    %d", plan.Summary.ToUpdate)
 	log.Printf("  To Delete:    %d", plan.Summary.ToDelete)
 
-	// 3. Execute
+	if err := s.deleteLimit.check(plan.Summary.ToDelete, len(localFiles)); err != nil {
+		return err
+	}
+	if s.planOut != "" {
+		return s.savePlan(ctx, "pull", plan, rootDir, groupID, topicID)
+	}
+
+	// 2. Execute
+	return s.pullExecutor().Execute(ctx, plan, rootDir, groupID, topicID)
+}
+
+func (s *Synchronizer) pullExecutor() SyncExecutor {
 	executor := NewExecutor(s.fs, s.storage, s.workers, s.ui)
-	return executor.Execute(ctx, plan, rootDir, groupID, topicID)
+	executor.SetVerify(s.verify)
+	executor.SetDeadline(s.deadline)
+	executor.SetRules(s.rules)
+	executor.SetMirror(s.mirrorDir)
+	executor.SetBackupDir(s.backupDir)
+	executor.SetLinkDupes(s.linkDupes)
+	executor.SetStats(s.stats)
+	executor.SetScope(s.subDir)
+	return executor
+}
+
+// planPull scans both sides and returns the plan of a pull, along with the
+// files it was computed from, once filtered.
+func (s *Synchronizer) planPull(ctx context.Context, rootDir string, groupID, topicID int64) (domain.SyncPlan, map[string]domain.LocalFile, map[string]domain.RemoteFile, error) {
+	scanner := NewScanner(s.fs, s.storage, s.subDir, s.skipMD5)
+	scanner.SetRules(s.rules)
+	scanner.SetRoute(s.routeTopic, s.defaultTopic)
+
+	// Note: ScanRemote is called first in original Pull, but order doesn't strictly matter
+	// unless we want to fail fast on network.
+	var remoteFiles map[string]domain.RemoteFile
+	var err error
+	start := time.Now()
+	if s.snapshot != "" {
+		remoteFiles, err = scanner.ScanSnapshot(ctx, groupID, topicID, s.snapshot)
+	} else {
+		remoteFiles, err = scanner.ScanRemote(ctx, groupID, topicID)
+	}
+	if err != nil {
+		return domain.SyncPlan{}, nil, nil, err
+	}
+	s.stats.addPhase("Remote listing", time.Since(start))
+
+	start = time.Now()
+	localFiles, err := scanner.ScanLocal(rootDir)
+	if err != nil {
+		return domain.SyncPlan{}, nil, nil, err
+	}
+	s.stats.addPhase("Local scan", time.Since(start))
+
+	if len(s.tagFilter) > 0 || s.fromHost != "" {
+		for path, f := range remoteFiles {
+			if !f.Meta.MatchesTags(s.tagFilter) || (s.fromHost != "" && !strings.EqualFold(f.Meta.Host, s.fromHost)) {
+				delete(remoteFiles, path)
+			}
+		}
+		for path := range localFiles {
+			if _, ok := remoteFiles[path]; !ok {
+				delete(localFiles, path)
+			}
+		}
+	}
+
+	if s.remoteGlob != "" {
+		for path := range remoteFiles {
+			if !glob.Match(s.remoteGlob, path) {
+				delete(remoteFiles, path)
+			}
+		}
+		for path := range localFiles {
+			if !glob.Match(s.remoteGlob, path) {
+				delete(localFiles, path)
+			}
+		}
+	}
+
+	sanitizePaths(s.pathPolicy, remoteFiles, localFiles)
+	if err := resolveCaseConflicts(s.casePolicy, s.fs, rootDir, remoteFiles, localFiles); err != nil {
+		return domain.SyncPlan{}, nil, nil, err
+	}
+
+	differ := NewDiffer(s.skipMD5)
+	differ.SetNoDelete(s.noDelete)
+	return differ.DiffPull(localFiles, remoteFiles), localFiles, remoteFiles, nil
 }
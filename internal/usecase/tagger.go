@@ -0,0 +1,56 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"path/filepath"
+	"tg-blobsync/internal/domain"
+)
+
+// Tagger edits the tags of remote files.
+type Tagger struct {
+	storage domain.BlobStorage
+}
+
+func NewTagger(storage domain.BlobStorage) *Tagger {
+	return &Tagger{
+		storage: storage,
+	}
+}
+
+// Tag sets the given tags on the remote file at path. Tags with an empty
+// value are removed.
+func (t *Tagger) Tag(ctx context.Context, groupID, topicID int64, path string, tags map[string]string) error {
+	scanner := NewScanner(nil, t.storage, "", false)
+	remoteFiles, err := scanner.ScanRemote(ctx, groupID, topicID)
+	if err != nil {
+		return err
+	}
+
+	file, ok := remoteFiles[filepath.ToSlash(path)]
+	if !ok {
+		return fmt.Errorf("remote file not found: %s", path)
+	}
+
+	meta := file.Meta
+	meta.Tags = make(map[string]string)
+	maps.Copy(meta.Tags, file.Meta.Tags)
+	for k, v := range tags {
+		if v == "" {
+			delete(meta.Tags, k)
+		} else {
+			meta.Tags[k] = v
+		}
+	}
+	if len(meta.Tags) == 0 {
+		meta.Tags = nil
+	}
+
+	if err := updateRemoteMeta(ctx, t.storage, groupID, topicID, file, meta); err != nil {
+		return fmt.Errorf("failed to update tags of %s: %w", path, err)
+	}
+	log.Printf("[*] Updated tags of: %s", path)
+	return nil
+}
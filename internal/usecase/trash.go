@@ -0,0 +1,134 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/glob"
+	"time"
+)
+
+// trash moves the remote files deleted by a sync to another topic of the
+// group instead of deleting them. The moved messages reference the same
+// documents, so nothing is uploaded again. A zero trash deletes files.
+type trash struct {
+	storage   domain.BlobStorage
+	topicID   int64
+	retention time.Duration
+}
+
+// trashed returns file as stored in the trash, deleted now.
+func trashed(file domain.RemoteFile) domain.LocalFile {
+	meta := file.Meta
+	meta.ClearFlag(domain.FlagPendingDelete)
+	meta.SetFlag(domain.FlagTrashed)
+	return domain.LocalFile{
+		Path:      meta.Path,
+		Checksum:  meta.Checksum,
+		Algorithm: meta.Algorithm,
+		ModTime:   meta.ModTime,
+		Size:      file.Size,
+		Tags:      meta.Tags,
+		Flags:     meta.Flags,
+		Version:   meta.Version,
+		DeletedAt: time.Now().Unix(),
+	}
+}
+
+// move copies file to the trash topic, leaving its deletion to the caller.
+func (t trash) move(ctx context.Context, groupID int64, file domain.RemoteFile) error {
+	if err := t.storage.CopyFile(ctx, groupID, t.topicID, file, trashed(file)); err != nil {
+		return fmt.Errorf("failed to move %s to the trash: %w", file.Meta.Path, err)
+	}
+	return nil
+}
+
+// purge deletes the files kept in the trash for longer than the retention.
+// A zero retention keeps them forever.
+func (t trash) purge(ctx context.Context, groupID int64) error {
+	if t.topicID == 0 || t.retention <= 0 {
+		return nil
+	}
+	files, err := t.storage.ListFiles(ctx, groupID, t.topicID)
+	if err != nil {
+		return fmt.Errorf("failed to list the trash: %w", err)
+	}
+
+	cutoff := time.Now().Add(-t.retention).Unix()
+	var ids []int
+	for _, f := range files {
+		if f.Pack == nil && f.Meta.HasFlag(domain.FlagTrashed) && f.Meta.DeletedAt < cutoff {
+			log.Printf("[-] Emptying from the trash: %s", f.Meta.Path)
+			ids = append(ids, f.MessageIDs()...)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := t.storage.DeleteFile(ctx, groupID, t.topicID, ids...); err != nil {
+		return fmt.Errorf("failed to empty the trash: %w", err)
+	}
+	return nil
+}
+
+// Undeleter brings files back from the trash topic.
+type Undeleter struct {
+	storage domain.BlobStorage
+}
+
+func NewUndeleter(storage domain.BlobStorage) *Undeleter {
+	return &Undeleter{storage: storage}
+}
+
+// Undelete moves the files of the trash topic whose path matches pattern
+// back to topicID. Only the latest deletion of every path is restored, and
+// paths that exist again in topicID are skipped.
+func (u *Undeleter) Undelete(ctx context.Context, groupID, topicID, trashTopicID int64, pattern string) error {
+	scanner := NewScanner(nil, u.storage, "", false)
+	inTrash, err := scanner.ScanRemote(ctx, groupID, trashTopicID)
+	if err != nil {
+		return err
+	}
+	current, err := scanner.ScanRemote(ctx, groupID, topicID)
+	if err != nil {
+		return err
+	}
+
+	restored := 0
+	for path, f := range inTrash {
+		if !glob.Match(pattern, path) || !f.Meta.HasFlag(domain.FlagTrashed) {
+			continue
+		}
+		if _, exists := current[path]; exists {
+			log.Printf("[!] Skipping %s: it exists again", path)
+			continue
+		}
+		if f.Pack != nil {
+			log.Printf("[!] Skipping %s: packed in the trash", path)
+			continue
+		}
+
+		file := trashed(f)
+		file.DeletedAt = 0
+		meta := domain.FileMeta{Flags: file.Flags}
+		meta.ClearFlag(domain.FlagTrashed)
+		file.Flags = meta.Flags
+
+		log.Printf("[+] Undeleting: %s (deleted %s)", path, time.Unix(f.Meta.DeletedAt, 0).Format("2006-01-02 15:04"))
+		if err := u.storage.CopyFile(ctx, groupID, topicID, f, file); err != nil {
+			return fmt.Errorf("failed to undelete %s: %w", path, err)
+		}
+		if err := u.storage.DeleteFile(ctx, groupID, trashTopicID, f.MessageIDs()...); err != nil {
+			log.Printf("[!] Warning: failed to remove %s from the trash: %v", path, err)
+		}
+		restored++
+	}
+
+	log.Printf("Undelete Summary:")
+	log.Printf("  Files undeleted: %d", restored)
+	if restored == 0 {
+		return fmt.Errorf("no file matching %s in the trash", pattern)
+	}
+	return nil
+}
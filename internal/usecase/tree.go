@@ -0,0 +1,157 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"tg-blobsync/internal/domain"
+)
+
+// TreePrinter prints the virtual directory hierarchy of a topic as an
+// indented tree, as the tree command does.
+type TreePrinter struct {
+	storage   domain.BlobStorage
+	tagFilter map[string]string
+	sizes     bool
+	maxDepth  int
+}
+
+func NewTreePrinter(storage domain.BlobStorage) *TreePrinter {
+	return &TreePrinter{storage: storage}
+}
+
+// SetTagFilter restricts the tree to the files carrying all the given tags.
+func (t *TreePrinter) SetTagFilter(filter map[string]string) {
+	t.tagFilter = filter
+}
+
+// SetSizes shows the size of every file, and the total size and number of
+// files of every directory.
+func (t *TreePrinter) SetSizes(sizes bool) {
+	t.sizes = sizes
+}
+
+// SetMaxDepth limits the tree to n levels below its root, 0 for no limit.
+// The sizes of the directories still cover the files below the limit.
+func (t *TreePrinter) SetMaxDepth(n int) {
+	t.maxDepth = n
+}
+
+// treeLevel holds the entries of a directory of the tree.
+type treeLevel struct {
+	dirs  []string
+	files []domain.RemoteFile
+}
+
+// Print writes the tree of the remote directory dir, "" being the root of
+// the topic, to w. Directories come before files, both sorted by name.
+func (t *TreePrinter) Print(ctx context.Context, w io.Writer, groupID, topicID int64, dir string) error {
+	dir = strings.Trim(filepath.ToSlash(dir), "/")
+	remote, err := NewScanner(nil, t.storage, "", false).ScanRemote(ctx, groupID, topicID)
+	if err != nil {
+		return err
+	}
+	var files []domain.RemoteFile
+	for _, f := range remote {
+		if f.Meta.MatchesTags(t.tagFilter) {
+			files = append(files, f)
+		}
+	}
+
+	totals := domain.DirTotals(files)
+	if _, ok := totals[dir]; !ok && dir != "" {
+		return fmt.Errorf("remote directory not found: %s", dir)
+	}
+	levels := make(map[string]*treeLevel)
+	level := func(p string) *treeLevel {
+		if levels[p] == nil {
+			levels[p] = &treeLevel{}
+		}
+		return levels[p]
+	}
+	for p := range totals {
+		if p != "" {
+			l := level(domain.ParentDir(p))
+			l.dirs = append(l.dirs, p)
+		}
+	}
+	for _, f := range files {
+		l := level(domain.ParentDir(filepath.ToSlash(f.Meta.Path)))
+		l.files = append(l.files, f)
+	}
+	for _, l := range levels {
+		sort.Strings(l.dirs)
+		sort.Slice(l.files, func(i, j int) bool {
+			return l.files[i].Meta.Path < l.files[j].Meta.Path
+		})
+	}
+
+	root := dir
+	if root == "" {
+		root = "/"
+	}
+	if _, err := fmt.Fprintln(w, root+t.dirLabel(totals[dir])); err != nil {
+		return err
+	}
+	c := treeCounts{}
+	if err := t.printLevel(w, levels, totals, dir, "", 1, &c); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "\n%d directories, %d files\n", c.dirs, c.files)
+	return err
+}
+
+// treeCounts counts the entries printed.
+type treeCounts struct {
+	dirs, files int
+}
+
+func (t *TreePrinter) printLevel(w io.Writer, levels map[string]*treeLevel, totals map[string]domain.DirTotal, dir, indent string, depth int, c *treeCounts) error {
+	l := levels[dir]
+	if l == nil {
+		return nil
+	}
+	n := len(l.dirs) + len(l.files)
+	for i := 0; i < n; i++ {
+		branch, next := "├── ", "│   "
+		if i == n-1 {
+			branch, next = "└── ", "    "
+		}
+		if i < len(l.dirs) {
+			sub := l.dirs[i]
+			c.dirs++
+			if _, err := fmt.Fprintln(w, indent+branch+path.Base(sub)+"/"+t.dirLabel(totals[sub])); err != nil {
+				return err
+			}
+			if t.maxDepth == 0 || depth < t.maxDepth {
+				if err := t.printLevel(w, levels, totals, sub, indent+next, depth+1, c); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		f := l.files[i-len(l.dirs)]
+		c.files++
+		label := path.Base(filepath.ToSlash(f.Meta.Path))
+		if t.sizes {
+			label += " (" + formatSize(f.Size) + ")"
+		}
+		if _, err := fmt.Fprintln(w, indent+branch+label); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirLabel returns what follows the name of a directory, its total when
+// sizes are shown.
+func (t *TreePrinter) dirLabel(total domain.DirTotal) string {
+	if !t.sizes {
+		return ""
+	}
+	return fmt.Sprintf(" (%s, %d files)", formatSize(total.Size), total.Files)
+}
@@ -0,0 +1,350 @@
+package usecase
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/checksum"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// VerifyStatus classifies a problem found by the Verifier.
+type VerifyStatus string
+
+const (
+	// VerifyMissing: a local file has no remote copy.
+	VerifyMissing VerifyStatus = "MISSING"
+	// VerifyCorrupted: the remote content does not match its metadata.
+	VerifyCorrupted VerifyStatus = "CORRUPTED"
+	// VerifyLocalCorrupted: the local content changed while its size and
+	// modification time still match the intact remote copy (bit rot).
+	VerifyLocalCorrupted VerifyStatus = "LOCAL_CORRUPTED"
+	// VerifyBlobMissing: the message or document of a remote file is gone.
+	VerifyBlobMissing VerifyStatus = "BLOB_MISSING"
+)
+
+// VerifyIssue is a single problem found by the Verifier.
+type VerifyIssue struct {
+	Path       string
+	Status     VerifyStatus
+	Detail     string
+	LocalFile  *domain.LocalFile
+	RemoteFile *domain.RemoteFile
+}
+
+// VerifyReport is the outcome of a verification run.
+type VerifyReport struct {
+	Checked int
+	Issues  []VerifyIssue
+}
+
+// Verifier checks the integrity of the remote mirror of a local directory
+// and repairs it.
+type Verifier struct {
+	fs      domain.FileSystem
+	storage domain.BlobStorage
+	workers int
+	ui      domain.UserInterface
+	subDir  string
+	sample  int   // percentage of the remote files scrubbed
+	sizeCap int64 // bytes scrubbed at most, 0 for no cap
+}
+
+func NewVerifier(fs domain.FileSystem, storage domain.BlobStorage, workers int, ui domain.UserInterface) *Verifier {
+	if workers <= 0 {
+		workers = 1
+	}
+	return &Verifier{
+		fs:      fs,
+		storage: storage,
+		workers: workers,
+		ui:      ui,
+		sample:  100,
+	}
+}
+
+func (v *Verifier) SetSubDir(subDir string) {
+	v.subDir = subDir
+}
+
+// SetSample makes Scrub check a random selection of percent of the remote
+// files, of at most sizeCap bytes in total (0 for no cap).
+func (v *Verifier) SetSample(percent int, sizeCap int64) {
+	v.sample = percent
+	v.sizeCap = sizeCap
+}
+
+// Verify downloads every remote file, recomputes its checksum and compares
+// it with its metadata and with the local tree.
+func (v *Verifier) Verify(ctx context.Context, rootDir string, groupID, topicID int64) (*VerifyReport, error) {
+	log.Println("Starting verification...")
+
+	scanner := NewScanner(v.fs, v.storage, v.subDir, false)
+
+	localFiles, err := scanner.ScanLocal(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteFiles, err := scanner.ScanRemote(ctx, groupID, topicID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &VerifyReport{}
+	var mu sync.Mutex
+	addIssue := func(issue VerifyIssue) {
+		mu.Lock()
+		defer mu.Unlock()
+		report.Issues = append(report.Issues, issue)
+	}
+
+	for path, localFile := range localFiles {
+		if _, ok := remoteFiles[path]; !ok {
+			addIssue(VerifyIssue{Path: path, Status: VerifyMissing, Detail: "no remote copy", LocalFile: &localFile})
+		}
+	}
+
+	if v.ui != nil {
+		v.ui.SetTotalFiles(len(remoteFiles))
+	}
+
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(v.workers)
+
+	for path, remoteFile := range remoteFiles {
+		if gCtx.Err() != nil {
+			break
+		}
+		g.Go(func() error {
+			detail, err := v.checkRemote(gCtx, groupID, topicID, &remoteFile)
+			if err != nil {
+				return fmt.Errorf("failed to verify %s: %w", path, err)
+			}
+
+			mu.Lock()
+			report.Checked++
+			mu.Unlock()
+
+			var localPtr *domain.LocalFile
+			if localFile, ok := localFiles[path]; ok {
+				localPtr = &localFile
+			}
+
+			if detail != "" {
+				addIssue(VerifyIssue{Path: path, Status: VerifyCorrupted, Detail: detail, LocalFile: localPtr, RemoteFile: &remoteFile})
+				return nil
+			}
+
+			if localPtr != nil && remoteFile.Meta.Checksum != "" && localPtr.Algorithm == remoteFile.Meta.Algorithm && localPtr.Checksum != remoteFile.Meta.Checksum &&
+				localPtr.ModTime == remoteFile.Meta.ModTime && localPtr.Size == remoteFile.ContentSize() {
+				addIssue(VerifyIssue{
+					Path:       path,
+					Status:     VerifyLocalCorrupted,
+					Detail:     fmt.Sprintf("local checksum %s, remote %s", localPtr.Checksum, remoteFile.Meta.Checksum),
+					LocalFile:  localPtr,
+					RemoteFile: &remoteFile,
+				})
+			}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	if v.ui != nil {
+		v.ui.Wait()
+	}
+
+	sort.Slice(report.Issues, func(i, j int) bool {
+		return report.Issues[i].Path < report.Issues[j].Path
+	})
+
+	log.Printf("Verification Summary:")
+	log.Printf("  Remote files checked: %d", report.Checked)
+	log.Printf("  Issues found:         %d", len(report.Issues))
+	for _, issue := range report.Issues {
+		log.Printf("  [%s] %s: %s", issue.Status, issue.Path, issue.Detail)
+	}
+	return report, nil
+}
+
+// Scrub downloads the remote files, recomputes their checksum and reports
+// those corrupted or gone, without looking at the local tree. A sample set
+// by SetSample is drawn anew on every run, so that periodic scrubs end up
+// covering every file.
+func (v *Verifier) Scrub(ctx context.Context, groupID, topicID int64) (*VerifyReport, error) {
+	log.Println("Starting scrub...")
+
+	scanner := NewScanner(v.fs, v.storage, v.subDir, true)
+	remoteFiles, err := scanner.ScanRemote(ctx, groupID, topicID)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]domain.RemoteFile, 0, len(remoteFiles))
+	for _, f := range remoteFiles {
+		files = append(files, f)
+	}
+	rand.Shuffle(len(files), func(i, j int) {
+		files[i], files[j] = files[j], files[i]
+	})
+
+	count := (len(files)*v.sample + 99) / 100
+	var selected []domain.RemoteFile
+	var total int64
+	for _, f := range files[:count] {
+		if v.sizeCap > 0 && total+f.Size > v.sizeCap {
+			continue
+		}
+		total += f.Size
+		selected = append(selected, f)
+	}
+	if len(selected) < len(files) {
+		log.Printf("[*] Scrubbing %d of %d remote files (%s)", len(selected), len(files), formatSize(total))
+	}
+
+	report := &VerifyReport{}
+	var mu sync.Mutex
+
+	if v.ui != nil {
+		v.ui.SetTotalFiles(len(selected))
+	}
+
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(v.workers)
+
+	for _, remoteFile := range selected {
+		if gCtx.Err() != nil {
+			break
+		}
+		g.Go(func() error {
+			path := remoteFile.Meta.Path
+			issue := VerifyIssue{Path: path, Status: VerifyCorrupted, RemoteFile: &remoteFile}
+			detail, err := v.checkRemote(gCtx, groupID, topicID, &remoteFile)
+			if errors.Is(err, domain.ErrNotFound) {
+				issue.Status = VerifyBlobMissing
+				detail = err.Error()
+			} else if err != nil {
+				return fmt.Errorf("failed to verify %s: %w", path, err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checked++
+			if detail != "" {
+				issue.Detail = detail
+				report.Issues = append(report.Issues, issue)
+			}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	if v.ui != nil {
+		v.ui.Wait()
+	}
+
+	sort.Slice(report.Issues, func(i, j int) bool {
+		return report.Issues[i].Path < report.Issues[j].Path
+	})
+
+	log.Printf("Scrub Summary:")
+	log.Printf("  Remote files checked: %d", report.Checked)
+	log.Printf("  Issues found:         %d", len(report.Issues))
+	for _, issue := range report.Issues {
+		log.Printf("  [%s] %s: %s", issue.Status, issue.Path, issue.Detail)
+	}
+	return report, nil
+}
+
+// checkRemote downloads the remote file and returns a description of the
+// mismatch with its metadata, or an empty string if it is intact.
+func (v *Verifier) checkRemote(ctx context.Context, groupID, topicID int64, file *domain.RemoteFile) (string, error) {
+	if file.Meta.HasFlag(domain.FlagEmptyFile) {
+		return "", nil
+	}
+
+	rc, err := openRemote(ctx, v.storage, groupID, topicID, file)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	h, err := checksum.New(file.Meta.Algorithm)
+	if err != nil {
+		return "", err
+	}
+	n, err := io.Copy(h, rc)
+	if err != nil {
+		return "", err
+	}
+
+	if n != file.ContentSize() {
+		return fmt.Sprintf("size %d, expected %d", n, file.ContentSize()), nil
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); file.Meta.Checksum != "" && sum != file.Meta.Checksum {
+		return fmt.Sprintf("checksum %s, expected %s", sum, file.Meta.Checksum), nil
+	}
+	return "", nil
+}
+
+// Repair fixes the issues of a report: missing and corrupted remote copies
+// are re-uploaded from an intact local file, corrupted local files are
+// downloaded again. Issues that can't be fixed are logged.
+func (v *Verifier) Repair(ctx context.Context, report *VerifyReport, rootDir string, groupID, topicID int64) error {
+	var plan domain.SyncPlan
+
+	for _, issue := range report.Issues {
+		switch issue.Status {
+		case VerifyMissing:
+			plan.Items = append(plan.Items, domain.SyncItem{
+				Path:      issue.Path,
+				Action:    domain.ActionUpload,
+				LocalFile: issue.LocalFile,
+				Reason:    domain.ReasonMissingRemotely,
+			})
+			plan.Summary.ToUpload++
+		case VerifyCorrupted:
+			if issue.LocalFile == nil || (issue.RemoteFile.Meta.Checksum != "" && !sameChecksum(*issue.LocalFile, *issue.RemoteFile)) {
+				log.Printf("[!] Cannot repair %s: no intact local copy", issue.Path)
+				continue
+			}
+			plan.Items = append(plan.Items, domain.SyncItem{
+				Path:       issue.Path,
+				Action:     domain.ActionUpload,
+				LocalFile:  issue.LocalFile,
+				RemoteFile: issue.RemoteFile,
+				Reason:     domain.ReasonCorruptedRemotely,
+			})
+			plan.Summary.ToUpdate++
+		case VerifyLocalCorrupted:
+			plan.Items = append(plan.Items, domain.SyncItem{
+				Path:       issue.Path,
+				Action:     domain.ActionDownload,
+				LocalFile:  issue.LocalFile,
+				RemoteFile: issue.RemoteFile,
+				Reason:     domain.ReasonCorruptedLocally,
+			})
+			plan.Summary.ToUpdate++
+		}
+	}
+	plan.Summary.Total = len(plan.Items)
+
+	executor := NewExecutor(v.fs, v.storage, v.workers, v.ui)
+	executor.SetScope(v.subDir)
+	return executor.Execute(ctx, plan, rootDir, groupID, topicID)
+}
@@ -0,0 +1,157 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/retry"
+	"time"
+)
+
+// nextVersion returns the version of the file uploaded by item.
+func nextVersion(item domain.SyncItem) int {
+	if item.RemoteFile == nil {
+		return 0
+	}
+	return item.RemoteFile.Meta.Version + 1
+}
+
+// supersede flags the version replaced by an upload as superseded, keeping
+// it out of listings, instead of deleting it.
+func (e *executor) supersede(ctx context.Context, item domain.SyncItem, groupID, topicID int64) {
+	log.Printf("[*] Keeping old version %d of: %s", item.RemoteFile.Meta.Version, item.Path)
+	meta := item.RemoteFile.Meta
+	meta.SetFlag(domain.FlagSuperseded)
+	err := retry.WithRetry(ctx, "UpdateMeta: "+item.Path, func() error {
+		return e.storage.UpdateFileMeta(ctx, groupID, topicID, *item.RemoteFile, meta)
+	}, 5, 1*time.Second)
+	if err != nil {
+		log.Printf("Warning: failed to keep old version of %s: %v", item.Path, err)
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.superseded == nil {
+		e.superseded = make(map[string]bool)
+	}
+	e.superseded[item.Path] = true
+}
+
+// versionKey identifies the messages of a single superseded version.
+type versionKey struct {
+	version  int
+	checksum string
+	modTime  int64
+}
+
+// supersededVersion is a superseded version of a path, made of one or more messages.
+type supersededVersion struct {
+	newest   int
+	messages []domain.RemoteMessage
+}
+
+// retainedVersions returns the complete superseded versions stored in the
+// topic, whose content uploads can reuse instead of sending it again.
+func retainedVersions(ctx context.Context, storage domain.BlobStorage, groupID, topicID int64) ([]domain.RemoteFile, error) {
+	messages, err := storage.ListMessages(ctx, groupID, topicID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list old versions: %w", err)
+	}
+
+	type versionParts struct {
+		meta  domain.FileMeta
+		parts map[int]domain.RemoteMessage
+	}
+	versions := make(map[chunkSetKey]*versionParts)
+	var order []chunkSetKey
+	for _, m := range messages {
+		if m.Meta == nil || !m.Meta.HasFlag(domain.FlagSuperseded) || m.Meta.Checksum == "" || m.Meta.HasFlag(domain.FlagEmptyFile) {
+			continue
+		}
+		key := chunkSetKey{path: m.Meta.Path, checksum: m.Meta.Checksum, modTime: m.Meta.ModTime, parts: m.Meta.Parts}
+		if !m.Meta.IsChunked() {
+			key.parts = -m.ID
+		}
+		v := versions[key]
+		if v == nil {
+			v = &versionParts{meta: *m.Meta, parts: make(map[int]domain.RemoteMessage)}
+			versions[key] = v
+			order = append(order, key)
+		}
+		v.parts[m.Meta.Part] = m
+	}
+
+	var files []domain.RemoteFile
+	for _, key := range order {
+		v := versions[key]
+		first, ok := v.parts[0]
+		if !ok || (v.meta.IsChunked() && len(v.parts) < v.meta.Parts) {
+			continue
+		}
+		meta := v.meta
+		meta.Part = 0
+		meta.PartChecksum = ""
+		file := domain.RemoteFile{Meta: meta, MessageID: first.ID, DocumentID: first.DocumentID}
+		for i := 0; i < meta.Parts && meta.IsChunked(); i++ {
+			part := v.parts[i]
+			file.Chunks = append(file.Chunks, domain.RemoteChunk{MessageID: part.ID, Size: part.Size, Checksum: part.Meta.PartChecksum})
+		}
+		for _, part := range v.parts {
+			file.Size += part.Size
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// pruneVersions deletes the superseded versions of the given paths but the
+// keep newest ones.
+func pruneVersions(ctx context.Context, storage domain.BlobStorage, groupID, topicID int64, paths map[string]bool, keep int) error {
+	messages, err := storage.ListMessages(ctx, groupID, topicID)
+	if err != nil {
+		return fmt.Errorf("failed to list old versions: %w", err)
+	}
+
+	byPath := make(map[string]map[versionKey]*supersededVersion)
+	for _, m := range messages {
+		if m.Meta == nil || !m.Meta.HasFlag(domain.FlagSuperseded) || !paths[m.Meta.Path] {
+			continue
+		}
+		versions := byPath[m.Meta.Path]
+		if versions == nil {
+			versions = make(map[versionKey]*supersededVersion)
+			byPath[m.Meta.Path] = versions
+		}
+		key := versionKey{version: m.Meta.Version, checksum: m.Meta.Checksum, modTime: m.Meta.ModTime}
+		v := versions[key]
+		if v == nil {
+			v = &supersededVersion{}
+			versions[key] = v
+		}
+		v.newest = max(v.newest, m.ID)
+		v.messages = append(v.messages, m)
+	}
+
+	for path, versions := range byPath {
+		if len(versions) <= keep {
+			continue
+		}
+		sorted := make([]*supersededVersion, 0, len(versions))
+		for _, v := range versions {
+			sorted = append(sorted, v)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i].newest > sorted[j].newest
+		})
+		for _, v := range sorted[keep:] {
+			log.Printf("[-] Deleting old version %d of: %s", v.messages[0].Meta.Version, path)
+			if err := storage.DeleteFile(ctx, groupID, topicID, messageIDsOf(v.messages)...); err != nil {
+				return fmt.Errorf("failed to delete old version of %s: %w", path, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,478 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strings"
+	"tg-blobsync/internal/domain"
+	"tg-blobsync/internal/pkg/pipeline"
+	"time"
+)
+
+const (
+	// watchQueueFile is the name of the pending change queue in the state dir.
+	watchQueueFile = "watch_queue.json"
+	// watchDebounce is how long the tree must stay quiet before pushing.
+	watchDebounce = 2 * time.Second
+	// watchRetryDelay is how long to wait before retrying a failed push.
+	watchRetryDelay = 30 * time.Second
+)
+
+// Watcher keeps a topic up to date with a local directory, pushing the
+// changes reported by a FileWatcher as they happen.
+type Watcher struct {
+	fs            domain.FileSystem
+	storage       domain.BlobStorage
+	watcher       domain.FileWatcher
+	workers       int
+	ui            domain.UserInterface
+	skipMD5       bool
+	subDir        string
+	stateDir      string
+	tags          map[string]string
+	packThreshold int64
+	packSize      int64
+	deleteGrace   time.Duration
+	noDelete      bool
+	pruneAfter    bool
+	force         bool
+	marker        string
+	rules         fileRules
+	keepVersions  int
+	pipeline      pipeline.Pipeline
+	trash         trash
+
+	reconcileInterval time.Duration
+}
+
+func NewWatcher(
+	fs domain.FileSystem,
+	storage domain.BlobStorage,
+	watcher domain.FileWatcher,
+	workers int,
+	ui domain.UserInterface,
+	skipMD5 bool,
+) *Watcher {
+	return &Watcher{
+		fs:      fs,
+		storage: storage,
+		watcher: watcher,
+		workers: workers,
+		ui:      ui,
+		skipMD5: skipMD5,
+	}
+}
+
+func (w *Watcher) SetSubDir(subDir string) {
+	w.subDir = strings.Trim(filepath.ToSlash(subDir), "/")
+}
+
+// SetStateDir sets the directory where the pending change queue is kept.
+func (w *Watcher) SetStateDir(stateDir string) {
+	w.stateDir = stateDir
+}
+
+// SetTags sets the tags attached to every uploaded file.
+func (w *Watcher) SetTags(tags map[string]string) {
+	w.tags = tags
+}
+
+// SetPacking bundles the files smaller than threshold into packs of at most
+// maxSize bytes.
+func (w *Watcher) SetPacking(threshold, maxSize int64) {
+	w.packThreshold = threshold
+	w.packSize = maxSize
+}
+
+// SetRules sets the per-path rules: the changes to skipped paths are ignored.
+func (w *Watcher) SetRules(rules []domain.FileRule) {
+	w.rules = rules
+}
+
+// SetPipeline passes the content of the uploaded files through p.
+func (w *Watcher) SetPipeline(p pipeline.Pipeline) {
+	w.pipeline = p
+}
+
+// SetKeepVersions keeps up to n old versions of every updated file instead
+// of deleting them.
+func (w *Watcher) SetKeepVersions(n int) {
+	w.keepVersions = n
+}
+
+// SetTrash moves the remote files deleted locally to the trash topic topicID
+// instead of deleting them, and empties the trash of the files deleted
+// longer than retention ago on every reconciliation (0 to keep them forever).
+func (w *Watcher) SetTrash(topicID int64, retention time.Duration) {
+	w.trash = trash{storage: w.storage, topicID: topicID, retention: retention}
+}
+
+// SetReconcileInterval makes watch mode repeat the reconciliation scan
+// periodically, catching the changes missed by the file watcher.
+// A zero interval only scans on startup.
+func (w *Watcher) SetReconcileInterval(interval time.Duration) {
+	w.reconcileInterval = interval
+}
+
+// Watch pushes the local changes until ctx is done. Changes still pending
+// from a previous run are replayed after a reconciliation scan.
+func (w *Watcher) Watch(ctx context.Context, rootDir string, groupID, topicID int64) error {
+	log.Println("Starting watch mode...")
+
+	var queueFile string
+	if w.stateDir != "" {
+		queueFile = filepath.Join(w.stateDir, watchQueueFile)
+	}
+	queue, err := loadQueue(queueFile)
+	if err != nil {
+		return err
+	}
+	if n := queue.Len(); n > 0 {
+		log.Printf("[*] Resuming %d pending changes", n)
+	}
+
+	// Watch first, so that nothing changed during the scan is missed
+	events, err := w.watcher.Watch(ctx, rootDir)
+	if err != nil {
+		return err
+	}
+
+	if err := w.reconcile(ctx, rootDir, groupID, topicID, queue); err != nil {
+		return err
+	}
+	if err := queue.Save(); err != nil {
+		log.Printf("[!] Warning: %v", err)
+	}
+
+	trigger := make(chan struct{}, 1)
+	kick := func() {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+
+	var reconcileC <-chan time.Time
+	if w.reconcileInterval > 0 {
+		ticker := time.NewTicker(w.reconcileInterval)
+		defer ticker.Stop()
+		reconcileC = ticker.C
+	}
+
+	// Pushes and periodic scans run apart from the event loop, so that
+	// events keep being queued while they are in progress
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-trigger:
+			case <-reconcileC:
+				if err := w.reconcile(ctx, rootDir, groupID, topicID, queue); err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					log.Printf("[!] Reconciliation scan failed: %v", err)
+					continue
+				}
+			}
+			w.flush(ctx, rootDir, groupID, topicID, queue, kick)
+		}
+	}()
+	kick()
+
+	debounce := time.NewTimer(watchDebounce)
+	debounce.Stop()
+	saveTicker := time.NewTicker(time.Second)
+	defer saveTicker.Stop()
+
+	log.Printf("Watching %s for changes (Ctrl+C to stop)...", rootDir)
+	for {
+		select {
+		case <-ctx.Done():
+			<-done
+			return queue.Save()
+		case path, ok := <-events:
+			if !ok {
+				<-done
+				if err := queue.Save(); err != nil {
+					log.Printf("[!] Warning: %v", err)
+				}
+				if ctx.Err() != nil {
+					return nil
+				}
+				return errors.New("file watcher stopped unexpectedly")
+			}
+			if w.inScope(path) && !domain.IsTempFile(path) {
+				queue.Add(path)
+				debounce.Reset(watchDebounce)
+			}
+		case <-saveTicker.C:
+			if err := queue.Save(); err != nil {
+				log.Printf("[!] Warning: %v", err)
+			}
+		case <-debounce.C:
+			kick()
+		}
+	}
+}
+
+// SetDeleteGrace keeps the remote copy of the files deleted locally as
+// pending delete for grace before deleting it.
+func (w *Watcher) SetDeleteGrace(grace time.Duration) {
+	w.deleteGrace = grace
+}
+
+// SetNoDelete keeps the remote copy of the files deleted locally.
+func (w *Watcher) SetNoDelete(noDelete bool) {
+	w.noDelete = noDelete
+}
+
+// SetPruneAfterVerify makes each batch of changes only delete remote files
+// once its uploads have been verified in a new listing.
+func (w *Watcher) SetPruneAfterVerify(verify bool) {
+	w.pruneAfter = verify
+}
+
+// SetForce lets reconciliation delete remote files even when the local
+// directory looks unmounted or emptied by mistake.
+func (w *Watcher) SetForce(force bool) {
+	w.force = force
+}
+
+// SetMarker makes the watcher stop pushing changes while the given file,
+// relative to the root, is missing, such as when the disk gets unmounted.
+func (w *Watcher) SetMarker(marker string) {
+	w.marker = marker
+}
+
+// reconcile queues the paths whose size or modification time differ from
+// their remote copy, catching the changes made while not watching.
+func (w *Watcher) reconcile(ctx context.Context, rootDir string, groupID, topicID int64, queue *changeQueue) error {
+	// Hashing the whole tree is what watch mode avoids: compare metadata only
+	scanner := NewScanner(w.fs, w.storage, w.subDir, true)
+	scanner.SetRules(w.rules)
+
+	localFiles, err := scanner.ScanLocal(rootDir)
+	if err != nil {
+		return err
+	}
+	remoteFiles, err := scanner.ScanRemote(ctx, groupID, topicID)
+	if err != nil {
+		return err
+	}
+
+	light := &differ{skipMD5: true}
+	var changed []string
+	for path, localFile := range localFiles {
+		if remoteFile, ok := remoteFiles[path]; !ok || light.shouldUpdate(localFile, remoteFile) ||
+			remoteFile.Meta.HasFlag(domain.FlagPendingDelete) {
+			changed = append(changed, path)
+		}
+	}
+	var missing []string
+	for path, remoteFile := range remoteFiles {
+		if w.noDelete || remoteFile.Meta.HasFlag(domain.FlagArchived) {
+			continue
+		}
+		if _, ok := localFiles[path]; !ok {
+			missing = append(missing, path)
+		}
+	}
+	if err := checkPrune(len(localFiles), remoteFiles, len(missing)); err != nil && !w.force {
+		log.Printf("[!] Not deleting the remote files missing locally: %v", err)
+	} else {
+		changed = append(changed, missing...)
+	}
+
+	log.Printf("[*] Reconciliation scan: %d changed paths", len(changed))
+	queue.Add(changed...)
+
+	if err := w.trash.purge(ctx, groupID); err != nil {
+		log.Printf("[!] Warning: %v", err)
+	}
+	return nil
+}
+
+// flush pushes the queued changes, scheduling a retry if it fails.
+func (w *Watcher) flush(ctx context.Context, rootDir string, groupID, topicID int64, queue *changeQueue, kick func()) {
+	snapshot := queue.Snapshot()
+	if len(snapshot) == 0 {
+		return
+	}
+	if err := queue.Save(); err != nil {
+		log.Printf("[!] Warning: %v", err)
+	}
+
+	if w.marker != "" {
+		if _, err := w.fs.StatFile(rootDir, w.marker, true); err != nil {
+			log.Printf("[!] Marker %s not found, retrying in %s: %v", w.marker, watchRetryDelay, err)
+			time.AfterFunc(watchRetryDelay, kick)
+			return
+		}
+	}
+
+	paths := make([]string, 0, len(snapshot))
+	for path := range snapshot {
+		paths = append(paths, path)
+	}
+
+	unsettled, err := w.pushPaths(ctx, rootDir, groupID, topicID, paths)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("[!] Failed to push %d changes, retrying in %s: %v", len(paths), watchRetryDelay, err)
+		time.AfterFunc(watchRetryDelay, kick)
+		return
+	}
+
+	// Files still being written stay queued until they settle
+	for _, path := range unsettled {
+		delete(snapshot, path)
+	}
+	if len(unsettled) > 0 {
+		time.AfterFunc(watchDebounce, kick)
+	}
+
+	queue.Done(snapshot)
+	if err := queue.Save(); err != nil {
+		log.Printf("[!] Warning: %v", err)
+	}
+	if err := w.storage.SaveIndex(ctx, groupID, topicID); err != nil {
+		log.Printf("[!] Warning: failed to update the remote index: %v", err)
+	}
+}
+
+// pushPaths uploads or deletes the remote copy of the given paths, and
+// returns the paths of the files skipped because they are still being
+// written. A path that no longer exists locally may have been a directory:
+// everything below it is deleted remotely too.
+//
+// Files moved or copied locally are matched by checksum with the remote
+// files, including the ones about to be deleted, so that their content is
+// reused rather than uploaded again.
+func (w *Watcher) pushPaths(ctx context.Context, rootDir string, groupID, topicID int64, paths []string) ([]string, error) {
+	scanner := NewScanner(w.fs, w.storage, w.subDir, w.skipMD5)
+	scanner.SetRules(w.rules)
+	remoteFiles, err := scanner.ScanRemote(ctx, groupID, topicID)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &differ{skipMD5: w.skipMD5, deleteGrace: w.deleteGrace, noDelete: w.noDelete}
+	duplicates := duplicateIndex(remoteFiles)
+	sizes := make(map[int64]bool, len(duplicates))
+	for _, f := range duplicates {
+		sizes[f.ContentSize()] = true
+	}
+
+	var plan domain.SyncPlan
+	var unsettled, vanished []string
+	var deletions []domain.SyncItem
+	deleted := make(map[string]bool)
+
+	for _, path := range paths {
+		if domain.IsTempFile(path) || w.rules.Skip(path) {
+			continue
+		}
+		localFile, err := w.fs.StatFile(rootDir, path, true)
+		switch {
+		case err == nil:
+			// A copy from another device shows up long before it completes
+			if time.Since(time.Unix(localFile.ModTime, 0)) < watchDebounce {
+				unsettled = append(unsettled, path)
+				continue
+			}
+			// Without MD5, only hash the files that may be a copy of a remote one
+			if !w.skipMD5 || sizes[localFile.Size] {
+				localFile, err = w.fs.StatFile(rootDir, path, false)
+				if err != nil {
+					log.Printf("[!] Skipping %s: %v", path, err)
+					continue
+				}
+			}
+
+			item := domain.SyncItem{Path: path, Action: domain.ActionUpload, LocalFile: &localFile}
+			if remoteFile, ok := remoteFiles[path]; !ok {
+				item.Reason = domain.ReasonNew
+				plan.Summary.ToUpload++
+			} else if reason, detail := d.changed(localFile, remoteFile); reason != "" {
+				item.RemoteFile = &remoteFile
+				item.Reason, item.Detail = reason, detail
+				plan.Summary.ToUpdate++
+			} else if remoteFile.Meta.HasFlag(domain.FlagPendingDelete) {
+				item.RemoteFile = &remoteFile
+				item.Action = domain.ActionUnmarkDeleted
+				item.Reason = domain.ReasonBackLocally
+				plan.Items = append(plan.Items, item)
+				plan.Summary.ToUpdate++
+				continue
+			} else {
+				continue
+			}
+			setSource(&item, duplicates)
+			plan.Items = append(plan.Items, item)
+
+		case errors.Is(err, fs.ErrNotExist):
+			vanished = append(vanished, path)
+			for remotePath, remoteFile := range remoteFiles {
+				if remotePath != path && !strings.HasPrefix(remotePath, path+"/") {
+					continue
+				}
+				if deleted[remotePath] || remoteFile.Meta.HasFlag(domain.FlagArchived) {
+					continue
+				}
+				if _, err := w.fs.StatFile(rootDir, remotePath, true); err == nil {
+					continue
+				}
+				deleted[remotePath] = true
+				if item, ok := d.deletion(remotePath, remoteFile); ok {
+					deletions = append(deletions, item)
+				}
+			}
+
+		default:
+			log.Printf("[!] Skipping %s: %v", path, err)
+		}
+	}
+
+	// A file being written may be the new copy of a deleted one: keep the
+	// deleted content around until it can be matched
+	if len(unsettled) > 0 {
+		unsettled = append(unsettled, vanished...)
+	} else {
+		plan.Items = append(plan.Items, deletions...)
+		plan.Summary.ToDelete = len(deletions)
+	}
+	plan.Summary.Total = len(plan.Items)
+
+	if plan.Summary.Total == 0 {
+		return unsettled, nil
+	}
+	log.Printf("[*] Pushing %d changes", plan.Summary.Total)
+
+	var ui domain.UserInterface
+	if w.ui != nil {
+		ui = preconfirmedUI{w.ui}
+	}
+	executor := NewExecutor(w.fs, w.storage, w.workers, ui)
+	executor.SetTags(w.tags)
+	executor.SetPacking(w.packThreshold, w.packSize)
+	executor.SetRules(w.rules)
+	executor.SetKeepVersions(w.keepVersions)
+	executor.SetPipeline(w.pipeline)
+	executor.SetTrash(w.trash.topicID)
+	executor.SetScope(w.subDir)
+	executor.SetPruneAfterVerify(w.pruneAfter)
+	return unsettled, executor.Execute(ctx, plan, rootDir, groupID, topicID)
+}
+
+func (w *Watcher) inScope(path string) bool {
+	return underPrefix(w.subDir, path)
+}